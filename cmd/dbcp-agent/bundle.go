@@ -0,0 +1,60 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/virtlabs-io/dbcp-agent/internal/config"
+	"github.com/virtlabs-io/dbcp-agent/internal/logger"
+	"github.com/virtlabs-io/dbcp-agent/internal/pkg"
+	"github.com/virtlabs-io/dbcp-agent/internal/system"
+)
+
+// runBundle implements "dbcp-agent bundle build".
+func runBundle(args []string) int {
+	if len(args) == 0 || args[0] != "build" {
+		fmt.Fprintln(os.Stderr, "Usage: dbcp-agent bundle build -c <config> [-o <dir|file.tar.gz>]")
+		return 2
+	}
+
+	var configPath, out string
+	fs := flag.NewFlagSet("bundle build", flag.ExitOnError)
+	fs.StringVar(&configPath, "config", "./configs/agent-config.yaml", "Path to configuration file")
+	fs.StringVar(&configPath, "c", "./configs/agent-config.yaml", "Path to configuration file (shorthand)")
+	fs.StringVar(&out, "o", "dbcp-bundle.tar.gz", "Output directory or .tar.gz file")
+	fs.Parse(args[1:])
+
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		fmt.Printf("Failed to load config: %v\n", err)
+		return 1
+	}
+
+	if err := cfg.Validate(); err != nil {
+		fmt.Printf("Invalid config: %v\n", err)
+		return 1
+	}
+
+	logger.Init(logger.Options{Level: cfg.LogLevel})
+
+	osInfo, err := system.DetectOS()
+	if err != nil {
+		logger.Error("OS detection failed: %v", err)
+		return 1
+	}
+
+	// Packages are resolved by this machine's package manager, so the bundle
+	// can only target nodes that look like it.
+	if cfg.Node.Arch != "" && system.NormalizeArch(cfg.Node.Arch) != osInfo.Arch {
+		logger.Error("Config targets %s but this machine is %s; build the bundle on a matching machine", cfg.Node.Arch, osInfo.Arch)
+		return 1
+	}
+
+	if err := pkg.BuildBundle(cfg, osInfo, out); err != nil {
+		logger.Error("Bundle build failed: %v", err)
+		return 1
+	}
+
+	return 0
+}
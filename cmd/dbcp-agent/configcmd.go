@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/virtlabs-io/dbcp-agent/internal/config"
+)
+
+// runConfig implements "dbcp-agent config validate" and
+// "dbcp-agent config render".
+func runConfig(args []string) int {
+	if len(args) == 0 || (args[0] != "validate" && args[0] != "render") {
+		fmt.Fprintln(os.Stderr, "Usage: dbcp-agent config validate|render -c <config>")
+		return 2
+	}
+
+	var configPath string
+	fs := flag.NewFlagSet("config "+args[0], flag.ExitOnError)
+	fs.StringVar(&configPath, "config", "./configs/agent-config.yaml", "Path to configuration file")
+	fs.StringVar(&configPath, "c", "./configs/agent-config.yaml", "Path to configuration file (shorthand)")
+	fs.Parse(args[1:])
+
+	if args[0] == "render" {
+		return renderConfig(configPath)
+	}
+	return validateConfig(configPath)
+}
+
+// validateConfig prints every problem in the config and fails if there are any.
+func validateConfig(configPath string) int {
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", configPath, err)
+		return 1
+	}
+
+	err = cfg.Validate()
+	var problems config.ValidationErrors
+	if errors.As(err, &problems) {
+		for _, problem := range problems {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", configPath, problem)
+		}
+		fmt.Fprintf(os.Stderr, "%d problem(s) found\n", len(problems))
+		return 1
+	} else if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", configPath, err)
+		return 1
+	}
+
+	fmt.Printf("%s: OK\n", configPath)
+	return 0
+}
+
+// renderConfig prints the config with everything it extends or includes
+// merged in. References are printed as written, never resolved.
+func renderConfig(configPath string) int {
+	out, err := config.Render(configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", configPath, err)
+		return 1
+	}
+	os.Stdout.Write(out)
+	return 0
+}
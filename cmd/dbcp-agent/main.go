@@ -1,23 +1,45 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"os"
+	"os/exec"
 	"os/signal"
 	"path/filepath"
 	"syscall"
+	"time"
 
+	"github.com/virtlabs-io/dbcp-agent/internal/agent"
 	"github.com/virtlabs-io/dbcp-agent/internal/config"
 	"github.com/virtlabs-io/dbcp-agent/internal/logger"
 	"github.com/virtlabs-io/dbcp-agent/internal/pkg"
 	"github.com/virtlabs-io/dbcp-agent/internal/system"
 )
 
+// subcommands maps "dbcp-agent <name> ..." to its handler. Without a
+// subcommand the agent itself runs.
+var subcommands = map[string]func(args []string) int{
+	"bundle": runBundle,
+	"config": runConfig,
+	"pki":    runPKI,
+	"secret": runSecret,
+	"tune":   runTune,
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		if run, ok := subcommands[os.Args[1]]; ok {
+			os.Exit(run(os.Args[2:]))
+		}
+	}
+
 	var configPath string
+	var dryRun bool
 	flag.StringVar(&configPath, "config", "./configs/agent-config.yaml", "Path to configuration file")
 	flag.StringVar(&configPath, "c", "./configs/agent-config.yaml", "Path to configuration file (shorthand)")
+	flag.BoolVar(&dryRun, "dry-run", false, "Print the commands and file changes the agent would make without applying them")
 	flag.Parse()
 
 	cfg, err := config.Load(configPath)
@@ -41,6 +63,14 @@ func main() {
 	})
 	logger.Info("Agent starting...")
 
+	// In dry-run mode every side effect is recorded instead of executed
+	var plan *pkg.Recorder
+	if dryRun {
+		plan = pkg.NewRecorder()
+		pkg.SetExecutor(plan)
+		logger.Info("Dry-run mode: no changes will be made")
+	}
+
 	if err := cfg.Validate(); err != nil {
 		logger.Error("Configuration validation failed: %v", err)
 		os.Exit(1)
@@ -50,12 +80,16 @@ func main() {
 	infraPaths := []string{
 		cfg.Node.PostgreSQL.DataDir,
 		cfg.Node.ETCD.DataDir,
-		filepath.Dir(cfg.Node.ETCD.CertFile),
-		filepath.Dir(cfg.Node.ETCD.KeyFile),
-		filepath.Dir(cfg.Node.ETCD.CAFile),
 		filepath.Dir(cfg.Node.Patroni.ConfigPath),
 		cfg.Node.TmpPath,
 	}
+	// TLS files are optional; an empty path would otherwise resolve to "."
+	restapi := cfg.Node.Patroni.RestAPI
+	for _, file := range []string{cfg.Node.ETCD.CertFile, cfg.Node.ETCD.KeyFile, cfg.Node.ETCD.CAFile, restapi.CertFile, restapi.KeyFile, restapi.CAFile} {
+		if file != "" {
+			infraPaths = append(infraPaths, filepath.Dir(file))
+		}
+	}
 	if err := pkg.CreateDirs(cfg, infraPaths...); err != nil {
 		logger.Error("Failed to create infrastructure directories: %v", err)
 		os.Exit(1)
@@ -67,6 +101,10 @@ func main() {
 		logger.Error("OS detection failed: %v", err)
 		os.Exit(1)
 	}
+	if cfg.Node.Arch != "" {
+		osInfo.Arch = system.NormalizeArch(cfg.Node.Arch)
+	}
+	logger.Info("Detected %s (%s)", osInfo.Pretty, osInfo.Arch)
 
 	// This is the installation block
 	// TODO: We need to verify if the package is already installed before we try to install it, or else every time we start the application it will attemp to install
@@ -85,8 +123,12 @@ func main() {
 		// ETCD installation
 		if pkg.ShouldInstallETCD(cfg) {
 			logger.Info("Installing ETCD...")
-			repoURL := cfg.Repositories.ETCD.Sources[cfg.Repositories.ETCD.Default]["url"]
-			if err := pkg.InstallETCD(cfg, repoURL); err != nil {
+			repoURL, err := pkg.ETCDRepoURL(cfg, osInfo)
+			if err != nil {
+				logger.Error("ETCD repository unavailable: %v", err)
+				os.Exit(1)
+			}
+			if err := pkg.InstallETCD(cfg, osInfo, repoURL); err != nil {
 				logger.Error("ETCD installation failed: %v", err)
 				os.Exit(1)
 			}
@@ -97,7 +139,7 @@ func main() {
 		// Patroni installation and config
 		if pkg.ShouldInstallPatroni(cfg) {
 			logger.Info("Installing Patroni...")
-			if err := pkg.InstallPatroni(cfg); err != nil {
+			if err := pkg.InstallPatroni(cfg, osInfo); err != nil {
 				logger.Error("Patroni installation failed: %v", err)
 				os.Exit(1)
 			}
@@ -106,8 +148,17 @@ func main() {
 		}
 	}
 
-	// Initialization block
-	{
+	// Patroni configuration
+	logger.Info("Generating Patroni config...")
+	if err := pkg.GeneratePatroniConfig(cfg); err != nil {
+		logger.Error("Failed to generate Patroni config: %v", err)
+		os.Exit(1)
+	}
+
+	// With systemd the units keep the services running; without it the
+	// agent supervises them itself. Dry-runs only record the start commands.
+	supervise := !dryRun && !pkg.UseSystemd(cfg)
+	if !supervise {
 		// Start ETCD cluster (bootstrap or join)
 		logger.Info("Starting ETCD...")
 		if err := pkg.StartETCD(cfg); err != nil {
@@ -115,25 +166,78 @@ func main() {
 			os.Exit(1)
 		}
 
-		// Patroni configuration and startup
-		logger.Info("Generating Patroni config...")
-		if err := pkg.GeneratePatroniConfig(cfg); err != nil {
-			logger.Error("Failed to generate Patroni config: %v", err)
-			os.Exit(1)
-		}
-
 		logger.Info("Starting Patroni...")
 		if err := pkg.StartPatroni(cfg); err != nil {
 			logger.Error("Failed to start Patroni: %v", err)
 			os.Exit(1)
 		}
+	}
 
+	if dryRun {
+		printPlan(plan)
+		return
 	}
 
 	// Handle shutdown
-	sig := make(chan os.Signal, 1)
-	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
-	<-sig
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	// SIGHUP re-reads the config and applies what can change at runtime
+	reloader := agent.NewReloader(configPath, cfg)
+	go reloader.HandleSignals(ctx)
+
+	if supervise {
+		sup := agent.NewSupervisor(etcdService(reloader.Config), patroniService(reloader.Config))
+		// Lets a restarted agent adopt the processes it left running
+		sup.StatePath = filepath.Join(cfg.Node.StateDir, agent.StateFile)
+		// Renewed certificates are loaded by restarting etcd the way it runs
+		go agent.NewCertMonitor(reloader.Config, func() error { return sup.Restart("etcd") }).Run(ctx)
+		if err := agent.Run(ctx, sup); err != nil {
+			logger.Error("Agent failed: %v", err)
+			os.Exit(1)
+		}
+	} else {
+		go agent.NewCertMonitor(reloader.Config, func() error { return pkg.RestartETCDUnit(reloader.Config()) }).Run(ctx)
+		<-ctx.Done()
+	}
 
 	logger.Info("Agent finished successfully.")
 }
+
+// etcdService and patroniService describe the processes the agent
+// supervises on nodes without systemd. Patroni is listed after etcd so it
+// starts later and stops first. Commands are built from the config in
+// effect at each (re)start, so reloaded settings are picked up.
+func etcdService(current func() *config.AgentConfig) agent.Service {
+	cfg := current()
+	return agent.Service{
+		Name:    "etcd",
+		Command: func() *exec.Cmd { return pkg.ETCDCommand(current()) },
+		Health:  func() error { return pkg.ETCDHealth(current()) },
+		LogPath: filepath.Join(cfg.Node.TmpPath, "etcd.log"),
+	}
+}
+
+func patroniService(current func() *config.AgentConfig) agent.Service {
+	cfg := current()
+	return agent.Service{
+		Name:    "patroni",
+		Command: func() *exec.Cmd { return pkg.PatroniCommand(current()) },
+		Health:  func() error { return pkg.PatroniHealth(current()) },
+		BeforeStart: func() error {
+			pkg.SecurePGDataDir(current())
+			return nil
+		},
+		LogPath: filepath.Join(cfg.Node.TmpPath, "patroni.log"),
+		// Patroni shuts PostgreSQL down cleanly on SIGTERM, which can take a while
+		StopTimeout: 2 * time.Minute,
+	}
+}
+
+func printPlan(plan *pkg.Recorder) {
+	ops := plan.Operations()
+	fmt.Printf("Dry-run plan (%d operations):\n", len(ops))
+	for i, op := range ops {
+		fmt.Printf("%3d. %s\n", i+1, op)
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/virtlabs-io/dbcp-agent/internal/config"
+	"github.com/virtlabs-io/dbcp-agent/internal/logger"
+	"github.com/virtlabs-io/dbcp-agent/internal/pkg"
+	"github.com/virtlabs-io/dbcp-agent/internal/pki"
+)
+
+const pkiUsage = `Usage:
+  dbcp-agent pki init -c <config>
+  dbcp-agent pki issue -c <config> [-node <name> | -all] [-o <dir>]
+  dbcp-agent pki status -c <config>`
+
+// runPKI implements "dbcp-agent pki init", "issue" and "status".
+func runPKI(args []string) int {
+	if len(args) == 0 || (args[0] != "init" && args[0] != "issue" && args[0] != "status") {
+		fmt.Fprintln(os.Stderr, pkiUsage)
+		return 2
+	}
+
+	var configPath, nodeName, out string
+	var all bool
+	fs := flag.NewFlagSet("pki "+args[0], flag.ExitOnError)
+	fs.StringVar(&configPath, "config", "./configs/agent-config.yaml", "Path to configuration file")
+	fs.StringVar(&configPath, "c", "./configs/agent-config.yaml", "Path to configuration file (shorthand)")
+	if args[0] == "issue" {
+		fs.StringVar(&nodeName, "node", "", "Node from cluster.nodes to issue for (default: this node)")
+		fs.BoolVar(&all, "all", false, "Issue for every node in cluster.nodes")
+		fs.StringVar(&out, "o", "", "Output directory (default: pki.dir for this node, <pki.ca_dir>/issued/<node> for others)")
+	}
+	fs.Parse(args[1:])
+
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load config: %v\n", err)
+		return 1
+	}
+	if err := cfg.Validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid config: %v\n", err)
+		return 1
+	}
+
+	logger.Init(logger.Options{Level: cfg.LogLevel})
+
+	switch args[0] {
+	case "init":
+		if err := pkg.InitCA(cfg); err != nil {
+			logger.Error("CA creation failed: %v", err)
+			return 1
+		}
+		return 0
+	case "status":
+		return pkiStatus(cfg)
+	}
+
+	if all && nodeName != "" {
+		fmt.Fprintln(os.Stderr, "-node and -all are mutually exclusive")
+		return 2
+	}
+	var nodes []config.ClusterNode
+	switch {
+	case all:
+		nodes = cfg.Cluster.Nodes
+	default:
+		if nodeName == "" {
+			nodeName = cfg.Node.Name
+		}
+		node, ok := pkg.ClusterNodeByName(cfg, nodeName)
+		if !ok {
+			fmt.Fprintf(os.Stderr, "Node %q is not in cluster.nodes\n", nodeName)
+			return 1
+		}
+		nodes = []config.ClusterNode{node}
+	}
+
+	for _, node := range nodes {
+		dir := pkiOutputDir(cfg, node.Name, out, all)
+		if err := pkg.IssueCertificate(cfg, node, dir); err != nil {
+			logger.Error("Certificate for %s failed: %v", node.Name, err)
+			return 1
+		}
+		if dir != cfg.PKI.Dir {
+			fmt.Fprintf(os.Stderr, "Copy the files in %s to %s on %s\n", dir, cfg.PKI.Dir, node.Host)
+		}
+	}
+
+	etcd := cfg.Node.ETCD
+	if etcd.CertFile != filepath.Join(cfg.PKI.Dir, pki.NodeCertFile) {
+		fmt.Fprintf(os.Stderr, "To use the certificate for etcd, set node.etcd.cert_file: %s, key_file: %s and ca_file: %s\n",
+			filepath.Join(cfg.PKI.Dir, pki.NodeCertFile), filepath.Join(cfg.PKI.Dir, pki.NodeKeyFile), filepath.Join(cfg.PKI.Dir, pki.CACertFile))
+	}
+	return 0
+}
+
+// pkiStatus prints the expiry of the CA and of every certificate the node's
+// services use. It exits non-zero when one is unusable or due for renewal.
+func pkiStatus(cfg *config.AgentConfig) int {
+	var statuses []pkg.CertStatus
+	if ca, ok := pkg.InspectCA(cfg); ok {
+		statuses = append(statuses, ca)
+	}
+	for _, pair := range pkg.ConfiguredCertificates(cfg) {
+		statuses = append(statuses, pkg.InspectCertificate(pair))
+	}
+	if len(statuses) == 0 {
+		fmt.Println("No certificates configured")
+		return 0
+	}
+
+	code := 0
+	now := time.Now()
+	threshold := pkg.RenewalThreshold(cfg)
+	fmt.Printf("%-11s %-40s %-11s %s\n", "SERVICE", "CERTIFICATE", "EXPIRES", "STATUS")
+	for _, st := range statuses {
+		expires, status := "-", "ok"
+		switch left := st.Remaining(now); {
+		case st.Err != nil:
+			status = st.Err.Error()
+			code = 1
+		case left <= 0:
+			expires = st.Cert.NotAfter.Format(time.DateOnly)
+			status = "expired"
+			code = 1
+		default:
+			expires = st.Cert.NotAfter.Format(time.DateOnly)
+			status = fmt.Sprintf("%d days left", int(left.Hours()/24))
+			if left <= threshold {
+				if st.Service == pkg.CertServiceCA {
+					status += ", too close to expiry to renew certificates; replace the CA"
+				} else {
+					status += ", due for renewal"
+				}
+				code = 1
+			}
+		}
+		fmt.Printf("%-11s %-40s %-11s %s\n", st.Service, st.CertFile, expires, status)
+	}
+	return code
+}
+
+// pkiOutputDir picks where a node's files go: the local node's straight into
+// pki.dir, other nodes' into a staging directory to copy from.
+func pkiOutputDir(cfg *config.AgentConfig, node, out string, all bool) string {
+	switch {
+	case out != "" && all:
+		return filepath.Join(out, node)
+	case out != "":
+		return out
+	case node == cfg.Node.Name:
+		return cfg.PKI.Dir
+	default:
+		return filepath.Join(cfg.PKI.CADir, "issued", node)
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/virtlabs-io/dbcp-agent/internal/config"
+	"github.com/virtlabs-io/dbcp-agent/internal/secrets"
+)
+
+const secretUsage = `Usage:
+  dbcp-agent secret encrypt [-c <config> | -key <file>] [-value <value>]
+  dbcp-agent secret rotate-key [-c <config> | -key <file>] <config>...`
+
+// runSecret implements "dbcp-agent secret encrypt" and
+// "dbcp-agent secret rotate-key".
+func runSecret(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, secretUsage)
+		return 2
+	}
+
+	var configPath, keyFile, value string
+	flags := flag.NewFlagSet("secret "+args[0], flag.ExitOnError)
+	flags.StringVar(&configPath, "config", "", "Configuration file whose secrets.key_file to use")
+	flags.StringVar(&configPath, "c", "", "Configuration file whose secrets.key_file to use (shorthand)")
+	flags.StringVar(&keyFile, "key", "", "Key file (overrides the config and DBCP_SECRETS_KEY_FILE)")
+	if args[0] == "encrypt" {
+		flags.StringVar(&value, "value", "", "Value to encrypt; read from stdin when omitted, which keeps it out of the shell history")
+	}
+	flags.Parse(args[1:])
+
+	if keyFile == "" {
+		keyFile = secrets.KeyPath("")
+		if configPath != "" {
+			path, err := config.SecretsKeyFile(configPath)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to read config: %v\n", err)
+				return 1
+			}
+			keyFile = path
+		}
+	}
+
+	switch args[0] {
+	case "encrypt":
+		return secretEncrypt(keyFile, value)
+	case "rotate-key":
+		files := flags.Args()
+		if len(files) == 0 && configPath != "" {
+			files = []string{configPath}
+		}
+		if len(files) == 0 {
+			fmt.Fprintln(os.Stderr, secretUsage)
+			return 2
+		}
+		return secretRotateKey(keyFile, files)
+	default:
+		fmt.Fprintln(os.Stderr, secretUsage)
+		return 2
+	}
+}
+
+// secretEncrypt prints value encrypted under the key, creating the key on
+// first use.
+func secretEncrypt(keyFile, value string) int {
+	if value == "" {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && err != io.EOF {
+			fmt.Fprintf(os.Stderr, "Failed to read value: %v\n", err)
+			return 1
+		}
+		value = strings.TrimRight(line, "\r\n")
+	}
+	if value == "" {
+		fmt.Fprintln(os.Stderr, "Refusing to encrypt an empty value")
+		return 1
+	}
+
+	key, err := secrets.LoadKey(keyFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		if key, err = secrets.GenerateKey(); err == nil {
+			err = secrets.WriteKey(keyFile, key)
+		}
+		if err == nil {
+			fmt.Fprintf(os.Stderr, "Created new key %s; copy it to every node that reads this value\n", keyFile)
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load key: %v\n", err)
+		return 1
+	}
+
+	encrypted, err := secrets.Encrypt(key, value)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to encrypt value: %v\n", err)
+		return 1
+	}
+	fmt.Println(encrypted)
+	return 0
+}
+
+// secretRotateKey replaces the key and re-encrypts every value in configs
+// and the files they extend or include. Everything is decrypted before
+// anything is written, so a file holding a value under another key aborts
+// the rotation untouched. The previous key is kept as <key>.old until the
+// new one has been copied to every node; a rotation refuses to run while an
+// earlier one's <key>.old is still there, as it would be overwritten.
+func secretRotateKey(keyFile string, configs []string) int {
+	if _, err := os.Stat(keyFile + ".old"); err == nil {
+		fmt.Fprintf(os.Stderr, "%s.old exists from an earlier rotation; remove it once every node has the current key\n", keyFile)
+		return 1
+	}
+
+	var files []string
+	seen := map[string]bool{}
+	for _, path := range configs {
+		included, err := config.Files(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to read %s: %v\n", path, err)
+			return 1
+		}
+		for _, file := range included {
+			abs, err := filepath.Abs(file)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%v\n", err)
+				return 1
+			}
+			if !seen[abs] {
+				seen[abs] = true
+				files = append(files, file)
+			}
+		}
+	}
+
+	oldKey, err := secrets.LoadKey(keyFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load key: %v\n", err)
+		return 1
+	}
+	newKey, err := secrets.GenerateKey()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+
+	rotated := make([][]byte, len(files))
+	for i, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to read %s: %v\n", file, err)
+			return 1
+		}
+		out, count, err := secrets.Reencrypt(data, oldKey, newKey)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", file, err)
+			return 1
+		}
+		rotated[i] = out
+		fmt.Fprintf(os.Stderr, "%s: %d value(s) re-encrypted\n", file, count)
+	}
+
+	if err := secrets.WriteKey(keyFile+".old", oldKey); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to back up the current key: %v\n", err)
+		return 1
+	}
+	if err := secrets.WriteKey(keyFile, newKey); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write the new key: %v\n", err)
+		return 1
+	}
+
+	for i, file := range files {
+		if err := replaceFile(file, rotated[i]); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to write %s: %v (the previous key is in %s.old)\n", file, err, keyFile)
+			return 1
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "Rotated %s; the previous key is kept in %s.old\n", keyFile, keyFile)
+	return 0
+}
+
+// replaceFile atomically rewrites path, keeping its permissions.
+func replaceFile(path string, data []byte) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), info.Mode().Perm()); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/virtlabs-io/dbcp-agent/internal/secrets"
+)
+
+func TestSecretRotateKeyFollowsIncludes(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "secrets.key")
+	key, err := secrets.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := secrets.WriteKey(keyFile, key); err != nil {
+		t.Fatal(err)
+	}
+	encrypt := func(value string) string {
+		out, err := secrets.Encrypt(key, value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return out
+	}
+
+	shared := filepath.Join(dir, "shared.yaml")
+	node := filepath.Join(dir, "node1.yaml")
+	files := map[string]string{
+		shared: "password: \"" + encrypt("from-include") + "\"\n",
+		node:   "include:\n  - shared.yaml\nnode:\n  password: \"" + encrypt("from-node") + "\"\n",
+	}
+	for path, text := range files {
+		if err := os.WriteFile(path, []byte(text), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if code := secretRotateKey(keyFile, []string{node}); code != 0 {
+		t.Fatalf("rotate-key exited %d", code)
+	}
+	newKey, err := secrets.LoadKey(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string]string{shared: "from-include", node: "from-node"} {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		start := strings.Index(string(data), "enc:v1:")
+		value := string(data[start:])
+		value = value[:strings.IndexByte(value, '"')]
+		if got, err := secrets.Decrypt(newKey, value); err != nil || got != want {
+			t.Errorf("%s: expected %q under the new key, got %q (%v)", filepath.Base(path), want, got, err)
+		}
+	}
+
+	// The previous key is still waiting to be cleaned up
+	if code := secretRotateKey(keyFile, []string{node}); code == 0 {
+		t.Error("expected a second rotation to refuse while secrets.key.old exists")
+	}
+}
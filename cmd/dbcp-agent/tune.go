@@ -0,0 +1,89 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/virtlabs-io/dbcp-agent/internal/config"
+	"github.com/virtlabs-io/dbcp-agent/internal/pkg"
+	"github.com/virtlabs-io/dbcp-agent/internal/system"
+)
+
+// runTune implements "dbcp-agent tune": it prints the PostgreSQL settings
+// computed for this node, and with -explain why each was chosen.
+func runTune(args []string) int {
+	var configPath, profile string
+	var explain bool
+	fs := flag.NewFlagSet("tune", flag.ExitOnError)
+	fs.StringVar(&configPath, "config", "./configs/agent-config.yaml", "Path to configuration file")
+	fs.StringVar(&configPath, "c", "./configs/agent-config.yaml", "Path to configuration file (shorthand)")
+	fs.StringVar(&profile, "profile", "", "Workload profile: oltp, olap or mixed (default: node.postgresql.tuning.profile, else mixed)")
+	fs.BoolVar(&explain, "explain", false, "Show the detected hardware and the reasoning behind each value")
+	fs.Parse(args)
+
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load config: %v\n", err)
+		return 1
+	}
+	if err := cfg.Validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid config: %v\n", err)
+		return 1
+	}
+
+	if profile == "" {
+		profile = cfg.Node.PostgreSQL.Tuning.Profile
+	}
+	if profile == "" {
+		profile = config.ProfileMixed
+	}
+	switch profile {
+	case config.ProfileOLTP, config.ProfileOLAP, config.ProfileMixed:
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown profile %q: use oltp, olap or mixed\n", profile)
+		return 2
+	}
+
+	hw, recs, err := pkg.Tune(cfg, profile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+
+	if explain {
+		storage := hw.Storage
+		if cfg.Node.PostgreSQL.Tuning.Storage != "" {
+			storage += " (from config)"
+		} else if hw.Device != "" {
+			storage += " (" + hw.Device + ")"
+		}
+		fmt.Printf("# Profile: %s\n", profile)
+		fmt.Printf("# Memory:  %.1f GiB\n", float64(hw.MemoryBytes)/(1<<30))
+		fmt.Printf("# CPUs:    %d\n", hw.CPUs)
+		fmt.Printf("# Storage: %s\n", storage)
+		if cfg.Node.PostgreSQL.Tuning.Profile == "" {
+			fmt.Println("# Tuning is off for this node; set node.postgresql.tuning.profile to apply these values.")
+		}
+		if hw.CPUs < 4 {
+			fmt.Println("# Fewer than 4 CPUs: parallel worker settings keep PostgreSQL's defaults.")
+		}
+		if hw.Storage == system.StorageUnknown {
+			fmt.Println("# Storage type unknown: set node.postgresql.tuning.storage for planner cost settings.")
+		}
+		fmt.Println()
+	}
+
+	fmt.Println("parameters:")
+	for _, rec := range recs {
+		if rec.Override != "" {
+			fmt.Printf("  %s: %s  # set in config; computed %s\n", rec.Name, rec.Override, rec.Value)
+		} else {
+			fmt.Printf("  %s: %s\n", rec.Name, rec.Value)
+		}
+		if explain {
+			fmt.Printf("    # %s\n", rec.Reason)
+		}
+	}
+	return 0
+}
@@ -2,24 +2,35 @@ package agent
 
 import (
 	"context"
-	"log"
 	"time"
+
+	"github.com/virtlabs-io/dbcp-agent/internal/logger"
 )
 
-func Run(ctx context.Context) error {
+// Run supervises the services of sup until ctx is cancelled and logs their
+// state periodically. On cancellation the services are stopped in reverse
+// dependency order before Run returns.
+func Run(ctx context.Context, sup *Supervisor) error {
 	ticker := time.NewTicker(10 * time.Second)
 	defer ticker.Stop()
 
-	log.Println("Agent running...")
+	logger.Info("Agent running...")
+
+	done := make(chan struct{})
+	go func() {
+		sup.Run(ctx)
+		close(done)
+	}()
 
 	for {
 		select {
-		case <-ctx.Done():
-			log.Println("Agent stopping due to cancellation...")
+		case <-done:
+			logger.Info("Agent stopped")
 			return nil
 		case <-ticker.C:
-			// Future periodic tasks
-			log.Println("Agent tick...")
+			for _, st := range sup.Status() {
+				logger.Debug("%s: %s (pid %d, %d restarts)", st.Name, st.State, st.PID, st.Restarts)
+			}
 		}
 	}
 }
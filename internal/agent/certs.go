@@ -0,0 +1,242 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/virtlabs-io/dbcp-agent/internal/config"
+	"github.com/virtlabs-io/dbcp-agent/internal/logger"
+	"github.com/virtlabs-io/dbcp-agent/internal/pkg"
+)
+
+// CertMonitor checks the node's certificates every pki.check_interval_hours
+// and logs how long each stays valid. Certificates from the cluster CA that
+// are due are renewed through etcd: the node asks for a new one, pki.ca_node
+// signs it with the CA key, which never leaves that node, and the node
+// installs it once it holds the rolling key, so one node at a time makes its
+// services load the new certificate: etcd is restarted and waited for, then
+// Patroni reloaded, which also reloads PostgreSQL.
+type CertMonitor struct {
+	Config func() *config.AgentConfig
+	// KV reaches etcd, where renewal requests and certificates are passed.
+	KV func() (pkg.KV, error)
+	// ETCDHealth reports whether every etcd member is healthy. It gates the
+	// restart of the local member, and then has HealthTimeout to pass again.
+	RestartETCD   func() error
+	ETCDHealth    func() error
+	ReloadPatroni func() error
+	HealthTimeout time.Duration
+
+	now func() time.Time
+}
+
+// renewalTurnTTL bounds how long a node holds the rolling key. A node whose
+// restart fails keeps it until then, so the others wait for a look at it.
+const renewalTurnTTL = 10 * time.Minute
+
+// NewCertMonitor wires the monitor to the pkg helpers; restartETCD depends
+// on whether etcd runs under systemd or the supervisor.
+func NewCertMonitor(current func() *config.AgentConfig, restartETCD func() error) *CertMonitor {
+	return &CertMonitor{
+		Config:        current,
+		KV:            func() (pkg.KV, error) { return pkg.NewETCDKV(current()) },
+		RestartETCD:   restartETCD,
+		ETCDHealth:    func() error { return pkg.ETCDClusterHealth(current()) },
+		ReloadPatroni: func() error { return pkg.ReloadPatroni(current()) },
+		HealthTimeout: 2 * time.Minute,
+		now:           time.Now,
+	}
+}
+
+// Run checks straight away and then on every interval until ctx is
+// cancelled. The interval is re-read after each check so reloads apply.
+func (m *CertMonitor) Run(ctx context.Context) {
+	for {
+		if err := m.Check(); err != nil {
+			logger.Error("Certificate check failed: %v", err)
+		}
+
+		interval := time.Duration(m.Config().PKI.CheckIntervalHours) * time.Hour
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// Check inspects every configured certificate once and moves the renewal of
+// the ones due a step further: requesting, signing the waiting requests on
+// the CA node, and installing what was signed. A renewal spans a few checks
+// when the CA node signs after this node asked.
+func (m *CertMonitor) Check() error {
+	cfg := m.Config()
+	pairs := pkg.ConfiguredCertificates(cfg)
+	if len(pairs) == 0 {
+		return nil
+	}
+
+	now := m.now()
+	threshold := pkg.RenewalThreshold(cfg)
+	signs := pkg.IsCANode(cfg) && pkg.CanRenewCertificates(cfg)
+	if !pkg.IsCANode(cfg) && pkg.CanRenewCertificates(cfg) {
+		logger.Error("Found a CA key in %s, but pki.ca_node is %s; keep the CA on that node only. Not signing here", cfg.PKI.CADir, cfg.PKI.CANode)
+	}
+
+	ca, ok := pkg.InspectCA(cfg)
+	if !ok || ca.Err != nil {
+		if ok {
+			logger.Error("CA certificate %s: %v", ca.CertFile, ca.Err)
+		}
+		for _, pair := range pairs {
+			if st := pkg.InspectCertificate(pair); st.Err == nil {
+				logExpiry(pair.Service, st, now, threshold)
+			}
+		}
+		return nil
+	}
+	logExpiry("CA", ca, now, threshold)
+	// Certificates never outlive the CA that signs them. Once the CA is
+	// inside the renewal window, so is every certificate renewed from it,
+	// and renewing would restart etcd on every check.
+	if ca.Remaining(now) <= threshold {
+		logger.Error("CA certificate %s expires on %s, too soon for renewed certificates to last; not renewing until the CA is replaced",
+			ca.CertFile, ca.Cert.NotAfter.Format(time.DateOnly))
+		return nil
+	}
+
+	var due []pkg.CertPair
+	for _, pair := range pairs {
+		st := pkg.InspectCertificate(pair)
+		if st.Err != nil {
+			logger.Error("%s certificate %s: %v", pair.Service, pair.CertFile, st.Err)
+			continue
+		}
+		logExpiry(pair.Service, st, now, threshold)
+		if st.Remaining(now) > threshold {
+			continue
+		}
+		if st.Cert.CheckSignatureFrom(ca.Cert) != nil {
+			logger.Warn("%s is due for renewal, but was not issued by the cluster CA; replace it by hand", pair.CertFile)
+			continue
+		}
+		due = append(due, pair)
+	}
+	if len(due) == 0 && !signs {
+		return nil
+	}
+
+	kv, err := m.KV()
+	if err != nil {
+		return err
+	}
+	if len(due) > 0 {
+		if err := pkg.RequestRenewal(cfg, kv); err != nil {
+			return fmt.Errorf("failed to request a renewed certificate: %w", err)
+		}
+	}
+	if signs {
+		if err := pkg.SignRenewals(cfg, kv); err != nil {
+			return fmt.Errorf("failed to sign renewed certificates: %w", err)
+		}
+	}
+	if len(due) == 0 {
+		return nil
+	}
+	return m.install(cfg, kv, due)
+}
+
+// install writes the certificate signed for this node, if there is one yet,
+// and makes the services load it while this node holds the rolling key.
+func (m *CertMonitor) install(cfg *config.AgentConfig, kv pkg.KV, due []pkg.CertPair) error {
+	certPEM, err := pkg.IssuedRenewal(cfg, kv)
+	if err != nil || certPEM == nil {
+		return err
+	}
+
+	turn := pkg.RollingKey(cfg)
+	held, err := kv.Lock(turn, cfg.Node.Name, renewalTurnTTL)
+	if err != nil {
+		return err
+	}
+	if !held {
+		logger.Info("Renewed certificate for %s is ready; waiting for another node to finish swapping its own", cfg.Node.Name)
+		return nil
+	}
+
+	services := map[string]bool{}
+	for _, pair := range due {
+		services[pair.Service] = true
+	}
+	// etcd is only restarted while every member is healthy; while another
+	// is down, this node keeps its certificates until the next check.
+	if services[pkg.CertServiceETCD] {
+		if err := m.ETCDHealth(); err != nil {
+			logger.Warn("etcd cluster is not healthy; postponing the certificate swap: %v", err)
+			return kv.Delete(turn)
+		}
+	}
+
+	if err := pkg.InstallRenewal(cfg, kv, certPEM, due); err != nil {
+		kv.Delete(turn)
+		return err
+	}
+	// A failed swap keeps the rolling key until it expires, so no other
+	// node restarts while this one may be down.
+	if err := m.swap(services); err != nil {
+		return err
+	}
+	return kv.Delete(turn)
+}
+
+// logExpiry logs how long a certificate stays valid, louder as it gets
+// closer to expiring.
+func logExpiry(what string, st pkg.CertStatus, now time.Time, threshold time.Duration) {
+	left := st.Remaining(now)
+	expires := st.Cert.NotAfter.Format(time.DateOnly)
+	switch {
+	case left <= 0:
+		logger.Error("%s certificate %s expired on %s", what, st.CertFile, expires)
+	case left <= threshold:
+		logger.Warn("%s certificate %s expires in %d days (%s)", what, st.CertFile, int(left.Hours()/24), expires)
+	default:
+		logger.Info("%s certificate %s is valid until %s", what, st.CertFile, expires)
+	}
+}
+
+// swap makes the services with renewed certificates load them.
+func (m *CertMonitor) swap(services map[string]bool) error {
+	if services[pkg.CertServiceETCD] {
+		logger.Info("Restarting etcd to load its renewed certificate...")
+		if err := m.RestartETCD(); err != nil {
+			return err
+		}
+		if err := m.waitETCD(); err != nil {
+			return err
+		}
+	}
+
+	if services[pkg.CertServicePatroni] || services[pkg.CertServicePostgreSQL] {
+		logger.Info("Reloading Patroni to load the renewed certificates...")
+		if err := m.ReloadPatroni(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *CertMonitor) waitETCD() error {
+	deadline := time.Now().Add(m.HealthTimeout)
+	for {
+		err := m.ETCDHealth()
+		if err == nil {
+			logger.Info("etcd cluster is healthy again")
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("etcd not healthy %s after restart: %w", m.HealthTimeout, err)
+		}
+		time.Sleep(time.Second)
+	}
+}
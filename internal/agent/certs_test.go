@@ -0,0 +1,296 @@
+package agent
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/virtlabs-io/dbcp-agent/internal/config"
+	"github.com/virtlabs-io/dbcp-agent/internal/pkg"
+	"github.com/virtlabs-io/dbcp-agent/internal/pki"
+)
+
+// memKV is an in-memory pkg.KV shared by the monitors of a test.
+type memKV map[string][]byte
+
+func (kv memKV) Get(key string) ([]byte, error) { return kv[key], nil }
+
+func (kv memKV) List(prefix string) (map[string][]byte, error) {
+	values := map[string][]byte{}
+	for key, value := range kv {
+		if strings.HasPrefix(key, prefix) {
+			values[key] = value
+		}
+	}
+	return values, nil
+}
+
+func (kv memKV) Put(key string, value []byte) error {
+	kv[key] = value
+	return nil
+}
+
+func (kv memKV) Delete(key string) error {
+	delete(kv, key)
+	return nil
+}
+
+func (kv memKV) Lock(key, owner string, ttl time.Duration) (bool, error) {
+	if holder, ok := kv[key]; ok {
+		return string(holder) == owner, nil
+	}
+	kv[key] = []byte(owner)
+	return true, nil
+}
+
+// certFixture issues a two-day etcd certificate from a local CA and returns
+// a monitor recording the restarts and reloads it makes.
+func certFixture(t *testing.T, kv memKV) (*config.AgentConfig, *CertMonitor, *[]string) {
+	t.Helper()
+	current, err := user.Current()
+	if err != nil {
+		t.Skip("no current user")
+	}
+	dir := t.TempDir()
+	cfg := &config.AgentConfig{}
+	cfg.Cluster.Name = "pg-test"
+	cfg.Cluster.Nodes = []config.ClusterNode{{Name: "node1", Host: "10.0.0.1"}, {Name: "node2", Host: "10.0.0.2"}}
+	cfg.Node.Name = "node1"
+	cfg.Node.Host = "10.0.0.1"
+	cfg.Node.User = current.Username
+	cfg.PKI = config.PKIConfig{
+		Dir:             filepath.Join(dir, "pki"),
+		CADir:           filepath.Join(dir, "ca"),
+		ValidDays:       2,
+		CAValidDays:     365,
+		RenewBeforeDays: 7,
+		CANode:          "node1",
+	}
+	if err := pkg.InitCA(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := pkg.IssueCertificate(cfg, cfg.Cluster.Nodes[0], cfg.PKI.Dir); err != nil {
+		t.Fatal(err)
+	}
+	cfg.PKI.ValidDays = 30
+	cfg.Node.ETCD = config.EtcdConfig{
+		CertFile: filepath.Join(cfg.PKI.Dir, pki.NodeCertFile),
+		KeyFile:  filepath.Join(cfg.PKI.Dir, pki.NodeKeyFile),
+		CAFile:   filepath.Join(cfg.PKI.Dir, pki.CACertFile),
+	}
+	cfg.Node.Patroni.Extra = map[string]any{"restapi": map[string]any{
+		"certfile": cfg.Node.ETCD.CertFile,
+		"keyfile":  cfg.Node.ETCD.KeyFile,
+	}}
+
+	var calls []string
+	m := &CertMonitor{
+		Config: func() *config.AgentConfig { return cfg },
+		KV:     func() (pkg.KV, error) { return kv, nil },
+		RestartETCD: func() error {
+			calls = append(calls, "restart etcd")
+			return nil
+		},
+		ETCDHealth: func() error { return nil },
+		ReloadPatroni: func() error {
+			calls = append(calls, "reload patroni")
+			return nil
+		},
+		HealthTimeout: time.Second,
+		now:           time.Now,
+	}
+	return cfg, m, &calls
+}
+
+// memberFixture sets up node2 with a two-day certificate from the CA of
+// caCfg, and no CA key, sharing kv with the CA node.
+func memberFixture(t *testing.T, caCfg *config.AgentConfig, kv memKV) (*config.AgentConfig, *CertMonitor, *[]string) {
+	t.Helper()
+	cfg, m, calls := certFixture(t, kv)
+	if err := os.RemoveAll(cfg.PKI.CADir); err != nil {
+		t.Fatal(err)
+	}
+	cfg.Node.Name, cfg.Node.Host = "node2", "10.0.0.2"
+	caCfg.PKI.ValidDays = 2
+	if err := pkg.IssueCertificate(caCfg, cfg.Cluster.Nodes[1], cfg.PKI.Dir); err != nil {
+		t.Fatal(err)
+	}
+	caCfg.PKI.ValidDays = 30
+	return cfg, m, calls
+}
+
+func renewedFor(t *testing.T, cfg *config.AgentConfig) bool {
+	t.Helper()
+	st := pkg.InspectCertificate(pkg.ConfiguredCertificates(cfg)[0])
+	if st.Err != nil {
+		t.Fatal(st.Err)
+	}
+	return st.Remaining(time.Now()) > 29*24*time.Hour && st.Cert.VerifyHostname(cfg.Node.Host) == nil
+}
+
+func TestCertMonitorRenewsAndSwaps(t *testing.T) {
+	kv := memKV{}
+	cfg, m, calls := certFixture(t, kv)
+
+	if err := m.Check(); err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(*calls); got != "[restart etcd reload patroni]" {
+		t.Errorf("expected etcd to restart before Patroni reloads, got %s", got)
+	}
+	if !renewedFor(t, cfg) {
+		t.Fatal("expected a renewed certificate")
+	}
+	if len(kv) != 0 {
+		t.Errorf("expected the renewal to be closed in etcd, left %v", kv)
+	}
+
+	// Nothing is due any more
+	*calls = nil
+	if err := m.Check(); err != nil {
+		t.Fatal(err)
+	}
+	if len(*calls) != 0 {
+		t.Errorf("expected no restarts, got %v", *calls)
+	}
+}
+
+func TestCertMonitorRenewsMembersThroughCANode(t *testing.T) {
+	kv := memKV{}
+	caCfg, caMonitor, caCalls := certFixture(t, kv)
+	// Only node2 is due
+	if err := pkg.IssueCertificate(caCfg, caCfg.Cluster.Nodes[0], caCfg.PKI.Dir); err != nil {
+		t.Fatal(err)
+	}
+	cfg, m, calls := memberFixture(t, caCfg, kv)
+
+	// node2 asks, node1 signs, node2 installs
+	for _, check := range []*CertMonitor{m, caMonitor, m} {
+		if err := check.Check(); err != nil {
+			t.Fatal(err)
+		}
+		for key, value := range kv {
+			if strings.Contains(string(value), "PRIVATE KEY") {
+				t.Errorf("a private key was put in etcd under %s", key)
+			}
+		}
+	}
+
+	if !renewedFor(t, cfg) {
+		t.Fatal("expected node2's certificate to be renewed")
+	}
+	if got := fmt.Sprint(*calls); got != "[restart etcd reload patroni]" {
+		t.Errorf("expected node2 to swap its certificate, got %s", got)
+	}
+	if len(*caCalls) != 0 {
+		t.Errorf("expected node1 to keep running, got %v", *caCalls)
+	}
+	if len(kv) != 0 {
+		t.Errorf("expected the renewal to be closed in etcd, left %v", kv)
+	}
+}
+
+func TestCertMonitorSwapsOneNodeAtATime(t *testing.T) {
+	kv := memKV{}
+	cfg, m, calls := certFixture(t, kv)
+	turn := pkg.RollingKey(cfg)
+	kv[turn] = []byte("node2")
+
+	if err := m.Check(); err != nil {
+		t.Fatal(err)
+	}
+	if len(*calls) != 0 || renewedFor(t, cfg) {
+		t.Errorf("expected node1 to wait while node2 swaps, got %v", *calls)
+	}
+
+	delete(kv, turn)
+	if err := m.Check(); err != nil {
+		t.Fatal(err)
+	}
+	if len(*calls) == 0 || !renewedFor(t, cfg) {
+		t.Error("expected node1 to swap once node2 is done")
+	}
+}
+
+func TestCertMonitorSignsOnlyOnCANode(t *testing.T) {
+	kv := memKV{}
+	cfg, m, calls := certFixture(t, kv)
+	// A CA key copied to another node is not used there
+	cfg.PKI.CANode = "node2"
+
+	if err := m.Check(); err != nil {
+		t.Fatal(err)
+	}
+	if len(*calls) != 0 || renewedFor(t, cfg) {
+		t.Errorf("expected only the CA node to sign, got %v", *calls)
+	}
+	if kv["/dbcp-agent/pg-test/pki/requests/node1"] == nil || kv["/dbcp-agent/pg-test/pki/issued/node1"] != nil {
+		t.Errorf("expected a request waiting for node2 to sign, got %v", kv)
+	}
+}
+
+func TestCertMonitorPostponesWhileETCDUnhealthy(t *testing.T) {
+	kv := memKV{}
+	cfg, m, calls := certFixture(t, kv)
+	m.ETCDHealth = func() error { return fmt.Errorf("no quorum") }
+
+	if err := m.Check(); err != nil {
+		t.Fatal(err)
+	}
+	if len(*calls) != 0 || renewedFor(t, cfg) {
+		t.Errorf("expected no swap while etcd is unhealthy, got %v", *calls)
+	}
+	if kv[pkg.RollingKey(cfg)] != nil {
+		t.Error("expected the rolling key to be released for other nodes")
+	}
+}
+
+func TestCertMonitorSkipsRenewalWhenCAExpires(t *testing.T) {
+	kv := memKV{}
+	cfg, m, calls := certFixture(t, kv)
+	// A CA that ends within renew_before_days caps every renewed certificate
+	// inside it too
+	if err := os.RemoveAll(cfg.PKI.CADir); err != nil {
+		t.Fatal(err)
+	}
+	cfg.PKI.CAValidDays = 5
+	if err := pkg.InitCA(cfg); err != nil {
+		t.Fatal(err)
+	}
+	cfg.PKI.ValidDays = 2
+	if err := pkg.IssueCertificate(cfg, cfg.Cluster.Nodes[0], cfg.PKI.Dir); err != nil {
+		t.Fatal(err)
+	}
+	cfg.PKI.ValidDays = 30
+	before, err := os.ReadFile(cfg.Node.ETCD.CertFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.Check(); err != nil {
+		t.Fatal(err)
+	}
+	if len(*calls) != 0 {
+		t.Errorf("expected no restarts while the CA expires, got %v", *calls)
+	}
+	after, err := os.ReadFile(cfg.Node.ETCD.CertFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(before, after) {
+		t.Error("expected the certificate to be left alone")
+	}
+	if len(kv) != 0 {
+		t.Errorf("expected no renewal request, got %v", kv)
+	}
+
+	ca, ok := pkg.InspectCA(cfg)
+	if !ok || ca.Err != nil || ca.Remaining(time.Now()) > 5*24*time.Hour {
+		t.Errorf("expected the CA to be reported, got %+v", ca)
+	}
+}
@@ -0,0 +1,149 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/virtlabs-io/dbcp-agent/internal/config"
+	"github.com/virtlabs-io/dbcp-agent/internal/logger"
+	"github.com/virtlabs-io/dbcp-agent/internal/pkg"
+)
+
+// Reloader holds the running config and applies changes to it without
+// restarting the agent or the services it manages.
+type Reloader struct {
+	path string
+
+	mu      sync.Mutex
+	current *config.AgentConfig
+}
+
+// NewReloader starts from cfg, which was loaded from path.
+func NewReloader(path string, cfg *config.AgentConfig) *Reloader {
+	return &Reloader{path: path, current: cfg}
+}
+
+// Config returns the config currently in effect.
+func (r *Reloader) Config() *config.AgentConfig {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.current
+}
+
+// Reload re-reads and validates the config file and applies what changed.
+// An invalid file leaves the running config untouched. Forbidden changes
+// are logged and skipped; the rest are applied in order of disruption:
+// agent settings, Patroni dynamic settings, patroni.yml, and finally a
+// PostgreSQL restart when allow_restart_services permits it.
+func (r *Reloader) Reload() ([]config.Change, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	next, err := config.Load(r.path)
+	if err != nil {
+		return nil, err
+	}
+	if err := next.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+
+	effective, changes, err := config.PlanReload(r.current, next)
+	if err != nil {
+		return nil, err
+	}
+	if len(changes) == 0 {
+		logger.Info("Config reloaded: no changes")
+		return nil, nil
+	}
+
+	var logChanged, patroniChanged, restart bool
+	for _, c := range changes {
+		switch {
+		case c.Class == config.ChangeForbidden:
+			logger.Warn("Ignoring change to %s: %s", c.Path, c.Reason)
+			continue
+		case c.Class == config.ChangePostgresRestart:
+			restart = true
+			patroniChanged = true
+		case c.Class == config.ChangePatroniReload, c.DCSKey != "":
+			patroniChanged = true
+		default:
+			logChanged = true
+		}
+		logger.Info("Config change: %s", c)
+	}
+
+	if logChanged {
+		logger.Init(logger.Options{
+			Level:       effective.LogLevel,
+			Output:      effective.LogOutput,
+			LogFilePath: effective.LogFilePath,
+			MaxSizeMB:   effective.LogMaxSizeMB,
+			MaxBackups:  effective.LogMaxBackups,
+			MaxAgeDays:  effective.LogMaxAgeDays,
+		})
+	}
+
+	if !patroniChanged {
+		r.current = effective
+		return changes, nil
+	}
+
+	// Patroni answers with its running REST API settings until it has
+	// reloaded, so new credentials or TLS files are only used after that.
+	// From here on the other new values are in effect even if Patroni
+	// rejects them, so the next reload retries only what changes again.
+	running := *effective
+	running.Node.Patroni.RestAPI = r.current.Node.Patroni.RestAPI
+	r.current = &running
+
+	if patch := pkg.DCSPatch(effective, changes); len(patch) > 0 {
+		if err := pkg.PatchPatroniConfig(&running, patch); err != nil {
+			return changes, err
+		}
+	}
+
+	if err := pkg.GeneratePatroniConfig(effective); err != nil {
+		return changes, err
+	}
+	if err := pkg.ReloadPatroni(&running); err != nil {
+		return changes, err
+	}
+	r.current = effective
+
+	if restart {
+		if !effective.Node.AllowRestartServices {
+			logger.Warn("PostgreSQL needs a restart to apply the new settings; allow_restart_services is off, so restart it with patronictl")
+			return changes, nil
+		}
+		logger.Info("Restarting PostgreSQL to apply the new settings...")
+		if err := pkg.RestartPostgres(effective); err != nil {
+			return changes, err
+		}
+	}
+
+	return changes, nil
+}
+
+// HandleSignals reloads the config on every SIGHUP until ctx is cancelled.
+func (r *Reloader) HandleSignals(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			logger.Info("SIGHUP received, reloading %s", r.path)
+			if _, err := r.Reload(); err != nil {
+				logger.Error("Config reload failed: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package agent
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/virtlabs-io/dbcp-agent/internal/config"
+)
+
+// reloadFixture writes a node config extending the sample cluster config,
+// with Patroni's API served by a test server recording the calls.
+func reloadFixture(t *testing.T) (path string, calls func() []string) {
+	t.Helper()
+	for _, name := range []string{"PG_SUPERUSER_PASSWORD", "PG_ADMIN_PASSWORD", "PG_APP_USER_PASSWORD", "PG_REPLICATION_PASSWORD", "PG_MONITOR_PASSWORD"} {
+		t.Setenv(name, "secret")
+	}
+
+	var mu sync.Mutex
+	var seen []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		call := r.Method + " " + r.URL.Path
+		if user, pass, ok := r.BasicAuth(); ok {
+			call += " as " + user + ":" + pass
+		}
+		seen = append(seen, call)
+	}))
+	t.Cleanup(srv.Close)
+
+	base, err := filepath.Abs("../../configs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Generated files are handed to os_user, so it has to exist here
+	current, err := user.Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	path = filepath.Join(dir, "node.yaml")
+
+	text := fmt.Sprintf(`extends: %s/cluster.yaml
+node:
+  name: "node1"
+  host: "192.168.56.101"
+  os_user: %q
+  patroni:
+    port: %d
+    config_path: %s/patroni.yml
+`, base, current.Username, srv.Listener.Addr().(*net.TCPAddr).Port, dir)
+	if err := os.WriteFile(path, []byte(text), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), seen...)
+	}
+}
+
+func loadValid(t *testing.T, path string) *config.AgentConfig {
+	t.Helper()
+	cfg, err := config.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func TestReloadAppliesAllowedChanges(t *testing.T) {
+	path, calls := reloadFixture(t)
+	r := NewReloader(path, loadValid(t, path))
+
+	text, _ := os.ReadFile(path)
+	edited := strings.Replace(string(text), "  patroni:\n", "  postgresql:\n    data_dir: /elsewhere\n  patroni:\n    dcs:\n      ttl: 45\n    tags:\n      nofailover: true\n", 1)
+	os.WriteFile(path, []byte(edited), 0600)
+
+	changes, err := r.Reload()
+	if err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+	if len(changes) != 3 {
+		t.Errorf("expected 3 changes, got %v", changes)
+	}
+
+	cfg := r.Config()
+	if cfg.Node.Patroni.DCS.TTL != 45 || !cfg.Node.Patroni.Tags.NoFailover {
+		t.Errorf("expected the allowed changes to be applied: %+v", cfg.Node.Patroni)
+	}
+	if cfg.Node.PostgreSQL.DataDir == "/elsewhere" {
+		t.Error("expected the data_dir change to be refused")
+	}
+
+	if got := strings.Join(calls(), ","); got != "PATCH /config,POST /reload" {
+		t.Errorf("unexpected Patroni calls: %s", got)
+	}
+	if data, err := os.ReadFile(cfg.Node.Patroni.ConfigPath); err != nil || !strings.Contains(string(data), "nofailover: true") {
+		t.Errorf("expected patroni.yml to be rewritten: %v", err)
+	}
+}
+
+func TestReloadExtensionParameter(t *testing.T) {
+	path, calls := reloadFixture(t)
+	r := NewReloader(path, loadValid(t, path))
+
+	// Extension settings keep their dot all the way into the DCS patch
+	text, _ := os.ReadFile(path)
+	edited := strings.Replace(string(text), "  patroni:\n", "  postgresql:\n    parameters:\n      pg_stat_statements.track: all\n  patroni:\n", 1)
+	os.WriteFile(path, []byte(edited), 0600)
+
+	changes, err := r.Reload()
+	if err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+	if len(changes) != 1 || changes[0].Class != config.ChangeLive || changes[0].DCSKey != "postgresql.parameters.pg_stat_statements.track" {
+		t.Fatalf("expected one live DCS change, got %v", changes)
+	}
+	if got := r.Config().Node.PostgreSQL.Parameters.Extra["pg_stat_statements.track"]; got != "all" {
+		t.Errorf("expected the parameter to be applied, got %q", got)
+	}
+	if got := strings.Join(calls(), ","); got != "PATCH /config,POST /reload" {
+		t.Errorf("unexpected Patroni calls: %s", got)
+	}
+}
+
+func TestReloadKeepsConfigWhenInvalid(t *testing.T) {
+	path, calls := reloadFixture(t)
+	running := loadValid(t, path)
+	r := NewReloader(path, running)
+
+	text, _ := os.ReadFile(path)
+	os.WriteFile(path, []byte(strings.Replace(string(text), "  patroni:\n", "  patroni:\n    dcs:\n      ttl: 0\n", 1)), 0600)
+
+	if _, err := r.Reload(); err == nil || !strings.Contains(err.Error(), "node.patroni.dcs.ttl") {
+		t.Errorf("expected the invalid ttl to be reported, got %v", err)
+	}
+	if r.Config() != running {
+		t.Error("expected the running config to be kept")
+	}
+	if len(calls()) != 0 {
+		t.Errorf("expected no Patroni calls, got %v", calls())
+	}
+}
+
+func TestReloadSwitchesRestAPICredentialsAfterPatroniReloads(t *testing.T) {
+	path, calls := reloadFixture(t)
+	text, _ := os.ReadFile(path)
+	withAuth := func(password, ttl string) string {
+		return strings.Replace(string(text), "  patroni:\n", "  patroni:\n    dcs:\n      ttl: "+ttl+"\n    restapi:\n      username: patroni\n      password: "+password+"\n", 1)
+	}
+	os.WriteFile(path, []byte(withAuth("old-pass", "30")), 0600)
+	r := NewReloader(path, loadValid(t, path))
+
+	// Patroni only knows the new password once it has reloaded patroni.yml
+	os.WriteFile(path, []byte(withAuth("new-pass", "45")), 0600)
+	if _, err := r.Reload(); err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+	if got := r.Config().Node.Patroni.RestAPI.Password; got != "new-pass" {
+		t.Errorf("expected the new credentials once Patroni reloaded, got %q", got)
+	}
+
+	os.WriteFile(path, []byte(withAuth("new-pass", "50")), 0600)
+	if _, err := r.Reload(); err != nil {
+		t.Fatalf("second Reload failed: %v", err)
+	}
+
+	want := "PATCH /config as patroni:old-pass,POST /reload as patroni:old-pass,PATCH /config as patroni:new-pass,POST /reload as patroni:new-pass"
+	if got := strings.Join(calls(), ","); got != want {
+		t.Errorf("unexpected Patroni calls:\n got: %s\nwant: %s", got, want)
+	}
+}
@@ -0,0 +1,91 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// StateFile is the name of the file, inside the state directory, that
+// records the processes the supervisor has launched.
+const StateFile = "services.json"
+
+// processRecord identifies a launched process well enough to recognise it
+// after an agent restart, even if its PID has been reused since.
+type processRecord struct {
+	PID       int       `json:"pid"`
+	Argv      []string  `json:"argv"`
+	StartedAt time.Time `json:"started_at"`
+}
+
+type state struct {
+	Services map[string]processRecord `json:"services"`
+}
+
+func loadState(path string) (*state, error) {
+	st := &state{Services: map[string]processRecord{}}
+	if path == "" {
+		return st, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return st, nil
+	}
+	if err != nil {
+		return st, fmt.Errorf("failed to read state file: %w", err)
+	}
+	if err := json.Unmarshal(data, st); err != nil {
+		return &state{Services: map[string]processRecord{}}, fmt.Errorf("failed to parse state file %s: %w", path, err)
+	}
+	if st.Services == nil {
+		st.Services = map[string]processRecord{}
+	}
+	return st, nil
+}
+
+// save writes the state atomically so a crash never leaves a torn file.
+func (st *state) save(path string) error {
+	if path == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// processAlive reports whether pid exists. EPERM means it exists but belongs
+// to someone else.
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+// processMatches reports whether pid is alive and still runs argv.
+func processMatches(rec processRecord) bool {
+	if rec.PID <= 0 || !processAlive(rec.PID) {
+		return false
+	}
+	cmdline, err := os.ReadFile("/proc/" + strconv.Itoa(rec.PID) + "/cmdline")
+	if err != nil {
+		return false
+	}
+	return string(cmdline) == strings.Join(rec.Argv, "\x00")+"\x00"
+}
@@ -0,0 +1,422 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/virtlabs-io/dbcp-agent/internal/logger"
+)
+
+// Service is a long-running child process kept alive by the Supervisor.
+type Service struct {
+	Name string
+	// Command builds a fresh command for every (re)start.
+	Command func() *exec.Cmd
+	// BeforeStart, when set, runs before every start; an error counts as a
+	// failed start.
+	BeforeStart func() error
+	// LogPath, when set, is the file the child writes its output to. The
+	// agent follows it into its own log, so the child keeps logging while
+	// no agent runs and an adopted child is followed again. Without it the
+	// output is discarded.
+	LogPath string
+	// StopTimeout is how long a SIGTERM may take before SIGKILL follows.
+	StopTimeout time.Duration
+	// Health, when set, decides whether a process left running by an
+	// earlier agent run can be adopted.
+	Health func() error
+}
+
+// State is the lifecycle state of a supervised service.
+type State string
+
+const (
+	StateStarting State = "starting"
+	StateRunning  State = "running"
+	StateBackoff  State = "backoff" // exited, waiting to be restarted
+	StateStopping State = "stopping"
+	StateStopped  State = "stopped"
+)
+
+// ServiceStatus is a snapshot of one supervised service.
+type ServiceStatus struct {
+	Name      string
+	State     State
+	PID       int
+	Restarts  int
+	StartedAt time.Time
+	LastError string
+}
+
+// Supervisor owns a set of child processes. Services are started in the
+// order given and stopped in reverse, so later services may depend on
+// earlier ones.
+type Supervisor struct {
+	// Backoff between restarts doubles from MinBackoff up to MaxBackoff and
+	// resets once a process has stayed up for StableAfter.
+	MinBackoff  time.Duration
+	MaxBackoff  time.Duration
+	StableAfter time.Duration
+
+	// StatePath is where launched processes are recorded so a restarted
+	// agent can adopt them instead of starting duplicates. Empty disables
+	// adoption.
+	StatePath string
+	// AdoptRetries health checks, AdoptRetryDelay apart, are made before a
+	// running process is declared unhealthy and replaced.
+	AdoptRetries    int
+	AdoptRetryDelay time.Duration
+
+	mu       sync.Mutex
+	services []*supervised
+	state    *state
+}
+
+// process is a running service, either started by this supervisor or
+// adopted from an earlier run.
+type process struct {
+	pid    int
+	argv   []string
+	exited <-chan error
+}
+
+type supervised struct {
+	Service
+	status  ServiceStatus
+	tail    *logger.Tail // follows LogPath across restarts of the child
+	restart chan struct{}
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+func NewSupervisor(services ...Service) *Supervisor {
+	s := &Supervisor{
+		MinBackoff:      time.Second,
+		MaxBackoff:      time.Minute,
+		StableAfter:     time.Minute,
+		AdoptRetries:    3,
+		AdoptRetryDelay: time.Second,
+		state:           &state{Services: map[string]processRecord{}},
+	}
+	for _, svc := range services {
+		if svc.StopTimeout == 0 {
+			svc.StopTimeout = 30 * time.Second
+		}
+		s.services = append(s.services, &supervised{
+			Service: svc,
+			status:  ServiceStatus{Name: svc.Name, State: StateStopped},
+			restart: make(chan struct{}, 1),
+			stop:    make(chan struct{}),
+			done:    make(chan struct{}),
+		})
+	}
+	return s
+}
+
+// Status returns a snapshot of every service in start order.
+func (s *Supervisor) Status() []ServiceStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	statuses := make([]ServiceStatus, len(s.services))
+	for i, svc := range s.services {
+		statuses[i] = svc.status
+	}
+	return statuses
+}
+
+// Restart stops the running process of the named service and starts a new
+// one straight away, without backoff. It returns before the new process is
+// up; a service that is not running picks the request up on its next start.
+func (s *Supervisor) Restart(name string) error {
+	for _, svc := range s.services {
+		if svc.Name == name {
+			select {
+			case svc.restart <- struct{}{}:
+			default: // a restart is already pending
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("no service named %q", name)
+}
+
+// Run starts every service and keeps it running until ctx is cancelled,
+// then stops them in reverse order. A Supervisor can only be run once.
+func (s *Supervisor) Run(ctx context.Context) {
+	st, err := loadState(s.StatePath)
+	if err != nil {
+		logger.Warn("Ignoring process state: %v", err)
+	}
+	s.mu.Lock()
+	s.state = st
+	s.mu.Unlock()
+
+	for _, svc := range s.services {
+		started := make(chan struct{})
+		go s.supervise(svc, started)
+		<-started
+	}
+
+	<-ctx.Done()
+
+	for i := len(s.services) - 1; i >= 0; i-- {
+		svc := s.services[i]
+		logger.Info("Stopping %s...", svc.Name)
+		close(svc.stop)
+		<-svc.done
+	}
+}
+
+func (s *Supervisor) update(svc *supervised, fn func(*ServiceStatus)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fn(&svc.status)
+}
+
+// record stores (or, for nil, forgets) the process running svc.
+func (s *Supervisor) record(svc *supervised, p *process) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if p == nil {
+		delete(s.state.Services, svc.Name)
+	} else {
+		s.state.Services[svc.Name] = processRecord{PID: p.pid, Argv: p.argv, StartedAt: time.Now().UTC()}
+	}
+	if err := s.state.save(s.StatePath); err != nil {
+		logger.Warn("Failed to save process state: %v", err)
+	}
+}
+
+// supervise runs svc until its stop channel is closed. started is closed
+// after the first start attempt so the next service can follow.
+func (s *Supervisor) supervise(svc *supervised, started chan struct{}) {
+	defer close(svc.done)
+	defer func() {
+		if svc.tail != nil {
+			svc.tail.Close()
+		}
+	}()
+
+	backoff := s.MinBackoff
+	first := true
+	for {
+		s.update(svc, func(st *ServiceStatus) { st.State = StateStarting })
+
+		var p *process
+		var err error
+		if first {
+			p = s.adopt(svc)
+		}
+		if p == nil {
+			p, err = s.start(svc)
+		}
+		if first {
+			close(started)
+			first = false
+		}
+
+		if err == nil {
+			startedAt := time.Now()
+			s.update(svc, func(st *ServiceStatus) {
+				st.State = StateRunning
+				st.PID = p.pid
+				st.StartedAt = startedAt
+			})
+			logger.Info("%s running with PID %d", svc.Name, p.pid)
+
+			select {
+			case err = <-p.exited:
+				s.record(svc, nil)
+				if err == nil {
+					err = fmt.Errorf("exited")
+				}
+				if time.Since(startedAt) >= s.StableAfter {
+					backoff = s.MinBackoff
+				}
+			case <-svc.restart:
+				logger.Info("Restarting %s (PID %d)...", svc.Name, p.pid)
+				s.update(svc, func(st *ServiceStatus) { st.State = StateStopping })
+				s.stopProcess(svc, p)
+				s.record(svc, nil)
+				s.update(svc, func(st *ServiceStatus) {
+					st.PID = 0
+					st.Restarts++
+				})
+				continue
+			case <-svc.stop:
+				s.terminate(svc, p)
+				return
+			}
+		}
+
+		logger.Warn("%s: %v; restarting in %s", svc.Name, err, backoff)
+		s.update(svc, func(st *ServiceStatus) {
+			st.State = StateBackoff
+			st.PID = 0
+			st.LastError = err.Error()
+		})
+
+		select {
+		case <-time.After(backoff):
+		case <-svc.stop:
+			s.update(svc, func(st *ServiceStatus) { st.State = StateStopped })
+			return
+		}
+
+		backoff *= 2
+		if backoff > s.MaxBackoff {
+			backoff = s.MaxBackoff
+		}
+		s.update(svc, func(st *ServiceStatus) { st.Restarts++ })
+	}
+}
+
+// adopt returns the process an earlier agent run left running for svc if
+// it is still the same process and healthy. Unhealthy ones are stopped so a
+// fresh one can take their place. An adopted process still writes to
+// LogPath, which is followed again from its current end.
+func (s *Supervisor) adopt(svc *supervised) *process {
+	s.mu.Lock()
+	rec, ok := s.state.Services[svc.Name]
+	s.mu.Unlock()
+	if !ok {
+		return nil
+	}
+
+	if !processMatches(rec) {
+		logger.Info("Recorded %s process (PID %d) is gone, starting a new one", svc.Name, rec.PID)
+		s.record(svc, nil)
+		return nil
+	}
+
+	p := &process{pid: rec.PID, argv: rec.Argv, exited: watchPID(rec.PID)}
+
+	if svc.Health != nil {
+		var err error
+		for i := 0; i < s.AdoptRetries; i++ {
+			if i > 0 {
+				time.Sleep(s.AdoptRetryDelay)
+			}
+			if err = svc.Health(); err == nil {
+				break
+			}
+		}
+		if err != nil {
+			logger.Warn("Running %s (PID %d) is unhealthy: %v; replacing it", svc.Name, rec.PID, err)
+			s.stopProcess(svc, p)
+			s.record(svc, nil)
+			return nil
+		}
+	}
+
+	if svc.LogPath != "" {
+		var offset int64
+		if info, err := os.Stat(svc.LogPath); err == nil {
+			offset = info.Size()
+		}
+		s.follow(svc, offset)
+	}
+	logger.Info("Adopted running %s (PID %d)", svc.Name, rec.PID)
+	return p
+}
+
+// watchPID reports the exit of a process this supervisor cannot wait on.
+func watchPID(pid int) <-chan error {
+	exited := make(chan error, 1)
+	go func() {
+		for processAlive(pid) {
+			time.Sleep(500 * time.Millisecond)
+		}
+		exited <- fmt.Errorf("adopted process %d exited", pid)
+	}()
+	return exited
+}
+
+// start launches the service and records it in the state file.
+func (s *Supervisor) start(svc *supervised) (*process, error) {
+	if svc.BeforeStart != nil {
+		if err := svc.BeforeStart(); err != nil {
+			return nil, err
+		}
+	}
+
+	cmd := svc.Command()
+	// Keep terminal signals away from children; the supervisor decides
+	// when and in which order they stop.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	if svc.LogPath != "" {
+		// The child gets the file itself rather than a pipe to the agent,
+		// so an agent exit cannot break its stdout.
+		file, err := logger.OpenComponentLog(svc.LogPath)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		offset, err := file.Seek(0, io.SeekEnd)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open log file: %w", err)
+		}
+		cmd.Stdout = file
+		cmd.Stderr = file
+		s.follow(svc, offset)
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start: %w", err)
+	}
+
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+
+	p := &process{pid: cmd.Process.Pid, argv: cmd.Args, exited: exited}
+	s.record(svc, p)
+	return p, nil
+}
+
+// terminate stops a running service for good.
+func (s *Supervisor) terminate(svc *supervised, p *process) {
+	s.update(svc, func(st *ServiceStatus) { st.State = StateStopping })
+	s.stopProcess(svc, p)
+	s.record(svc, nil)
+
+	s.update(svc, func(st *ServiceStatus) {
+		st.State = StateStopped
+		st.PID = 0
+	})
+	logger.Info("%s stopped", svc.Name)
+}
+
+// follow starts logging the lines appended to svc.LogPath from offset on,
+// unless an earlier run of the child is followed already.
+func (s *Supervisor) follow(svc *supervised, offset int64) {
+	if svc.tail == nil {
+		svc.tail = logger.TailComponent(svc.Name, svc.LogPath, offset)
+	}
+}
+
+// stopProcess sends SIGTERM and escalates to SIGKILL after StopTimeout.
+func (s *Supervisor) stopProcess(svc *supervised, p *process) {
+	if err := syscall.Kill(p.pid, syscall.SIGTERM); err != nil {
+		logger.Warn("Failed to send SIGTERM to %s: %v", svc.Name, err)
+	}
+
+	select {
+	case <-p.exited:
+	case <-time.After(svc.StopTimeout):
+		logger.Warn("%s did not stop within %s, killing it", svc.Name, svc.StopTimeout)
+		// The child leads its own process group; take its children with it
+		syscall.Kill(-p.pid, syscall.SIGKILL)
+		<-p.exited
+	}
+}
@@ -0,0 +1,354 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSupervisorRestartsWithBackoff(t *testing.T) {
+	sup := NewSupervisor(Service{
+		Name:    "crashy",
+		Command: func() *exec.Cmd { return exec.Command("sh", "-c", "exit 3") },
+	})
+	sup.MinBackoff = 10 * time.Millisecond
+	sup.MaxBackoff = 40 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		sup.Run(ctx)
+		close(done)
+	}()
+
+	waitFor(t, "restarts", func() bool { return sup.Status()[0].Restarts >= 3 })
+	if st := sup.Status()[0]; !strings.Contains(st.LastError, "exit status 3") {
+		t.Errorf("expected the exit status to be recorded, got %q", st.LastError)
+	}
+
+	cancel()
+	<-done
+	if st := sup.Status()[0]; st.State != StateStopped {
+		t.Errorf("expected stopped after shutdown, got %s", st.State)
+	}
+}
+
+func TestSupervisorStopsInReverseOrder(t *testing.T) {
+	dir := t.TempDir()
+	order := filepath.Join(dir, "order")
+
+	// Each service appends its name to a shared file when it gets SIGTERM
+	service := func(name string) Service {
+		script := "trap 'echo " + name + " >> " + order + "; exit 0' TERM; while :; do sleep 0.01; done"
+		return Service{
+			Name:    name,
+			Command: func() *exec.Cmd { return exec.Command("sh", "-c", script) },
+		}
+	}
+
+	sup := NewSupervisor(service("etcd"), service("patroni"))
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		sup.Run(ctx)
+		close(done)
+	}()
+
+	waitFor(t, "both services running", func() bool {
+		for _, st := range sup.Status() {
+			if st.State != StateRunning {
+				return false
+			}
+		}
+		return true
+	})
+
+	cancel()
+	<-done
+
+	data, err := os.ReadFile(order)
+	if err != nil {
+		t.Fatalf("services did not record their shutdown: %v", err)
+	}
+	if got := strings.Fields(string(data)); strings.Join(got, ",") != "patroni,etcd" {
+		t.Errorf("expected patroni to stop before etcd, got %v", got)
+	}
+	for _, st := range sup.Status() {
+		if st.Restarts != 0 {
+			t.Errorf("%s was restarted %d times", st.Name, st.Restarts)
+		}
+	}
+}
+
+func TestSupervisorKillsAfterStopTimeout(t *testing.T) {
+	sup := NewSupervisor(Service{
+		Name:        "stubborn",
+		Command:     func() *exec.Cmd { return exec.Command("sh", "-c", "trap '' TERM; while :; do sleep 0.01; done") },
+		StopTimeout: 50 * time.Millisecond,
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		sup.Run(ctx)
+		close(done)
+	}()
+
+	waitFor(t, "service running", func() bool { return sup.Status()[0].State == StateRunning })
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("supervisor did not kill a service ignoring SIGTERM")
+	}
+}
+
+// leftover starts a process the way a previous agent run would have and
+// records it in a state file.
+func leftover(t *testing.T, statePath, name string) *exec.Cmd {
+	t.Helper()
+	cmd := exec.Command("sleep", "30")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	// Reap it once it is stopped so it does not linger as a zombie
+	go cmd.Wait()
+	t.Cleanup(func() { cmd.Process.Kill() })
+
+	rec := processRecord{PID: cmd.Process.Pid, Argv: cmd.Args}
+	// Until exec completes the child still runs the test binary
+	waitFor(t, "leftover process exec", func() bool { return processMatches(rec) })
+
+	st := &state{Services: map[string]processRecord{name: rec}}
+	if err := st.save(statePath); err != nil {
+		t.Fatal(err)
+	}
+	return cmd
+}
+
+func runSupervisor(t *testing.T, sup *Supervisor) func() {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		sup.Run(ctx)
+		close(done)
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+func TestSupervisorRestartOnRequest(t *testing.T) {
+	sup := NewSupervisor(Service{
+		Name:    "etcd",
+		Command: func() *exec.Cmd { return exec.Command("sleep", "30") },
+	})
+	// A requested restart must not wait out a backoff
+	sup.MinBackoff = time.Hour
+	stop := runSupervisor(t, sup)
+	defer stop()
+
+	waitFor(t, "etcd running", func() bool { return sup.Status()[0].State == StateRunning })
+	first := sup.Status()[0].PID
+
+	if err := sup.Restart("etcd"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "a new etcd process", func() bool {
+		st := sup.Status()[0]
+		return st.State == StateRunning && st.PID != 0 && st.PID != first
+	})
+	if processAlive(first) {
+		t.Error("expected the old process to be stopped")
+	}
+	if st := sup.Status()[0]; st.Restarts != 1 {
+		t.Errorf("expected 1 restart, got %d", st.Restarts)
+	}
+
+	if err := sup.Restart("patroni"); err == nil {
+		t.Error("expected an unknown service to be rejected")
+	}
+}
+
+func TestSupervisorAdoptsHealthyProcess(t *testing.T) {
+	statePath := filepath.Join(t.TempDir(), StateFile)
+	running := leftover(t, statePath, "etcd")
+
+	started := 0
+	sup := NewSupervisor(Service{
+		Name: "etcd",
+		Command: func() *exec.Cmd {
+			started++
+			return exec.Command("sleep", "30")
+		},
+		Health: func() error { return nil },
+	})
+	sup.StatePath = statePath
+	stop := runSupervisor(t, sup)
+
+	waitFor(t, "etcd running", func() bool { return sup.Status()[0].State == StateRunning })
+	if pid := sup.Status()[0].PID; pid != running.Process.Pid {
+		t.Errorf("expected PID %d to be adopted, got %d", running.Process.Pid, pid)
+	}
+	if started != 0 {
+		t.Errorf("expected no new process, %d were started", started)
+	}
+
+	stop()
+	if processAlive(running.Process.Pid) {
+		t.Error("expected the adopted process to be stopped on shutdown")
+	}
+	st, _ := loadState(statePath)
+	if len(st.Services) != 0 {
+		t.Errorf("expected an empty state after shutdown, got %v", st.Services)
+	}
+}
+
+func TestSupervisorReplacesUnhealthyProcess(t *testing.T) {
+	statePath := filepath.Join(t.TempDir(), StateFile)
+	running := leftover(t, statePath, "patroni")
+
+	sup := NewSupervisor(Service{
+		Name:    "patroni",
+		Command: func() *exec.Cmd { return exec.Command("sleep", "30") },
+		Health:  func() error { return fmt.Errorf("connection refused") },
+	})
+	sup.StatePath = statePath
+	sup.AdoptRetryDelay = time.Millisecond
+	stop := runSupervisor(t, sup)
+	defer stop()
+
+	waitFor(t, "patroni running", func() bool { return sup.Status()[0].State == StateRunning })
+	pid := sup.Status()[0].PID
+	if pid == running.Process.Pid {
+		t.Fatal("expected the unhealthy process to be replaced")
+	}
+	// The process is reaped asynchronously, so give it a moment to go away
+	waitFor(t, "unhealthy process stopped", func() bool { return !processAlive(running.Process.Pid) })
+
+	st, _ := loadState(statePath)
+	if st.Services["patroni"].PID != pid {
+		t.Errorf("expected the new PID %d in the state file, got %v", pid, st.Services)
+	}
+}
+
+func TestSupervisorIgnoresStaleRecord(t *testing.T) {
+	statePath := filepath.Join(t.TempDir(), StateFile)
+	// A recycled PID running something else must not be adopted
+	st := &state{Services: map[string]processRecord{
+		"etcd": {PID: os.Getpid(), Argv: []string{"/usr/local/bin/etcd"}},
+	}}
+	if err := st.save(statePath); err != nil {
+		t.Fatal(err)
+	}
+
+	sup := NewSupervisor(Service{
+		Name:    "etcd",
+		Command: func() *exec.Cmd { return exec.Command("sleep", "30") },
+	})
+	sup.StatePath = statePath
+	stop := runSupervisor(t, sup)
+	defer stop()
+
+	waitFor(t, "etcd running", func() bool { return sup.Status()[0].State == StateRunning })
+	if pid := sup.Status()[0].PID; pid == os.Getpid() {
+		t.Error("expected a stale record to be ignored")
+	}
+}
+
+// tickerService logs a line every 50ms; with stdout on a broken pipe its
+// next echo would kill it.
+func tickerService(logPath string) Service {
+	return Service{
+		Name:    "etcd",
+		Command: func() *exec.Cmd { return exec.Command("sh", "-c", "while :; do echo tick; sleep 0.05; done") },
+		LogPath: logPath,
+	}
+}
+
+// TestSupervisorHelperProcess is the agent that crashes in
+// TestAdoptedProcessSurvivesAgentCrash; it only runs in the re-executed
+// test binary.
+func TestSupervisorHelperProcess(t *testing.T) {
+	statePath := os.Getenv("DBCP_SUPERVISOR_STATE")
+	if statePath == "" {
+		t.Skip("only run as a helper process")
+	}
+	sup := NewSupervisor(tickerService(os.Getenv("DBCP_SUPERVISOR_LOG")))
+	sup.StatePath = statePath
+	sup.Run(context.Background())
+}
+
+func TestAdoptedProcessSurvivesAgentCrash(t *testing.T) {
+	dir := t.TempDir()
+	statePath := filepath.Join(dir, StateFile)
+	logPath := filepath.Join(dir, "etcd.log")
+	size := func() int64 {
+		info, err := os.Stat(logPath)
+		if err != nil {
+			return 0
+		}
+		return info.Size()
+	}
+
+	agent := exec.Command(os.Args[0], "-test.run=^TestSupervisorHelperProcess$")
+	agent.Env = append(os.Environ(), "DBCP_SUPERVISOR_STATE="+statePath, "DBCP_SUPERVISOR_LOG="+logPath)
+	if err := agent.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { agent.Process.Kill() })
+
+	var rec processRecord
+	waitFor(t, "the child to be recorded", func() bool {
+		st, _ := loadState(statePath)
+		rec = st.Services["etcd"]
+		return processMatches(rec)
+	})
+	t.Cleanup(func() { syscall.Kill(rec.PID, syscall.SIGKILL) })
+
+	// The agent dies without stopping its children
+	agent.Process.Kill()
+	agent.Wait()
+
+	written := size()
+	waitFor(t, "output after the agent died", func() bool { return size() > written })
+	if !processAlive(rec.PID) {
+		t.Fatal("expected the child to survive writing without an agent")
+	}
+
+	sup := NewSupervisor(tickerService(logPath))
+	sup.StatePath = statePath
+	stop := runSupervisor(t, sup)
+	waitFor(t, "the child to be adopted", func() bool {
+		st := sup.Status()[0]
+		return st.State == StateRunning && st.PID == rec.PID
+	})
+	written = size()
+	waitFor(t, "output after adoption", func() bool { return size() > written })
+
+	stop()
+	if processAlive(rec.PID) {
+		t.Error("expected the adopted child to be stopped on shutdown")
+	}
+}
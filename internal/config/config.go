@@ -3,9 +3,11 @@ package config
 import (
 	"fmt"
 	"os"
+	"strconv"
 	"strings"
 
 	"github.com/virtlabs-io/dbcp-agent/internal/logger"
+	"github.com/virtlabs-io/dbcp-agent/internal/system"
 	"gopkg.in/yaml.v3"
 )
 
@@ -20,6 +22,37 @@ type AgentConfig struct {
 	Node         NodeConfig    `yaml:"node"`
 	Cluster      ClusterConfig `yaml:"cluster"`
 	Repositories Repositories  `yaml:"repositories"`
+	Secrets      SecretsConfig `yaml:"secrets"`
+	PKI          PKIConfig     `yaml:"pki"`
+
+	// The parsed files, kept so validation can report positions
+	root    *yaml.Node
+	origins map[*yaml.Node]string
+	// Paths of values resolved from references or encrypted values
+	secretPaths map[string]bool
+}
+
+// SecretsConfig locates the key for "enc:v1:" values. DBCP_SECRETS_KEY_FILE
+// takes precedence over key_file; without either /etc/dbcp/secrets.key is used.
+type SecretsConfig struct {
+	KeyFile string `yaml:"key_file"`
+}
+
+// PKIConfig is used by "dbcp-agent pki": the cluster CA is kept in ca_dir
+// (only on the host that issues certificates), and each node's certificate,
+// key and a copy of the CA certificate in dir.
+type PKIConfig struct {
+	Dir         string `yaml:"dir"`           // node certificates, /etc/dbcp/pki by default
+	CADir       string `yaml:"ca_dir"`        // CA certificate and key, /etc/dbcp/ca by default
+	ValidDays   int    `yaml:"valid_days"`    // node certificates, 365 by default
+	CAValidDays int    `yaml:"ca_valid_days"` // the CA, 3650 by default
+
+	// The agent checks every configured certificate and renews the ones due
+	// through etcd: the CA key stays on ca_node, which signs every member's
+	// requests, and members swap certificates one at a time.
+	RenewBeforeDays    int    `yaml:"renew_before_days"`    // 30 by default
+	CheckIntervalHours int    `yaml:"check_interval_hours"` // 12 by default
+	CANode             string `yaml:"ca_node"`              // first of cluster.nodes by default
 }
 
 type NodeConfig struct {
@@ -28,12 +61,33 @@ type NodeConfig struct {
 	Role                 string           `yaml:"role"`
 	User                 string           `yaml:"os_user"` // OS-level user (e.g., "vagrant")
 	TmpPath              string           `yaml:"tmp_path"`
+	StateDir             string           `yaml:"state_dir"` // where the agent tracks the processes it runs; defaults to tmp_path
+	Arch                 string           `yaml:"arch"`      // overrides the detected CPU architecture (amd64, arm64, ...)
 	AllowRestartServices bool             `yaml:"allow_restart_services"`
 	PostgreSQL           PostgreSQLConfig `yaml:"postgresql"`
 	ETCD                 EtcdConfig       `yaml:"etcd"`
 	Patroni              PatroniConfig    `yaml:"patroni"`
+	Systemd              SystemdConfig    `yaml:"systemd"`
+}
+
+// --------------- Service management
+type SystemdConfig struct {
+	Mode string `yaml:"mode"` // auto (default), systemd or direct
+	Root string `yaml:"root"` // prefix for unit file paths, "/" by default
+
+	// Extra [Service] directives written to a drop-in next to each unit,
+	// e.g. LimitNOFILE or Environment.
+	ETCDOverrides    map[string]string `yaml:"etcd_overrides"`
+	PatroniOverrides map[string]string `yaml:"patroni_overrides"`
 }
 
+// Service management modes.
+const (
+	ServiceModeAuto    = "auto"    // systemd when it is running, direct otherwise
+	ServiceModeSystemd = "systemd" // always install units
+	ServiceModeDirect  = "direct"  // spawn etcd and Patroni from the agent
+)
+
 // --------------- PostgreSQL Configuration
 type PostgreSQLConfig struct {
 	Version    string                  `yaml:"version"`
@@ -42,9 +96,25 @@ type PostgreSQLConfig struct {
 	Users      map[string]PostgresUser `yaml:"users"`
 	Parameters PostgresSettings        `yaml:"parameters"`
 	InitDB     []map[string]string     `yaml:"initdb"`
-	PGHBA      []string                `yaml:"pg_hba"`
+	PGHBA      []HBARule               `yaml:"pg_hba"`
+	PGHBAAuto  bool                    `yaml:"pg_hba_auto"` // generate replication and superuser rules from cluster.nodes
+	Tuning     TuningConfig            `yaml:"tuning"`
+}
+
+// TuningConfig sizes PostgreSQL settings from the node's hardware. Values
+// in parameters always win over computed ones.
+type TuningConfig struct {
+	Profile string `yaml:"profile"` // oltp, olap or mixed; empty disables tuning
+	Storage string `yaml:"storage"` // ssd or hdd; detected from data_dir when empty
 }
 
+// Workload profiles for tuning.
+const (
+	ProfileOLTP  = "oltp"
+	ProfileOLAP  = "olap"
+	ProfileMixed = "mixed"
+)
+
 type PostgresUser struct {
 	Password string   `yaml:"password"`
 	Options  []string `yaml:"options"` // e.g., createrole, createdb, superuser
@@ -59,6 +129,10 @@ type PostgresSettings struct {
 	HotStandby              string `yaml:"hot_standby"`
 	SynchronousCommit       string `yaml:"synchronous_commit"`
 	SynchronousStandbyNames string `yaml:"synchronous_standby_names"`
+
+	// Any other PostgreSQL setting, e.g. shared_buffers: 4GB. Well-known
+	// settings are type-checked; see guc.go.
+	Extra map[string]string `yaml:",inline"`
 }
 
 // --------------- ETCD Configuration
@@ -72,6 +146,17 @@ type EtcdConfig struct {
 	PeerPort    int    `yaml:"peer_port"`
 	ClientPort  int    `yaml:"client_port"`
 	ClusterMode string `yaml:"cluster_mode"`
+
+	// Release verification. Without a pinned checksum the digest is taken
+	// from the release's SHA256SUMS file.
+	Checksum         string `yaml:"checksum"`          // sha256 of the release archive, optionally "sha256:"-prefixed
+	SignatureKeyring string `yaml:"signature_keyring"` // GPG keyring used to verify SHA256SUMS.asc
+}
+
+// TLSEnabled reports whether etcd serves client and peer traffic over TLS
+// with client certificate authentication, which takes all three files.
+func (e EtcdConfig) TLSEnabled() bool {
+	return e.CertFile != "" && e.KeyFile != "" && e.CAFile != ""
 }
 
 // --------------- Patroni
@@ -81,13 +166,55 @@ type PatroniConfig struct {
 	APIListen            string            `yaml:"api_listen"`
 	Port                 int               `yaml:"port"`
 	ConfigPath           string            `yaml:"config_path"`
-	TemplatePath         string            `yaml:"template_path"`
+	TemplatePath         string            `yaml:"template_path"` // optional; the built-in template otherwise
+	VenvPath             string            `yaml:"venv_path"`     // virtualenv for pip installs
 	DCS                  DCSConfig         `yaml:"dcs"`
 	Authentication       PatroniAuthConfig `yaml:"authentication"`
 	CreateReplicaMethods []string          `yaml:"create_replica_methods"`
 	Tags                 PatroniTags       `yaml:"tags"`
+	Watchdog             WatchdogConfig    `yaml:"watchdog"`
+	Generator            string            `yaml:"generator"` // template (default) or structured
+	RestAPI              RestAPIConfig     `yaml:"restapi"`
+
+	// Extra is deep-merged into the generated patroni.yml, for settings the
+	// agent does not model, e.g. {postgresql: {pgpass: /tmp/pgpass0}}.
+	Extra map[string]any `yaml:"extra"`
+}
+
+// Ways of producing patroni.yml.
+const (
+	PatroniGeneratorTemplate   = "template"   // render the built-in template or template_path
+	PatroniGeneratorStructured = "structured" // marshal typed structs
+)
+
+// WatchdogConfig is Patroni's watchdog section; an empty mode leaves it out.
+type WatchdogConfig struct {
+	Mode         string `yaml:"mode"` // off, automatic or required
+	Device       string `yaml:"device"`
+	SafetyMargin int    `yaml:"safety_margin"`
 }
 
+// RestAPIConfig serves Patroni's REST API over TLS when cert_file is set.
+// Username and password are sent with the agent's reload and PATCH /config
+// requests, for a Patroni whose restapi.authentication requires them.
+type RestAPIConfig struct {
+	CertFile     string `yaml:"cert_file"`
+	KeyFile      string `yaml:"key_file"`
+	CAFile       string `yaml:"ca_file"`
+	VerifyClient string `yaml:"verify_client"` // none, optional or required; needs ca_file
+	Username     string `yaml:"username"`
+	Password     string `yaml:"password"`
+}
+
+// TLSEnabled reports whether the REST API is served over https.
+func (r RestAPIConfig) TLSEnabled() bool {
+	return r.CertFile != ""
+}
+
+// DefaultPatroniVenv is where pip-installed Patroni lives unless
+// patroni.venv_path says otherwise.
+const DefaultPatroniVenv = "/opt/dbcp/patroni"
+
 type PatroniAuthConfig struct {
 	Replication UserCredentials `yaml:"replication"`
 	Superuser   UserCredentials `yaml:"superuser"`
@@ -127,205 +254,392 @@ type ClusterNode struct {
 type Repositories struct {
 	PostgreSQL RepoEntry `yaml:"postgresql"`
 	ETCD       RepoEntry `yaml:"etcd"`
+	Patroni    RepoEntry `yaml:"patroni"`
 }
 
 type RepoEntry struct {
-	Default string                       `yaml:"default"`
-	Sources map[string]map[string]string `yaml:"sources"`
+	Default string                `yaml:"default"`
+	Sources map[string]RepoSource `yaml:"sources"`
+}
+
+// RepoSource describes one place a component can be installed from. Which
+// fields apply depends on the component and on the source type.
+type RepoSource struct {
+	Type string `yaml:"type"` // empty for network sources, "bundle" for local bundles
+	Path string `yaml:"path"` // bundle directory or tarball
+
+	// Release downloads (etcd)
+	URL string `yaml:"url"`
+
+	// Package repositories (PostgreSQL, Patroni): either full per-family URLs...
+	Debian string `yaml:"debian"`
+	RHEL   string `yaml:"rhel"`
+	// ...or an internal mirror with per-family paths below a base URL
+	BaseURL     string `yaml:"base_url"`
+	DebianPath  string `yaml:"debian_path"`
+	RHELPath    string `yaml:"rhel_path"`    // may use yum variables such as $releasever and $basearch
+	DebianSuite string `yaml:"debian_suite"` // defaults to "$(lsb_release -cs)-pgdg"
+
+	// SigningKey is the URL or local path of the repository's GPG key.
+	SigningKey string `yaml:"signing_key"`
+
+	// Patroni: distro package names are installed with apt/dnf, from the
+	// debian/rhel repositories above when set. Families without a package
+	// name install pip_package into patroni.venv_path instead.
+	DebianPackage string `yaml:"debian_package"`
+	RHELPackage   string `yaml:"rhel_package"`
+	PipPackage    string `yaml:"pip_package"` // defaults to "patroni[etcd3,psycopg3]"
+	IndexURL      string `yaml:"index_url"`   // pip index, e.g. an internal PyPI mirror
+}
+
+// BundleSourceType marks a source that installs from a local artifact bundle
+// (a directory or .tar.gz built by "dbcp-agent bundle build") instead of the network.
+const BundleSourceType = "bundle"
+
+// Selected returns the default source of the repository.
+func (r RepoEntry) Selected() RepoSource {
+	return r.Sources[r.Default]
+}
+
+// BundlePath returns the bundle location when the default source is a bundle.
+func (r RepoEntry) BundlePath() (string, bool) {
+	src := r.Selected()
+	if src.Type != BundleSourceType {
+		return "", false
+	}
+	return src.Path, true
+}
+
+// IsMirror reports whether the source is an internal mirror described by
+// base_url and per-family paths.
+func (s RepoSource) IsMirror() bool {
+	return s.BaseURL != ""
+}
+
+// PackageRepoURL returns the package repository URL for an OS family.
+func (s RepoSource) PackageRepoURL(family string) string {
+	if s.IsMirror() {
+		base := strings.TrimSuffix(s.BaseURL, "/")
+		if family == "debian" {
+			return base + s.DebianPath
+		}
+		return base + s.RHELPath
+	}
+	if family == "debian" {
+		return s.Debian
+	}
+	return s.RHEL
 }
 
 // -----------------------
 
+// Load reads the config at path, merges in the files it extends or
+// includes, and resolves references and encrypted values.
 func Load(path string) (*AgentConfig, error) {
-	data, err := os.ReadFile(path)
+	tree, err := loadTree(path)
+	if err != nil {
+		return nil, err
+	}
+
+	secretPaths, err := resolveSecrets(tree.root)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read config file: %w", err)
+		return nil, fmt.Errorf("failed to resolve config references: %w", err)
 	}
 
 	var cfg AgentConfig
-	if err := yaml.Unmarshal(data, &cfg); err != nil {
+	if err := tree.root.Decode(&cfg); err != nil {
 		return nil, fmt.Errorf("failed to parse YAML: %w", err)
 	}
+	cfg.root = tree.root
+	cfg.origins = tree.origins
+	cfg.secretPaths = secretPaths
 
 	return &cfg, nil
 }
 
+// Validate checks the whole config and fills in defaults. It reports every
+// problem at once as ValidationErrors rather than stopping at the first.
 func (cfg *AgentConfig) Validate() error {
-	if err := cfg.validateNode(); err != nil {
-		return err
-	}
+	f := cfg.newFieldErrors()
+	f.collect(cfg.validateNode())
+	f.collect(cfg.validatePostgreSQL())
+	f.collect(cfg.validaPatroni())
+	f.collect(cfg.validateETCD())
+	f.collect(cfg.validateCluster())
+	f.collect(cfg.validateRepositories())
+	f.collect(cfg.validatePKI())
+	f.sort()
+	return f.err()
+}
 
-	if err := cfg.validatePostgreSQL(); err != nil {
-		return err
-	}
+func (cfg *AgentConfig) validateNode() error {
+	f := cfg.newFieldErrors()
 
-	if err := cfg.validaPatroni(); err != nil {
-		return err
+	if cfg.Node.Name == "" {
+		f.add("node.name", "is required")
 	}
 
-	if err := cfg.validateETCD(); err != nil {
-		return err
+	if cfg.Node.Host == "" {
+		f.add("node.host", "is required")
 	}
 
-	if err := cfg.validateCluster(); err != nil {
-		return err
+	if cfg.Node.Role == "" {
+		f.add("node.role", "is required")
 	}
 
-	if err := cfg.validateRepositories(); err != nil {
-		return err
+	if cfg.Node.User == "" {
+		f.add("node.os_user", "is required (OS-level user)")
 	}
 
-	return nil
-}
+	if cfg.Node.TmpPath == "" {
+		f.add("node.tmp_path", "is required")
+	}
 
-func (cfg *AgentConfig) validateNode() error {
-	if cfg.Node.Name == "" {
-		return fmt.Errorf("node.name is required")
+	if cfg.Node.StateDir == "" {
+		cfg.Node.StateDir = cfg.Node.TmpPath
 	}
 
-	if cfg.Node.Host == "" || cfg.Node.Role == "" {
-		return fmt.Errorf("node.host and node.role are required")
+	if cfg.Node.Arch != "" && system.NormalizeArch(cfg.Node.Arch) == "" {
+		f.add("node.arch", "%q is not a supported architecture", cfg.Node.Arch)
 	}
 
-	if cfg.Node.User == "" {
-		return fmt.Errorf("node.user is required (OS-level user)")
+	switch cfg.Node.Systemd.Mode {
+	case "":
+		cfg.Node.Systemd.Mode = ServiceModeAuto
+	case ServiceModeAuto, ServiceModeSystemd, ServiceModeDirect:
+	default:
+		f.add("node.systemd.mode", "must be auto, systemd or direct")
 	}
 
-	if cfg.Node.TmpPath == "" {
-		return fmt.Errorf("node.tmp_path is required")
+	if cfg.Node.Systemd.Root == "" {
+		cfg.Node.Systemd.Root = "/"
 	}
 
-	return nil
+	return f.err()
+}
+
+// roleOptions are the role attributes node.postgresql.users may set; they
+// end up verbatim in the post_bootstrap script's ALTER ROLE statements.
+var roleOptions = map[string]bool{
+	"superuser": true, "createdb": true, "createrole": true, "replication": true,
+	"bypassrls": true, "inherit": true, "noinherit": true, "login": true, "nologin": true,
 }
 
 func (cfg *AgentConfig) validatePostgreSQL() error {
+	f := cfg.newFieldErrors()
 	pg := cfg.Node.PostgreSQL
 
 	if pg.Version == "" {
-		return fmt.Errorf("postgresql.version is required")
+		f.add("node.postgresql.version", "is required")
 	}
 
 	if pg.DataDir == "" {
-		return fmt.Errorf("postgresql.data_dir is required")
+		f.add("node.postgresql.data_dir", "is required")
 	}
 
 	if pg.BinPath == "" {
 		logger.Warn("postgresql.bin_path is not specified, will use OS-detected default")
-		pg.BinPath = guessPostgresBinPath()
+		cfg.Node.PostgreSQL.BinPath = guessPostgresBinPath()
 	}
 
 	// Validate parameters
 	params := pg.Parameters
 	if params.Port == 0 {
-		return fmt.Errorf("postgresql.parameters.port must be a valid port number")
+		f.add("node.postgresql.parameters.port", "must be a valid port number")
 	}
 
 	if params.WALLevel == "" {
-		return fmt.Errorf("postgresql.parameters.wal_level is required")
+		f.add("node.postgresql.parameters.wal_level", "is required")
 	}
 
 	if params.HotStandby == "" {
-		return fmt.Errorf("postgresql.parameters.hot_standby is required")
+		f.add("node.postgresql.parameters.hot_standby", "is required")
 	}
 
 	if params.SynchronousCommit == "" {
-		return fmt.Errorf("postgresql.parameters.synchronous_commit is required")
+		f.add("node.postgresql.parameters.synchronous_commit", "is required")
 	}
 
 	if params.SynchronousStandbyNames == "" {
-		return fmt.Errorf("postgresql.parameters.synchronous_standby_names is required")
+		f.add("node.postgresql.parameters.synchronous_standby_names", "is required")
+	}
+
+	settings := params.Settings()
+	for _, name := range sortedKeys(settings) {
+		if err := validateGUC(name, settings[name]); err != nil {
+			f.add("node.postgresql.parameters."+name, "%v", err)
+		}
 	}
 
 	// Validate users
 	if len(pg.Users) == 0 {
-		return fmt.Errorf("at least one postgresql.users entry is required")
+		f.add("node.postgresql.users", "at least one user is required")
 	}
 
 	hasSuperuser := false
-	for username, user := range pg.Users {
+	for _, username := range sortedKeys(pg.Users) {
+		user := pg.Users[username]
 		if user.Password == "" {
-			return fmt.Errorf("postgresql.users[%s] is missing a password", username)
+			f.add("node.postgresql.users."+username+".password", "is required")
 		}
 
-		for _, opt := range user.Options {
+		for i, opt := range user.Options {
+			if !roleOptions[opt] {
+				f.add(fmt.Sprintf("node.postgresql.users.%s.options[%d]", username, i), "unknown role option %q", opt)
+			}
 			if opt == "superuser" {
 				hasSuperuser = true
 			}
 		}
 	}
 
-	if !hasSuperuser {
-		return fmt.Errorf("at least one user must have the 'superuser' option")
+	if len(pg.Users) > 0 && !hasSuperuser {
+		f.add("node.postgresql.users", "at least one user must have the 'superuser' option")
 	}
 
 	// Validate initdb
 	for i, entry := range pg.InitDB {
 		if len(entry) == 0 {
-			return fmt.Errorf("patroni.initdb[%d] must not be empty", i)
+			f.add(fmt.Sprintf("node.postgresql.initdb[%d]", i), "must not be empty")
 		}
 	}
 
 	// Validate pg_hba
-	if len(pg.PGHBA) == 0 {
-		return fmt.Errorf("patroni.pg_hba must contain at least one entry")
+	cfg.validateHBA(f)
+
+	switch pg.Tuning.Profile {
+	case "", ProfileOLTP, ProfileOLAP, ProfileMixed:
+	default:
+		f.add("node.postgresql.tuning.profile", "must be 'oltp', 'olap' or 'mixed', got %q", pg.Tuning.Profile)
+	}
+	switch pg.Tuning.Storage {
+	case "", "ssd", "hdd":
+	default:
+		f.add("node.postgresql.tuning.storage", "must be 'ssd' or 'hdd', got %q", pg.Tuning.Storage)
 	}
 
-	return nil
+	return f.err()
 }
 
 func (cfg *AgentConfig) validaPatroni() error {
-	// PatroniConfig
+	f := cfg.newFieldErrors()
 	p := cfg.Node.Patroni
 
 	if p.APIListen == "" {
-		return fmt.Errorf("patroni.api_listen is required")
+		f.add("node.patroni.api_listen", "is required")
 	}
 
 	if p.Port == 0 {
-		return fmt.Errorf("patroni.port must be a valid port number")
+		f.add("node.patroni.port", "must be a valid port number")
 	}
 
 	if p.ConfigPath == "" {
-		return fmt.Errorf("patroni.config_path is required")
+		f.add("node.patroni.config_path", "is required")
+	}
+
+	if p.VenvPath == "" {
+		cfg.Node.Patroni.VenvPath = DefaultPatroniVenv
+	}
+
+	switch p.Generator {
+	case "":
+		cfg.Node.Patroni.Generator = PatroniGeneratorTemplate
+	case PatroniGeneratorTemplate:
+	case PatroniGeneratorStructured:
+		if p.TemplatePath != "" {
+			f.add("node.patroni.template_path", "is only used by the template generator")
+		}
+	default:
+		f.add("node.patroni.generator", "must be 'template' or 'structured', got %q", p.Generator)
+	}
+
+	switch p.Watchdog.Mode {
+	case "", "off", "automatic", "required":
+	default:
+		f.add("node.patroni.watchdog.mode", "must be 'off', 'automatic' or 'required', got %q", p.Watchdog.Mode)
 	}
 
-	if p.TemplatePath == "" {
-		return fmt.Errorf("patroni.template_path is required")
+	api := p.RestAPI
+	if (api.Username == "") != (api.Password == "") {
+		f.add("node.patroni.restapi", "username and password must be set together")
+	}
+	if api.KeyFile != "" && api.CertFile == "" {
+		f.add("node.patroni.restapi.cert_file", "is required with key_file")
+	}
+	switch api.VerifyClient {
+	case "", "none":
+	case "optional", "required":
+		if !api.TLSEnabled() {
+			f.add("node.patroni.restapi.verify_client", "needs cert_file")
+		}
+		if api.CAFile == "" {
+			f.add("node.patroni.restapi.ca_file", "is required with verify_client %q", api.VerifyClient)
+		}
+	default:
+		f.add("node.patroni.restapi.verify_client", "must be 'none', 'optional' or 'required', got %q", api.VerifyClient)
 	}
 
 	// Validate DCS settings
 	if p.DCS.TTL <= 0 {
-		return fmt.Errorf("patroni.dcs.ttl must be greater than 0")
+		f.add("node.patroni.dcs.ttl", "must be greater than 0")
 	}
 
 	if p.DCS.LoopWait <= 0 {
-		return fmt.Errorf("patroni.dcs.loop_wait must be greater than 0")
+		f.add("node.patroni.dcs.loop_wait", "must be greater than 0")
 	}
 
 	if p.DCS.RetryTimeout <= 0 {
-		return fmt.Errorf("patroni.dcs.retry_timeout must be greater than 0")
+		f.add("node.patroni.dcs.retry_timeout", "must be greater than 0")
 	}
 
 	if p.DCS.MaximumLagOnFailover < 0 {
-		return fmt.Errorf("patroni.dcs.maximum_lag_on_failover must be non-negative")
+		f.add("node.patroni.dcs.maximum_lag_on_failover", "must be non-negative")
 	}
 
 	// Validate authentication
-	if p.Authentication.Superuser.Username == "" || p.Authentication.Superuser.Password == "" {
-		return fmt.Errorf("patroni.authentication.superuser.username and password are required")
-	}
-
-	if p.Authentication.Replication.Username == "" || p.Authentication.Replication.Password == "" {
-		return fmt.Errorf("patroni.authentication.replication.username and password are required")
+	for _, role := range []string{"superuser", "replication"} {
+		creds := p.Authentication.Superuser
+		if role == "replication" {
+			creds = p.Authentication.Replication
+		}
+		if creds.Username == "" {
+			f.add("node.patroni.authentication."+role+".username", "is required")
+		}
+		if creds.Password == "" {
+			f.add("node.patroni.authentication."+role+".password", "is required")
+		}
 	}
 
-	return nil
+	return f.err()
 }
 
 func (cfg *AgentConfig) validateETCD() error {
+	f := cfg.newFieldErrors()
 	etcd := cfg.Node.ETCD
-	if etcd.Version == "" || etcd.DataDir == "" || etcd.PeerPort == 0 || etcd.ClientPort == 0 {
-		return fmt.Errorf("etcd.version, data_dir, peer_port, and client_port are required")
+
+	if etcd.Version == "" {
+		f.add("node.etcd.version", "is required")
+	}
+
+	if etcd.DataDir == "" {
+		f.add("node.etcd.data_dir", "is required")
+	}
+
+	if etcd.PeerPort == 0 {
+		f.add("node.etcd.peer_port", "must be a valid port number")
+	}
+
+	if etcd.ClientPort == 0 {
+		f.add("node.etcd.client_port", "must be a valid port number")
+	}
+
+	// Partial TLS settings would silently leave etcd, and Patroni with it, on http
+	if (etcd.CertFile != "" || etcd.KeyFile != "" || etcd.CAFile != "") && !etcd.TLSEnabled() {
+		f.add("node.etcd", "cert_file, key_file and ca_file must be set together")
+	}
+
+	if etcd.Checksum != "" && !isSHA256Hex(strings.TrimPrefix(etcd.Checksum, "sha256:")) {
+		f.add("node.etcd.checksum", "must be a 64-character hex sha256 digest")
 	}
 
 	if etcd.BinPath == "" {
@@ -337,38 +651,303 @@ func (cfg *AgentConfig) validateETCD() error {
 		cfg.Node.ETCD.ClusterMode = "bootstrap"
 		logger.Warn("etcd.cluster_mode not set, defaulting to 'bootstrap'")
 	} else if etcd.ClusterMode != "bootstrap" && etcd.ClusterMode != "join" {
-		return fmt.Errorf("invalid etcd.cluster_mode: must be 'bootstrap' or 'join'")
+		f.add("node.etcd.cluster_mode", "must be 'bootstrap' or 'join'")
 	}
 
-	return nil
+	return f.err()
 }
 
 func (cfg *AgentConfig) validateCluster() error {
-	if cfg.Cluster.Name == "" || len(cfg.Cluster.Nodes) == 0 {
-		return fmt.Errorf("cluster.name and at least one node are required")
+	f := cfg.newFieldErrors()
+
+	if cfg.Cluster.Name == "" {
+		f.add("cluster.name", "is required")
+	}
+
+	if len(cfg.Cluster.Nodes) == 0 {
+		f.add("cluster.nodes", "at least one node is required")
+	}
+
+	names := map[string]int{}
+	hosts := map[string]int{}
+	for i, node := range cfg.Cluster.Nodes {
+		if node.Name == "" {
+			f.add(fmt.Sprintf("cluster.nodes[%d].name", i), "is required")
+		} else if first, dup := names[node.Name]; dup {
+			f.add(fmt.Sprintf("cluster.nodes[%d].name", i), "%q is already used by cluster.nodes[%d]", node.Name, first)
+		} else {
+			names[node.Name] = i
+		}
+
+		if node.Host == "" {
+			f.add(fmt.Sprintf("cluster.nodes[%d].host", i), "is required")
+		} else if first, dup := hosts[node.Host]; dup {
+			f.add(fmt.Sprintf("cluster.nodes[%d].host", i), "%q is already used by cluster.nodes[%d]", node.Host, first)
+		} else {
+			hosts[node.Host] = i
+		}
 	}
 
-	for _, node := range cfg.Cluster.Nodes {
-		if node.Name == "" || node.Host == "" {
-			return fmt.Errorf("each cluster node must have name and host")
+	// This node must be one of the cluster's members, under the same host
+	if cfg.Node.Name != "" && len(cfg.Cluster.Nodes) > 0 {
+		if i, ok := names[cfg.Node.Name]; !ok {
+			f.add("node.name", "%q is not listed in cluster.nodes", cfg.Node.Name)
+		} else if host := cfg.Cluster.Nodes[i].Host; cfg.Node.Host != "" && host != "" && host != cfg.Node.Host {
+			f.add("node.host", "%q does not match cluster.nodes[%d].host %q", cfg.Node.Host, i, host)
 		}
 	}
 
-	return nil
+	// Everything listens on the same host, so the ports must differ
+	ports := []struct {
+		path string
+		port int
+	}{
+		{"node.postgresql.parameters.port", cfg.Node.PostgreSQL.Parameters.Port},
+		{"node.patroni.port", cfg.Node.Patroni.Port},
+		{"node.etcd.peer_port", cfg.Node.ETCD.PeerPort},
+		{"node.etcd.client_port", cfg.Node.ETCD.ClientPort},
+	}
+	for i, p := range ports {
+		if p.port < 0 || p.port > 65535 {
+			f.add(p.path, "%d is not a valid port number", p.port)
+			continue
+		}
+		for _, earlier := range ports[:i] {
+			if p.port != 0 && p.port == earlier.port {
+				f.add(p.path, "port %d is already used by %s", p.port, earlier.path)
+				break
+			}
+		}
+	}
+
+	// Patroni sets each member's application_name to its node name
+	if standbys := cfg.Node.PostgreSQL.Parameters.SynchronousStandbyNames; standbys != "" && len(names) > 0 {
+		members, err := parseStandbyNames(standbys)
+		if err != nil {
+			f.add("node.postgresql.parameters.synchronous_standby_names", "%v", err)
+		}
+		for _, member := range members {
+			if member == "*" {
+				continue
+			}
+			if _, ok := names[member]; !ok {
+				f.add("node.postgresql.parameters.synchronous_standby_names", "%q is not a cluster node name", member)
+			}
+		}
+	}
+
+	// Patroni connects replicas as this user but does not create it
+	if username := cfg.Node.Patroni.Authentication.Replication.Username; username != "" {
+		if user, ok := cfg.Node.PostgreSQL.Users[username]; !ok {
+			f.add("node.patroni.authentication.replication.username", "%q is not defined in node.postgresql.users", username)
+		} else if !hasOption(user.Options, "replication") {
+			f.add("node.postgresql.users."+username+".options", "replication user %q needs the 'replication' option", username)
+		}
+	}
+
+	return f.err()
+}
+
+// parseStandbyNames returns the member names in a synchronous_standby_names
+// value: "FIRST 1 (a, b)", "ANY 2 (a, b, c)", "1 (a, b)" or "a, b".
+func parseStandbyNames(value string) ([]string, error) {
+	list := strings.TrimSpace(value)
+	if open := strings.IndexByte(list, '('); open >= 0 {
+		if !strings.HasSuffix(list, ")") {
+			return nil, fmt.Errorf("missing closing parenthesis")
+		}
+		prefix := strings.Fields(list[:open])
+		if len(prefix) == 2 && (strings.EqualFold(prefix[0], "FIRST") || strings.EqualFold(prefix[0], "ANY")) {
+			prefix = prefix[1:]
+		}
+		if len(prefix) != 1 {
+			return nil, fmt.Errorf("expected [FIRST|ANY] num_sync (names...)")
+		}
+		if n, err := strconv.Atoi(prefix[0]); err != nil || n < 1 {
+			return nil, fmt.Errorf("%q is not a valid number of synchronous standbys", prefix[0])
+		}
+		list = list[open+1 : len(list)-1]
+	}
+
+	var members []string
+	for _, member := range strings.Split(list, ",") {
+		member = strings.Trim(strings.TrimSpace(member), `"`)
+		if member == "" {
+			return nil, fmt.Errorf("empty standby name")
+		}
+		members = append(members, member)
+	}
+	return members, nil
+}
+
+func hasOption(options []string, option string) bool {
+	for _, opt := range options {
+		if strings.EqualFold(opt, option) {
+			return true
+		}
+	}
+	return false
 }
 
 func (cfg *AgentConfig) validateRepositories() error {
-	if repo := cfg.Repositories.PostgreSQL.Sources[cfg.Repositories.PostgreSQL.Default]; repo == nil {
-		return fmt.Errorf("postgresql repositories not found for default: %s", cfg.Repositories.PostgreSQL.Default)
+	f := cfg.newFieldErrors()
+
+	if _, ok := cfg.Repositories.PostgreSQL.Sources[cfg.Repositories.PostgreSQL.Default]; !ok {
+		f.add("repositories.postgresql.default", "no source named %q", cfg.Repositories.PostgreSQL.Default)
+	}
+
+	if _, ok := cfg.Repositories.ETCD.Sources[cfg.Repositories.ETCD.Default]; !ok {
+		f.add("repositories.etcd.default", "no source named %q", cfg.Repositories.ETCD.Default)
+	}
+
+	if patroni := cfg.Repositories.Patroni; patroni.Default != "" {
+		if _, ok := patroni.Sources[patroni.Default]; !ok {
+			f.add("repositories.patroni.default", "no source named %q", patroni.Default)
+		}
+	}
+
+	repos := map[string]RepoEntry{
+		"postgresql": cfg.Repositories.PostgreSQL,
+		"etcd":       cfg.Repositories.ETCD,
+		"patroni":    cfg.Repositories.Patroni,
+	}
+	for _, name := range sortedKeys(repos) {
+		sources := repos[name].Sources
+		for _, srcName := range sortedKeys(sources) {
+			src := sources[srcName]
+			path := "repositories." + name + ".sources." + srcName
+
+			if src.Type != "" && src.Type != BundleSourceType {
+				f.add(path+".type", "unknown type %q", src.Type)
+				continue
+			}
+			if src.Type == BundleSourceType && src.Path == "" {
+				f.add(path+".path", "bundle sources require a path")
+				continue
+			}
+
+			var err error
+			switch name {
+			case "postgresql":
+				err = validatePostgresSource(src)
+			case "etcd":
+				if src.Type == "" && src.URL == "" {
+					err = fmt.Errorf("url is required")
+				}
+			case "patroni":
+				err = validatePatroniSource(src)
+			}
+			if err != nil {
+				f.add(path, "%v", err)
+			}
+		}
+	}
+
+	return f.err()
+}
+
+func (cfg *AgentConfig) validatePKI() error {
+	f := cfg.newFieldErrors()
+	pki := &cfg.PKI
+
+	if pki.Dir == "" {
+		pki.Dir = "/etc/dbcp/pki"
+	}
+	if pki.CADir == "" {
+		pki.CADir = "/etc/dbcp/ca"
+	}
+	if pki.ValidDays == 0 {
+		pki.ValidDays = 365
+	}
+	if pki.CAValidDays == 0 {
+		pki.CAValidDays = 3650
+	}
+	if pki.RenewBeforeDays == 0 {
+		pki.RenewBeforeDays = 30
+	}
+	if pki.CheckIntervalHours == 0 {
+		pki.CheckIntervalHours = 12
+	}
+	if pki.CANode == "" && len(cfg.Cluster.Nodes) > 0 {
+		pki.CANode = cfg.Cluster.Nodes[0].Name
+	}
+
+	if pki.ValidDays < 0 {
+		f.add("pki.valid_days", "must be positive")
+	}
+	if pki.CAValidDays < 0 {
+		f.add("pki.ca_valid_days", "must be positive")
+	}
+	if pki.RenewBeforeDays < 0 {
+		f.add("pki.renew_before_days", "must be positive")
+	} else if pki.RenewBeforeDays >= pki.ValidDays {
+		// Every freshly issued certificate would be due for renewal again
+		f.add("pki.renew_before_days", "must be less than pki.valid_days (%d)", pki.ValidDays)
+	}
+	if pki.CheckIntervalHours < 0 {
+		f.add("pki.check_interval_hours", "must be positive")
+	}
+	if pki.CANode != "" && len(cfg.Cluster.Nodes) > 0 {
+		listed := false
+		for _, node := range cfg.Cluster.Nodes {
+			listed = listed || node.Name == pki.CANode
+		}
+		if !listed {
+			f.add("pki.ca_node", "%q is not listed in cluster.nodes", pki.CANode)
+		}
+	}
+	if pki.Dir == pki.CADir {
+		f.add("pki.ca_dir", "must differ from pki.dir, so the CA key is not handed to the node's OS user")
 	}
 
-	if repo := cfg.Repositories.ETCD.Sources[cfg.Repositories.ETCD.Default]; repo == nil {
-		return fmt.Errorf("etcd repositories not found for default: %s", cfg.Repositories.ETCD.Default)
+	return f.err()
+}
+
+func validatePostgresSource(src RepoSource) error {
+	switch {
+	case src.Type == BundleSourceType:
+		return nil
+	case src.IsMirror():
+		if src.DebianPath == "" || src.RHELPath == "" {
+			return fmt.Errorf("mirror sources require debian_path and rhel_path")
+		}
+		if src.SigningKey == "" {
+			return fmt.Errorf("mirror sources require a signing_key")
+		}
+	case src.Debian == "" && src.RHEL == "":
+		return fmt.Errorf("either debian/rhel URLs or base_url with paths are required")
 	}
+	return nil
+}
 
+func validatePatroniSource(src RepoSource) error {
+	if src.Type == BundleSourceType {
+		return nil
+	}
+	if src.Debian != "" && src.DebianPackage == "" {
+		return fmt.Errorf("a debian repository requires debian_package")
+	}
+	if src.RHEL != "" && src.RHELPackage == "" {
+		return fmt.Errorf("a rhel repository requires rhel_package")
+	}
+	if (src.Debian != "" || src.RHEL != "") && src.SigningKey == "" {
+		return fmt.Errorf("package repositories require a signing_key")
+	}
 	return nil
 }
 
+func isSHA256Hex(s string) bool {
+	if len(s) != 64 {
+		return false
+	}
+	for _, c := range s {
+		if !strings.ContainsRune("0123456789abcdefABCDEF", c) {
+			return false
+		}
+	}
+	return true
+}
+
 func guessPostgresBinPath() string {
 	osRelease, _ := os.ReadFile("/etc/os-release")
 	content := string(osRelease)
@@ -1,9 +1,12 @@
 package config
 
 import (
+	"errors"
+	"os"
 	"strings"
 	"testing"
 
+	"github.com/virtlabs-io/dbcp-agent/internal/secrets"
 	"gopkg.in/yaml.v3"
 )
 
@@ -41,6 +44,10 @@ node:
         password: "qaz123"
         options:
           - login
+      replicator:
+        password: "qaz123"
+        options:
+          - replication
 
     parameters:
       port: 5432
@@ -130,8 +137,9 @@ repositories:
         rhel: "https://download.postgresql.org/pub/repos/yum"
       custom:
         base_url: "https://internal-repo.example.com/postgresql"
-        debian_path: "/debian/$(lsb_release -cs)-pgdg"
-        rhel_path: "/rhel/$(releasever)/$(basearch)"
+        debian_path: "/debian"
+        rhel_path: "/rhel/$releasever/$basearch"
+        signing_key: "https://internal-repo.example.com/keys/postgresql.asc"
 
   etcd:
     default: "official" # or "custom"
@@ -144,12 +152,20 @@ repositories:
   patroni:
     default: "official" # or "custom"
     sources:
-      official:
+      official:  # PyPI, installed into patroni.venv_path
+        pip_package: "patroni[etcd3,psycopg3]"
+      pypi-mirror:
+        index_url: "https://internal-repo.example.com/pypi/simple"
+        pip_package: "patroni[etcd3,psycopg3]"
+      distro:  # OS packages from the already configured repositories
         debian_package: "patroni"
-        rhel_pip: "patroni[etcd]"
-      custom:
-        debian_url: "https://internal-repo.example.com/patroni/deb"
-        rhel_rpm: "https://internal-repo.example.com/patroni/rpm"
+        rhel_package: "patroni"
+      custom:  # internal deb/rpm repositories
+        debian: "https://internal-repo.example.com/patroni/deb"
+        debian_package: "patroni"
+        rhel: "https://internal-repo.example.com/patroni/rpm/el$releasever/$basearch"
+        rhel_package: "patroni"
+        signing_key: "https://internal-repo.example.com/keys/patroni.asc"
 
 `
 
@@ -166,8 +182,8 @@ func TestRepositorySelection(t *testing.T) {
 	repoType := cfg.Repositories.PostgreSQL.Default
 	sources := cfg.Repositories.PostgreSQL.Sources[repoType]
 
-	debianRepo := sources["debian"]
-	rhelRepo := sources["rhel"]
+	debianRepo := sources.PackageRepoURL("debian")
+	rhelRepo := sources.PackageRepoURL("rhel")
 
 	if debianRepo != "https://apt.postgresql.org/pub/repos/apt" {
 		t.Errorf("unexpected Debian repo: %s", debianRepo)
@@ -189,3 +205,815 @@ func TestValidConfigValidation(t *testing.T) {
 		t.Errorf("expected valid config, got validation error: %v", err)
 	}
 }
+
+func TestCustomRepositoryURLs(t *testing.T) {
+	var cfg AgentConfig
+	if err := yaml.NewDecoder(strings.NewReader(testYAML)).Decode(&cfg); err != nil {
+		t.Fatalf("failed to parse test YAML: %v", err)
+	}
+
+	custom := cfg.Repositories.PostgreSQL.Sources["custom"]
+	if !custom.IsMirror() {
+		t.Fatal("expected the custom source to be a mirror")
+	}
+	if got := custom.PackageRepoURL("debian"); got != "https://internal-repo.example.com/postgresql/debian" {
+		t.Errorf("unexpected Debian mirror URL: %s", got)
+	}
+	if got := custom.PackageRepoURL("rhel"); got != "https://internal-repo.example.com/postgresql/rhel/$releasever/$basearch" {
+		t.Errorf("unexpected RHEL mirror URL: %s", got)
+	}
+}
+
+func TestIncompleteCustomRepositoryRejected(t *testing.T) {
+	cases := map[string]RepoSource{
+		"missing paths":       {BaseURL: "https://mirror.example.com", SigningKey: "/etc/key.asc"},
+		"missing signing key": {BaseURL: "https://mirror.example.com", DebianPath: "/debian", RHELPath: "/rhel"},
+		"empty":               {},
+	}
+
+	for name, src := range cases {
+		var cfg AgentConfig
+		if err := yaml.NewDecoder(strings.NewReader(testYAML)).Decode(&cfg); err != nil {
+			t.Fatalf("failed to parse test YAML: %v", err)
+		}
+		cfg.Repositories.PostgreSQL.Sources["custom"] = src
+
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("%s: expected incomplete custom source to be rejected", name)
+		}
+	}
+}
+
+func TestPatroniRepositoryValidation(t *testing.T) {
+	cases := map[string]RepoSource{
+		"repository without package": {Debian: "https://repo.example.com/deb", SigningKey: "/etc/key.asc"},
+		"repository without key":     {RHEL: "https://repo.example.com/rpm", RHELPackage: "patroni"},
+	}
+
+	for name, src := range cases {
+		var cfg AgentConfig
+		if err := yaml.NewDecoder(strings.NewReader(testYAML)).Decode(&cfg); err != nil {
+			t.Fatalf("failed to parse test YAML: %v", err)
+		}
+		if err := cfg.validateRepositories(); err != nil {
+			t.Fatalf("sample repositories should be valid: %v", err)
+		}
+
+		cfg.Repositories.Patroni.Sources["custom"] = src
+		if err := cfg.validateRepositories(); err == nil {
+			t.Errorf("%s: expected the source to be rejected", name)
+		}
+	}
+}
+
+func TestSystemdDefaults(t *testing.T) {
+	var cfg AgentConfig
+	if err := yaml.NewDecoder(strings.NewReader(testYAML)).Decode(&cfg); err != nil {
+		t.Fatalf("failed to parse test YAML: %v", err)
+	}
+
+	if err := cfg.validateNode(); err != nil {
+		t.Fatalf("validateNode failed: %v", err)
+	}
+	if cfg.Node.Systemd.Mode != ServiceModeAuto || cfg.Node.Systemd.Root != "/" {
+		t.Errorf("unexpected systemd defaults: %+v", cfg.Node.Systemd)
+	}
+
+	cfg.Node.Systemd.Mode = "upstart"
+	if err := cfg.validateNode(); err == nil {
+		t.Error("expected an unknown systemd mode to be rejected")
+	}
+}
+
+func TestLoadResolvesReferences(t *testing.T) {
+	dir := t.TempDir()
+	secretFile := dir + "/replication"
+	if err := os.WriteFile(secretFile, []byte("from-file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("DBCP_TEST_SUPERUSER_PASSWORD", "from-env")
+
+	yamlText := strings.NewReplacer(
+		"username: postgres\n        password: \"qaz123\"", "username: postgres\n        password: \"${DBCP_TEST_SUPERUSER_PASSWORD}\"",
+		"username: replicator\n        password: \"qaz123\"", "username: replicator\n        password: \"${file:"+secretFile+"}\"",
+		"monitor:  # Monitoring user\n        password: \"qaz123\"", "monitor:\n        password: \"${exec:printf 'from-%s' exec}\"",
+		`namespace: "dbcp"`, `namespace: "$${literal}"`,
+	).Replace(testYAML)
+	path := dir + "/config.yaml"
+	if err := os.WriteFile(path, []byte(yamlText), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+
+	if got := cfg.Node.Patroni.Authentication.Superuser.Password; got != "from-env" {
+		t.Errorf("env reference resolved to %q", got)
+	}
+	if got := cfg.Node.Patroni.Authentication.Replication.Password; got != "from-file" {
+		t.Errorf("file reference resolved to %q", got)
+	}
+	if got := cfg.Node.PostgreSQL.Users["monitor"].Password; got != "from-exec" {
+		t.Errorf("exec reference resolved to %q", got)
+	}
+	if cfg.Node.Patroni.Namespace != "${literal}" {
+		t.Errorf("escaped reference resolved to %q", cfg.Node.Patroni.Namespace)
+	}
+	if got := cfg.Repositories.PostgreSQL.Sources["custom"].RHELPath; got != "/rhel/$releasever/$basearch" {
+		t.Errorf("yum variables must be left alone, got %q", got)
+	}
+}
+
+func TestLoadReferenceErrorsDoNotLeakSecrets(t *testing.T) {
+	t.Setenv("DBCP_TEST_SUPERUSER_PASSWORD", "do-not-print-me")
+	yamlText := strings.NewReplacer(
+		"username: postgres\n        password: \"qaz123\"", "username: postgres\n        password: \"${DBCP_TEST_SUPERUSER_PASSWORD}\"",
+		"username: replicator\n        password: \"qaz123\"", "username: replicator\n        password: \"${DBCP_TEST_UNSET_VARIABLE}\"",
+	).Replace(testYAML)
+	path := t.TempDir() + "/config.yaml"
+	if err := os.WriteFile(path, []byte(yamlText), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := Load(path)
+	if err == nil {
+		t.Fatal("expected an unset variable to fail the load")
+	}
+	if !strings.Contains(err.Error(), "DBCP_TEST_UNSET_VARIABLE") || !strings.Contains(err.Error(), "password") {
+		t.Errorf("expected the error to name the variable and field, got: %v", err)
+	}
+	if strings.Contains(err.Error(), "do-not-print-me") {
+		t.Errorf("error leaks a resolved secret: %v", err)
+	}
+}
+
+func TestLoadDecryptsValues(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := dir + "/secrets.key"
+	key, err := secrets.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := secrets.WriteKey(keyFile, key); err != nil {
+		t.Fatal(err)
+	}
+	encrypted, err := secrets.Encrypt(key, "from-enc")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	yamlText := strings.NewReplacer(
+		"username: postgres\n        password: \"qaz123\"", "username: postgres\n        password: \""+encrypted+"\"",
+	).Replace(testYAML) + "\nsecrets:\n  key_file: \"" + keyFile + "\"\n"
+	path := dir + "/config.yaml"
+	if err := os.WriteFile(path, []byte(yamlText), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv(secrets.KeyFileEnv, "")
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if got := cfg.Node.Patroni.Authentication.Superuser.Password; got != "from-enc" {
+		t.Errorf("encrypted value decrypted to %q", got)
+	}
+
+	// The environment overrides the configured key file
+	t.Setenv(secrets.KeyFileEnv, dir+"/missing.key")
+	_, err = Load(path)
+	if err == nil || !strings.Contains(err.Error(), "password") || !strings.Contains(err.Error(), "missing.key") {
+		t.Errorf("expected a missing key to fail the load naming the field, got: %v", err)
+	}
+}
+
+func TestValidateReportsEveryProblemWithPosition(t *testing.T) {
+	yamlText := strings.NewReplacer(
+		"name: \"node1\"\n  host", "name: \"\"\n  host",
+		"port: 5432", "port: 0",
+		"ttl: 30", "ttl: 0",
+	).Replace(testYAML)
+	path := t.TempDir() + "/config.yaml"
+	if err := os.WriteFile(path, []byte(yamlText), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+
+	var problems ValidationErrors
+	if err := cfg.Validate(); !errors.As(err, &problems) {
+		t.Fatalf("expected ValidationErrors, got %v", err)
+	}
+
+	want := []string{"node.name", "node.postgresql.parameters.port", "node.patroni.dcs.ttl"}
+	var got []string
+	for _, p := range problems {
+		got = append(got, p.Path)
+		if p.Line == 0 {
+			t.Errorf("%s: missing position", p.Path)
+		}
+	}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("expected problems %v in file order, got %v", want, got)
+	}
+}
+
+func TestLocateMissingFieldUsesParent(t *testing.T) {
+	var root yaml.Node
+	if err := yaml.Unmarshal([]byte("cluster:\n  nodes:\n    - name: a\n    - host: b\n"), &root); err != nil {
+		t.Fatal(err)
+	}
+
+	if node := locate(&root, "cluster.nodes[1].name"); node == nil || node.Line != 4 {
+		t.Errorf("expected the second list element on line 4, got %+v", node)
+	}
+	if node := locate(&root, "cluster.nodes[0].name"); node == nil || node.Line != 3 || node.Value != "name" {
+		t.Errorf("expected the name key on line 3, got %+v", node)
+	}
+	if node := locate(&root, "node.name"); node != nil {
+		t.Errorf("expected nothing for a missing section, got %+v", node)
+	}
+}
+
+func TestClusterConsistency(t *testing.T) {
+	cases := map[string]struct {
+		edit func(cfg *AgentConfig)
+		path string
+	}{
+		"node not in cluster": {func(cfg *AgentConfig) { cfg.Node.Name = "node9" }, "node.name"},
+		"host mismatch":       {func(cfg *AgentConfig) { cfg.Node.Host = "10.0.0.1" }, "node.host"},
+		"duplicate name":      {func(cfg *AgentConfig) { cfg.Cluster.Nodes[2].Name = "node2" }, "cluster.nodes[2].name"},
+		"duplicate host":      {func(cfg *AgentConfig) { cfg.Cluster.Nodes[1].Host = "192.168.56.101" }, "cluster.nodes[1].host"},
+		"port collision":      {func(cfg *AgentConfig) { cfg.Node.ETCD.ClientPort = 8008 }, "node.etcd.client_port"},
+		"unknown standby": {func(cfg *AgentConfig) {
+			cfg.Node.PostgreSQL.Parameters.SynchronousStandbyNames = "ANY 1 (node2, nodeX)"
+		}, "node.postgresql.parameters.synchronous_standby_names"},
+		"replication user missing": {func(cfg *AgentConfig) {
+			delete(cfg.Node.PostgreSQL.Users, "replicator")
+		}, "node.patroni.authentication.replication.username"},
+		"replication option missing": {func(cfg *AgentConfig) {
+			cfg.Node.PostgreSQL.Users["replicator"] = PostgresUser{Password: "x", Options: []string{"login"}}
+		}, "node.postgresql.users.replicator.options"},
+	}
+
+	for name, tc := range cases {
+		var cfg AgentConfig
+		if err := yaml.NewDecoder(strings.NewReader(testYAML)).Decode(&cfg); err != nil {
+			t.Fatalf("failed to parse test YAML: %v", err)
+		}
+		if err := cfg.validateCluster(); err != nil {
+			t.Fatalf("sample cluster should be consistent: %v", err)
+		}
+
+		tc.edit(&cfg)
+		var problems ValidationErrors
+		if err := cfg.validateCluster(); !errors.As(err, &problems) || problems[0].Path != tc.path {
+			t.Errorf("%s: expected a problem at %s, got %v", name, tc.path, err)
+		}
+	}
+}
+
+func TestValidateRoleOptions(t *testing.T) {
+	var cfg AgentConfig
+	if err := yaml.NewDecoder(strings.NewReader(testYAML)).Decode(&cfg); err != nil {
+		t.Fatalf("failed to parse test YAML: %v", err)
+	}
+	cfg.Node.PostgreSQL.Users["app"] = PostgresUser{Password: "x", Options: []string{"login", "superuser; DROP ROLE postgres"}}
+
+	var problems ValidationErrors
+	if err := cfg.validatePostgreSQL(); !errors.As(err, &problems) || problems[0].Path != "node.postgresql.users.app.options[1]" {
+		t.Errorf("expected the unknown option to be rejected, got %v", err)
+	}
+}
+
+func TestParseStandbyNames(t *testing.T) {
+	cases := map[string]string{
+		"1 (node2,node3)":       "node2,node3",
+		"FIRST 2 (a, \"b\", c)": "a,b,c",
+		"any 1 (a)":             "a",
+		"a, b":                  "a,b",
+		"*":                     "*",
+	}
+	for value, want := range cases {
+		got, err := parseStandbyNames(value)
+		if err != nil || strings.Join(got, ",") != want {
+			t.Errorf("%q: got %v, %v", value, got, err)
+		}
+	}
+
+	for _, value := range []string{"1 (a, b", "LAST 1 (a)", "0 (a)", "a,,b"} {
+		if _, err := parseStandbyNames(value); err == nil {
+			t.Errorf("%q: expected an error", value)
+		}
+	}
+}
+
+func TestLoadExtendsSharedFile(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, text string) string {
+		path := dir + "/" + name
+		if err := os.WriteFile(path, []byte(text), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	write("cluster.yaml", testYAML)
+	write("logging.yaml", "log_level: \"warn\"\n")
+	path := write("node2.yaml", `extends: cluster.yaml
+include:
+  - logging.yaml
+node:
+  name: "node2"
+  host: "192.168.56.102"
+  patroni:
+    dcs:
+      ttl: 0
+`)
+
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if cfg.Node.Name != "node2" || cfg.Node.Host != "192.168.56.102" {
+		t.Errorf("overlay not applied: %s %s", cfg.Node.Name, cfg.Node.Host)
+	}
+	if cfg.LogLevel != "warn" {
+		t.Errorf("expected the include to override the base, got log_level %q", cfg.LogLevel)
+	}
+	if cfg.Node.Patroni.Port != 8008 || cfg.Node.Patroni.DCS.LoopWait != 10 {
+		t.Errorf("expected siblings of overridden keys to be kept: %+v", cfg.Node.Patroni)
+	}
+
+	var problems ValidationErrors
+	if err := cfg.Validate(); !errors.As(err, &problems) || len(problems) != 1 {
+		t.Fatalf("expected one problem, got %v", err)
+	}
+	if p := problems[0]; p.Path != "node.patroni.dcs.ttl" || p.File != "" || p.Line != 9 {
+		t.Errorf("expected the overlay's position, got %v", p)
+	}
+
+	// Problems in the shared file name it
+	write("node2.yaml", "extends: cluster.yaml\nnode:\n  name: \"node2\"\n")
+	cfg, err = Load(path)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if err := cfg.Validate(); !errors.As(err, &problems) || problems[0].File != dir+"/cluster.yaml" {
+		t.Errorf("expected the problem to point at cluster.yaml, got %v", err)
+	}
+}
+
+func TestLoadRejectsIncludeCycle(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(dir+"/a.yaml", []byte("extends: b.yaml\n"), 0600)
+	os.WriteFile(dir+"/b.yaml", []byte("extends: a.yaml\n"), 0600)
+
+	if _, err := Load(dir + "/a.yaml"); err == nil || !strings.Contains(err.Error(), "includes itself") {
+		t.Errorf("expected a cycle error, got %v", err)
+	}
+}
+
+func TestRenderKeepsReferences(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(dir+"/cluster.yaml", []byte("node:\n  role: database\n  patroni:\n    port: 8008\n"), 0600)
+	os.WriteFile(dir+"/node.yaml", []byte("extends: cluster.yaml\nnode:\n  name: n1\n  password: \"${SECRET}\"\n"), 0600)
+
+	out, err := Render(dir + "/node.yaml")
+	if err != nil {
+		t.Fatalf("Render failed: %v", err)
+	}
+	want := "node:\n  role: database\n  patroni:\n    port: 8008\n  name: n1\n  password: \"${SECRET}\"\n"
+	if string(out) != want {
+		t.Errorf("unexpected render:\n%s", out)
+	}
+}
+
+func TestPlanReload(t *testing.T) {
+	load := func(edit func(cfg *AgentConfig)) *AgentConfig {
+		var cfg AgentConfig
+		if err := yaml.NewDecoder(strings.NewReader(testYAML)).Decode(&cfg); err != nil {
+			t.Fatalf("failed to parse test YAML: %v", err)
+		}
+		edit(&cfg)
+		return &cfg
+	}
+
+	running := load(func(cfg *AgentConfig) {})
+	next := load(func(cfg *AgentConfig) {
+		cfg.LogLevel = "info"
+		cfg.Node.Patroni.DCS.TTL = 20
+		cfg.Node.Patroni.Tags.NoFailover = true
+		cfg.Node.PostgreSQL.Parameters.MaxConnections = 300
+		cfg.Node.PostgreSQL.DataDir = "/elsewhere"
+		cfg.Node.Patroni.Authentication.Replication.Password = "rotated"
+	})
+
+	effective, changes, err := PlanReload(running, next)
+	if err != nil {
+		t.Fatalf("PlanReload failed: %v", err)
+	}
+
+	want := map[string]ChangeClass{
+		"log_level": ChangeLive,
+		"node.patroni.authentication.replication.password": ChangePatroniReload,
+		"node.patroni.dcs.ttl":                             ChangeLive,
+		"node.patroni.tags.nofailover":                     ChangePatroniReload,
+		"node.postgresql.data_dir":                         ChangeForbidden,
+		"node.postgresql.parameters.max_connections":       ChangePostgresRestart,
+	}
+	if len(changes) != len(want) {
+		t.Errorf("expected %d changes, got %v", len(want), changes)
+	}
+	for _, c := range changes {
+		if class, ok := want[c.Path]; !ok || class != c.Class {
+			t.Errorf("%s: unexpected class %s", c.Path, c.Class)
+		}
+		if c.Path == "node.patroni.dcs.ttl" && (c.DCSKey != "ttl" || c.New != 20) {
+			t.Errorf("unexpected DCS change %+v", c)
+		}
+		if strings.Contains(c.String(), "rotated") || strings.Contains(c.String(), "qaz123") {
+			t.Errorf("change description leaks a password: %s", c)
+		}
+	}
+
+	if effective.Node.PostgreSQL.DataDir != running.Node.PostgreSQL.DataDir {
+		t.Errorf("expected the forbidden data_dir change to be reverted, got %s", effective.Node.PostgreSQL.DataDir)
+	}
+	if effective.Node.Patroni.DCS.TTL != 20 || effective.LogLevel != "info" || !effective.Node.Patroni.Tags.NoFailover {
+		t.Errorf("expected allowed changes to be kept: %+v", effective.Node.Patroni)
+	}
+}
+
+func TestPlanReloadMasksSecrets(t *testing.T) {
+	path := t.TempDir() + "/config.yaml"
+	load := func(token string) *AgentConfig {
+		t.Setenv("DBCP_TEST_TOKEN", token)
+		yamlText := strings.Replace(testYAML, "  patroni:\n", `  patroni:
+    extra:
+      restapi:
+        http_extra_headers:
+          X-Api: "${DBCP_TEST_TOKEN}"
+      citus:
+        servers: ["${DBCP_TEST_TOKEN}"]
+      ctl:
+        api_token: "`+token+`"
+`, 1)
+		if err := os.WriteFile(path, []byte(yamlText), 0600); err != nil {
+			t.Fatal(err)
+		}
+		cfg, err := Load(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cfg
+	}
+
+	_, changes, err := PlanReload(load("first-value"), load("second-value"))
+	if err != nil {
+		t.Fatalf("PlanReload failed: %v", err)
+	}
+	if len(changes) != 3 {
+		t.Fatalf("expected 3 changes, got %v", changes)
+	}
+	for _, c := range changes {
+		if strings.Contains(c.String(), "-value") {
+			t.Errorf("change description leaks a secret: %s", c)
+		}
+	}
+}
+
+func TestFreeFormParameters(t *testing.T) {
+	yamlText := strings.Replace(testYAML, "      max_connections: 200\n",
+		"      max_connections: 200\n      shared_buffers: 4GB\n      jit: off\n      pg_stat_statements.max: 10000\n", 1)
+
+	var cfg AgentConfig
+	if err := yaml.Unmarshal([]byte(yamlText), &cfg); err != nil {
+		t.Fatalf("failed to parse YAML: %v", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("expected valid parameters, got %v", err)
+	}
+
+	settings := cfg.Node.PostgreSQL.Parameters.Settings()
+	for name, want := range map[string]string{
+		"shared_buffers":         "4GB",
+		"jit":                    "off",
+		"pg_stat_statements.max": "10000",
+		"max_connections":        "200",
+		"wal_level":              "logical",
+	} {
+		if settings[name] != want {
+			t.Errorf("%s: expected %q, got %q", name, want, settings[name])
+		}
+	}
+	for _, name := range []string{"port", "use_slots", "use_pg_rewind"} {
+		if _, ok := settings[name]; ok {
+			t.Errorf("%s is not a PostgreSQL setting for Patroni", name)
+		}
+	}
+}
+
+func TestParseHBARule(t *testing.T) {
+	tests := map[string]string{
+		"host replication replicator 192.168.56.0/24 scram-sha-256":     "host replication replicator 192.168.56.0/24 scram-sha-256",
+		"local   all   postgres   peer":                                 "local all postgres peer",
+		"host all all 10.1.0.0 255.255.0.0 md5":                         "host all all 10.1.0.0/16 md5",
+		`hostssl all app .example.com cert clientcert=verify-full`:      "hostssl all app .example.com cert clientcert=verify-full",
+		`host all all 0.0.0.0/0 ldap ldapbinddn="cn=admin, dc=example"`: `host all all 0.0.0.0/0 ldap ldapbinddn="cn=admin, dc=example"`,
+	}
+	for line, want := range tests {
+		rule, err := ParseHBARule(line)
+		if err != nil {
+			t.Errorf("%q: %v", line, err)
+			continue
+		}
+		if got := rule.String(); got != want {
+			t.Errorf("%q: expected %q, got %q", line, want, got)
+		}
+	}
+
+	for _, line := range []string{"host all all md5", "local all", `host all all 10.0.0.0/8 ldap ldapserver="x`, "host all all 10.0.0.0/8 md5 clientcert"} {
+		if _, err := ParseHBARule(line); err == nil {
+			t.Errorf("%q: expected a parse error", line)
+		}
+	}
+}
+
+func TestHBAValidation(t *testing.T) {
+	yamlText := strings.Replace(testYAML,
+		"      - host all         all        192.168.56.0/24 scram-sha-256\n",
+		`      - host all         all        192.168.56.0/24 scram-sha-256
+      - {type: hostssl, database: all, user: app, address: 10.0.0.0/8, method: cert, options: {clientcert: verify-full}}
+      - host all all 10.0.0.1 md5
+      - local all all 127.0.0.1/32 peer
+      - host all all 10.0.0.0/8 peer
+      - hots all all 10.0.0.0/8 md5
+      - host all
+`, 1)
+	path := t.TempDir() + "/config.yaml"
+	if err := os.WriteFile(path, []byte(yamlText), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+
+	var problems ValidationErrors
+	if err := cfg.Validate(); !errors.As(err, &problems) {
+		t.Fatalf("expected ValidationErrors, got %v", err)
+	}
+	want := map[string]string{
+		"node.postgresql.pg_hba[3]": "needs a CIDR mask, e.g. 10.0.0.1/32",
+		"node.postgresql.pg_hba[4]": "local rules take no address",
+		"node.postgresql.pg_hba[5]": "peer authentication only works for local rules",
+		"node.postgresql.pg_hba[6]": `type "hots" is not one of`,
+		"node.postgresql.pg_hba[7]": "expected \"type database user [address] method [options]\"",
+	}
+	if len(problems) != len(want) {
+		t.Errorf("expected %d problems, got %v", len(want), problems)
+	}
+	for _, p := range problems {
+		if !strings.Contains(p.Message, want[p.Path]) || want[p.Path] == "" {
+			t.Errorf("unexpected problem %v", p)
+		}
+		if p.Line == 0 {
+			t.Errorf("%s: missing position", p.Path)
+		}
+	}
+}
+
+func TestHBARequiresReplicationRule(t *testing.T) {
+	yamlText := strings.Replace(testYAML, "      - host replication replicator 192.168.56.0/24 scram-sha-256\n", "", 1)
+	var cfg AgentConfig
+	if err := yaml.Unmarshal([]byte(yamlText), &cfg); err != nil {
+		t.Fatalf("failed to parse YAML: %v", err)
+	}
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), `no rule lets replication user "replicator" connect`) {
+		t.Errorf("expected a missing replication rule, got %v", err)
+	}
+
+	cfg.Node.PostgreSQL.PGHBAAuto = true
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("expected generated rules to cover replication, got %v", err)
+	}
+
+	cfg.Cluster.Nodes = []ClusterNode{{Name: "node1", Host: "192.168.56.101"}, {Name: "node2", Host: "db-2.example.com"}}
+	cfg.Node.PostgreSQL.Parameters.Extra = map[string]string{"password_encryption": "md5"}
+	want := []string{
+		"host all postgres 127.0.0.1/32 md5",
+		"host replication replicator 192.168.56.101/32 md5",
+		"host all postgres 192.168.56.101/32 md5",
+		"host replication replicator db-2.example.com md5",
+		"host all postgres db-2.example.com md5",
+		"host all all 192.168.56.0/24 scram-sha-256",
+	}
+	if got := cfg.HBARules(); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("unexpected rules:\n%s", strings.Join(got, "\n"))
+	}
+}
+
+func TestPatroniGeneratorValidation(t *testing.T) {
+	var cfg AgentConfig
+	if err := yaml.Unmarshal([]byte(testYAML), &cfg); err != nil {
+		t.Fatalf("failed to parse YAML: %v", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Node.Patroni.Generator != PatroniGeneratorTemplate {
+		t.Errorf("expected the template generator by default, got %q", cfg.Node.Patroni.Generator)
+	}
+
+	cfg.Node.Patroni.Generator = PatroniGeneratorStructured
+	cfg.Node.Patroni.Watchdog.Mode = "sometimes"
+	err := cfg.Validate()
+	for _, want := range []string{
+		"node.patroni.template_path: is only used by the template generator",
+		"node.patroni.watchdog.mode: must be 'off', 'automatic' or 'required'",
+	} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("expected %q, got %v", want, err)
+		}
+	}
+
+	cfg.Node.Patroni.Generator = "jinja"
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "node.patroni.generator: must be 'template' or 'structured'") {
+		t.Errorf("expected an unknown generator to be rejected, got %v", err)
+	}
+}
+
+func TestTuningValidation(t *testing.T) {
+	yamlText := strings.Replace(testYAML, "    parameters:\n",
+		"    tuning:\n      profile: batch\n      storage: nvme\n    parameters:\n", 1)
+
+	var cfg AgentConfig
+	if err := yaml.Unmarshal([]byte(yamlText), &cfg); err != nil {
+		t.Fatalf("failed to parse YAML: %v", err)
+	}
+	err := cfg.Validate()
+	for _, want := range []string{
+		"node.postgresql.tuning.profile: must be 'oltp', 'olap' or 'mixed'",
+		"node.postgresql.tuning.storage: must be 'ssd' or 'hdd'",
+	} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("expected %q, got %v", want, err)
+		}
+	}
+
+	cfg.Node.PostgreSQL.Tuning = TuningConfig{Profile: ProfileOLTP, Storage: "ssd"}
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("expected a valid tuning section, got %v", err)
+	}
+}
+
+func TestPKIValidation(t *testing.T) {
+	var cfg AgentConfig
+	if err := yaml.Unmarshal([]byte(testYAML), &cfg); err != nil {
+		t.Fatalf("failed to parse YAML: %v", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.PKI.Dir != "/etc/dbcp/pki" || cfg.PKI.CADir != "/etc/dbcp/ca" || cfg.PKI.ValidDays != 365 || cfg.PKI.CAValidDays != 3650 {
+		t.Errorf("unexpected pki defaults: %+v", cfg.PKI)
+	}
+
+	if cfg.PKI.RenewBeforeDays != 30 || cfg.PKI.CheckIntervalHours != 12 || cfg.PKI.CANode != cfg.Cluster.Nodes[0].Name {
+		t.Errorf("unexpected renewal defaults: %+v", cfg.PKI)
+	}
+
+	cfg.PKI = PKIConfig{Dir: "/etc/dbcp/pki", CADir: "/etc/dbcp/pki", ValidDays: -1}
+	err := cfg.Validate()
+	for _, want := range []string{"pki.valid_days: must be positive", "pki.ca_dir: must differ from pki.dir"} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("expected %q, got %v", want, err)
+		}
+	}
+
+	cfg.PKI = PKIConfig{ValidDays: 30, RenewBeforeDays: 30}
+	err = cfg.Validate()
+	for _, want := range []string{"pki.renew_before_days: must be less than pki.valid_days (30)"} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("expected %q, got %v", want, err)
+		}
+	}
+
+	cfg.PKI = PKIConfig{CANode: "node9"}
+	err = cfg.Validate()
+	for _, want := range []string{`pki.ca_node: "node9" is not listed in cluster.nodes`} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("expected %q, got %v", want, err)
+		}
+	}
+}
+
+func TestTLSValidation(t *testing.T) {
+	cases := map[string]struct {
+		edit func(cfg *AgentConfig)
+		want string
+	}{
+		"partial etcd TLS": {func(cfg *AgentConfig) {
+			cfg.Node.ETCD.CertFile = "/etc/dbcp/pki/node.crt"
+			cfg.Node.ETCD.KeyFile = "/etc/dbcp/pki/node.key"
+		}, "node.etcd: cert_file, key_file and ca_file must be set together"},
+		"restapi key without cert": {func(cfg *AgentConfig) {
+			cfg.Node.Patroni.RestAPI.KeyFile = "/etc/dbcp/pki/node.key"
+		}, "node.patroni.restapi.cert_file: is required with key_file"},
+		"verify_client without CA": {func(cfg *AgentConfig) {
+			cfg.Node.Patroni.RestAPI = RestAPIConfig{CertFile: "/etc/dbcp/pki/node.crt", VerifyClient: "required"}
+		}, `node.patroni.restapi.ca_file: is required with verify_client "required"`},
+		"unknown verify_client": {func(cfg *AgentConfig) {
+			cfg.Node.Patroni.RestAPI = RestAPIConfig{CertFile: "/etc/dbcp/pki/node.crt", VerifyClient: "always"}
+		}, "node.patroni.restapi.verify_client: must be 'none', 'optional' or 'required'"},
+	}
+
+	for name, tc := range cases {
+		var cfg AgentConfig
+		if err := yaml.Unmarshal([]byte(testYAML), &cfg); err != nil {
+			t.Fatalf("failed to parse YAML: %v", err)
+		}
+		tc.edit(&cfg)
+		if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: expected %q, got %v", name, tc.want, err)
+		}
+	}
+}
+
+func TestRestAPIAuthValidation(t *testing.T) {
+	load := func() *AgentConfig {
+		var cfg AgentConfig
+		if err := yaml.Unmarshal([]byte(testYAML), &cfg); err != nil {
+			t.Fatalf("failed to parse YAML: %v", err)
+		}
+		return &cfg
+	}
+
+	cfg := load()
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("expected no credentials to be needed, got %v", err)
+	}
+
+	cfg = load()
+	cfg.Node.Patroni.RestAPI.Username = "patroni"
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "username and password must be set together") {
+		t.Errorf("expected a username without password to be refused, got %v", err)
+	}
+
+	cfg.Node.Patroni.RestAPI.Password = "s3cret"
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("expected username and password to be accepted, got %v", err)
+	}
+}
+
+func TestValidateGUC(t *testing.T) {
+	valid := map[string]string{
+		"shared_buffers":               "128MB",
+		"work_mem":                     "4096",
+		"wal_buffers":                  "-1",
+		"checkpoint_timeout":           "5min",
+		"checkpoint_completion_target": "0.9",
+		"wal_level":                    "Replica",
+		"hot_standby":                  "true",
+		"max_connections":              "500",
+		"my_extension.setting":         "anything",
+	}
+	for name, value := range valid {
+		if err := validateGUC(name, value); err != nil {
+			t.Errorf("%s=%s: unexpected error %v", name, value, err)
+		}
+	}
+
+	invalid := map[string]string{
+		"shared_buffers":               "4gb",
+		"work_mem":                     "-1",
+		"checkpoint_timeout":           "5 minutes",
+		"checkpoint_completion_target": "1.5",
+		"wal_level":                    "archive",
+		"hot_standby":                  "maybe",
+		"max_connections":              "0",
+		"data_directory":               "/data",
+		"bad-name":                     "1",
+	}
+	for name, value := range invalid {
+		if err := validateGUC(name, value); err == nil {
+			t.Errorf("%s=%s: expected an error", name, value)
+		}
+	}
+
+	if !IsPostmasterParameter("shared_buffers") || IsPostmasterParameter("work_mem") || IsPostmasterParameter("unknown") {
+		t.Error("unexpected postmaster classification")
+	}
+	if class, key, _ := classify("node.postgresql.parameters.shared_buffers"); class != ChangePostgresRestart || key != "postgresql.parameters.shared_buffers" {
+		t.Errorf("shared_buffers: got %s %s", class, key)
+	}
+	if class, key, _ := classify("node.postgresql.parameters.work_mem"); class != ChangeLive || key != "postgresql.parameters.work_mem" {
+		t.Errorf("work_mem: got %s %s", class, key)
+	}
+}
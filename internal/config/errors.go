@@ -0,0 +1,160 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// FieldError is one validation problem, tied to the YAML path of the field
+// it concerns and, for configs read by Load, its position in the file.
+type FieldError struct {
+	Path    string // e.g. "node.postgresql.parameters.port" or "cluster.nodes[1].host"
+	File    string // set when the field comes from an extended or included file
+	Line    int    // 0 when the position is unknown
+	Column  int
+	Message string
+}
+
+func (e *FieldError) Error() string {
+	if e.File != "" {
+		return fmt.Sprintf("%s (%s line %d, col %d): %s", e.Path, e.File, e.Line, e.Column, e.Message)
+	}
+	if e.Line > 0 {
+		return fmt.Sprintf("%s (line %d, col %d): %s", e.Path, e.Line, e.Column, e.Message)
+	}
+	return fmt.Sprintf("%s: %s", e.Path, e.Message)
+}
+
+// ValidationErrors is every problem Validate found, in file order where the
+// positions are known.
+type ValidationErrors []*FieldError
+
+func (errs ValidationErrors) Error() string {
+	if len(errs) == 1 {
+		return errs[0].Error()
+	}
+	lines := make([]string, len(errs))
+	for i, err := range errs {
+		lines[i] = "  - " + err.Error()
+	}
+	return fmt.Sprintf("%d problems found:\n%s", len(errs), strings.Join(lines, "\n"))
+}
+
+// fieldErrors collects the problems of one validation pass.
+type fieldErrors struct {
+	root    *yaml.Node
+	origins map[*yaml.Node]string
+	errs    ValidationErrors
+}
+
+func (cfg *AgentConfig) newFieldErrors() *fieldErrors {
+	return &fieldErrors{root: cfg.root, origins: cfg.origins}
+}
+
+// add records a problem with the field at path. When the field is missing
+// from the file, the position of its closest parent is used instead.
+func (f *fieldErrors) add(path, format string, args ...any) {
+	err := &FieldError{Path: path, Message: fmt.Sprintf(format, args...)}
+	if node := locate(f.root, path); node != nil {
+		err.File, err.Line, err.Column = f.origins[node], node.Line, node.Column
+	}
+	f.errs = append(f.errs, err)
+}
+
+// err returns the collected problems, or nil.
+func (f *fieldErrors) err() error {
+	if len(f.errs) == 0 {
+		return nil
+	}
+	return f.errs
+}
+
+// collect appends the problems of err, as returned by a validation pass.
+func (f *fieldErrors) collect(err error) {
+	if errs, ok := err.(ValidationErrors); ok {
+		f.errs = append(f.errs, errs...)
+	} else if err != nil {
+		f.errs = append(f.errs, &FieldError{Message: err.Error()})
+	}
+}
+
+// sort orders the problems by file and position.
+func (f *fieldErrors) sort() {
+	sort.SliceStable(f.errs, func(i, j int) bool {
+		a, b := f.errs[i], f.errs[j]
+		if a.File != b.File {
+			return a.File < b.File
+		}
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.Column < b.Column
+	})
+}
+
+// locate finds the node for a dotted path in a parsed config file: the key
+// node for mapping entries, the element for sequence indexes. It stops at
+// the deepest part of the path that exists.
+func locate(root *yaml.Node, path string) *yaml.Node {
+	if root == nil {
+		return nil
+	}
+	node := root
+	if node.Kind == yaml.DocumentNode && len(node.Content) > 0 {
+		node = node.Content[0]
+	}
+
+	var found *yaml.Node
+	for _, part := range strings.Split(path, ".") {
+		name, index := part, -1
+		if i := strings.IndexByte(part, '['); i >= 0 && strings.HasSuffix(part, "]") {
+			name = part[:i]
+			n, err := strconv.Atoi(part[i+1 : len(part)-1])
+			if err != nil {
+				return found
+			}
+			index = n
+		}
+
+		key, value := mappingEntry(node, name)
+		if key == nil {
+			return found
+		}
+		found, node = key, value
+
+		if index >= 0 {
+			if node.Kind != yaml.SequenceNode || index >= len(node.Content) {
+				return found
+			}
+			node = node.Content[index]
+			found = node
+		}
+	}
+	return found
+}
+
+func mappingEntry(node *yaml.Node, key string) (*yaml.Node, *yaml.Node) {
+	if node.Kind != yaml.MappingNode {
+		return nil, nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i], node.Content[i+1]
+		}
+	}
+	return nil, nil
+}
+
+// sortedKeys makes map-driven validation report in a stable order.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
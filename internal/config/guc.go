@@ -0,0 +1,206 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// gucKind is the type of a PostgreSQL setting, as in pg_settings.vartype
+// with units split out.
+type gucKind int
+
+const (
+	gucBool gucKind = iota
+	gucInt
+	gucReal
+	gucEnum
+	gucMemory // integer with an optional kB/MB/GB/TB unit
+	gucTime   // integer with an optional us/ms/s/min/h/d unit
+	gucString
+)
+
+// gucSpec describes a well-known setting. min and max bound integers and
+// reals; memory and time settings are only checked for their format, with
+// -1 allowed where PostgreSQL uses it to mean "disabled" or "default".
+type gucSpec struct {
+	kind       gucKind
+	min, max   float64
+	values     []string // enum values
+	minusOne   bool     // -1 is accepted
+	postmaster bool     // only changes on a server restart
+}
+
+var knownGUCs = map[string]gucSpec{
+	// Postmaster settings: a change needs a restart
+	"max_connections":                {kind: gucInt, min: 1, max: 262143, postmaster: true},
+	"superuser_reserved_connections": {kind: gucInt, min: 0, max: 262143, postmaster: true},
+	"shared_buffers":                 {kind: gucMemory, postmaster: true},
+	"huge_pages":                     {kind: gucEnum, values: []string{"on", "off", "try"}, postmaster: true},
+	"wal_level":                      {kind: gucEnum, values: []string{"minimal", "replica", "logical"}, postmaster: true},
+	"wal_buffers":                    {kind: gucMemory, minusOne: true, postmaster: true},
+	"wal_log_hints":                  {kind: gucBool, postmaster: true},
+	"hot_standby":                    {kind: gucBool, postmaster: true},
+	"max_wal_senders":                {kind: gucInt, min: 0, max: 262143, postmaster: true},
+	"max_replication_slots":          {kind: gucInt, min: 0, max: 262143, postmaster: true},
+	"max_worker_processes":           {kind: gucInt, min: 0, max: 262143, postmaster: true},
+	"max_prepared_transactions":      {kind: gucInt, min: 0, max: 262143, postmaster: true},
+	"max_locks_per_transaction":      {kind: gucInt, min: 10, max: 2147483647, postmaster: true},
+	"autovacuum_max_workers":         {kind: gucInt, min: 1, max: 262143, postmaster: true},
+	"track_commit_timestamp":         {kind: gucBool, postmaster: true},
+	"archive_mode":                   {kind: gucEnum, values: []string{"on", "off", "always"}, postmaster: true},
+	"shared_preload_libraries":       {kind: gucString, postmaster: true},
+	"listen_addresses":               {kind: gucString, postmaster: true},
+	"unix_socket_directories":        {kind: gucString, postmaster: true},
+
+	// Reloadable settings
+	"work_mem":                            {kind: gucMemory},
+	"maintenance_work_mem":                {kind: gucMemory},
+	"autovacuum_work_mem":                 {kind: gucMemory, minusOne: true},
+	"effective_cache_size":                {kind: gucMemory},
+	"max_wal_size":                        {kind: gucMemory},
+	"min_wal_size":                        {kind: gucMemory},
+	"wal_keep_size":                       {kind: gucMemory},
+	"random_page_cost":                    {kind: gucReal, min: 0, max: 1.79769e+308},
+	"seq_page_cost":                       {kind: gucReal, min: 0, max: 1.79769e+308},
+	"effective_io_concurrency":            {kind: gucInt, min: 0, max: 1000},
+	"default_statistics_target":           {kind: gucInt, min: 1, max: 10000},
+	"max_parallel_workers":                {kind: gucInt, min: 0, max: 1024},
+	"max_parallel_workers_per_gather":     {kind: gucInt, min: 0, max: 1024},
+	"max_parallel_maintenance_workers":    {kind: gucInt, min: 0, max: 1024},
+	"checkpoint_timeout":                  {kind: gucTime},
+	"checkpoint_completion_target":        {kind: gucReal, min: 0, max: 1},
+	"synchronous_commit":                  {kind: gucEnum, values: []string{"on", "off", "local", "remote_write", "remote_apply"}},
+	"synchronous_standby_names":           {kind: gucString},
+	"hot_standby_feedback":                {kind: gucBool},
+	"wal_compression":                     {kind: gucEnum, values: []string{"on", "off", "true", "false", "yes", "no", "1", "0", "pglz", "lz4", "zstd"}},
+	"archive_command":                     {kind: gucString},
+	"archive_timeout":                     {kind: gucTime},
+	"statement_timeout":                   {kind: gucTime},
+	"lock_timeout":                        {kind: gucTime},
+	"idle_in_transaction_session_timeout": {kind: gucTime},
+	"log_min_duration_statement":          {kind: gucTime, minusOne: true},
+	"log_statement":                       {kind: gucEnum, values: []string{"none", "ddl", "mod", "all"}},
+	"log_connections":                     {kind: gucBool},
+	"log_disconnections":                  {kind: gucBool},
+	"autovacuum":                          {kind: gucBool},
+	"jit":                                 {kind: gucBool},
+	"timezone":                            {kind: gucString},
+}
+
+// patroniManagedGUCs are derived by Patroni from its own settings; setting
+// them as parameters would be ignored or conflict.
+var patroniManagedGUCs = map[string]string{
+	"data_directory":   "set node.postgresql.data_dir",
+	"hba_file":         "Patroni manages pg_hba.conf",
+	"primary_conninfo": "Patroni manages replication connections",
+}
+
+var gucNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)?$`)
+
+var (
+	memoryPattern = regexp.MustCompile(`^-?[0-9]+\s*(kB|MB|GB|TB)?$`)
+	timePattern   = regexp.MustCompile(`^-?[0-9]+\s*(us|ms|s|min|h|d)?$`)
+)
+
+// IsPostmasterParameter reports whether changing the setting needs a
+// PostgreSQL restart. Unknown settings are assumed to be reloadable.
+func IsPostmasterParameter(name string) bool {
+	return knownGUCs[strings.ToLower(name)].postmaster
+}
+
+// validateGUC checks value against what PostgreSQL accepts for name.
+// Settings it does not know, such as extension settings, only need a valid
+// name.
+func validateGUC(name, value string) error {
+	if !gucNamePattern.MatchString(name) {
+		return fmt.Errorf("%q is not a valid parameter name", name)
+	}
+	if why, ok := patroniManagedGUCs[strings.ToLower(name)]; ok {
+		return fmt.Errorf("cannot be set here: %s", why)
+	}
+
+	spec, ok := knownGUCs[strings.ToLower(name)]
+	if !ok {
+		return nil
+	}
+	value = strings.TrimSpace(value)
+
+	switch spec.kind {
+	case gucBool:
+		if _, ok := parseGUCBool(value); !ok {
+			return fmt.Errorf("%q is not a boolean (on/off)", value)
+		}
+	case gucInt:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("%q is not an integer", value)
+		}
+		if float64(n) < spec.min || float64(n) > spec.max {
+			return fmt.Errorf("%d is outside %g..%g", n, spec.min, spec.max)
+		}
+	case gucReal:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("%q is not a number", value)
+		}
+		if f < spec.min || f > spec.max {
+			return fmt.Errorf("%g is outside %g..%g", f, spec.min, spec.max)
+		}
+	case gucEnum:
+		for _, allowed := range spec.values {
+			if strings.EqualFold(value, allowed) {
+				return nil
+			}
+		}
+		return fmt.Errorf("%q is not one of %s", value, strings.Join(spec.values, ", "))
+	case gucMemory, gucTime:
+		pattern, units := memoryPattern, "kB, MB, GB or TB"
+		if spec.kind == gucTime {
+			pattern, units = timePattern, "us, ms, s, min, h or d"
+		}
+		if !pattern.MatchString(value) {
+			return fmt.Errorf("%q is not a number with an optional unit (%s; units are case-sensitive)", value, units)
+		}
+		if strings.HasPrefix(value, "-") && !(spec.minusOne && value == "-1") {
+			return fmt.Errorf("%q must not be negative", value)
+		}
+	}
+	return nil
+}
+
+func parseGUCBool(value string) (bool, bool) {
+	switch strings.ToLower(value) {
+	case "on", "true", "yes", "1":
+		return true, true
+	case "off", "false", "no", "0":
+		return false, true
+	}
+	return false, false
+}
+
+// Settings returns every PostgreSQL setting in the section by name: the
+// typed fields that are set plus the free-form ones. Port and the Patroni
+// options (use_pg_rewind, use_slots) are not PostgreSQL settings here, as
+// Patroni derives them from its own configuration.
+func (s PostgresSettings) Settings() map[string]string {
+	settings := map[string]string{}
+	for name, value := range s.Extra {
+		settings[name] = value
+	}
+	if s.MaxConnections != 0 {
+		settings["max_connections"] = strconv.Itoa(s.MaxConnections)
+	}
+	for name, value := range map[string]string{
+		"wal_level":                 s.WALLevel,
+		"hot_standby":               s.HotStandby,
+		"synchronous_commit":        s.SynchronousCommit,
+		"synchronous_standby_names": s.SynchronousStandbyNames,
+	} {
+		if value != "" {
+			settings[name] = value
+		}
+	}
+	return settings
+}
@@ -0,0 +1,355 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// HBARule is one pg_hba.conf line. In YAML it is either the line itself,
+//
+//   - host replication replicator 10.0.0.0/24 scram-sha-256
+//
+// or a mapping with the same fields:
+//
+//   - {type: hostssl, database: all, user: app, address: 10.0.0.0/24, method: cert}
+type HBARule struct {
+	Type     string            `yaml:"type"`     // local, host, hostssl, hostnossl, hostgssenc, hostnogssenc
+	Database string            `yaml:"database"` // all, sameuser, samerole, replication or a comma-separated list
+	User     string            `yaml:"user"`     // all, a comma-separated list, +group for role members
+	Address  string            `yaml:"address"`  // CIDR, hostname, all, samehost or samenet; empty for local
+	Method   string            `yaml:"method"`
+	Options  map[string]string `yaml:"options"` // e.g. clientcert: verify-full
+
+	// A line that could not be parsed is kept as written and reported by
+	// Validate, so every problem in the config is listed at once.
+	raw      string
+	parseErr error
+}
+
+var hbaTypes = map[string]bool{
+	"local": true, "host": true, "hostssl": true, "hostnossl": true, "hostgssenc": true, "hostnogssenc": true,
+}
+
+var hbaMethods = map[string]bool{
+	"trust": true, "reject": true, "scram-sha-256": true, "md5": true, "password": true, "gss": true,
+	"sspi": true, "ident": true, "peer": true, "pam": true, "ldap": true, "radius": true, "cert": true,
+}
+
+var (
+	hbaHostnamePattern = regexp.MustCompile(`^\.?[A-Za-z0-9]([A-Za-z0-9-]*[A-Za-z0-9])?(\.[A-Za-z0-9]([A-Za-z0-9-]*[A-Za-z0-9])?)*$`)
+	hbaOptionPattern   = regexp.MustCompile(`^[a-z_]+$`)
+)
+
+// ParseHBARule parses a pg_hba.conf line. An address followed by a
+// netmask is converted to CIDR notation.
+func ParseHBARule(line string) (HBARule, error) {
+	fields, err := splitHBALine(line)
+	if err != nil {
+		return HBARule{}, err
+	}
+
+	minFields := 5
+	if len(fields) > 0 && fields[0] == "local" {
+		minFields = 4
+	}
+	if len(fields) < minFields {
+		return HBARule{}, fmt.Errorf("expected \"type database user [address] method [options]\", got %q", line)
+	}
+
+	rule := HBARule{Type: fields[0], Database: fields[1], User: fields[2]}
+	rest := fields[3:]
+	// An address on a local line is kept so validate can point it out
+	localAddress := rule.Type == "local" && len(rest) > 1 && (strings.Contains(rest[0], "/") || net.ParseIP(rest[0]) != nil)
+	if rule.Type != "local" || localAddress {
+		rule.Address, rest = rest[0], rest[1:]
+		if len(rest) > 1 && net.ParseIP(rest[0]) != nil {
+			cidr, err := maskToCIDR(rule.Address, rest[0])
+			if err != nil {
+				return HBARule{}, err
+			}
+			rule.Address, rest = cidr, rest[1:]
+		}
+	}
+	rule.Method, rest = rest[0], rest[1:]
+
+	for _, option := range rest {
+		name, value, ok := strings.Cut(option, "=")
+		if !ok {
+			return HBARule{}, fmt.Errorf("option %q is not name=value", option)
+		}
+		if rule.Options == nil {
+			rule.Options = map[string]string{}
+		}
+		rule.Options[name] = value
+	}
+	return rule, nil
+}
+
+// splitHBALine splits on whitespace, keeping double-quoted text together.
+func splitHBALine(line string) ([]string, error) {
+	var fields []string
+	var field strings.Builder
+	inQuotes, hasField := false, false
+	for _, r := range line {
+		switch {
+		case r == '"':
+			inQuotes = !inQuotes
+			hasField = true
+		case !inQuotes && (r == ' ' || r == '\t'):
+			if hasField {
+				fields = append(fields, field.String())
+				field.Reset()
+				hasField = false
+			}
+		default:
+			field.WriteRune(r)
+			hasField = true
+		}
+	}
+	if inQuotes {
+		return nil, fmt.Errorf("unterminated quote in %q", line)
+	}
+	if hasField {
+		fields = append(fields, field.String())
+	}
+	return fields, nil
+}
+
+func maskToCIDR(address, mask string) (string, error) {
+	ip := net.ParseIP(address)
+	maskIP := net.ParseIP(mask)
+	if ip == nil {
+		return "", fmt.Errorf("%q is not an IP address for netmask %s", address, mask)
+	}
+	var m net.IPMask
+	if v4 := maskIP.To4(); v4 != nil && ip.To4() != nil {
+		m = net.IPMask(v4)
+	} else {
+		m = net.IPMask(maskIP.To16())
+	}
+	ones, bits := m.Size()
+	if bits == 0 {
+		return "", fmt.Errorf("%q is not a valid netmask", mask)
+	}
+	return fmt.Sprintf("%s/%d", address, ones), nil
+}
+
+// String returns the rule as a pg_hba.conf line.
+func (r HBARule) String() string {
+	if r.parseErr != nil {
+		return r.raw
+	}
+	fields := []string{r.Type, r.Database, r.User}
+	if r.Address != "" {
+		fields = append(fields, r.Address)
+	}
+	fields = append(fields, r.Method)
+	for _, name := range sortedKeys(r.Options) {
+		value := r.Options[name]
+		if strings.ContainsAny(value, " \t\"") || value == "" {
+			value = `"` + value + `"`
+		}
+		fields = append(fields, name+"="+value)
+	}
+	return strings.Join(fields, " ")
+}
+
+// UnmarshalYAML accepts the line form as well as the mapping form.
+func (r *HBARule) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		rule, err := ParseHBARule(node.Value)
+		if err != nil {
+			rule = HBARule{raw: node.Value, parseErr: err}
+		}
+		*r = rule
+		return nil
+	}
+	type plain HBARule
+	return node.Decode((*plain)(r))
+}
+
+// MarshalYAML writes the line form, so rules compare as text on reload.
+func (r HBARule) MarshalYAML() (any, error) {
+	return r.String(), nil
+}
+
+// validate checks the rule the way PostgreSQL reads pg_hba.conf.
+func (r HBARule) validate() error {
+	if r.parseErr != nil {
+		return r.parseErr
+	}
+	var problems []string
+	if !hbaTypes[r.Type] {
+		problems = append(problems, fmt.Sprintf("type %q is not one of local, host, hostssl, hostnossl, hostgssenc, hostnogssenc", r.Type))
+	}
+	if r.Database == "" {
+		problems = append(problems, "database is required")
+	}
+	if r.User == "" {
+		problems = append(problems, "user is required")
+	}
+
+	switch {
+	case r.Type == "local" && r.Address != "":
+		problems = append(problems, "local rules take no address")
+	case r.Type != "local" && r.Address == "":
+		problems = append(problems, "address is required")
+	case r.Type != "local":
+		if err := validateHBAAddress(r.Address); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+
+	switch {
+	case r.Method == "":
+		problems = append(problems, "method is required")
+	case !hbaMethods[r.Method]:
+		problems = append(problems, fmt.Sprintf("method %q is not a PostgreSQL authentication method", r.Method))
+	case r.Method == "peer" && r.Type != "local":
+		problems = append(problems, "peer authentication only works for local rules")
+	case r.Method == "ident" && r.Type == "local":
+		problems = append(problems, "ident authentication does not work for local rules; use peer")
+	case r.Method == "cert" && r.Type != "hostssl":
+		problems = append(problems, "cert authentication needs a hostssl rule")
+	}
+
+	for _, name := range sortedKeys(r.Options) {
+		if !hbaOptionPattern.MatchString(name) {
+			problems = append(problems, fmt.Sprintf("%q is not a valid option name", name))
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("%s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+func validateHBAAddress(address string) error {
+	switch address {
+	case "all", "samehost", "samenet":
+		return nil
+	}
+	if strings.Contains(address, "/") {
+		if _, _, err := net.ParseCIDR(address); err != nil {
+			return fmt.Errorf("address %q is not a valid CIDR", address)
+		}
+		return nil
+	}
+	if net.ParseIP(address) != nil {
+		return fmt.Errorf("address %q needs a CIDR mask, e.g. %s", address, hostCIDR(address))
+	}
+	if !hbaHostnamePattern.MatchString(address) {
+		return fmt.Errorf("address %q is not a CIDR, hostname or keyword", address)
+	}
+	return nil
+}
+
+// hostCIDR returns the address of a single host: an IP with a full mask,
+// or a hostname as it is.
+func hostCIDR(host string) string {
+	ip := net.ParseIP(host)
+	switch {
+	case ip == nil:
+		return host
+	case ip.To4() != nil:
+		return host + "/32"
+	default:
+		return host + "/128"
+	}
+}
+
+// matchesHBAUser reports whether a rule's user field can match user.
+// Group membership (+role) is assumed to match.
+func matchesHBAUser(field, user string) bool {
+	for _, name := range strings.Split(field, ",") {
+		if name == "all" || name == user || strings.HasPrefix(name, "+") {
+			return true
+		}
+	}
+	return false
+}
+
+// GeneratedHBARules returns the rules Patroni needs between cluster nodes:
+// replication and superuser access (for pg_rewind and Patroni itself) from
+// every node, and superuser access from localhost.
+func (cfg *AgentConfig) GeneratedHBARules() []HBARule {
+	method := "scram-sha-256"
+	if cfg.Node.PostgreSQL.Parameters.Settings()["password_encryption"] == "md5" {
+		method = "md5"
+	}
+	superuser := cfg.Node.Patroni.Authentication.Superuser.Username
+	replication := cfg.Node.Patroni.Authentication.Replication.Username
+
+	var rules []HBARule
+	if superuser != "" {
+		rules = append(rules, HBARule{Type: "host", Database: "all", User: superuser, Address: "127.0.0.1/32", Method: method})
+	}
+	for _, node := range cfg.Cluster.Nodes {
+		if node.Host == "" {
+			continue
+		}
+		address := hostCIDR(node.Host)
+		if replication != "" {
+			rules = append(rules, HBARule{Type: "host", Database: "replication", User: replication, Address: address, Method: method})
+		}
+		if superuser != "" {
+			rules = append(rules, HBARule{Type: "host", Database: "all", User: superuser, Address: address, Method: method})
+		}
+	}
+	return rules
+}
+
+// HBARules returns the pg_hba rules for Patroni: the generated ones first
+// when pg_hba_auto is on, then those from the config. Duplicates are dropped.
+func (cfg *AgentConfig) HBARules() []string {
+	var rules []HBARule
+	if cfg.Node.PostgreSQL.PGHBAAuto {
+		rules = append(rules, cfg.GeneratedHBARules()...)
+	}
+	rules = append(rules, cfg.Node.PostgreSQL.PGHBA...)
+
+	seen := map[string]bool{}
+	var lines []string
+	for _, rule := range rules {
+		line := rule.String()
+		if !seen[line] {
+			seen[line] = true
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// validateHBA checks each rule, and that the replication user can connect
+// when the rules are written by hand.
+func (cfg *AgentConfig) validateHBA(f *fieldErrors) {
+	pg := cfg.Node.PostgreSQL
+	if len(pg.PGHBA) == 0 && !pg.PGHBAAuto {
+		f.add("node.postgresql.pg_hba", "must contain at least one entry, or set pg_hba_auto")
+		return
+	}
+
+	for i, rule := range pg.PGHBA {
+		if err := rule.validate(); err != nil {
+			f.add(fmt.Sprintf("node.postgresql.pg_hba[%d]", i), "%v", err)
+		}
+	}
+
+	replication := cfg.Node.Patroni.Authentication.Replication.Username
+	if pg.PGHBAAuto || replication == "" {
+		return
+	}
+	for _, rule := range pg.PGHBA {
+		if rule.Type != "local" && rule.Method != "reject" && matchesHBAUser(rule.User, replication) &&
+			slices.Contains(strings.Split(rule.Database, ","), "replication") {
+			return
+		}
+	}
+	f.add("node.postgresql.pg_hba", "no rule lets replication user %q connect for replication; add one or set pg_hba_auto", replication)
+}
@@ -0,0 +1,238 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v3"
+)
+
+// A config file may build on shared files:
+//
+//	extends: cluster.yaml       # the file this one overrides
+//	include:                    # more fragments, merged after extends
+//	  - repositories.yaml
+//
+// Paths are relative to the file naming them. Files are deep-merged in the
+// order extends, include..., the file itself: mappings are merged key by
+// key, while lists and scalars from a later file replace earlier ones.
+const (
+	extendsKey = "extends"
+	includeKey = "include"
+)
+
+// maxIncludeDepth stops runaway include chains early with a clear error.
+const maxIncludeDepth = 16
+
+// configTree is a parsed config file with everything it includes merged in.
+type configTree struct {
+	root *yaml.Node
+	// origins maps nodes that came from an included file to that file, so
+	// validation can point at the right place.
+	origins map[*yaml.Node]string
+	// files lists every file read, the top-level one first
+	files []string
+}
+
+// loadTree reads path and merges in the files it extends or includes.
+func loadTree(path string) (*configTree, error) {
+	tree := &configTree{origins: map[*yaml.Node]string{}}
+	root, err := tree.load(path, nil)
+	if err != nil {
+		return nil, err
+	}
+	tree.root = &yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{root}}
+	return tree, nil
+}
+
+// load returns the merged top-level mapping of path. stack holds the files
+// currently being loaded, to catch cycles.
+func (t *configTree) load(path string, stack []string) (*yaml.Node, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, open := range stack {
+		if open == abs {
+			return nil, fmt.Errorf("%s includes itself", path)
+		}
+	}
+	if len(stack) >= maxIncludeDepth {
+		return nil, fmt.Errorf("%s: includes are nested more than %d levels deep", path, maxIncludeDepth)
+	}
+	stack = append(stack, abs)
+	t.files = append(t.files, path)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if len(stack) == 1 {
+			return nil, fmt.Errorf("failed to read config file: %w", err)
+		}
+		return nil, fmt.Errorf("failed to read included file: %w", err)
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		if len(stack) == 1 {
+			return nil, fmt.Errorf("failed to parse YAML: %w", err)
+		}
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+
+	root := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	if len(doc.Content) > 0 {
+		root = doc.Content[0]
+	}
+	if root.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("%s: the top level must be a mapping", path)
+	}
+	if len(stack) > 1 {
+		t.recordOrigin(root, path)
+	}
+
+	bases, err := takeIncludes(root, path)
+	if err != nil {
+		return nil, err
+	}
+
+	var merged *yaml.Node
+	for _, base := range bases {
+		node, err := t.load(base, stack)
+		if err != nil {
+			return nil, err
+		}
+		merged = mergeNodes(merged, node)
+	}
+	return mergeNodes(merged, root), nil
+}
+
+// Files returns the config file at path and every file it extends or
+// includes, directly or not, each once.
+func Files(path string) ([]string, error) {
+	tree, err := loadTree(path)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	seen := map[string]bool{}
+	for _, file := range tree.files {
+		abs, err := filepath.Abs(file)
+		if err != nil {
+			return nil, err
+		}
+		if !seen[abs] {
+			seen[abs] = true
+			files = append(files, file)
+		}
+	}
+	return files, nil
+}
+
+// takeIncludes removes extends and include from a file's top-level mapping
+// and returns the files they name, resolved against the file's directory.
+func takeIncludes(root *yaml.Node, path string) ([]string, error) {
+	var extends, includes []string
+	var content []*yaml.Node
+
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		key, value := root.Content[i], root.Content[i+1]
+		switch key.Value {
+		case extendsKey:
+			if value.Kind != yaml.ScalarNode || value.Value == "" {
+				return nil, fmt.Errorf("%s line %d: extends must be a file name", path, key.Line)
+			}
+			extends = []string{value.Value}
+		case includeKey:
+			switch value.Kind {
+			case yaml.ScalarNode:
+				includes = append(includes, value.Value)
+			case yaml.SequenceNode:
+				for _, item := range value.Content {
+					if item.Kind != yaml.ScalarNode || item.Value == "" {
+						return nil, fmt.Errorf("%s line %d: include entries must be file names", path, item.Line)
+					}
+					includes = append(includes, item.Value)
+				}
+			default:
+				return nil, fmt.Errorf("%s line %d: include must be a file name or a list of them", path, key.Line)
+			}
+		default:
+			content = append(content, key, value)
+		}
+	}
+	root.Content = content
+
+	files := append(extends, includes...)
+	for i, file := range files {
+		if !filepath.IsAbs(file) {
+			files[i] = filepath.Join(filepath.Dir(path), file)
+		}
+	}
+	return files, nil
+}
+
+// MergeYAML deep-merges overlay onto base the way extends and include do:
+// mappings key by key, anything else replaced. Key order and comments of
+// base are kept.
+func MergeYAML(base, overlay *yaml.Node) *yaml.Node {
+	return mergeNodes(base, overlay)
+}
+
+// mergeNodes deep-merges overlay onto base and returns the result, reusing
+// the nodes of both. Keys that overlay sets keep overlay's key node so their
+// position points at the file that set them.
+func mergeNodes(base, overlay *yaml.Node) *yaml.Node {
+	if base == nil {
+		return overlay
+	}
+	if base.Kind != yaml.MappingNode || overlay.Kind != yaml.MappingNode {
+		return overlay
+	}
+
+	for i := 0; i+1 < len(overlay.Content); i += 2 {
+		key, value := overlay.Content[i], overlay.Content[i+1]
+		replaced := false
+		for j := 0; j+1 < len(base.Content); j += 2 {
+			if base.Content[j].Value == key.Value {
+				base.Content[j] = key
+				base.Content[j+1] = mergeNodes(base.Content[j+1], value)
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			base.Content = append(base.Content, key, value)
+		}
+	}
+	return base
+}
+
+func (t *configTree) recordOrigin(node *yaml.Node, path string) {
+	t.origins[node] = path
+	for _, child := range node.Content {
+		t.recordOrigin(child, path)
+	}
+}
+
+// Render returns the effective config at path with everything it extends or
+// includes merged in. References and encrypted values are left as written,
+// so the output is as safe to share as the files themselves.
+func Render(path string) ([]byte, error) {
+	tree, err := loadTree(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(tree.root); err != nil {
+		return nil, fmt.Errorf("failed to render config: %w", err)
+	}
+	if err := enc.Close(); err != nil {
+		return nil, fmt.Errorf("failed to render config: %w", err)
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,321 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ChangeClass says how a config change reaches a running node.
+type ChangeClass int
+
+const (
+	// ChangeLive is applied without touching PostgreSQL: agent settings, or
+	// Patroni's dynamic (DCS) settings, which Patroni applies cluster-wide.
+	ChangeLive ChangeClass = iota
+	// ChangePatroniReload rewrites patroni.yml and asks Patroni to reload it.
+	ChangePatroniReload
+	// ChangePostgresRestart only takes effect once PostgreSQL restarts.
+	ChangePostgresRestart
+	// ChangeForbidden cannot be applied to a running node and is ignored.
+	ChangeForbidden
+)
+
+func (c ChangeClass) String() string {
+	switch c {
+	case ChangeLive:
+		return "live"
+	case ChangePatroniReload:
+		return "patroni reload"
+	case ChangePostgresRestart:
+		return "postgres restart"
+	default:
+		return "forbidden"
+	}
+}
+
+// Change is one field that differs between the running and the reloaded config.
+type Change struct {
+	Path     string
+	Old, New any // as decoded from YAML; nil when the field is unset
+	Class    ChangeClass
+	// DCSKey is the dotted key of the setting in Patroni's dynamic
+	// configuration, for changes applied through PATCH /config.
+	DCSKey string
+	Reason string // why a forbidden change is refused
+	// Secret is set when either value came from a reference or an
+	// encrypted value; String then leaves both out.
+	Secret bool
+}
+
+func (c Change) String() string {
+	if c.Secret || isSensitive(c.Path) || hasSensitiveKey(c.Old) || hasSensitiveKey(c.New) {
+		return fmt.Sprintf("%s changed (%s)", c.Path, c.Class)
+	}
+	return fmt.Sprintf("%s: %v -> %v (%s)", c.Path, c.Old, c.New, c.Class)
+}
+
+// isSensitive guesses from a field's name whether its value is a secret.
+func isSensitive(path string) bool {
+	if strings.HasPrefix(path, "secrets.") {
+		return true
+	}
+	name := strings.ToLower(path[strings.LastIndex(path, ".")+1:])
+	for _, word := range []string{"password", "passwd", "secret", "token", "credential"} {
+		if strings.Contains(name, word) {
+			return true
+		}
+	}
+	return name == "key" || strings.HasSuffix(name, "_key") || strings.HasSuffix(name, "auth")
+}
+
+// hasSensitiveKey reports whether a list or map value, which is compared
+// as a whole, holds a field that looks like a secret.
+func hasSensitiveKey(value any) bool {
+	switch v := value.(type) {
+	case map[string]any:
+		for key, child := range v {
+			if isSensitive(key) || hasSensitiveKey(child) {
+				return true
+			}
+		}
+	case []any:
+		for _, child := range v {
+			if hasSensitiveKey(child) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// fromSecret reports whether the value at path, or anything inside it,
+// was resolved from a reference or an encrypted value. List items are
+// recorded as path[i] but compared as part of the whole list.
+func (cfg *AgentConfig) fromSecret(path string) bool {
+	for secret := range cfg.secretPaths {
+		if i := strings.IndexByte(secret, '['); i >= 0 {
+			secret = secret[:i]
+		}
+		if secret == path || strings.HasPrefix(secret, path+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// reloadRule classifies the fields at and below a path. The longest
+// matching path wins; fields without a rule are forbidden.
+type reloadRule struct {
+	path   string
+	class  ChangeClass
+	dcsKey string
+}
+
+var reloadRules = []reloadRule{
+	{path: "log_level", class: ChangeLive},
+	{path: "log_output", class: ChangeLive},
+	{path: "log_file_path", class: ChangeLive},
+	{path: "log_max_size_mb", class: ChangeLive},
+	{path: "log_max_backups", class: ChangeLive},
+	{path: "log_max_age_days", class: ChangeLive},
+	{path: "node.allow_restart_services", class: ChangeLive},
+	// Read by "dbcp-agent pki" and by every certificate check
+	{path: "pki", class: ChangeLive},
+
+	// Dynamic settings live in the DCS; the bootstrap section of patroni.yml
+	// is only read when the cluster is first created.
+	{path: "node.patroni.dcs.ttl", class: ChangeLive, dcsKey: "ttl"},
+	{path: "node.patroni.dcs.loop_wait", class: ChangeLive, dcsKey: "loop_wait"},
+	{path: "node.patroni.dcs.retry_timeout", class: ChangeLive, dcsKey: "retry_timeout"},
+	{path: "node.patroni.dcs.maximum_lag_on_failover", class: ChangeLive, dcsKey: "maximum_lag_on_failover"},
+	{path: "node.postgresql.parameters.use_pg_rewind", class: ChangeLive, dcsKey: "postgresql.use_pg_rewind"},
+	{path: "node.postgresql.parameters.use_slots", class: ChangeLive, dcsKey: "postgresql.use_slots"},
+	{path: "node.postgresql.pg_hba", class: ChangeLive, dcsKey: "postgresql.pg_hba"},
+	{path: "node.postgresql.pg_hba_auto", class: ChangeLive, dcsKey: "postgresql.pg_hba"},
+
+	{path: "node.patroni.tags", class: ChangePatroniReload},
+	{path: "node.patroni.create_replica_methods", class: ChangePatroniReload},
+	{path: "node.patroni.authentication", class: ChangePatroniReload},
+	{path: "node.patroni.watchdog", class: ChangePatroniReload},
+	{path: "node.patroni.generator", class: ChangePatroniReload},
+	{path: "node.patroni.template_path", class: ChangePatroniReload},
+	{path: "node.patroni.extra", class: ChangePatroniReload},
+	{path: "node.patroni.restapi", class: ChangePatroniReload},
+
+	{path: "node.postgresql.parameters.port", class: ChangePostgresRestart},
+}
+
+// forbiddenReasons explains the most common refusals.
+var forbiddenReasons = map[string]string{
+	"node.name":                "the member name identifies this node in the cluster",
+	"node.postgresql.data_dir": "moving the data directory needs a rebuild of the member",
+	"node.postgresql.version":  "major upgrades are not done by reload",
+	"node.postgresql.users":    "users are only created when the cluster is bootstrapped",
+	"node.postgresql.initdb":   "initdb options only apply when the cluster is bootstrapped",
+	"node.postgresql.tuning":   "tuned settings are computed at startup; restart the agent, or set the values in parameters",
+	"node.etcd":                "etcd membership and storage cannot change under a running member",
+	"cluster":                  "cluster membership and name cannot change by reload",
+	"repositories":             "sources are only used when installing; restart the agent",
+}
+
+func classify(path string) (ChangeClass, string, string) {
+	best := -1
+	for i, rule := range reloadRules {
+		if pathWithin(path, rule.path) && (best < 0 || len(rule.path) > len(reloadRules[best].path)) {
+			best = i
+		}
+	}
+	if best >= 0 {
+		return reloadRules[best].class, reloadRules[best].dcsKey, ""
+	}
+
+	// PostgreSQL settings go through the DCS; postmaster ones also need a
+	// restart. The rest of the path is one name, dotted for extension
+	// settings such as pg_stat_statements.track.
+	if name, ok := strings.CutPrefix(path, "node.postgresql.parameters."); ok {
+		if IsPostmasterParameter(name) {
+			return ChangePostgresRestart, "postgresql.parameters." + name, ""
+		}
+		return ChangeLive, "postgresql.parameters." + name, ""
+	}
+
+	reason := "not supported by reload; restart the agent to apply it"
+	match := ""
+	for prefix, why := range forbiddenReasons {
+		if pathWithin(path, prefix) && len(prefix) > len(match) {
+			match, reason = prefix, why
+		}
+	}
+	return ChangeForbidden, "", reason
+}
+
+func pathWithin(path, prefix string) bool {
+	return path == prefix || strings.HasPrefix(path, prefix+".")
+}
+
+// PlanReload compares the running config with a reloaded one. It returns
+// the changes, ordered by path, and the config to run from now on: next
+// with every forbidden change reverted to its running value.
+func PlanReload(running, next *AgentConfig) (*AgentConfig, []Change, error) {
+	oldTree, err := toTree(running)
+	if err != nil {
+		return nil, nil, err
+	}
+	newTree, err := toTree(next)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	oldLeaves := map[string]leaf{}
+	newLeaves := map[string]leaf{}
+	flatten(oldTree, nil, oldLeaves)
+	flatten(newTree, nil, newLeaves)
+
+	paths := map[string]bool{}
+	for path := range oldLeaves {
+		paths[path] = true
+	}
+	for path := range newLeaves {
+		paths[path] = true
+	}
+
+	var changes []Change
+	for _, path := range sortedKeys(paths) {
+		oldLeaf, newLeaf := oldLeaves[path], newLeaves[path]
+		if reflect.DeepEqual(oldLeaf.value, newLeaf.value) {
+			continue
+		}
+
+		class, dcsKey, reason := classify(path)
+		changes = append(changes, Change{
+			Path: path, Old: oldLeaf.value, New: newLeaf.value,
+			Class: class, DCSKey: dcsKey, Reason: reason,
+			Secret: running.fromSecret(path) || next.fromSecret(path),
+		})
+		if class == ChangeForbidden {
+			keys := oldLeaf.keys
+			if keys == nil {
+				keys = newLeaf.keys
+			}
+			setLeaf(newTree, keys, oldLeaf.value)
+		}
+	}
+
+	effective, err := fromTree(newTree)
+	if err != nil {
+		return nil, nil, err
+	}
+	effective.root, effective.origins, effective.secretPaths = next.root, next.origins, next.secretPaths
+	return effective, changes, nil
+}
+
+// toTree converts a config to plain maps keyed by YAML field names.
+func toTree(cfg *AgentConfig) (map[string]any, error) {
+	data, err := yaml.Marshal(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode config: %w", err)
+	}
+	tree := map[string]any{}
+	if err := yaml.Unmarshal(data, &tree); err != nil {
+		return nil, fmt.Errorf("failed to encode config: %w", err)
+	}
+	return tree, nil
+}
+
+func fromTree(tree map[string]any) (*AgentConfig, error) {
+	data, err := yaml.Marshal(tree)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode config: %w", err)
+	}
+	var cfg AgentConfig
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("failed to decode config: %w", err)
+	}
+	return &cfg, nil
+}
+
+// leaf is a value in a config tree with the keys leading to it. Keys may
+// contain dots themselves (extension settings, user names), so the dotted
+// path alone cannot be split back into them.
+type leaf struct {
+	keys  []string
+	value any
+}
+
+// flatten records every leaf of tree under its dotted path. Lists and
+// empty maps are leaves, compared as a whole.
+func flatten(tree map[string]any, prefix []string, leaves map[string]leaf) {
+	for key, value := range tree {
+		keys := append(append([]string{}, prefix...), key)
+		if child, ok := value.(map[string]any); ok && len(child) > 0 {
+			flatten(child, keys, leaves)
+		} else {
+			leaves[strings.Join(keys, ".")] = leaf{keys: keys, value: value}
+		}
+	}
+}
+
+// setLeaf sets the value under keys, deleting it for nil.
+func setLeaf(tree map[string]any, parts []string, value any) {
+	for _, part := range parts[:len(parts)-1] {
+		child, ok := tree[part].(map[string]any)
+		if !ok {
+			if value == nil {
+				return
+			}
+			child = map[string]any{}
+			tree[part] = child
+		}
+		tree = child
+	}
+
+	last := parts[len(parts)-1]
+	if value == nil {
+		delete(tree, last)
+	} else {
+		tree[last] = value
+	}
+}
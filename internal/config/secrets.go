@@ -0,0 +1,234 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/virtlabs-io/dbcp-agent/internal/secrets"
+	"gopkg.in/yaml.v3"
+)
+
+// Any string value in the config may embed references that are resolved
+// when the file is loaded, so the YAML itself can be committed:
+//
+//	${NAME}          environment variable NAME (same as ${env:NAME})
+//	${file:/path}    contents of a file, without the trailing newline
+//	${exec:command}  output of a shell command, without the trailing newline
+//	$${              a literal "${"
+//
+// Shell-style "$releasever" or "$(lsb_release -cs)" are left alone. Values
+// of the form "enc:v1:..." (see "dbcp-agent secret encrypt") are decrypted
+// with the key in secrets.key_file. Resolved values never appear in errors
+// or logs.
+var secretRefPattern = regexp.MustCompile(`\$\$\{|\$\{([^}]*)\}`)
+
+var envNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// secretExecTimeout bounds ${exec:...} commands such as vault or pass lookups.
+const secretExecTimeout = 30 * time.Second
+
+// secretResolver carries the decryption key across one config file. The key
+// is only read once the file turns out to hold an encrypted value.
+type secretResolver struct {
+	keyFile string
+	key     []byte
+	// paths holds the values that came from a reference or an encrypted
+	// value, e.g. node.patroni.extra.restapi.authentication.password.
+	paths map[string]bool
+}
+
+// resolveSecrets replaces references and encrypted values in every string
+// scalar of a parsed config file. Mapping keys are left as they are. It
+// returns the paths of the values it replaced, which are never logged.
+func resolveSecrets(root *yaml.Node) (map[string]bool, error) {
+	keyFile, err := lookupKeyFile(root)
+	if err != nil {
+		return nil, err
+	}
+	r := &secretResolver{keyFile: secrets.KeyPath(keyFile), paths: map[string]bool{}}
+	if err := r.resolve(root, ""); err != nil {
+		return nil, err
+	}
+	return r.paths, nil
+}
+
+func (r *secretResolver) resolve(node *yaml.Node, path string) error {
+	switch node.Kind {
+	case yaml.DocumentNode, yaml.SequenceNode:
+		for i, child := range node.Content {
+			childPath := path
+			if node.Kind == yaml.SequenceNode {
+				childPath = fmt.Sprintf("%s[%d]", path, i)
+			}
+			if err := r.resolve(child, childPath); err != nil {
+				return err
+			}
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			childPath := node.Content[i].Value
+			if path != "" {
+				childPath = path + "." + childPath
+			}
+			if err := r.resolve(node.Content[i+1], childPath); err != nil {
+				return err
+			}
+		}
+	case yaml.ScalarNode:
+		if node.ShortTag() != "!!str" {
+			return nil
+		}
+		value, err := resolveString(node.Value)
+		if err == nil && secrets.IsEncrypted(value) {
+			value, err = r.decrypt(value)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		if hasSecret(node.Value) {
+			r.paths[path] = true
+		}
+		node.Value = value
+	}
+	return nil
+}
+
+// hasSecret reports whether a raw value holds a reference or is encrypted;
+// a "$${" escape alone is not a secret.
+func hasSecret(s string) bool {
+	if secrets.IsEncrypted(s) {
+		return true
+	}
+	for _, match := range secretRefPattern.FindAllString(s, -1) {
+		if match != "$${" {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *secretResolver) decrypt(value string) (string, error) {
+	if r.key == nil {
+		key, err := secrets.LoadKey(r.keyFile)
+		if err != nil {
+			return "", fmt.Errorf("cannot decrypt value: %w", err)
+		}
+		r.key = key
+	}
+	return secrets.Decrypt(r.key, value)
+}
+
+// lookupKeyFile returns secrets.key_file from a parsed config file, with its
+// references resolved, before the rest of the file is.
+func lookupKeyFile(root *yaml.Node) (string, error) {
+	node := root
+	for _, key := range []string{"secrets", "key_file"} {
+		if node.Kind == yaml.DocumentNode && len(node.Content) > 0 {
+			node = node.Content[0]
+		}
+		if node.Kind != yaml.MappingNode {
+			return "", nil
+		}
+		var next *yaml.Node
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if node.Content[i].Value == key {
+				next = node.Content[i+1]
+			}
+		}
+		if next == nil {
+			return "", nil
+		}
+		node = next
+	}
+
+	keyFile, err := resolveString(node.Value)
+	if err != nil {
+		return "", fmt.Errorf("secrets.key_file: %w", err)
+	}
+	return keyFile, nil
+}
+
+// SecretsKeyFile returns the key file used for the config at path, without
+// resolving anything else in it, so the key can be managed before every
+// referenced secret is available.
+func SecretsKeyFile(path string) (string, error) {
+	tree, err := loadTree(path)
+	if err != nil {
+		return "", err
+	}
+
+	keyFile, err := lookupKeyFile(tree.root)
+	if err != nil {
+		return "", err
+	}
+	return secrets.KeyPath(keyFile), nil
+}
+
+// resolveString expands every reference in s.
+func resolveString(s string) (string, error) {
+	if !strings.Contains(s, "${") {
+		return s, nil
+	}
+
+	var firstErr error
+	resolved := secretRefPattern.ReplaceAllStringFunc(s, func(match string) string {
+		if match == "$${" {
+			return "${"
+		}
+		value, err := resolveRef(match[2 : len(match)-1])
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		return value
+	})
+	if firstErr != nil {
+		return "", firstErr
+	}
+	return resolved, nil
+}
+
+func resolveRef(ref string) (string, error) {
+	kind, arg, found := strings.Cut(ref, ":")
+	if !found {
+		kind, arg = "env", ref
+	}
+
+	switch kind {
+	case "env":
+		if !envNamePattern.MatchString(arg) {
+			return "", fmt.Errorf("invalid environment variable name in ${%s}", ref)
+		}
+		value, ok := os.LookupEnv(arg)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", arg)
+		}
+		return value, nil
+
+	case "file":
+		data, err := os.ReadFile(arg)
+		if err != nil {
+			return "", fmt.Errorf("failed to read secret file: %w", err)
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+
+	case "exec":
+		ctx, cancel := context.WithTimeout(context.Background(), secretExecTimeout)
+		defer cancel()
+
+		// Only stdout is the secret; stderr and the output are kept out of
+		// the error so nothing sensitive ends up in a log line.
+		output, err := exec.CommandContext(ctx, "sh", "-c", arg).Output()
+		if err != nil {
+			return "", fmt.Errorf("secret command %q failed: %v", arg, err)
+		}
+		return strings.TrimRight(string(output), "\r\n"), nil
+
+	default:
+		return "", fmt.Errorf("unknown reference type %q in ${%s}", kind, ref)
+	}
+}
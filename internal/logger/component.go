@@ -0,0 +1,154 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"strings"
+	"sync"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// maxLineLength caps how much of an unterminated line is buffered before it
+// is logged anyway.
+const maxLineLength = 64 * 1024
+
+// rotation keeps the rotation settings passed to Init for component sinks.
+var rotation Options
+
+// componentWriter turns a child process's output into log entries.
+type componentWriter struct {
+	mu        sync.Mutex
+	component string
+	buf       []byte
+	sink      io.WriteCloser
+}
+
+// NewComponentWriter returns a writer for the stdout/stderr of a managed
+// process. Every line is logged with a "[component]" prefix at the level
+// parsed from the line. When filePath is set the raw output is also kept
+// there, rotated with the agent's log_max_* settings.
+func NewComponentWriter(component, filePath string) io.WriteCloser {
+	w := &componentWriter{component: component}
+	if filePath != "" {
+		w.sink = &lumberjack.Logger{
+			Filename:   filePath,
+			MaxSize:    rotation.MaxSizeMB,
+			MaxBackups: rotation.MaxBackups,
+			MaxAge:     rotation.MaxAgeDays,
+			Compress:   true,
+		}
+	}
+	return w
+}
+
+func (w *componentWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.sink != nil {
+		if _, err := w.sink.Write(p); err != nil {
+			Warn("[%s] failed to write log file: %v", w.component, err)
+		}
+	}
+
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.logLine(string(w.buf[:i]))
+		w.buf = w.buf[i+1:]
+	}
+	if len(w.buf) > maxLineLength {
+		w.logLine(string(w.buf))
+		w.buf = nil
+	}
+	return len(p), nil
+}
+
+// Close logs any unterminated last line and closes the file sink.
+func (w *componentWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if len(w.buf) > 0 {
+		w.logLine(string(w.buf))
+		w.buf = nil
+	}
+	if w.sink != nil {
+		return w.sink.Close()
+	}
+	return nil
+}
+
+func (w *componentWriter) logLine(line string) {
+	line = strings.TrimRight(line, "\r")
+	if strings.TrimSpace(line) == "" {
+		return
+	}
+
+	switch ParseLevel(line) {
+	case ErrorLevel:
+		Error("[%s] %s", w.component, line)
+	case WarnLevel:
+		Warn("[%s] %s", w.component, line)
+	case DebugLevel:
+		Debug("[%s] %s", w.component, line)
+	default:
+		Info("[%s] %s", w.component, line)
+	}
+}
+
+// ParseLevel guesses the level of a line written by a managed process:
+// etcd logs JSON with a "level" field, Patroni and PostgreSQL prefix their
+// messages with "INFO:", "WARNING:", "ERROR:" and the like. Lines without a
+// recognisable level are treated as info.
+func ParseLevel(line string) LogLevel {
+	if strings.HasPrefix(line, "{") {
+		var entry struct {
+			Level string `json:"level"`
+		}
+		if json.Unmarshal([]byte(line), &entry) == nil && entry.Level != "" {
+			return levelFromName(entry.Level)
+		}
+	}
+
+	// Only look at the prefix, and only at upper-case words, so messages
+	// that merely mention "error" keep their level.
+	fields := strings.Fields(line)
+	if len(fields) > levelFieldLimit {
+		fields = fields[:levelFieldLimit]
+	}
+	for _, field := range fields {
+		if level, ok := levelNames[strings.TrimRight(field, ":")]; ok {
+			return level
+		}
+	}
+	return InfoLevel
+}
+
+// levelFieldLimit covers PostgreSQL's "2024-01-02 10:00:00.000 UTC [42] LOG:".
+const levelFieldLimit = 6
+
+var levelNames = map[string]LogLevel{
+	"PANIC":    ErrorLevel,
+	"DPANIC":   ErrorLevel,
+	"FATAL":    ErrorLevel,
+	"CRITICAL": ErrorLevel,
+	"ERROR":    ErrorLevel,
+	"WARNING":  WarnLevel,
+	"WARN":     WarnLevel,
+	"INFO":     InfoLevel,
+	"LOG":      InfoLevel,
+	"DEBUG":    DebugLevel,
+}
+
+func levelFromName(name string) LogLevel {
+	if level, ok := levelNames[strings.ToUpper(name)]; ok {
+		return level
+	}
+	return InfoLevel
+}
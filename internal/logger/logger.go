@@ -38,6 +38,7 @@ type Options struct {
 
 func Init(opts Options) {
 	SetLevel(opts.Level)
+	rotation = opts
 
 	var output io.Writer = os.Stdout
 
@@ -3,6 +3,7 @@ package logger
 import (
 	"bytes"
 	"log"
+	"os"
 	"strings"
 	"testing"
 )
@@ -65,3 +66,101 @@ func TestLogLevelFiltering(t *testing.T) {
 func newTestLogger(w *bytes.Buffer, prefix string) *log.Logger {
 	return log.New(w, prefix, 0)
 }
+
+func TestParseLevel(t *testing.T) {
+	cases := []struct {
+		line     string
+		expected LogLevel
+	}{
+		{`{"level":"warn","ts":"2024-05-01T10:00:00Z","msg":"slow fdatasync"}`, WarnLevel},
+		{`{"level":"info","msg":"serving client traffic"}`, InfoLevel},
+		{"2024-05-01 10:00:00,123 INFO: no action. I am (node1), the leader with the lock", InfoLevel},
+		{"2024-05-01 10:00:00,123 ERROR: failed to update leader lock", ErrorLevel},
+		{"2024-05-01 10:00:00.000 UTC [42] WARNING:  archive_mode enabled", WarnLevel},
+		{"2024-05-01 10:00:00.000 UTC [42] FATAL:  password authentication failed", ErrorLevel},
+		{"server started, no error so far", InfoLevel},
+	}
+
+	for _, c := range cases {
+		if got := ParseLevel(c.line); got != c.expected {
+			t.Errorf("ParseLevel(%q) = %v; want %v", c.line, got, c.expected)
+		}
+	}
+}
+
+func TestComponentWriter(t *testing.T) {
+	var buf bytes.Buffer
+	Init(Options{Level: "debug"})
+	errorLogger = newTestLogger(&buf, "[ERROR] ")
+	warnLogger = newTestLogger(&buf, "[WARN]  ")
+	infoLogger = newTestLogger(&buf, "[INFO]  ")
+	debugLogger = newTestLogger(&buf, "[DEBUG] ")
+
+	path := t.TempDir() + "/patroni.log"
+	w := NewComponentWriter("patroni", path)
+
+	// Lines may arrive split across writes
+	w.Write([]byte("2024-05-01 10:00:00,123 INFO: starting\n2024-05-01 10:00:01,000 ERR"))
+	w.Write([]byte("OR: lost the lock\npartial"))
+	w.Close()
+
+	want := "[INFO]  [patroni] 2024-05-01 10:00:00,123 INFO: starting\n" +
+		"[ERROR] [patroni] 2024-05-01 10:00:01,000 ERROR: lost the lock\n" +
+		"[INFO]  [patroni] partial\n"
+	if got := buf.String(); got != want {
+		t.Errorf("unexpected log output:\n%s\nwant:\n%s", got, want)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("expected a component log file: %v", err)
+	}
+	if !strings.HasSuffix(string(data), "lost the lock\npartial") {
+		t.Errorf("expected raw output in the component log, got %q", data)
+	}
+}
+
+func TestTailComponent(t *testing.T) {
+	var buf bytes.Buffer
+	Init(Options{Level: "debug", MaxSizeMB: 1, MaxBackups: 2})
+	errorLogger = newTestLogger(&buf, "[ERROR] ")
+	warnLogger = newTestLogger(&buf, "[WARN]  ")
+	infoLogger = newTestLogger(&buf, "[INFO]  ")
+	debugLogger = newTestLogger(&buf, "[DEBUG] ")
+
+	path := t.TempDir() + "/etcd.log"
+	file, err := OpenComponentLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	file.WriteString("written before the tail started\n")
+	info, _ := file.Stat()
+
+	tail := TailComponent("etcd", path, info.Size())
+	file.WriteString(`{"level":"warn","msg":"slow fdatasync"}` + "\n")
+	// Past log_max_size_mb the file is copied aside and emptied
+	file.WriteString(strings.Repeat("x", 1024*1024) + "\nlast")
+	tail.Close()
+
+	got := buf.String()
+	if strings.Contains(got, "before the tail") {
+		t.Error("expected output before the offset to be skipped")
+	}
+	if !strings.Contains(got, `[WARN]  [etcd] {"level":"warn","msg":"slow fdatasync"}`) || !strings.HasSuffix(got, "[INFO]  [etcd] last\n") {
+		t.Errorf("unexpected log output: %.200q", got)
+	}
+
+	rotated, err := os.ReadFile(path + ".1")
+	if err != nil || !strings.HasPrefix(string(rotated), "written before") {
+		t.Errorf("expected the output to be rotated to %s.1: %v", path, err)
+	}
+	if current, _ := os.ReadFile(path); len(current) != 0 {
+		t.Errorf("expected the rotated file to be truncated, got %d bytes", len(current))
+	}
+	// The writer appends to the emptied file
+	file.WriteString("after rotation\n")
+	if current, _ := os.ReadFile(path); string(current) != "after rotation\n" {
+		t.Errorf("expected appends to continue at the start, got %q", current)
+	}
+}
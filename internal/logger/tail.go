@@ -0,0 +1,154 @@
+package logger
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// tailInterval is how often a followed log file is checked for new output.
+var tailInterval = 250 * time.Millisecond
+
+// defaultMaxSizeMB applies when log_max_size_mb is not set, as in lumberjack.
+const defaultMaxSizeMB = 100
+
+// OpenComponentLog opens the log file a managed process writes its
+// stdout/stderr to. The process gets the descriptor itself, so its output
+// does not depend on the agent staying up to read it.
+func OpenComponentLog(path string) (*os.File, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create log directory: %w", err)
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open log file: %w", err)
+	}
+	return file, nil
+}
+
+// Tail follows a component log file and logs every line appended to it.
+type Tail struct {
+	component string
+	path      string
+	lines     *componentWriter
+	offset    int64
+
+	stop chan struct{}
+	done chan struct{}
+	once sync.Once
+}
+
+// TailComponent logs every line written to path from offset on with a
+// "[component]" prefix, like NewComponentWriter. A restarted agent attaches
+// a new tail to the file a still running process writes to. As that
+// process's descriptor cannot be moved to a new file, rotation copies the
+// file to path.1 (shifting older copies up to log_max_backups) and
+// truncates it.
+func TailComponent(component, path string, offset int64) *Tail {
+	t := &Tail{
+		component: component,
+		path:      path,
+		lines:     &componentWriter{component: component},
+		offset:    offset,
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	go t.run()
+	return t
+}
+
+// Close reads what is left in the file, logs any unterminated last line
+// and stops following the file.
+func (t *Tail) Close() error {
+	t.once.Do(func() { close(t.stop) })
+	<-t.done
+	return nil
+}
+
+func (t *Tail) run() {
+	defer close(t.done)
+	ticker := time.NewTicker(tailInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-t.stop:
+			t.read()
+			t.lines.Close()
+			return
+		case <-ticker.C:
+			t.read()
+		}
+	}
+}
+
+// read logs what was appended since the last read and rotates the file
+// once it has grown past log_max_size_mb.
+func (t *Tail) read() {
+	file, err := os.Open(t.path)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return
+	}
+	if info.Size() < t.offset {
+		// Truncated by someone else; start over
+		t.offset = 0
+	}
+	if _, err := file.Seek(t.offset, io.SeekStart); err != nil {
+		return
+	}
+	n, _ := io.Copy(t.lines, file)
+	t.offset += n
+
+	maxSize := rotation.MaxSizeMB
+	if maxSize <= 0 {
+		maxSize = defaultMaxSizeMB
+	}
+	if t.offset >= int64(maxSize)*1024*1024 {
+		if err := t.rotate(); err != nil {
+			Warn("[%s] failed to rotate %s: %v", t.component, t.path, err)
+		}
+	}
+}
+
+func (t *Tail) rotate() error {
+	backups := rotation.MaxBackups
+	if backups <= 0 {
+		backups = 1
+	}
+	for i := backups - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", t.path, i), fmt.Sprintf("%s.%d", t.path, i+1))
+	}
+
+	src, err := os.Open(t.path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(t.path+".1", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+
+	// The writer appends, so it carries on at the start of the emptied file
+	if err := os.Truncate(t.path, 0); err != nil {
+		return err
+	}
+	t.offset = 0
+	return nil
+}
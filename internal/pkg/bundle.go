@@ -0,0 +1,199 @@
+package pkg
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/virtlabs-io/dbcp-agent/internal/config"
+	"github.com/virtlabs-io/dbcp-agent/internal/logger"
+	"github.com/virtlabs-io/dbcp-agent/internal/system"
+	"gopkg.in/yaml.v3"
+)
+
+// An artifact bundle mirrors the upstream release layouts so the regular
+// installers can read from it:
+//
+//	manifest.yaml
+//	postgresql/          .deb or .rpm packages with all their dependencies
+//	etcd/v<version>/     etcd release archive and its SHA256SUMS
+//	patroni/             Python wheels for Patroni and its dependencies
+const bundleManifestFile = "manifest.yaml"
+
+// BundleManifest records what a bundle contains and which nodes it fits.
+type BundleManifest struct {
+	Family     string    `yaml:"family"`
+	Arch       string    `yaml:"arch"`
+	PostgreSQL string    `yaml:"postgresql"`
+	ETCD       string    `yaml:"etcd"`
+	Patroni    string    `yaml:"patroni"`
+	CreatedAt  time.Time `yaml:"created_at"`
+}
+
+func isTarball(path string) bool {
+	return strings.HasSuffix(path, ".tar.gz") || strings.HasSuffix(path, ".tgz")
+}
+
+// resolveBundle returns the bundle directory for path, extracting tarballs
+// under tmp_path first, and checks that the bundle was built for this node.
+func resolveBundle(cfg *config.AgentConfig, osInfo *system.OSInfo, path string) (string, error) {
+	dir := path
+	if isTarball(path) {
+		dir = filepath.Join(cfg.Node.TmpPath, "bundle")
+		if _, err := executor.Stat(filepath.Join(dir, bundleManifestFile)); err != nil {
+			logger.Info("Extracting bundle %s to %s", path, dir)
+			if err := executor.Extract(path, dir); err != nil {
+				return "", fmt.Errorf("failed to extract bundle %s: %w", path, err)
+			}
+		}
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, bundleManifestFile))
+	if os.IsNotExist(err) {
+		logger.Warn("Bundle %s has no readable manifest, skipping compatibility check", path)
+		return dir, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read bundle manifest: %w", err)
+	}
+
+	var manifest BundleManifest
+	if err := yaml.Unmarshal(data, &manifest); err != nil {
+		return "", fmt.Errorf("failed to parse bundle manifest: %w", err)
+	}
+	if manifest.Arch != osInfo.Arch {
+		return "", fmt.Errorf("bundle %s was built for %s, this node is %s", path, manifest.Arch, osInfo.Arch)
+	}
+	if manifest.Family != osInfo.Family {
+		return "", fmt.Errorf("bundle %s was built for %s, this node is %s", path, manifest.Family, osInfo.Family)
+	}
+
+	return dir, nil
+}
+
+// BuildBundle downloads everything needed to install cfg's components and
+// writes it as a bundle to out (a directory, or a .tar.gz file). It has to run
+// on a connected machine of the same OS family and architecture as the
+// target nodes, with the PostgreSQL repository already configured.
+func BuildBundle(cfg *config.AgentConfig, osInfo *system.OSInfo, out string) error {
+	staging := out
+	if isTarball(out) {
+		staging = filepath.Join(os.TempDir(), fmt.Sprintf("dbcp-bundle-%d", time.Now().Unix()))
+		defer executor.Remove(staging)
+	}
+
+	logger.Info("Building %s/%s bundle in %s", osInfo.Family, osInfo.Arch, staging)
+
+	if err := bundleETCD(cfg, osInfo, staging); err != nil {
+		return err
+	}
+
+	if err := bundlePostgreSQL(cfg, osInfo, staging); err != nil {
+		return err
+	}
+
+	if err := bundlePatroni(cfg, staging); err != nil {
+		return err
+	}
+
+	manifest, err := yaml.Marshal(BundleManifest{
+		Family:     osInfo.Family,
+		Arch:       osInfo.Arch,
+		PostgreSQL: cfg.Node.PostgreSQL.Version,
+		ETCD:       cfg.Node.ETCD.Version,
+		Patroni:    cfg.Node.Patroni.Version,
+		CreatedAt:  time.Now().UTC(),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode bundle manifest: %w", err)
+	}
+	if err := executor.WriteFile(filepath.Join(staging, bundleManifestFile), manifest, 0644); err != nil {
+		return fmt.Errorf("failed to write bundle manifest: %w", err)
+	}
+
+	if isTarball(out) {
+		if output, err := executor.Run("tar", "-czf", out, "-C", staging, "."); err != nil {
+			logger.Error("tar failed: %s", string(output))
+			return fmt.Errorf("failed to create %s: %w", out, err)
+		}
+	}
+
+	logger.Info("Bundle written to %s", out)
+	return nil
+}
+
+// bundleETCD stores the verified release archive next to a SHA256SUMS file
+// listing only that archive, so offline installs verify it the same way.
+func bundleETCD(cfg *config.AgentConfig, osInfo *system.OSInfo, staging string) error {
+	if _, ok := cfg.Repositories.ETCD.BundlePath(); ok {
+		return fmt.Errorf("repositories.etcd.default must point at a download source to build a bundle")
+	}
+
+	_, archiveName := etcdReleaseNames(cfg, osInfo)
+	releaseURL := etcdReleaseURL(cfg, cfg.Repositories.ETCD.Selected().URL)
+	releaseDir := filepath.Join(staging, "etcd", "v"+cfg.Node.ETCD.Version)
+	archivePath := filepath.Join(releaseDir, archiveName)
+
+	if err := executor.MkdirAll(releaseDir, 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %w", releaseDir, err)
+	}
+
+	logger.Info("Downloading ETCD %s for the bundle", archiveName)
+	if err := executor.Download(archivePath, releaseURL+"/"+archiveName); err != nil {
+		return fmt.Errorf("failed to download etcd: %w", err)
+	}
+
+	checksum, err := etcdArchiveChecksum(cfg, releaseURL, archiveName)
+	if err == nil {
+		err = executor.VerifySHA256(archivePath, checksum)
+	}
+	if err != nil {
+		return fmt.Errorf("etcd archive verification failed: %w", err)
+	}
+
+	sums := fmt.Sprintf("%s  %s\n", checksum, archiveName)
+	if err := executor.WriteFile(filepath.Join(releaseDir, "SHA256SUMS"), []byte(sums), 0644); err != nil {
+		return fmt.Errorf("failed to write SHA256SUMS: %w", err)
+	}
+	return nil
+}
+
+func bundlePostgreSQL(cfg *config.AgentConfig, osInfo *system.OSInfo, staging string) error {
+	version := cfg.Node.PostgreSQL.Version
+	dir := filepath.Join(staging, "postgresql")
+	if err := executor.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %w", dir, err)
+	}
+
+	logger.Info("Downloading PostgreSQL %s packages and dependencies", version)
+
+	var cmd string
+	switch osInfo.Family {
+	case "debian":
+		cmd = fmt.Sprintf(`cd %s && apt-get download $(apt-cache depends --recurse --no-recommends --no-suggests --no-conflicts --no-breaks --no-replaces --no-enhances postgresql-%s | grep "^\w" | sort -u)`, dir, version)
+	case "rhel", "fedora":
+		cmd = fmt.Sprintf("dnf download --resolve --alldeps --arch %s --arch noarch --destdir %s postgresql%s-server postgresql%s", osInfo.RPMArch(), dir, version, version)
+	default:
+		return fmt.Errorf("unsupported OS family for bundles: %s", osInfo.Family)
+	}
+
+	return runCommand(cmd)
+}
+
+func bundlePatroni(cfg *config.AgentConfig, staging string) error {
+	dir := filepath.Join(staging, "patroni")
+	if err := executor.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %w", dir, err)
+	}
+
+	spec := patroniPipSpec(config.RepoSource{}, cfg.Node.Patroni.Version)
+
+	logger.Info("Downloading %s wheels", spec)
+	if output, err := executor.Run("python3", "-m", "pip", "download", "--dest", dir, spec); err != nil {
+		logger.Error("pip download failed: %s", string(output))
+		return fmt.Errorf("failed to download Patroni wheels: %w", err)
+	}
+	return nil
+}
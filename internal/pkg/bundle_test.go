@@ -0,0 +1,150 @@
+package pkg
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/virtlabs-io/dbcp-agent/internal/config"
+	"github.com/virtlabs-io/dbcp-agent/internal/system"
+)
+
+// writeBundle lays out a bundle directory containing only an etcd release.
+func writeBundle(t *testing.T, version, arch string) string {
+	t.Helper()
+
+	srv, digest := newETCDReleaseServer(t, version, arch)
+	dir := t.TempDir()
+	releaseDir := filepath.Join(dir, "etcd", "v"+version)
+	if err := os.MkdirAll(releaseDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	archiveName := fmt.Sprintf("etcd-v%s-linux-%s.tar.gz", version, arch)
+	if err := downloadFile(filepath.Join(releaseDir, archiveName), srv.URL+"/v"+version+"/"+archiveName); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(releaseDir, "SHA256SUMS"), []byte(digest+"  "+archiveName+"\n"), 0644)
+	os.WriteFile(filepath.Join(dir, bundleManifestFile), []byte("family: debian\narch: "+arch+"\n"), 0644)
+	return dir
+}
+
+func bundleConfig(path string) *config.AgentConfig {
+	bundle := map[string]config.RepoSource{"bundle": {Type: config.BundleSourceType, Path: path}}
+	return &config.AgentConfig{
+		Node: config.NodeConfig{TmpPath: "/dbcp/tmp", PostgreSQL: config.PostgreSQLConfig{Version: "16"}},
+		Repositories: config.Repositories{
+			PostgreSQL: config.RepoEntry{Default: "bundle", Sources: bundle},
+			ETCD:       config.RepoEntry{Default: "bundle", Sources: bundle},
+			Patroni:    config.RepoEntry{Default: "bundle", Sources: bundle},
+		},
+	}
+}
+
+func TestInstallETCDFromBundle(t *testing.T) {
+	dir := writeBundle(t, "3.5.12", "amd64")
+	cfg := bundleConfig(dir)
+	cfg.Node.ETCD = config.EtcdConfig{Version: "3.5.12", BinPath: t.TempDir()}
+	osInfo := &system.OSInfo{Family: "debian", Arch: "amd64"}
+
+	repoURL, err := ETCDRepoURL(cfg, osInfo)
+	if err != nil {
+		t.Fatalf("ETCDRepoURL failed: %v", err)
+	}
+	if !strings.HasPrefix(repoURL, "file://") {
+		t.Fatalf("expected a file:// repo URL, got %s", repoURL)
+	}
+
+	if err := InstallETCD(cfg, osInfo, repoURL); err != nil {
+		t.Fatalf("failed to install ETCD from bundle: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(cfg.Node.ETCD.BinPath, "etcd")); err != nil {
+		t.Errorf("expected etcd binary to be installed: %v", err)
+	}
+}
+
+func TestBundleArchMismatch(t *testing.T) {
+	dir := writeBundle(t, "3.5.13", "arm64")
+	cfg := bundleConfig(dir)
+
+	if _, err := ETCDRepoURL(cfg, &system.OSInfo{Family: "debian", Arch: "amd64"}); err == nil {
+		t.Fatal("expected an arm64 bundle to be rejected on amd64")
+	}
+}
+
+func TestInstallFromBundleSequence(t *testing.T) {
+	rec := NewRecorder()
+	defer SetExecutor(SetExecutor(rec))
+
+	cfg := bundleConfig("/srv/dbcp-bundle.tar.gz")
+	osInfo := &system.OSInfo{ID: "debian", Family: "debian", Arch: "amd64"}
+
+	if err := InstallPostgreSQL(cfg, osInfo); err != nil {
+		t.Fatalf("InstallPostgreSQL failed: %v", err)
+	}
+	if err := InstallPatroni(cfg, osInfo); err != nil {
+		t.Fatalf("InstallPatroni failed: %v", err)
+	}
+
+	ops := rec.Operations()
+	if ops[0].Kind != "extract" || ops[0].Target != "/srv/dbcp-bundle.tar.gz" {
+		t.Errorf("expected the bundle to be extracted first, got %v", ops[0])
+	}
+
+	cmds := strings.Join(rec.Commands(), "\n")
+	for _, want := range []string{
+		"apt-get install -y --no-download /dbcp/tmp/bundle/postgresql/*.deb",
+		"/opt/dbcp/patroni/bin/python -m pip install --no-index --find-links /dbcp/tmp/bundle/patroni patroni[etcd3,psycopg3]",
+	} {
+		if !strings.Contains(cmds, want) {
+			t.Errorf("expected %q in:\n%s", want, cmds)
+		}
+	}
+	for _, op := range ops[1:] {
+		if op.Kind == "extract" || strings.Contains(op.Target, "curl") || strings.Contains(op.Target, "apt-get update") {
+			t.Errorf("unexpected operation for an air-gapped install: %v", op)
+		}
+	}
+}
+
+func TestBuildBundlePlan(t *testing.T) {
+	rec := NewRecorder()
+	defer SetExecutor(SetExecutor(rec))
+
+	cfg := &config.AgentConfig{
+		Node: config.NodeConfig{
+			PostgreSQL: config.PostgreSQLConfig{Version: "16"},
+			ETCD:       config.EtcdConfig{Version: "3.5.20", Checksum: strings.Repeat("ab", 32)},
+			Patroni:    config.PatroniConfig{Version: "4.0.4"},
+		},
+		Repositories: config.Repositories{
+			ETCD: config.RepoEntry{
+				Default: "official",
+				Sources: map[string]config.RepoSource{"official": {URL: "https://storage.googleapis.com/etcd"}},
+			},
+		},
+	}
+
+	if err := BuildBundle(cfg, &system.OSInfo{Family: "rhel", Arch: "arm64"}, "/srv/out.tar.gz"); err != nil {
+		t.Fatalf("BuildBundle failed: %v", err)
+	}
+
+	plan := ""
+	for _, op := range rec.Operations() {
+		plan += op.String() + "\n"
+	}
+	for _, want := range []string{
+		"https://storage.googleapis.com/etcd/v3.5.20/etcd-v3.5.20-linux-arm64.tar.gz",
+		"dnf download --resolve --alldeps --arch aarch64",
+		"pip download --dest",
+		"patroni[etcd3,psycopg3]==4.0.4",
+		bundleManifestFile,
+		"tar -czf /srv/out.tar.gz",
+	} {
+		if !strings.Contains(plan, want) {
+			t.Errorf("expected %q in plan:\n%s", want, plan)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package pkg
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/virtlabs-io/dbcp-agent/internal/config"
+	"github.com/virtlabs-io/dbcp-agent/internal/logger"
+	"github.com/virtlabs-io/dbcp-agent/internal/pki"
+)
+
+// Renewals pass through etcd under /dbcp-agent/<cluster>/pki. A member
+// whose certificates are due puts a certificate request under
+// requests/<node> and keeps the new key to itself; the CA node signs it and
+// puts the certificate under issued/<node>; the member installs it when it
+// holds the rolling key, so members restart one at a time.
+
+func renewalPrefix(cfg *config.AgentConfig) string {
+	return "/dbcp-agent/" + cfg.Cluster.Name + "/pki/"
+}
+
+// RollingKey is the etcd key a member holds while it swaps certificates.
+func RollingKey(cfg *config.AgentConfig) string {
+	return renewalPrefix(cfg) + "rolling"
+}
+
+func renewalKey(cfg *config.AgentConfig, kind, node string) string {
+	return renewalPrefix(cfg) + kind + "/" + node
+}
+
+// pendingKeyPath is where a member keeps the key of its open request.
+func pendingKeyPath(cfg *config.AgentConfig) string {
+	return filepath.Join(cfg.PKI.Dir, pki.NodeKeyFile+".next")
+}
+
+// RequestRenewal asks the CA node for a new certificate for this node,
+// unless a request or a signed certificate is already waiting.
+func RequestRenewal(cfg *config.AgentConfig, kv KV) error {
+	for _, kind := range []string{"requests", "issued"} {
+		value, err := kv.Get(renewalKey(cfg, kind, cfg.Node.Name))
+		if err != nil {
+			return err
+		}
+		if value != nil {
+			return nil
+		}
+	}
+
+	keyPEM, csrPEM, err := pki.NewRequest(cfg.Node.Name)
+	if err != nil {
+		return err
+	}
+	if err := MkdirAllAsUser(cfg.PKI.Dir, cfg.Node.User, 0750); err != nil {
+		return err
+	}
+	if err := writePKIFile(pendingKeyPath(cfg), keyPEM, 0600, cfg.Node.User); err != nil {
+		return err
+	}
+	if err := kv.Put(renewalKey(cfg, "requests", cfg.Node.Name), csrPEM); err != nil {
+		return err
+	}
+	logger.Info("Requested a renewed certificate for %s from %s", cfg.Node.Name, cfg.PKI.CANode)
+	return nil
+}
+
+// SignRenewals signs the waiting requests of every node in cluster.nodes
+// with the local CA; only the CA node calls it. The names in a certificate
+// come from cluster.nodes, never from the request.
+func SignRenewals(cfg *config.AgentConfig, kv KV) error {
+	requests, err := kv.List(renewalPrefix(cfg) + "requests/")
+	if err != nil {
+		return err
+	}
+	if len(requests) == 0 {
+		return nil
+	}
+	ca, err := loadCA(cfg)
+	if err != nil {
+		return err
+	}
+
+	keys := make([]string, 0, len(requests))
+	for key := range requests {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		name := path.Base(key)
+		node, ok := ClusterNodeByName(cfg, name)
+		if !ok {
+			logger.Warn("Ignoring certificate request from %s, which is not in cluster.nodes", name)
+			continue
+		}
+		certPEM, err := ca.Sign(requests[key], node.Name, node.Host, days(cfg.PKI.ValidDays))
+		if err != nil {
+			logger.Error("Cannot sign certificate request from %s: %v", name, err)
+			continue
+		}
+		if err := kv.Put(renewalKey(cfg, "issued", name), certPEM); err != nil {
+			return err
+		}
+		if err := kv.Delete(key); err != nil {
+			return err
+		}
+		logger.Info("Signed a renewed certificate for %s", name)
+	}
+	return nil
+}
+
+// IssuedRenewal returns the certificate the CA node signed for this node,
+// or nil while there is none.
+func IssuedRenewal(cfg *config.AgentConfig, kv KV) ([]byte, error) {
+	return kv.Get(renewalKey(cfg, "issued", cfg.Node.Name))
+}
+
+// InstallRenewal writes the signed certificate and the key kept by
+// RequestRenewal to every pair, and closes the request. A certificate that
+// does not match the kept key is dropped, so the next check asks again.
+func InstallRenewal(cfg *config.AgentConfig, kv KV, certPEM []byte, pairs []CertPair) error {
+	issued := renewalKey(cfg, "issued", cfg.Node.Name)
+	keyPEM, err := os.ReadFile(pendingKeyPath(cfg))
+	if err == nil {
+		_, err = tls.X509KeyPair(certPEM, keyPEM)
+	}
+	if err != nil {
+		if delErr := kv.Delete(issued); delErr != nil {
+			return delErr
+		}
+		return fmt.Errorf("signed certificate does not match the requested key, requesting again: %w", err)
+	}
+	cert, err := pki.ParseCertificate(certPEM)
+	if err != nil {
+		return err
+	}
+
+	written := map[string]bool{}
+	for _, pair := range pairs {
+		if written[pair.CertFile] {
+			continue
+		}
+		// The key goes first: until the certificate follows, the old one is
+		// what gets loaded, and a restart in between would fail either way.
+		if pair.KeyFile != pair.CertFile {
+			if err := writePKIFile(pair.KeyFile, keyPEM, 0600, cfg.Node.User); err != nil {
+				return err
+			}
+			if err := writePKIFile(pair.CertFile, certPEM, 0644, cfg.Node.User); err != nil {
+				return err
+			}
+		} else {
+			combined := append(append([]byte{}, certPEM...), keyPEM...)
+			if err := writePKIFile(pair.CertFile, combined, 0600, cfg.Node.User); err != nil {
+				return err
+			}
+		}
+		written[pair.CertFile] = true
+		logger.Info("Renewed %s certificate %s, valid until %s", pair.Service, pair.CertFile, cert.NotAfter.Format(time.DateOnly))
+	}
+
+	if err := executor.Remove(pendingKeyPath(cfg)); err != nil && !os.IsNotExist(err) {
+		logger.Warn("Failed to remove %s: %v", pendingKeyPath(cfg), err)
+	}
+	return kv.Delete(issued)
+}
@@ -0,0 +1,208 @@
+package pkg
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/virtlabs-io/dbcp-agent/internal/config"
+	"github.com/virtlabs-io/dbcp-agent/internal/logger"
+	"github.com/virtlabs-io/dbcp-agent/internal/pki"
+)
+
+// Services a certificate can be configured for.
+const (
+	CertServiceETCD       = "etcd"
+	CertServicePatroni    = "patroni"
+	CertServicePostgreSQL = "postgresql"
+	CertServiceCA         = "ca" // the cluster CA itself, see InspectCA
+)
+
+// CertPair is a certificate and key configured for a service.
+type CertPair struct {
+	Service  string
+	CertFile string
+	KeyFile  string
+	CAFile   string // optional; the chain is checked against it when set
+}
+
+// CertStatus is what InspectCertificate found.
+type CertStatus struct {
+	CertPair
+	Cert *x509.Certificate // nil when the file could not be read
+	Err  error             // unreadable, key mismatch or not signed by CAFile
+}
+
+// ConfiguredCertificates lists the certificates the node's services use:
+// etcd's, the Patroni REST API's (patroni.restapi, or restapi in
+// patroni.extra) and PostgreSQL's (ssl_cert_file, relative to data_dir,
+// when ssl is on).
+func ConfiguredCertificates(cfg *config.AgentConfig) []CertPair {
+	var pairs []CertPair
+
+	etcd := cfg.Node.ETCD
+	if etcd.TLSEnabled() {
+		pairs = append(pairs, CertPair{Service: CertServiceETCD, CertFile: etcd.CertFile, KeyFile: etcd.KeyFile, CAFile: etcd.CAFile})
+	}
+
+	if api := cfg.Node.Patroni.RestAPI; api.TLSEnabled() {
+		keyFile := api.KeyFile
+		if keyFile == "" {
+			keyFile = api.CertFile
+		}
+		pairs = append(pairs, CertPair{Service: CertServicePatroni, CertFile: api.CertFile, KeyFile: keyFile, CAFile: api.CAFile})
+	} else if restapi, ok := cfg.Node.Patroni.Extra["restapi"].(map[string]any); ok {
+		certFile, _ := restapi["certfile"].(string)
+		keyFile, _ := restapi["keyfile"].(string)
+		caFile, _ := restapi["cafile"].(string)
+		if certFile != "" {
+			if keyFile == "" {
+				keyFile = certFile // Patroni accepts the key inside the certificate file
+			}
+			pairs = append(pairs, CertPair{Service: CertServicePatroni, CertFile: certFile, KeyFile: keyFile, CAFile: caFile})
+		}
+	}
+
+	settings := cfg.Node.PostgreSQL.Parameters.Settings()
+	if on, _ := parseBool(settings["ssl"]); on || settings["ssl_cert_file"] != "" {
+		dataFile := func(name, fallback string) string {
+			if name == "" {
+				name = fallback
+			}
+			if name == "" || filepath.IsAbs(name) {
+				return name
+			}
+			return filepath.Join(cfg.Node.PostgreSQL.DataDir, name)
+		}
+		pairs = append(pairs, CertPair{
+			Service:  CertServicePostgreSQL,
+			CertFile: dataFile(settings["ssl_cert_file"], "server.crt"),
+			KeyFile:  dataFile(settings["ssl_key_file"], "server.key"),
+			CAFile:   dataFile(settings["ssl_ca_file"], ""),
+		})
+	}
+	return pairs
+}
+
+// InspectCertificate reads the certificate in pair and checks that its key
+// matches and, when pair has a CA file, that the CA signed it.
+func InspectCertificate(pair CertPair) CertStatus {
+	status := CertStatus{CertPair: pair}
+
+	data, err := os.ReadFile(pair.CertFile)
+	if err != nil {
+		status.Err = fmt.Errorf("failed to read certificate: %w", err)
+		return status
+	}
+	cert, err := pki.ParseCertificate(data)
+	if err != nil {
+		status.Err = fmt.Errorf("%s: %w", pair.CertFile, err)
+		return status
+	}
+	status.Cert = cert
+
+	if _, err := tls.LoadX509KeyPair(pair.CertFile, pair.KeyFile); err != nil {
+		status.Err = fmt.Errorf("key %s does not match the certificate: %w", pair.KeyFile, err)
+		return status
+	}
+
+	if pair.CAFile != "" {
+		caPEM, err := os.ReadFile(pair.CAFile)
+		if err != nil {
+			status.Err = fmt.Errorf("failed to read CA: %w", err)
+			return status
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(caPEM) {
+			status.Err = fmt.Errorf("no certificates found in %s", pair.CAFile)
+			return status
+		}
+		opts := x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}, CurrentTime: cert.NotBefore}
+		if _, err := cert.Verify(opts); err != nil {
+			status.Err = fmt.Errorf("not signed by %s: %w", pair.CAFile, err)
+		}
+	}
+	return status
+}
+
+// InspectCA reads the cluster CA certificate: the one in pki.ca_dir on the
+// CA host, otherwise the first CA file a service is configured with. It
+// reports false when neither exists.
+func InspectCA(cfg *config.AgentConfig) (CertStatus, bool) {
+	path := filepath.Join(cfg.PKI.CADir, pki.CACertFile)
+	if _, err := os.Stat(path); err != nil {
+		path = ""
+		for _, pair := range ConfiguredCertificates(cfg) {
+			if pair.CAFile != "" {
+				path = pair.CAFile
+				break
+			}
+		}
+	}
+	if path == "" {
+		return CertStatus{}, false
+	}
+
+	status := CertStatus{CertPair: CertPair{Service: CertServiceCA, CertFile: path}}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		status.Err = fmt.Errorf("failed to read CA certificate: %w", err)
+		return status, true
+	}
+	status.Cert, status.Err = pki.ParseCertificate(data)
+	return status, true
+}
+
+// Remaining is how long the certificate stays valid; negative once expired.
+func (s CertStatus) Remaining(now time.Time) time.Duration {
+	if s.Cert == nil {
+		return 0
+	}
+	return s.Cert.NotAfter.Sub(now)
+}
+
+// RenewalThreshold is the remaining validity below which certificates are
+// renewed: pki.renew_before_days.
+func RenewalThreshold(cfg *config.AgentConfig) time.Duration {
+	return days(cfg.PKI.RenewBeforeDays)
+}
+
+// CanRenewCertificates reports whether this host holds the cluster CA.
+func CanRenewCertificates(cfg *config.AgentConfig) bool {
+	for _, name := range []string{pki.CACertFile, pki.CAKeyFile} {
+		if _, err := os.Stat(filepath.Join(cfg.PKI.CADir, name)); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// IsCANode reports whether this node is pki.ca_node, the one node that
+// holds the CA key and signs renewed certificates. Without cluster.nodes
+// the node is on its own and is the CA node.
+func IsCANode(cfg *config.AgentConfig) bool {
+	return cfg.PKI.CANode == "" || cfg.PKI.CANode == cfg.Node.Name
+}
+
+// RestartETCDUnit restarts the etcd systemd unit, e.g. to load a renewed
+// certificate. Supervised etcd members are restarted by the supervisor.
+func RestartETCDUnit(cfg *config.AgentConfig) error {
+	if output, err := executor.Run("systemctl", "restart", ETCDUnit); err != nil {
+		logger.Error("systemctl restart failed: %s", string(output))
+		return fmt.Errorf("failed to restart %s: %w", ETCDUnit, err)
+	}
+	return nil
+}
+
+func parseBool(value string) (bool, bool) {
+	switch value {
+	case "on", "true", "yes", "1":
+		return true, true
+	case "off", "false", "no", "0":
+		return false, true
+	}
+	return false, false
+}
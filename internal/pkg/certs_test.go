@@ -0,0 +1,150 @@
+package pkg
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/virtlabs-io/dbcp-agent/internal/config"
+	"github.com/virtlabs-io/dbcp-agent/internal/pki"
+)
+
+func TestConfiguredCertificates(t *testing.T) {
+	cfg := &config.AgentConfig{}
+	if pairs := ConfiguredCertificates(cfg); len(pairs) != 0 {
+		t.Errorf("expected no certificates without TLS, got %+v", pairs)
+	}
+
+	cfg.Node.ETCD = config.EtcdConfig{CertFile: "/pki/node.crt", KeyFile: "/pki/node.key", CAFile: "/pki/ca.crt"}
+	cfg.Node.Patroni.Extra = map[string]any{"restapi": map[string]any{"certfile": "/pki/rest.pem"}}
+	cfg.Node.PostgreSQL.DataDir = "/pgdata"
+	cfg.Node.PostgreSQL.Parameters.Extra = map[string]string{"ssl": "on", "ssl_key_file": "/pki/node.key"}
+
+	want := []CertPair{
+		{Service: CertServiceETCD, CertFile: "/pki/node.crt", KeyFile: "/pki/node.key", CAFile: "/pki/ca.crt"},
+		{Service: CertServicePatroni, CertFile: "/pki/rest.pem", KeyFile: "/pki/rest.pem"},
+		{Service: CertServicePostgreSQL, CertFile: "/pgdata/server.crt", KeyFile: "/pki/node.key"},
+	}
+	got := ConfiguredCertificates(cfg)
+	if len(got) != len(want) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("pair %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestInspectCertificate(t *testing.T) {
+	cfg := pkiTestConfig(t)
+	if err := InitCA(cfg); err != nil {
+		t.Fatal(err)
+	}
+	cfg.PKI.ValidDays = 2
+	if err := IssueCertificate(cfg, cfg.Cluster.Nodes[0], cfg.PKI.Dir); err != nil {
+		t.Fatal(err)
+	}
+	pair := CertPair{
+		Service:  CertServiceETCD,
+		CertFile: filepath.Join(cfg.PKI.Dir, pki.NodeCertFile),
+		KeyFile:  filepath.Join(cfg.PKI.Dir, pki.NodeKeyFile),
+		CAFile:   filepath.Join(cfg.PKI.Dir, pki.CACertFile),
+	}
+
+	st := InspectCertificate(pair)
+	if st.Err != nil {
+		t.Fatal(st.Err)
+	}
+	if left := st.Remaining(time.Now()); left <= 0 || left > 2*24*time.Hour {
+		t.Errorf("unexpected remaining validity %s", left)
+	}
+
+	mismatched := pair
+	mismatched.KeyFile = filepath.Join(cfg.PKI.CADir, pki.CAKeyFile)
+	if st := InspectCertificate(mismatched); st.Err == nil || !strings.Contains(st.Err.Error(), "does not match") {
+		t.Errorf("expected a key mismatch, got %v", st.Err)
+	}
+
+}
+
+func TestRenewalRoundTrip(t *testing.T) {
+	port, data := fakeETCD(t)
+	caNode := pkiTestConfig(t)
+	caNode.Node.ETCD.ClientPort = port
+	if err := InitCA(caNode); err != nil {
+		t.Fatal(err)
+	}
+
+	// node2 holds a certificate from the cluster CA, but not the CA key
+	member := pkiTestConfig(t)
+	member.Node.Name, member.Node.Host = "node2", "10.0.0.2"
+	member.Node.ETCD.ClientPort = port
+	if err := IssueCertificate(caNode, member.Cluster.Nodes[1], member.PKI.Dir); err != nil {
+		t.Fatal(err)
+	}
+	pair := CertPair{
+		Service:  CertServiceETCD,
+		CertFile: filepath.Join(member.PKI.Dir, pki.NodeCertFile),
+		KeyFile:  filepath.Join(member.PKI.Dir, pki.NodeKeyFile),
+		CAFile:   filepath.Join(member.PKI.Dir, pki.CACertFile),
+	}
+	before := InspectCertificate(pair)
+
+	kv, err := NewETCDKV(member)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := RequestRenewal(member, kv); err != nil {
+		t.Fatal(err)
+	}
+	request := data["/dbcp-agent/pg-test/pki/requests/node2"]
+	if !strings.Contains(string(request), "CERTIFICATE REQUEST") {
+		t.Fatalf("expected a certificate request in etcd, got %q", request)
+	}
+	// Asking again while the request is open changes nothing
+	if err := RequestRenewal(member, kv); err != nil || !bytes.Equal(data["/dbcp-agent/pg-test/pki/requests/node2"], request) {
+		t.Errorf("expected the open request to be kept: %v", err)
+	}
+
+	if err := SignRenewals(caNode, kv); err != nil {
+		t.Fatal(err)
+	}
+	for key, value := range data {
+		if strings.Contains(string(value), "PRIVATE KEY") {
+			t.Errorf("a private key was put in etcd under %s", key)
+		}
+	}
+	certPEM, err := IssuedRenewal(member, kv)
+	if err != nil || certPEM == nil {
+		t.Fatalf("expected a signed certificate for node2, got %v", err)
+	}
+	if err := InstallRenewal(member, kv, certPEM, []CertPair{pair}); err != nil {
+		t.Fatal(err)
+	}
+
+	after := InspectCertificate(pair)
+	if after.Err != nil || after.Cert.Equal(before.Cert) || after.Cert.VerifyHostname("10.0.0.2") != nil {
+		t.Errorf("expected a new certificate for node2, got %v", after.Err)
+	}
+	if len(data) != 0 {
+		t.Errorf("expected the request to be closed, left %v", data)
+	}
+}
+
+func TestIsCANode(t *testing.T) {
+	cfg := pkiTestConfig(t)
+	if !IsCANode(cfg) {
+		t.Error("expected a node without pki.ca_node to renew")
+	}
+	cfg.PKI.CANode = "node1"
+	if !IsCANode(cfg) {
+		t.Error("expected node1 to be the CA node")
+	}
+	cfg.Node.Name = "node2"
+	if IsCANode(cfg) {
+		t.Error("expected node2 not to renew")
+	}
+}
@@ -3,9 +3,7 @@ package pkg
 import (
 	"fmt"
 	"os"
-	"os/user"
 	"path/filepath"
-	"strconv"
 
 	"github.com/virtlabs-io/dbcp-agent/internal/config"
 	"github.com/virtlabs-io/dbcp-agent/internal/logger"
@@ -31,31 +29,10 @@ func CreateDirs(cfg *config.AgentConfig, paths ...string) error {
 // MkdirAllAsUser creates the directory and sets ownership to the given username
 func MkdirAllAsUser(path, username string, perm os.FileMode) error {
 	// Create the directory with desired permissions
-	if err := os.MkdirAll(path, perm); err != nil {
+	if err := executor.MkdirAll(path, perm); err != nil {
 		return fmt.Errorf("failed to create directory %s: %w", path, err)
 	}
 
-	// Lookup UID and GID
-	usr, err := user.Lookup(username)
-	if err != nil {
-		return fmt.Errorf("failed to lookup user %s: %w", username, err)
-	}
-
-	uid, err := strconv.Atoi(usr.Uid)
-	if err != nil {
-		return fmt.Errorf("failed to convert UID: %w", err)
-	}
-
-	gid, err := strconv.Atoi(usr.Gid)
-	if err != nil {
-		return fmt.Errorf("failed to convert GID: %w", err)
-	}
-
-	// Walk recursively to chown everything
-	return filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-		return os.Chown(p, uid, gid)
-	})
+	// Chown everything below it as well
+	return executor.Chown(path, username, true)
 }
@@ -13,41 +13,55 @@ import (
 
 	"github.com/virtlabs-io/dbcp-agent/internal/config"
 	"github.com/virtlabs-io/dbcp-agent/internal/logger"
+	"github.com/virtlabs-io/dbcp-agent/internal/system"
 )
 
-func InstallETCD(cfg *config.AgentConfig, repoURL string) error {
-	logger.Info("Installing ETCD version %s...", cfg.Node.ETCD.Version)
+func InstallETCD(cfg *config.AgentConfig, osInfo *system.OSInfo, repoURL string) error {
+	logger.Info("Installing ETCD version %s for %s...", cfg.Node.ETCD.Version, osInfo.Arch)
 
-	etcdURL := fmt.Sprintf("%s/v%s/etcd-v%s-linux-amd64.tar.gz",
-		strings.TrimSuffix(repoURL, "/"),
-		cfg.Node.ETCD.Version,
-		cfg.Node.ETCD.Version,
-	)
+	releaseName, archiveName := etcdReleaseNames(cfg, osInfo)
+	releaseURL := etcdReleaseURL(cfg, repoURL)
+	etcdURL := releaseURL + "/" + archiveName
 
-	archivePath := fmt.Sprintf("/tmp/etcd-v%s-linux-amd64.tar.gz", cfg.Node.ETCD.Version)
+	archivePath := filepath.Join("/tmp", archiveName)
 
 	logger.Info("Downloading ETCD from %s", etcdURL)
-	if err := downloadFile(archivePath, etcdURL); err != nil {
+	if err := executor.Download(archivePath, etcdURL); err != nil {
 		return fmt.Errorf("failed to download etcd: %w", err)
 	}
 
+	// Never extract an archive we could not verify
+	checksum, err := etcdArchiveChecksum(cfg, releaseURL, archiveName)
+	if err == nil {
+		err = executor.VerifySHA256(archivePath, checksum)
+	}
+	if err != nil {
+		if rmErr := executor.Remove(archivePath); rmErr != nil {
+			logger.Warn("Failed to remove unverified archive %s: %v", archivePath, rmErr)
+		}
+		return fmt.Errorf("etcd archive verification failed: %w", err)
+	}
+	if checksum != dryRunChecksum {
+		logger.Info("Verified %s (sha256 %s)", archiveName, checksum)
+	}
+
 	extractDir := filepath.Join("/tmp", fmt.Sprintf("etcd-v%s", cfg.Node.ETCD.Version))
-	if err := extractTarGz(archivePath, extractDir); err != nil {
+	if err := executor.Extract(archivePath, extractDir); err != nil {
 		return fmt.Errorf("failed to extract etcd: %w", err)
 	}
 
 	binDir := cfg.Node.ETCD.BinPath
-	if err := os.MkdirAll(binDir, 0755); err != nil {
+	if err := executor.MkdirAll(binDir, 0755); err != nil {
 		return fmt.Errorf("failed to create bin path: %w", err)
 	}
 
 	for _, bin := range []string{"etcd", "etcdctl"} {
-		src := filepath.Join(extractDir, fmt.Sprintf("etcd-v%s-linux-amd64", cfg.Node.ETCD.Version), bin)
+		src := filepath.Join(extractDir, releaseName, bin)
 		dst := filepath.Join(binDir, bin)
-		if err := os.Rename(src, dst); err != nil {
+		if err := executor.Rename(src, dst); err != nil {
 			return fmt.Errorf("failed to move %s: %w", bin, err)
 		}
-		if err := os.Chmod(dst, 0755); err != nil {
+		if err := executor.Chmod(dst, 0755); err != nil {
 			return fmt.Errorf("failed to chmod %s: %w", dst, err)
 		}
 	}
@@ -56,16 +70,55 @@ func InstallETCD(cfg *config.AgentConfig, repoURL string) error {
 	return nil
 }
 
+// StartETCD runs etcd as a systemd unit, or spawns it directly when the
+// node does not use systemd.
 func StartETCD(cfg *config.AgentConfig) error {
+	if UseSystemd(cfg) {
+		return InstallUnit(cfg, ETCDUnitFor(cfg))
+	}
+
+	// Create the command, logging to the ETCD log file
+	logFilePath := filepath.Join(cfg.Node.TmpPath, "etcd.log")
+	cmd := ETCDCommand(cfg)
+
+	// Start in background
+	pid, err := executor.Start(cmd, logFilePath)
+	if err != nil {
+		return fmt.Errorf("failed to start ETCD: %w", err)
+	}
+
+	logger.Info("ETCD started in background with PID %d — logs at %s", pid, logFilePath)
+	return nil
+}
+
+// ETCDCommand returns the command that runs this node's etcd member.
+func ETCDCommand(cfg *config.AgentConfig) *exec.Cmd {
+	return exec.Command(filepath.Join(cfg.Node.ETCD.BinPath, "etcd"), etcdArgs(cfg)...)
+}
+
+// ETCDUnitFor describes the systemd unit running this node's etcd member.
+func ETCDUnitFor(cfg *config.AgentConfig) SystemdUnit {
+	bin := filepath.Join(cfg.Node.ETCD.BinPath, "etcd")
+	return SystemdUnit{
+		Name:        ETCDUnit,
+		Description: "etcd member " + cfg.Node.Name + " (dbcp-agent)",
+		Type:        "notify",
+		User:        cfg.Node.User,
+		ExecStart:   append([]string{bin}, etcdArgs(cfg)...),
+		Overrides:   cfg.Node.Systemd.ETCDOverrides,
+	}
+}
+
+// etcdArgs builds the etcd command line flags for this node.
+func etcdArgs(cfg *config.AgentConfig) []string {
 	node := cfg.Node
 	dataDir := node.ETCD.DataDir
-	bin := filepath.Join(node.ETCD.BinPath, "etcd")
 
 	protocol := "http"
 	args := []string{}
 
 	// Use TLS if configured
-	if cfg.Node.ETCD.CertFile != "" && cfg.Node.ETCD.KeyFile != "" && cfg.Node.ETCD.CAFile != "" {
+	if cfg.Node.ETCD.TLSEnabled() {
 		protocol = "https"
 		args = append(args,
 			"--cert-file", cfg.Node.ETCD.CertFile,
@@ -102,45 +155,97 @@ func StartETCD(cfg *config.AgentConfig) error {
 		fmt.Sprintf("--listen-client-urls=%s://0.0.0.0:%d", protocol, node.ETCD.ClientPort),
 		fmt.Sprintf("--advertise-client-urls=%s://%s:%d", protocol, node.Host, node.ETCD.ClientPort),
 	)
+	return args
+}
 
-	// Create ETCD log file
-	logFilePath := filepath.Join(node.TmpPath, "etcd.log")
-	logFile, err := os.OpenFile(logFilePath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
-	if err != nil {
-		return fmt.Errorf("failed to create ETCD log file: %w", err)
+// ETCDRepoURL returns the base URL etcd releases are fetched from. Bundle
+// sources are served as file:// URLs from the (extracted) bundle.
+func ETCDRepoURL(cfg *config.AgentConfig, osInfo *system.OSInfo) (string, error) {
+	if path, ok := cfg.Repositories.ETCD.BundlePath(); ok {
+		dir, err := resolveBundle(cfg, osInfo, path)
+		if err != nil {
+			return "", err
+		}
+		return "file://" + filepath.Join(dir, "etcd"), nil
+	}
+	return cfg.Repositories.ETCD.Selected().URL, nil
+}
+
+// etcdReleaseNames returns the top-level directory and archive file name of
+// the etcd release for this node's architecture.
+func etcdReleaseNames(cfg *config.AgentConfig, osInfo *system.OSInfo) (string, string) {
+	releaseName := fmt.Sprintf("etcd-v%s-linux-%s", cfg.Node.ETCD.Version, osInfo.Arch)
+	return releaseName, releaseName + ".tar.gz"
+}
+
+func etcdReleaseURL(cfg *config.AgentConfig, repoURL string) string {
+	return fmt.Sprintf("%s/v%s", strings.TrimSuffix(repoURL, "/"), cfg.Node.ETCD.Version)
+}
+
+// dryRunChecksum stands in for the SHA256SUMS digest in a dry run, which
+// fetches nothing and so has nothing to verify against.
+const dryRunChecksum = "(from SHA256SUMS, not fetched in a dry run)"
+
+// etcdArchiveChecksum returns the expected sha256 of the release archive:
+// the pinned etcd.checksum when set, otherwise the entry in the release's
+// SHA256SUMS (whose GPG signature is checked when a keyring is configured).
+func etcdArchiveChecksum(cfg *config.AgentConfig, releaseURL, archiveName string) (string, error) {
+	if pinned := cfg.Node.ETCD.Checksum; pinned != "" {
+		return strings.ToLower(strings.TrimPrefix(pinned, "sha256:")), nil
 	}
 
-	// Create the command
-	cmd := exec.Command(bin, args...)
-	cmd.Stdout = logFile
-	cmd.Stderr = logFile
+	sumsURL := releaseURL + "/SHA256SUMS"
+	sums, err := executor.Fetch(sumsURL)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch %s (set etcd.checksum to pin the digest instead): %w", sumsURL, err)
+	}
 
-	// Start in background
-	if err := cmd.Start(); err != nil {
-		return fmt.Errorf("failed to start ETCD: %w", err)
+	if keyring := cfg.Node.ETCD.SignatureKeyring; keyring != "" {
+		signature, err := executor.Fetch(sumsURL + ".asc")
+		if err != nil {
+			return "", fmt.Errorf("failed to fetch SHA256SUMS signature: %w", err)
+		}
+		if err := executor.VerifySignature(sumsURL, sums, signature, keyring); err != nil {
+			return "", err
+		}
+		if len(sums) > 0 {
+			logger.Info("SHA256SUMS signature verified with %s", keyring)
+		}
 	}
 
-	logger.Info("ETCD started in background with PID %d — logs at %s", cmd.Process.Pid, logFilePath)
-	return nil
+	if len(sums) == 0 {
+		// Only a dry run fetches nothing: a real empty download is an error
+		return dryRunChecksum, nil
+	}
+	return checksumFromSums(sums, archiveName)
 }
 
 func downloadFile(target string, url string) error {
-	out, err := os.Create(target)
+	resp, err := httpClient.Get(url)
 	if err != nil {
 		return err
 	}
-	defer out.Close()
+	defer resp.Body.Close()
 
-	resp, err := http.Get(url)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: unexpected status %s", url, resp.Status)
+	}
+
+	out, err := os.Create(target)
 	if err != nil {
 		return err
 	}
-	defer resp.Body.Close()
 
-	_, err = io.Copy(out, resp.Body)
-	return err
+	if _, err := io.Copy(out, resp.Body); err != nil {
+		out.Close()
+		os.Remove(target)
+		return err
+	}
+	return out.Close()
 }
 
+// extractTarGz unpacks the directories and regular files of an archive
+// into dest. Links and entries that would land outside dest are refused.
 func extractTarGz(gzPath string, dest string) error {
 	f, err := os.Open(gzPath)
 	if err != nil {
@@ -165,11 +270,20 @@ func extractTarGz(gzPath string, dest string) error {
 			return err
 		}
 
+		// Entries must stay inside dest, whatever their name says
 		path := filepath.Join(dest, header.Name)
+		if rel, err := filepath.Rel(dest, path); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("archive entry %q points outside %s", header.Name, dest)
+		}
 		switch header.Typeflag {
 		case tar.TypeDir:
-			os.MkdirAll(path, os.FileMode(header.Mode))
+			if err := os.MkdirAll(path, os.FileMode(header.Mode)); err != nil {
+				return err
+			}
 		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return err
+			}
 			outFile, err := os.Create(path)
 			if err != nil {
 				return err
@@ -179,6 +293,9 @@ func extractTarGz(gzPath string, dest string) error {
 				return err
 			}
 			outFile.Close()
+		case tar.TypeSymlink, tar.TypeLink:
+			// A link could point a later entry anywhere on the host
+			return fmt.Errorf("archive entry %q is a link, which is not extracted", header.Name)
 		}
 	}
 	return nil
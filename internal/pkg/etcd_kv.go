@@ -0,0 +1,144 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/virtlabs-io/dbcp-agent/internal/config"
+)
+
+// KV is the part of etcd's key-value API that certificate renewal uses to
+// pass requests and certificates between nodes and to take turns.
+type KV interface {
+	// Get returns the value at key, or nil when it is not set.
+	Get(key string) ([]byte, error)
+	// List returns every key under prefix with its value.
+	List(prefix string) (map[string][]byte, error)
+	Put(key string, value []byte) error
+	Delete(key string) error
+	// Lock sets key to owner unless another owner holds it, and reports
+	// whether owner holds it now. The key expires after ttl, so a node that
+	// dies holding it does not block the others for good.
+	Lock(key, owner string, ttl time.Duration) (bool, error)
+}
+
+// etcdKV talks to the local etcd member through its JSON gateway, which
+// needs no client library: keys and values travel base64-encoded.
+type etcdKV struct {
+	client  *http.Client
+	baseURL string
+}
+
+// NewETCDKV returns a KV backed by the local etcd member, reached the same
+// way as its health endpoint.
+func NewETCDKV(cfg *config.AgentConfig) (KV, error) {
+	client, scheme, err := etcdHealthClient(cfg.Node.ETCD)
+	if err != nil {
+		return nil, err
+	}
+	return &etcdKV{client: client, baseURL: fmt.Sprintf("%s://127.0.0.1:%d", scheme, cfg.Node.ETCD.ClientPort)}, nil
+}
+
+// etcdKeyValue is a key-value pair as the gateway encodes it; []byte fields
+// marshal to base64 like it expects.
+type etcdKeyValue struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value,omitempty"`
+}
+
+func (kv *etcdKV) Get(key string) ([]byte, error) {
+	var resp struct {
+		KVs []etcdKeyValue `json:"kvs"`
+	}
+	if err := kv.call("/v3/kv/range", map[string]any{"key": []byte(key)}, &resp); err != nil {
+		return nil, err
+	}
+	if len(resp.KVs) == 0 {
+		return nil, nil
+	}
+	return resp.KVs[0].Value, nil
+}
+
+func (kv *etcdKV) List(prefix string) (map[string][]byte, error) {
+	// Everything from prefix up to the next prefix is under it
+	end := []byte(prefix)
+	end[len(end)-1]++
+	var resp struct {
+		KVs []etcdKeyValue `json:"kvs"`
+	}
+	if err := kv.call("/v3/kv/range", map[string]any{"key": []byte(prefix), "range_end": end}, &resp); err != nil {
+		return nil, err
+	}
+	values := make(map[string][]byte, len(resp.KVs))
+	for _, item := range resp.KVs {
+		values[string(item.Key)] = item.Value
+	}
+	return values, nil
+}
+
+func (kv *etcdKV) Put(key string, value []byte) error {
+	return kv.call("/v3/kv/put", etcdKeyValue{Key: []byte(key), Value: value}, nil)
+}
+
+func (kv *etcdKV) Delete(key string) error {
+	return kv.call("/v3/kv/deleterange", map[string]any{"key": []byte(key)}, nil)
+}
+
+func (kv *etcdKV) Lock(key, owner string, ttl time.Duration) (bool, error) {
+	holder, err := kv.Get(key)
+	if err != nil {
+		return false, err
+	}
+	if holder != nil {
+		return string(holder) == owner, nil
+	}
+
+	var lease struct {
+		ID string `json:"ID"`
+	}
+	if err := kv.call("/v3/lease/grant", map[string]any{"TTL": int64(ttl.Seconds())}, &lease); err != nil {
+		return false, err
+	}
+
+	// Only put the key if nobody created it since we looked
+	txn := map[string]any{
+		"compare": []map[string]any{{"key": []byte(key), "target": "CREATE", "create_revision": "0"}},
+		"success": []map[string]any{{"request_put": map[string]any{"key": []byte(key), "value": []byte(owner), "lease": lease.ID}}},
+	}
+	var resp struct {
+		Succeeded bool `json:"succeeded"`
+	}
+	if err := kv.call("/v3/kv/txn", txn, &resp); err != nil {
+		return false, err
+	}
+	return resp.Succeeded, nil
+}
+
+func (kv *etcdKV) call(path string, req, resp any) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	r, err := kv.client.Post(kv.baseURL+path, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("etcd %s: %w", path, err)
+	}
+	defer r.Body.Close()
+
+	if r.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(r.Body, 512))
+		return fmt.Errorf("etcd %s: %s: %s", path, r.Status, strings.TrimSpace(string(msg)))
+	}
+	if resp == nil {
+		return nil
+	}
+	if err := json.NewDecoder(r.Body).Decode(resp); err != nil {
+		return fmt.Errorf("etcd %s: invalid response: %w", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/virtlabs-io/dbcp-agent/internal/config"
+)
+
+// fakeETCD serves the parts of etcd's JSON gateway that etcdKV uses, from
+// memory, and returns the port and the stored keys.
+func fakeETCD(t *testing.T) (int, map[string][]byte) {
+	t.Helper()
+	var mu sync.Mutex
+	data := map[string][]byte{}
+
+	port := localServer(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		var req struct {
+			Key      []byte `json:"key"`
+			RangeEnd []byte `json:"range_end"`
+			Value    []byte `json:"value"`
+			Compare  []struct {
+				Key []byte `json:"key"`
+			} `json:"compare"`
+			Success []struct {
+				RequestPut struct {
+					Key   []byte `json:"key"`
+					Value []byte `json:"value"`
+					Lease string `json:"lease"`
+				} `json:"request_put"`
+			} `json:"success"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		resp := map[string]any{}
+		switch r.URL.Path {
+		case "/v3/kv/range":
+			var kvs []etcdKeyValue
+			for key, value := range data {
+				k := []byte(key)
+				if bytes.Equal(k, req.Key) || (req.RangeEnd != nil && bytes.Compare(k, req.Key) >= 0 && bytes.Compare(k, req.RangeEnd) < 0) {
+					kvs = append(kvs, etcdKeyValue{Key: k, Value: value})
+				}
+			}
+			sort.Slice(kvs, func(i, j int) bool { return bytes.Compare(kvs[i].Key, kvs[j].Key) < 0 })
+			resp["kvs"] = kvs
+		case "/v3/kv/put":
+			data[string(req.Key)] = req.Value
+		case "/v3/kv/deleterange":
+			delete(data, string(req.Key))
+		case "/v3/lease/grant":
+			resp["ID"] = "7587"
+		case "/v3/kv/txn":
+			if _, taken := data[string(req.Compare[0].Key)]; !taken && req.Success[0].RequestPut.Lease == "7587" {
+				put := req.Success[0].RequestPut
+				data[string(put.Key)] = put.Value
+				resp["succeeded"] = true
+			}
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(resp)
+	})
+	return port, data
+}
+
+func TestETCDKV(t *testing.T) {
+	port, data := fakeETCD(t)
+	cfg := &config.AgentConfig{Node: config.NodeConfig{ETCD: config.EtcdConfig{ClientPort: port}}}
+	kv, err := NewETCDKV(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if value, err := kv.Get("/a/missing"); err != nil || value != nil {
+		t.Errorf("expected nothing for a missing key, got %q, %v", value, err)
+	}
+	for _, key := range []string{"/a/b/1", "/a/b/2", "/a/c"} {
+		if err := kv.Put(key, []byte("v"+key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if value, err := kv.Get("/a/c"); err != nil || string(value) != "v/a/c" {
+		t.Errorf("Get = %q, %v", value, err)
+	}
+	if values, err := kv.List("/a/b/"); err != nil || len(values) != 2 || string(values["/a/b/2"]) != "v/a/b/2" {
+		t.Errorf("List = %q, %v", values, err)
+	}
+	if err := kv.Delete("/a/c"); err != nil || data["/a/c"] != nil {
+		t.Errorf("expected /a/c to be deleted: %v", err)
+	}
+
+	if ok, err := kv.Lock("/a/turn", "node1", time.Minute); !ok || err != nil {
+		t.Errorf("expected node1 to take the lock, got %v, %v", ok, err)
+	}
+	if ok, err := kv.Lock("/a/turn", "node1", time.Minute); !ok || err != nil {
+		t.Errorf("expected node1 to keep the lock, got %v, %v", ok, err)
+	}
+	if ok, err := kv.Lock("/a/turn", "node2", time.Minute); ok || err != nil {
+		t.Errorf("expected node2 to wait, got %v, %v", ok, err)
+	}
+}
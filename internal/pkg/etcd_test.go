@@ -2,21 +2,66 @@
 package pkg
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"testing"
 
 	"github.com/virtlabs-io/dbcp-agent/internal/config"
+	"github.com/virtlabs-io/dbcp-agent/internal/system"
 )
 
+// newETCDReleaseServer serves a fake etcd release archive and its SHA256SUMS.
+func newETCDReleaseServer(t *testing.T, version, arch string) (*httptest.Server, string) {
+	t.Helper()
+
+	dir := fmt.Sprintf("etcd-v%s-linux-%s", version, arch)
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	tw.WriteHeader(&tar.Header{Name: dir + "/", Typeflag: tar.TypeDir, Mode: 0755})
+	for _, bin := range []string{"etcd", "etcdctl"} {
+		body := []byte("#!/bin/sh\necho " + bin + "\n")
+		tw.WriteHeader(&tar.Header{Name: dir + "/" + bin, Typeflag: tar.TypeReg, Mode: 0755, Size: int64(len(body))})
+		tw.Write(body)
+	}
+	tw.Close()
+	gz.Close()
+
+	archive := buf.Bytes()
+	sum := sha256.Sum256(archive)
+	digest := hex.EncodeToString(sum[:])
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(fmt.Sprintf("/v%s/%s.tar.gz", version, dir), func(w http.ResponseWriter, r *http.Request) {
+		w.Write(archive)
+	})
+	mux.HandleFunc(fmt.Sprintf("/v%s/SHA256SUMS", version), func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s  %s.tar.gz\n", digest, dir)
+	})
+
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv, digest
+}
+
 func TestInstallETCDMock(t *testing.T) {
+	srv, _ := newETCDReleaseServer(t, "3.5.9", "amd64")
+
 	cfg := &config.AgentConfig{
 		Node: config.NodeConfig{
 			Host:    "localhost",
 			TmpPath: "/tmp",
 			ETCD: config.EtcdConfig{
 				Version:    "3.5.9",
-				BinPath:    "/tmp/etcd-test-bin",
+				BinPath:    t.TempDir(),
 				DataDir:    "/tmp/etcd-data",
 				PeerPort:   2380,
 				ClientPort: 2379,
@@ -25,16 +70,16 @@ func TestInstallETCDMock(t *testing.T) {
 		Repositories: config.Repositories{
 			ETCD: config.RepoEntry{
 				Default: "official",
-				Sources: map[string]map[string]string{
-					"official": {"url": "https://storage.googleapis.com/etcd"},
+				Sources: map[string]config.RepoSource{
+					"official": {URL: srv.URL},
 				},
 			},
 		},
 	}
 
-	repoURL := cfg.Repositories.ETCD.Sources["official"]["url"]
+	repoURL := cfg.Repositories.ETCD.Sources["official"].URL
 
-	err := InstallETCD(cfg, repoURL)
+	err := InstallETCD(cfg, &system.OSInfo{Arch: "amd64"}, repoURL)
 	if err != nil {
 		t.Fatalf("failed to install ETCD: %v", err)
 	}
@@ -44,3 +89,158 @@ func TestInstallETCDMock(t *testing.T) {
 		t.Errorf("expected etcd binary to exist at %s", bin)
 	}
 }
+
+func TestInstallETCDChecksumMismatch(t *testing.T) {
+	srv, _ := newETCDReleaseServer(t, "3.5.10", "amd64")
+
+	cfg := &config.AgentConfig{
+		Node: config.NodeConfig{
+			ETCD: config.EtcdConfig{
+				Version:  "3.5.10",
+				BinPath:  t.TempDir(),
+				Checksum: "sha256:" + hex.EncodeToString(make([]byte, 32)),
+			},
+		},
+	}
+
+	if err := InstallETCD(cfg, &system.OSInfo{Arch: "amd64"}, srv.URL); err == nil {
+		t.Fatal("expected checksum mismatch to abort the install")
+	}
+
+	if _, err := os.Stat("/tmp/etcd-v3.5.10-linux-amd64.tar.gz"); !os.IsNotExist(err) {
+		t.Error("expected unverified archive to be removed")
+	}
+	if _, err := os.Stat(filepath.Join(cfg.Node.ETCD.BinPath, "etcd")); !os.IsNotExist(err) {
+		t.Error("expected nothing to be installed after a failed verification")
+	}
+}
+
+func TestInstallETCDMissingRelease(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+
+	cfg := &config.AgentConfig{
+		Node: config.NodeConfig{
+			ETCD: config.EtcdConfig{Version: "9.9.9", BinPath: t.TempDir()},
+		},
+	}
+
+	if err := InstallETCD(cfg, &system.OSInfo{Arch: "amd64"}, srv.URL); err == nil {
+		t.Fatal("expected a 404 download to fail")
+	}
+	if _, err := os.Stat("/tmp/etcd-v9.9.9-linux-amd64.tar.gz"); !os.IsNotExist(err) {
+		t.Error("expected no archive to be written for a 404 response")
+	}
+}
+
+func TestInstallETCDArm64(t *testing.T) {
+	srv, _ := newETCDReleaseServer(t, "3.5.11", "arm64")
+
+	cfg := &config.AgentConfig{
+		Node: config.NodeConfig{
+			ETCD: config.EtcdConfig{Version: "3.5.11", BinPath: t.TempDir()},
+		},
+	}
+
+	if err := InstallETCD(cfg, &system.OSInfo{Arch: "arm64"}, srv.URL); err != nil {
+		t.Fatalf("failed to install arm64 ETCD: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(cfg.Node.ETCD.BinPath, "etcdctl")); err != nil {
+		t.Errorf("expected etcdctl to be installed: %v", err)
+	}
+}
+
+func TestChecksumFromSums(t *testing.T) {
+	sums := []byte("aaaa  etcd-v3.5.9-linux-arm64.tar.gz\nBBBB *etcd-v3.5.9-linux-amd64.tar.gz\n")
+
+	got, err := checksumFromSums(sums, "etcd-v3.5.9-linux-amd64.tar.gz")
+	if err != nil || got != "bbbb" {
+		t.Errorf("checksumFromSums = %q, %v; want bbbb", got, err)
+	}
+
+	if _, err := checksumFromSums(sums, "etcd-v3.5.9-darwin-amd64.zip"); err == nil {
+		t.Error("expected missing entry to be an error")
+	}
+}
+
+func TestInstallETCDDryRunFetchesNothing(t *testing.T) {
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		http.NotFound(w, r)
+	}))
+	defer srv.Close()
+
+	rec := NewRecorder()
+	defer SetExecutor(SetExecutor(rec))
+
+	cfg := &config.AgentConfig{
+		Node: config.NodeConfig{
+			ETCD: config.EtcdConfig{Version: "3.5.9", BinPath: "/usr/local/bin", SignatureKeyring: "/etc/dbcp/etcd.gpg"},
+		},
+	}
+	if err := InstallETCD(cfg, &system.OSInfo{Arch: "amd64"}, srv.URL); err != nil {
+		t.Fatalf("dry run failed: %v", err)
+	}
+	if requests != 0 {
+		t.Errorf("expected a dry run to stay off the network, got %d requests", requests)
+	}
+
+	var kinds []string
+	for _, op := range rec.Operations()[:5] {
+		kinds = append(kinds, op.Kind+" "+filepath.Base(op.Target))
+	}
+	want := "[download etcd-v3.5.9-linux-amd64.tar.gz fetch SHA256SUMS fetch SHA256SUMS.asc verify SHA256SUMS verify etcd-v3.5.9-linux-amd64.tar.gz]"
+	if got := fmt.Sprint(kinds); got != want {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+	if got := rec.Operations()[4].Detail; got != "sha256 "+dryRunChecksum {
+		t.Errorf("expected the plan to mark the digest as unverified, got %q", got)
+	}
+}
+
+func TestExtractTarGzRejectsUnsafeEntries(t *testing.T) {
+	archive := func(headers ...*tar.Header) string {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		tw := tar.NewWriter(gz)
+		for _, h := range headers {
+			tw.WriteHeader(h)
+			if h.Size > 0 {
+				tw.Write(bytes.Repeat([]byte("x"), int(h.Size)))
+			}
+		}
+		tw.Close()
+		gz.Close()
+		path := filepath.Join(t.TempDir(), "archive.tar.gz")
+		if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	dest := t.TempDir()
+	ok := archive(&tar.Header{Name: "etcd-v3.5.9/bin/etcd", Typeflag: tar.TypeReg, Mode: 0755, Size: 4})
+	if err := extractTarGz(ok, dest); err != nil {
+		t.Fatalf("expected a file without a directory entry to extract, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dest, "etcd-v3.5.9/bin/etcd")); err != nil {
+		t.Error(err)
+	}
+
+	unsafe := map[string]*tar.Header{
+		"traversal": {Name: "../escaped", Typeflag: tar.TypeReg, Mode: 0644, Size: 1},
+		"nested":    {Name: "etcd/../../escaped", Typeflag: tar.TypeReg, Mode: 0644, Size: 1},
+		"symlink":   {Name: "etcd/link", Typeflag: tar.TypeSymlink, Linkname: "/etc"},
+		"hardlink":  {Name: "etcd/hard", Typeflag: tar.TypeLink, Linkname: "/etc/passwd"},
+	}
+	for name, header := range unsafe {
+		dest := filepath.Join(t.TempDir(), "dest")
+		if err := extractTarGz(archive(header), dest); err == nil {
+			t.Errorf("%s: expected the entry to be refused", name)
+		}
+		if _, err := os.Lstat(filepath.Join(filepath.Dir(dest), "escaped")); err == nil {
+			t.Errorf("%s: a file was written outside dest", name)
+		}
+	}
+}
@@ -0,0 +1,347 @@
+package pkg
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/virtlabs-io/dbcp-agent/internal/logger"
+)
+
+// Executor performs every side effect the installers need: running commands,
+// starting background processes and touching the filesystem or network.
+// Read-only probes (version checks, OS detection) do not go through it.
+type Executor interface {
+	// Run executes a command to completion and returns its combined output.
+	Run(name string, args ...string) ([]byte, error)
+	// Start launches a long-running process without waiting for it. When
+	// logPath is set, stdout and stderr go to the agent log under a
+	// component named after the file ("etcd.log" -> "etcd") and to logPath.
+	Start(cmd *exec.Cmd, logPath string) (int, error)
+	Stat(path string) (os.FileInfo, error)
+	MkdirAll(path string, perm os.FileMode) error
+	WriteFile(path string, data []byte, perm os.FileMode) error
+	// Chown hands path over to the given OS user (and its primary group).
+	Chown(path, username string, recursive bool) error
+	Chmod(path string, perm os.FileMode) error
+	Rename(src, dst string) error
+	Remove(path string) error
+	Download(target, url string) error
+	// Fetch reads a small metadata file such as SHA256SUMS into memory.
+	Fetch(url string) ([]byte, error)
+	// VerifySHA256 fails unless the file at path has the expected digest.
+	VerifySHA256(path, expected string) error
+	// VerifySignature checks a detached GPG signature of data, fetched from
+	// url, against keyring.
+	VerifySignature(url string, data, signature []byte, keyring string) error
+	Extract(archive, dest string) error
+}
+
+var executor Executor = SystemExecutor{}
+
+// SetExecutor replaces the executor used by this package and returns the
+// previous one so callers can restore it.
+func SetExecutor(e Executor) Executor {
+	prev := executor
+	executor = e
+	return prev
+}
+
+// SystemExecutor applies every operation to the local machine.
+type SystemExecutor struct{}
+
+func (SystemExecutor) Run(name string, args ...string) ([]byte, error) {
+	return exec.Command(name, args...).CombinedOutput()
+}
+
+func (SystemExecutor) Start(cmd *exec.Cmd, logPath string) (int, error) {
+	var tail *logger.Tail
+	if logPath != "" {
+		// The process writes to the file itself, so it outlives the agent
+		file, err := logger.OpenComponentLog(logPath)
+		if err != nil {
+			return 0, err
+		}
+		defer file.Close()
+		offset, err := file.Seek(0, io.SeekEnd)
+		if err != nil {
+			return 0, fmt.Errorf("failed to open log file: %w", err)
+		}
+		cmd.Stdout = file
+		cmd.Stderr = file
+		component := strings.TrimSuffix(filepath.Base(logPath), filepath.Ext(logPath))
+		tail = logger.TailComponent(component, logPath, offset)
+	}
+
+	if err := cmd.Start(); err != nil {
+		if tail != nil {
+			tail.Close()
+		}
+		return 0, err
+	}
+
+	// Reap the process and log the rest of its output once it exits
+	go func() {
+		cmd.Wait()
+		if tail != nil {
+			tail.Close()
+		}
+	}()
+	return cmd.Process.Pid, nil
+}
+
+func (SystemExecutor) Stat(path string) (os.FileInfo, error) {
+	return os.Stat(path)
+}
+
+func (SystemExecutor) MkdirAll(path string, perm os.FileMode) error {
+	return os.MkdirAll(path, perm)
+}
+
+func (SystemExecutor) WriteFile(path string, data []byte, perm os.FileMode) error {
+	return os.WriteFile(path, data, perm)
+}
+
+func (SystemExecutor) Chown(path, username string, recursive bool) error {
+	usr, err := user.Lookup(username)
+	if err != nil {
+		return fmt.Errorf("failed to lookup user %s: %w", username, err)
+	}
+
+	uid, err := strconv.Atoi(usr.Uid)
+	if err != nil {
+		return fmt.Errorf("failed to convert UID: %w", err)
+	}
+
+	gid, err := strconv.Atoi(usr.Gid)
+	if err != nil {
+		return fmt.Errorf("failed to convert GID: %w", err)
+	}
+
+	if !recursive {
+		return os.Chown(path, uid, gid)
+	}
+
+	// Walk recursively to chown everything
+	return filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Chown(p, uid, gid)
+	})
+}
+
+func (SystemExecutor) Chmod(path string, perm os.FileMode) error {
+	return os.Chmod(path, perm)
+}
+
+func (SystemExecutor) Rename(src, dst string) error {
+	return os.Rename(src, dst)
+}
+
+func (SystemExecutor) Remove(path string) error {
+	return os.RemoveAll(path)
+}
+
+func (SystemExecutor) Download(target, url string) error {
+	return downloadFile(target, url)
+}
+
+func (SystemExecutor) Fetch(url string) ([]byte, error) {
+	return fetchURL(url)
+}
+
+func (SystemExecutor) VerifySHA256(path, expected string) error {
+	return verifySHA256File(path, expected)
+}
+
+func (SystemExecutor) VerifySignature(url string, data, signature []byte, keyring string) error {
+	return verifySignature(data, signature, keyring)
+}
+
+func (SystemExecutor) Extract(archive, dest string) error {
+	return extractTarGz(archive, dest)
+}
+
+// Operation is a single side effect captured by a Recorder.
+type Operation struct {
+	Kind   string // run, start, mkdir, write, chown, chmod, rename, remove, download, fetch, verify, extract
+	Target string // command line or path
+	Detail string
+	Data   []byte // file contents for writes; never printed
+}
+
+func (op Operation) String() string {
+	if op.Detail == "" {
+		return fmt.Sprintf("%-8s %s", op.Kind, op.Target)
+	}
+	return fmt.Sprintf("%-8s %s (%s)", op.Kind, op.Target, op.Detail)
+}
+
+// Recorder is a dry-run Executor: it records every operation in order and
+// performs none of them.
+type Recorder struct {
+	ops     []Operation
+	planned map[string]bool // paths that would exist once the plan has run, true for directories
+}
+
+func NewRecorder() *Recorder {
+	return &Recorder{planned: map[string]bool{}}
+}
+
+// Operations returns the recorded operations in the order they were issued.
+func (r *Recorder) Operations() []Operation {
+	return r.ops
+}
+
+// Commands returns the command lines of all run and start operations.
+func (r *Recorder) Commands() []string {
+	var cmds []string
+	for _, op := range r.ops {
+		if op.Kind == "run" || op.Kind == "start" {
+			cmds = append(cmds, op.Target)
+		}
+	}
+	return cmds
+}
+
+func (r *Recorder) record(kind, target, detail string) {
+	r.ops = append(r.ops, Operation{Kind: kind, Target: target, Detail: detail})
+}
+
+func (r *Recorder) Run(name string, args ...string) ([]byte, error) {
+	r.record("run", formatCommand(name, args), "")
+	return nil, nil
+}
+
+func (r *Recorder) Start(cmd *exec.Cmd, logPath string) (int, error) {
+	detail := ""
+	if logPath != "" {
+		detail = "logs: " + logPath
+	}
+	r.record("start", formatCommand(cmd.Args[0], cmd.Args[1:]), detail)
+	return 0, nil
+}
+
+// Stat reports paths created earlier in the plan as existing and falls back
+// to the real filesystem for everything else.
+func (r *Recorder) Stat(path string) (os.FileInfo, error) {
+	for p := filepath.Clean(path); ; p = filepath.Dir(p) {
+		if dir, ok := r.planned[p]; ok {
+			return plannedFile{name: filepath.Base(path), dir: dir && p == filepath.Clean(path)}, nil
+		}
+		if p == filepath.Dir(p) {
+			break
+		}
+	}
+	return os.Stat(path)
+}
+
+func (r *Recorder) MkdirAll(path string, perm os.FileMode) error {
+	r.planned[filepath.Clean(path)] = true
+	r.record("mkdir", path, fmt.Sprintf("mode %04o", perm))
+	return nil
+}
+
+func (r *Recorder) WriteFile(path string, data []byte, perm os.FileMode) error {
+	r.planned[filepath.Clean(path)] = false
+	r.ops = append(r.ops, Operation{
+		Kind:   "write",
+		Target: path,
+		Detail: fmt.Sprintf("%d bytes, mode %04o", len(data), perm),
+		Data:   data,
+	})
+	return nil
+}
+
+func (r *Recorder) Chown(path, username string, recursive bool) error {
+	detail := "owner " + username
+	if recursive {
+		detail += ", recursive"
+	}
+	r.record("chown", path, detail)
+	return nil
+}
+
+func (r *Recorder) Chmod(path string, perm os.FileMode) error {
+	r.record("chmod", path, fmt.Sprintf("mode %04o", perm))
+	return nil
+}
+
+func (r *Recorder) Rename(src, dst string) error {
+	r.planned[filepath.Clean(dst)] = r.planned[filepath.Clean(src)]
+	r.record("rename", src, "to "+dst)
+	return nil
+}
+
+func (r *Recorder) Remove(path string) error {
+	delete(r.planned, filepath.Clean(path))
+	r.record("remove", path, "")
+	return nil
+}
+
+func (r *Recorder) Download(target, url string) error {
+	r.planned[filepath.Clean(target)] = false
+	r.record("download", url, "to "+target)
+	return nil
+}
+
+// Fetch returns no data: a dry run does not touch the network, so what the
+// file would hold is only known once the plan runs.
+func (r *Recorder) Fetch(url string) ([]byte, error) {
+	r.record("fetch", url, "")
+	return nil, nil
+}
+
+func (r *Recorder) VerifySHA256(path, expected string) error {
+	r.record("verify", path, "sha256 "+expected)
+	return nil
+}
+
+func (r *Recorder) VerifySignature(url string, data, signature []byte, keyring string) error {
+	r.record("verify", url, "gpg signature, keyring "+keyring)
+	return nil
+}
+
+func (r *Recorder) Extract(archive, dest string) error {
+	r.planned[filepath.Clean(dest)] = true
+	r.record("extract", archive, "to "+dest)
+	return nil
+}
+
+// formatCommand renders a command line, quoting arguments that contain spaces.
+func formatCommand(name string, args []string) string {
+	parts := []string{name}
+	for _, arg := range args {
+		if arg == "" || strings.ContainsAny(arg, " \t\"'$") {
+			arg = "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+		}
+		parts = append(parts, arg)
+	}
+	return strings.Join(parts, " ")
+}
+
+// plannedFile stands in for a file that only exists in a dry-run plan.
+type plannedFile struct {
+	name string
+	dir  bool
+}
+
+func (f plannedFile) Name() string       { return f.name }
+func (f plannedFile) Size() int64        { return 0 }
+func (f plannedFile) ModTime() time.Time { return time.Time{} }
+func (f plannedFile) IsDir() bool        { return f.dir }
+func (f plannedFile) Sys() any           { return nil }
+
+func (f plannedFile) Mode() os.FileMode {
+	if f.dir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
@@ -0,0 +1,158 @@
+package pkg
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/virtlabs-io/dbcp-agent/internal/config"
+	"github.com/virtlabs-io/dbcp-agent/internal/system"
+)
+
+func TestRecorderPostgresAptSequence(t *testing.T) {
+	rec := NewRecorder()
+	defer SetExecutor(SetExecutor(rec))
+
+	src := config.RepoSource{Debian: "https://apt.postgresql.org/pub/repos/apt"}
+	if err := installPostgresApt("16", "official", src); err != nil {
+		t.Fatalf("installPostgresApt failed: %v", err)
+	}
+
+	want := []string{
+		"bash -c 'apt-get update'",
+		"bash -c 'apt-get install -y curl ca-certificates gnupg lsb-release'",
+		"bash -c 'mkdir -p /usr/share/postgresql-common/pgdg'",
+		"bash -c 'curl -fsSL https://www.postgresql.org/media/keys/ACCC4CF8.asc -o /usr/share/postgresql-common/pgdg/official.asc'",
+		`bash -c 'sh -c '\''echo "deb [signed-by=/usr/share/postgresql-common/pgdg/official.asc] https://apt.postgresql.org/pub/repos/apt $(lsb_release -cs)-pgdg main" > /etc/apt/sources.list.d/pgdg.list'\'''`,
+		"bash -c 'apt-get update'",
+		"bash -c 'apt-get install -y postgresql-16'",
+		"bash -c 'systemctl stop postgresql'",
+		"bash -c 'systemctl disable postgresql'",
+		"bash -c 'rm -Rf /etc/postgresql*'",
+		"bash -c 'rm -Rf /var/lib/postgresql'",
+	}
+	if got := rec.Commands(); !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected command sequence:\n got: %q\nwant: %q", got, want)
+	}
+}
+
+func TestRecorderPostgresRpmSequence(t *testing.T) {
+	rec := NewRecorder()
+	defer SetExecutor(SetExecutor(rec))
+
+	cfg := &config.AgentConfig{
+		Node: config.NodeConfig{
+			TmpPath:    "/dbcp/tmp",
+			PostgreSQL: config.PostgreSQLConfig{Version: "16"},
+		},
+		Repositories: config.Repositories{
+			PostgreSQL: config.RepoEntry{
+				Default: "official",
+				Sources: map[string]config.RepoSource{
+					"official": {RHEL: "https://download.postgresql.org/pub/repos/yum"},
+				},
+			},
+		},
+	}
+	osInfo := &system.OSInfo{ID: "rocky", VersionID: "9.3", Family: "rhel", Arch: "arm64"}
+
+	if err := InstallPostgreSQL(cfg, osInfo); err != nil {
+		t.Fatalf("InstallPostgreSQL failed: %v", err)
+	}
+
+	want := []string{
+		"bash -c 'curl -sSL -o /dbcp/tmp/pgdg-redhat-repo-latest.noarch.rpm https://download.postgresql.org/pub/repos/yum/reporpms/EL-9-aarch64/pgdg-redhat-repo-latest.noarch.rpm'",
+		"bash -c 'dnf install -y /dbcp/tmp/pgdg-redhat-repo-latest.noarch.rpm'",
+		"bash -c 'dnf -qy module disable postgresql'",
+		"bash -c 'dnf install -y postgresql16-server postgresql16'",
+	}
+	if got := rec.Commands(); !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected command sequence:\n got: %q\nwant: %q", got, want)
+	}
+}
+
+func TestRecorderDoesNotTouchFilesystem(t *testing.T) {
+	rec := NewRecorder()
+	defer SetExecutor(SetExecutor(rec))
+
+	dir := t.TempDir() + "/nested/dir"
+	if err := MkdirAllAsUser(dir, "nobody-that-does-not-exist", 0755); err != nil {
+		t.Fatalf("MkdirAllAsUser failed: %v", err)
+	}
+
+	if _, err := (SystemExecutor{}).Stat(dir); err == nil {
+		t.Errorf("dry-run should not have created %s", dir)
+	}
+	if _, err := rec.Stat(dir + "/file"); err != nil {
+		t.Errorf("expected planned directory to be reported as existing: %v", err)
+	}
+	if info, err := rec.Stat(dir); err != nil || !info.IsDir() {
+		t.Errorf("expected planned directory to be reported as a directory: %v", err)
+	}
+	rec.WriteFile(dir+"/conf", nil, 0644)
+	if info, err := rec.Stat(dir + "/conf"); err != nil || info.IsDir() {
+		t.Errorf("expected planned file to be reported as a regular file: %v", err)
+	}
+
+	ops := rec.Operations()
+	if len(ops) != 3 || ops[0].Kind != "mkdir" || ops[1].Kind != "chown" || ops[2].Kind != "write" {
+		t.Errorf("unexpected operations: %v", ops)
+	}
+}
+
+func TestRecorderPostgresMirrorSequence(t *testing.T) {
+	mirror := config.RepoSource{
+		BaseURL:    "https://mirror.example.com/postgresql/",
+		DebianPath: "/debian",
+		RHELPath:   "/rhel/$releasever/$basearch",
+		SigningKey: "/etc/dbcp/keys/mirror.asc",
+	}
+	cfg := &config.AgentConfig{
+		Node: config.NodeConfig{PostgreSQL: config.PostgreSQLConfig{Version: "16"}},
+		Repositories: config.Repositories{
+			PostgreSQL: config.RepoEntry{
+				Default: "custom",
+				Sources: map[string]config.RepoSource{"custom": mirror},
+			},
+		},
+	}
+
+	rec := NewRecorder()
+	defer SetExecutor(SetExecutor(rec))
+
+	if err := InstallPostgreSQL(cfg, &system.OSInfo{ID: "ubuntu", Family: "debian", Arch: "amd64"}); err != nil {
+		t.Fatalf("apt mirror install failed: %v", err)
+	}
+	cmds := rec.Commands()
+	if cmds[3] != "bash -c 'install -m 0644 /etc/dbcp/keys/mirror.asc /usr/share/postgresql-common/pgdg/custom.asc'" {
+		t.Errorf("unexpected key installation: %s", cmds[3])
+	}
+	if !strings.Contains(cmds[4], "deb [signed-by=/usr/share/postgresql-common/pgdg/custom.asc] https://mirror.example.com/postgresql/debian $(lsb_release -cs)-pgdg main") {
+		t.Errorf("unexpected apt source: %s", cmds[4])
+	}
+
+	rec = NewRecorder()
+	SetExecutor(rec)
+
+	if err := InstallPostgreSQL(cfg, &system.OSInfo{ID: "rocky", VersionID: "9", Family: "rhel", Arch: "amd64"}); err != nil {
+		t.Fatalf("yum mirror install failed: %v", err)
+	}
+	op := rec.Operations()[0]
+	if op.Kind != "write" || op.Target != "/etc/yum.repos.d/dbcp-postgresql.repo" {
+		t.Fatalf("expected the .repo file to be written first, got %v", op)
+	}
+	for _, want := range []string{
+		"baseurl=https://mirror.example.com/postgresql/rhel/$releasever/$basearch",
+		"gpgcheck=1",
+		"gpgkey=file:///etc/dbcp/keys/mirror.asc",
+	} {
+		if !strings.Contains(string(op.Data), want) {
+			t.Errorf("expected %q in repo file:\n%s", want, op.Data)
+		}
+	}
+	for _, cmd := range rec.Commands() {
+		if strings.Contains(cmd, "pgdg-redhat-repo") {
+			t.Errorf("mirror installs must not fetch the PGDG repo RPM: %s", cmd)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package pkg
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/virtlabs-io/dbcp-agent/internal/config"
+)
+
+// healthTimeout bounds every probe so a hung service cannot stall the agent.
+const healthTimeout = 3 * time.Second
+
+// ETCDHealth queries the local etcd member's /health endpoint.
+func ETCDHealth(cfg *config.AgentConfig) error {
+	client, scheme, err := etcdHealthClient(cfg.Node.ETCD)
+	if err != nil {
+		return err
+	}
+	return etcdMemberHealth(client, fmt.Sprintf("%s://127.0.0.1:%d/health", scheme, cfg.Node.ETCD.ClientPort))
+}
+
+// ETCDClusterHealth queries /health on every member in cluster.nodes, so a
+// member is only restarted while the others can keep quorum.
+func ETCDClusterHealth(cfg *config.AgentConfig) error {
+	if len(cfg.Cluster.Nodes) == 0 {
+		return ETCDHealth(cfg)
+	}
+	client, scheme, err := etcdHealthClient(cfg.Node.ETCD)
+	if err != nil {
+		return err
+	}
+	for _, node := range cfg.Cluster.Nodes {
+		url := fmt.Sprintf("%s://%s/health", scheme, net.JoinHostPort(node.Host, strconv.Itoa(cfg.Node.ETCD.ClientPort)))
+		if err := etcdMemberHealth(client, url); err != nil {
+			return fmt.Errorf("etcd member %s: %w", node.Name, err)
+		}
+	}
+	return nil
+}
+
+func etcdHealthClient(etcd config.EtcdConfig) (*http.Client, string, error) {
+	client := &http.Client{Timeout: healthTimeout}
+	if !etcd.TLSEnabled() {
+		return client, "http", nil
+	}
+	tlsConfig, err := etcdClientTLS(etcd)
+	if err != nil {
+		return nil, "", err
+	}
+	client.Transport = &http.Transport{TLSClientConfig: tlsConfig}
+	return client, "https", nil
+}
+
+func etcdMemberHealth(client *http.Client, url string) error {
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var health struct {
+		Health string `json:"health"`
+		Reason string `json:"reason"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&health); err != nil {
+		return fmt.Errorf("invalid etcd health response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK || health.Health != "true" {
+		return fmt.Errorf("etcd reports unhealthy (%s): %s", resp.Status, health.Reason)
+	}
+	return nil
+}
+
+// PatroniHealth queries the liveness endpoint of the local Patroni REST API.
+func PatroniHealth(cfg *config.AgentConfig) error {
+	baseURL, client, err := patroniAPIClient(cfg, healthTimeout)
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.Get(baseURL + "/liveness")
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("patroni liveness check returned %s", resp.Status)
+	}
+	return nil
+}
+
+// etcdClientTLS authenticates to etcd with the node's own certificate, as
+// etcd runs with client certificate authentication when TLS is on.
+func etcdClientTLS(etcd config.EtcdConfig) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(etcd.CertFile, etcd.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load etcd client certificate: %w", err)
+	}
+
+	caPEM, err := os.ReadFile(etcd.CAFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read etcd CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("no certificates found in %s", etcd.CAFile)
+	}
+
+	return &tls.Config{Certificates: []tls.Certificate{cert}, RootCAs: pool}, nil
+}
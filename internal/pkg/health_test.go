@@ -0,0 +1,111 @@
+package pkg
+
+import (
+	"encoding/pem"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/virtlabs-io/dbcp-agent/internal/config"
+)
+
+func localServer(t *testing.T, handler http.HandlerFunc) int {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	return srv.Listener.Addr().(*net.TCPAddr).Port
+}
+
+func TestETCDHealth(t *testing.T) {
+	healthy := true
+	port := localServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" {
+			http.NotFound(w, r)
+			return
+		}
+		if healthy {
+			w.Write([]byte(`{"health":"true","reason":""}`))
+		} else {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(`{"health":"false","reason":"RAFT NO LEADER"}`))
+		}
+	})
+	cfg := &config.AgentConfig{Node: config.NodeConfig{ETCD: config.EtcdConfig{ClientPort: port}}}
+
+	if err := ETCDHealth(cfg); err != nil {
+		t.Errorf("expected healthy etcd, got %v", err)
+	}
+
+	healthy = false
+	if err := ETCDHealth(cfg); err == nil {
+		t.Error("expected an unhealthy etcd to be reported")
+	}
+}
+
+func TestETCDClusterHealth(t *testing.T) {
+	port := localServer(t, func(w http.ResponseWriter, r *http.Request) {
+		// node2 is reached as localhost and has lost the leader
+		if strings.HasPrefix(r.Host, "localhost:") {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(`{"health":"false","reason":"RAFT NO LEADER"}`))
+			return
+		}
+		w.Write([]byte(`{"health":"true","reason":""}`))
+	})
+	cfg := &config.AgentConfig{Node: config.NodeConfig{ETCD: config.EtcdConfig{ClientPort: port}}}
+	cfg.Cluster.Nodes = []config.ClusterNode{{Name: "node1", Host: "127.0.0.1"}}
+
+	if err := ETCDClusterHealth(cfg); err != nil {
+		t.Errorf("expected a healthy cluster, got %v", err)
+	}
+
+	cfg.Cluster.Nodes = append(cfg.Cluster.Nodes, config.ClusterNode{Name: "node2", Host: "localhost"})
+	if err := ETCDClusterHealth(cfg); err == nil || !strings.Contains(err.Error(), "node2") {
+		t.Errorf("expected node2 to be reported unhealthy, got %v", err)
+	}
+}
+
+func TestPatroniHealth(t *testing.T) {
+	port := localServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/liveness" {
+			http.NotFound(w, r)
+		}
+	})
+	cfg := &config.AgentConfig{Node: config.NodeConfig{Patroni: config.PatroniConfig{Port: port}}}
+
+	if err := PatroniHealth(cfg); err != nil {
+		t.Errorf("expected live Patroni, got %v", err)
+	}
+
+	cfg.Node.Patroni.Port = 1
+	if err := PatroniHealth(cfg); err == nil {
+		t.Error("expected an unreachable Patroni to be reported")
+	}
+}
+
+func TestPatroniHealthOverTLS(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	t.Cleanup(srv.Close)
+
+	caFile := filepath.Join(t.TempDir(), "ca.crt")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	if err := os.WriteFile(caFile, caPEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.AgentConfig{}
+	cfg.Node.Patroni.Port = srv.Listener.Addr().(*net.TCPAddr).Port
+
+	// Plain http against a TLS listener fails
+	if err := PatroniHealth(cfg); err == nil {
+		t.Error("expected http to fail against an https API")
+	}
+
+	cfg.Node.Patroni.RestAPI = config.RestAPIConfig{CertFile: "/etc/dbcp/pki/node.crt", CAFile: caFile}
+	if err := PatroniHealth(cfg); err != nil {
+		t.Errorf("expected live Patroni over https, got %v", err)
+	}
+}
@@ -54,8 +54,11 @@ func IsETCDInstalled(cfg *config.AgentConfig) bool {
 	return strings.Contains(string(output), cfg.Node.ETCD.Version)
 }
 
+// IsPatroniInstalled reports whether the patroni StartPatroni would run is
+// the configured version. A different installed version is logged so it is
+// not mistaken for a missing install.
 func IsPatroniInstalled(cfg *config.AgentConfig) bool {
-	path, err := exec.LookPath("patroni")
+	path, err := exec.LookPath(PatroniBinary(cfg))
 	if err != nil {
 		return false
 	}
@@ -67,7 +70,22 @@ func IsPatroniInstalled(cfg *config.AgentConfig) bool {
 		return false
 	}
 
-	return strings.Contains(string(output), cfg.Node.Patroni.Version)
+	installed := parsePatroniVersion(string(output))
+	if want := cfg.Node.Patroni.Version; want != "" && installed != want {
+		logger.Warn("Patroni version mismatch: %s has %q, patroni.version is %q", path, installed, want)
+		return false
+	}
+	return true
+}
+
+// parsePatroniVersion extracts the version from "patroni --version" output,
+// e.g. "patroni 4.0.4".
+func parsePatroniVersion(output string) string {
+	fields := strings.Fields(output)
+	if len(fields) == 0 {
+		return ""
+	}
+	return fields[len(fields)-1]
 }
 
 // Public wrappers: We should use these in main.go or during orchestration
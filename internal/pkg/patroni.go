@@ -3,12 +3,12 @@ package pkg
 import (
 	"bytes"
 	"fmt"
-	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"syscall"
-	"text/template"
 
 	"github.com/virtlabs-io/dbcp-agent/internal/config"
 	"github.com/virtlabs-io/dbcp-agent/internal/logger"
@@ -19,10 +19,14 @@ type PatroniTemplateData struct {
 	Cluster   config.ClusterConfig
 	Node      config.NodeConfig
 	Host      string
-	EtcdHosts string // comma-separated list of etcd endpoints for etcd3
+	EtcdHosts []string // host:port of every etcd client endpoint, for etcd3
+	// Etcd3 is the whole etcd3 section, with TLS settings matching etcd's
+	Etcd3 PatroniEtcd
 
 	// Patroni API
 	APIListen string
+	RestAPI   PatroniRestAPI
+	Ctl       *PatroniCtl // nil unless the REST API is served over TLS
 
 	// PostgreSQL details
 	PGPort    int
@@ -30,162 +34,467 @@ type PatroniTemplateData struct {
 	PGBinDir  string
 
 	// Users
-	PGUsers     map[string]config.PostgresUser // All defined PostgreSQL users
-	SuperUser   config.UserCredentials         // for authentication.superuser
-	Replication config.UserCredentials         // for authentication.replication
+	PGUsers       map[string]config.PostgresUser // All defined PostgreSQL users
+	PostBootstrap string                         // script that creates PGUsers in a new cluster
+	SuperUser     config.UserCredentials         // for authentication.superuser
+	Replication   config.UserCredentials         // for authentication.replication
 
 	// Init and DCS
-	InitDB      []string         // initdb steps
-	PGHBA       []string         // initdb steps
+	InitDB      []any            // initdb options: a flag name, or a name/value mapping
+	PGHBA       []string         // pg_hba lines
 	UsePGRewind bool             // from parameters
 	UseSlots    bool             // from parameters
 	DCS         config.DCSConfig // ttl, loop_wait, etc.
 
 	// PostgreSQL runtime parameters
 	Parameters config.PostgresSettings
+	// PGParameters holds every PostgreSQL setting, for bootstrap.dcs and the
+	// local postgresql section. Plain numbers are kept as numbers.
+	PGParameters map[string]any
+	LogLevel     string // Python level name for Patroni's log section
 }
 
-func InstallPatroni(cfg *config.AgentConfig) error {
-	logger.Info("Installing Patroni...")
+func InstallPatroni(cfg *config.AgentConfig, osInfo *system.OSInfo) error {
+	version := cfg.Node.Patroni.Version
+	logger.Info("Installing Patroni %s...", version)
 
-	osInfo, err := system.DetectOS()
-	if err != nil {
-		return fmt.Errorf("failed to detect OS: %w", err)
+	if path, ok := cfg.Repositories.Patroni.BundlePath(); ok {
+		dir, err := resolveBundle(cfg, osInfo, path)
+		if err != nil {
+			return err
+		}
+		return installViaPip(osInfo, patroniVenv(cfg), patroniPipSpec(config.RepoSource{}, version), "--no-index", "--find-links", filepath.Join(dir, "patroni"))
 	}
 
+	// Without configured sources this is pip from PyPI.
+	src := cfg.Repositories.Patroni.Selected()
+
 	switch osInfo.Family {
 	case "debian":
-		return installViaApt("patroni")
+		if src.DebianPackage != "" {
+			return installPatroniApt(src, version)
+		}
 	case "rhel", "fedora", "centos", "rocky", "almalinux", "oracle":
-		return installViaPip("patroni[etcd]")
+		if src.RHELPackage != "" {
+			return installPatroniDnf(src, version)
+		}
 	default:
 		return fmt.Errorf("unsupported OS family: %s", osInfo.Family)
 	}
+
+	var extraArgs []string
+	if src.IndexURL != "" {
+		extraArgs = []string{"--index-url", src.IndexURL}
+	}
+	return installViaPip(osInfo, patroniVenv(cfg), patroniPipSpec(src, version), extraArgs...)
+}
+
+// patroniVenv returns the virtualenv pip installs Patroni into.
+func patroniVenv(cfg *config.AgentConfig) string {
+	if cfg.Node.Patroni.VenvPath != "" {
+		return cfg.Node.Patroni.VenvPath
+	}
+	return config.DefaultPatroniVenv
+}
+
+// PatroniBinary returns the patroni executable to run: the one in the
+// agent's virtualenv, or the one on PATH for distro package installs.
+func PatroniBinary(cfg *config.AgentConfig) string {
+	bin := filepath.Join(patroniVenv(cfg), "bin", "patroni")
+	if _, err := executor.Stat(bin); err == nil {
+		return bin
+	}
+	if path, err := exec.LookPath("patroni"); err == nil {
+		return path
+	}
+	return "patroni"
+}
+
+// patroniPipSpec returns the pip requirement for src, pinned to version.
+func patroniPipSpec(src config.RepoSource, version string) string {
+	spec := src.PipPackage
+	if spec == "" {
+		spec = "patroni[etcd3,psycopg3]"
+	}
+	if version != "" {
+		spec += "==" + version
+	}
+	return spec
 }
 
-func installViaApt(pkg string) error {
+// installPatroniApt installs the Debian package, adding src's repository
+// first when it has one. Pinned versions may downgrade a newer package.
+func installPatroniApt(src config.RepoSource, version string) error {
 	logger.Info("Installing Patroni using apt...")
-	if output, err := exec.Command("apt-get", "update").CombinedOutput(); err != nil {
+
+	if src.Debian != "" {
+		keyPath := "/etc/apt/keyrings/dbcp-patroni.asc"
+		suite := src.DebianSuite
+		if suite == "" {
+			suite = "$(lsb_release -cs)-pgdg"
+		}
+		cmds := []string{
+			"mkdir -p /etc/apt/keyrings",
+			fetchKeyCommand(src.SigningKey, keyPath),
+			fmt.Sprintf(`sh -c 'echo "deb [signed-by=%s] %s %s main" > /etc/apt/sources.list.d/dbcp-patroni.list'`, keyPath, src.Debian, suite),
+		}
+		for _, cmd := range cmds {
+			logger.Debug("Executing: %s", cmd)
+			if err := runCommand(cmd); err != nil {
+				return err
+			}
+		}
+	}
+
+	pkg := src.DebianPackage
+	if version != "" {
+		// Debian versions carry a revision suffix, e.g. 4.0.4-1.pgdg120+1
+		pkg += "=" + version + "-*"
+	}
+
+	if output, err := executor.Run("apt-get", "update"); err != nil {
 		logger.Error("apt-get update failed: %s", string(output))
 		return err
 	}
-	cmd := exec.Command("apt-get", "-y", "install", pkg)
-	if output, err := cmd.CombinedOutput(); err != nil {
+	if output, err := executor.Run("apt-get", "-y", "--allow-downgrades", "install", pkg); err != nil {
 		logger.Error("apt-get install failed: %s", string(output))
 		return err
 	}
 	return nil
 }
 
-func installViaPip(pkg string) error {
+// installPatroniDnf installs the RPM package, adding src's repository first
+// when it has one.
+func installPatroniDnf(src config.RepoSource, version string) error {
+	logger.Info("Installing Patroni using dnf...")
+
+	if src.RHEL != "" {
+		gpgKey := src.SigningKey
+		if !strings.Contains(gpgKey, "://") {
+			gpgKey = "file://" + gpgKey
+		}
+
+		repo := fmt.Sprintf(`[dbcp-patroni]
+name=Patroni (internal repository)
+baseurl=%s
+enabled=1
+gpgcheck=1
+gpgkey=%s
+`, src.RHEL, gpgKey)
+
+		repoFile := "/etc/yum.repos.d/dbcp-patroni.repo"
+		if err := executor.WriteFile(repoFile, []byte(repo), 0644); err != nil {
+			return fmt.Errorf("failed to write %s: %w", repoFile, err)
+		}
+	}
+
+	pkg := src.RHELPackage
+	if version != "" {
+		pkg += "-" + version
+	}
+
+	if output, err := executor.Run("dnf", "install", "-y", pkg); err != nil {
+		logger.Error("dnf install failed: %s", string(output))
+		return err
+	}
+	return nil
+}
+
+// installVenvSupport installs the distro package behind python3 -m venv.
+// Debian and Ubuntu ship it separately from python3 (python3-venv); on
+// RHEL-family systems python3-virtualenv brings in the same support.
+func installVenvSupport(osInfo *system.OSInfo) error {
+	name, args := "dnf", []string{"install", "-y", "python3-virtualenv"}
+	if osInfo.Family == "debian" {
+		name, args = "apt-get", []string{"install", "-y", "python3-venv"}
+	}
+	if output, err := executor.Run(name, args...); err != nil {
+		logger.Error("%s install failed: %s", name, string(output))
+		return fmt.Errorf("failed to install virtualenv support: %w", err)
+	}
+	return nil
+}
+
+// installViaPip installs pkg into the virtualenv at venv, creating it first.
+// Keeping Patroni out of the system interpreter avoids PEP 668 refusals and
+// clashes with distro Python packages.
+func installViaPip(osInfo *system.OSInfo, venv, pkg string, extraArgs ...string) error {
+	python := filepath.Join(venv, "bin", "python")
+	if _, err := executor.Stat(python); err != nil {
+		logger.Info("Creating Patroni virtualenv in %s", venv)
+		if err := installVenvSupport(osInfo); err != nil {
+			return err
+		}
+		if err := executor.MkdirAll(venv, 0755); err != nil {
+			return fmt.Errorf("failed to create %s: %w", venv, err)
+		}
+		if output, err := executor.Run("python3", "-m", "venv", venv); err != nil {
+			logger.Error("python3 -m venv failed: %s", string(output))
+			return fmt.Errorf("failed to create virtualenv: %w", err)
+		}
+	}
+
 	logger.Info("Installing Patroni using pip...")
-	cmd := exec.Command("python3", "-m", "pip", "install", pkg)
-	if output, err := cmd.CombinedOutput(); err != nil {
+	args := append([]string{"-m", "pip", "install"}, extraArgs...)
+	if output, err := executor.Run(python, append(args, pkg)...); err != nil {
 		logger.Error("pip install failed: %s", string(output))
 		return err
 	}
 	return nil
 }
 
+// GeneratePatroniConfig writes patroni.yml, rendered from the template or
+// built from typed structs as patroni.generator says, with patroni.extra
+// merged in. Nothing is written unless the result parses as YAML.
 func GeneratePatroniConfig(cfg *config.AgentConfig) error {
 	p := cfg.Node.Patroni
 
-	// Construct ETCD hosts list from all cluster nodes
-	etcdPort := cfg.Node.ETCD.ClientPort
-	var etcdHosts []string
-	for _, node := range cfg.Cluster.Nodes {
-		etcdHosts = append(etcdHosts, fmt.Sprintf(" %s:%d", node.Host, etcdPort))
+	var data []byte
+	var err error
+	if p.Generator == config.PatroniGeneratorStructured {
+		data, err = marshalYAML(BuildPatroniFile(cfg))
+		if err != nil {
+			return fmt.Errorf("failed to encode Patroni config: %w", err)
+		}
+	} else {
+		data, err = renderPatroniTemplate(cfg)
+		if err != nil {
+			return err
+		}
 	}
 
-	var initDB []string
-	for _, item := range cfg.Node.PostgreSQL.InitDB {
-		for k, v := range item {
-			if v == "" {
-				initDB = append(initDB, k)
-			} else {
-				initDB = append(initDB, fmt.Sprintf("%s: %s", k, v))
-			}
+	if len(p.Extra) > 0 {
+		if data, err = mergePatroniExtra(data, p.Extra); err != nil {
+			return err
 		}
 	}
+	if err := checkRenderedYAML(data); err != nil {
+		return err
+	}
+
+	if err := executor.MkdirAll(filepath.Dir(p.ConfigPath), 0755); err != nil {
+		return fmt.Errorf("failed to create config directory: %w", err)
+	}
+
+	if err := executor.WriteFile(p.ConfigPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write patroni.yml: %w", err)
+	}
+	if err := writePostBootstrapScript(cfg); err != nil {
+		return err
+	}
 
-	// var pgHBA []string
-	// for _, item := range cfg.Node.PostgreSQL.PGHBA {
-	// 	pgHBA = append(pgHBA, item)
-	// }
+	logger.Info("Patroni configuration written to %s", p.ConfigPath)
+	return nil
+}
 
+func renderPatroniTemplate(cfg *config.AgentConfig) ([]byte, error) {
 	tmplData := PatroniTemplateData{
 		Cluster:   cfg.Cluster,
 		Node:      cfg.Node,
 		Host:      cfg.Node.Host,
-		EtcdHosts: strings.Join(etcdHosts, ","), // pre-formatted string: "http://host1:2379","http://host2:2379"
+		EtcdHosts: patroniEtcdHosts(cfg),
+		Etcd3:     patroniEtcd3(cfg),
 		APIListen: cfg.Node.Patroni.APIListen,
+		RestAPI:   patroniRestAPI(cfg),
+		Ctl:       patroniCtl(cfg),
 		PGPort:    cfg.Node.PostgreSQL.Parameters.Port,
 		PGDataDir: cfg.Node.PostgreSQL.DataDir,
 		PGBinDir:  cfg.Node.PostgreSQL.BinPath,
 
 		// Users
-		PGUsers:     cfg.Node.PostgreSQL.Users,
-		SuperUser:   cfg.Node.Patroni.Authentication.Superuser,
-		Replication: cfg.Node.Patroni.Authentication.Replication,
+		PGUsers:       cfg.Node.PostgreSQL.Users,
+		PostBootstrap: patroniPostBootstrapPath(cfg),
+		SuperUser:     cfg.Node.Patroni.Authentication.Superuser,
+		Replication:   cfg.Node.Patroni.Authentication.Replication,
 
 		// Init & cluster settings
-		InitDB:      initDB,
-		PGHBA:       cfg.Node.PostgreSQL.PGHBA,
+		InitDB:      patroniInitDB(cfg),
+		PGHBA:       cfg.HBARules(),
 		UsePGRewind: cfg.Node.PostgreSQL.Parameters.UsePGRewind,
 		UseSlots:    cfg.Node.PostgreSQL.Parameters.UseSlots,
 		DCS:         cfg.Node.Patroni.DCS,
 		Parameters:  cfg.Node.PostgreSQL.Parameters,
+
+		PGParameters: patroniParameters(cfg),
+		LogLevel:     patroniLogLevel(cfg.LogLevel),
 	}
 
-	tmpl, err := template.ParseFiles(cfg.Node.Patroni.TemplatePath)
-	logger.Debug("Template path: %s", cfg.Node.Patroni.TemplatePath)
+	if path := cfg.Node.Patroni.TemplatePath; path != "" {
+		logger.Debug("Template path: %s", path)
+	}
+	tmpl, err := loadPatroniTemplate(cfg.Node.Patroni.TemplatePath)
 	if err != nil {
-		return fmt.Errorf("failed to load template: %w", err)
+		return nil, err
 	}
 
 	var buf bytes.Buffer
 	if err := tmpl.Execute(&buf, tmplData); err != nil {
-		return fmt.Errorf("failed to execute template: %w", err)
+		return nil, fmt.Errorf("failed to execute template: %w", err)
 	}
+	return buf.Bytes(), nil
+}
 
-	if err := os.MkdirAll(filepath.Dir(p.ConfigPath), 0755); err != nil {
-		return fmt.Errorf("failed to create config directory: %w", err)
+// patroniEtcdHosts lists the etcd client endpoint of every cluster node.
+func patroniEtcdHosts(cfg *config.AgentConfig) []string {
+	var hosts []string
+	for _, node := range cfg.Cluster.Nodes {
+		hosts = append(hosts, fmt.Sprintf("%s:%d", node.Host, cfg.Node.ETCD.ClientPort))
 	}
+	return hosts
+}
 
-	if err := os.WriteFile(p.ConfigPath, buf.Bytes(), 0644); err != nil {
-		return fmt.Errorf("failed to write patroni.yml: %w", err)
-	}
+// patroniPostBootstrapPath returns where the post_bootstrap script lives:
+// next to patroni.yml.
+func patroniPostBootstrapPath(cfg *config.AgentConfig) string {
+	return filepath.Join(filepath.Dir(cfg.Node.Patroni.ConfigPath), "post_bootstrap.sh")
+}
 
-	logger.Info("Patroni configuration written to %s", p.ConfigPath)
+// writePostBootstrapScript writes the script Patroni runs once after it
+// initializes a new cluster. Patroni 4 dropped bootstrap.users, so this is
+// what creates node.postgresql.users. It holds their passwords and is only
+// readable by the node user, which Patroni runs as.
+func writePostBootstrapScript(cfg *config.AgentConfig) error {
+	path := patroniPostBootstrapPath(cfg)
+	if err := executor.WriteFile(path, postBootstrapScript(cfg), 0700); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	if cfg.Node.User != "" {
+		if err := executor.Chown(path, cfg.Node.User, false); err != nil {
+			return fmt.Errorf("failed to chown %s: %w", path, err)
+		}
+	}
 	return nil
 }
 
+// postBootstrapScript returns a shell script that creates or updates every
+// configured user through psql. Patroni passes a connection URL for the new
+// primary as the only argument.
+func postBootstrapScript(cfg *config.AgentConfig) []byte {
+	var sql strings.Builder
+	users := cfg.Node.PostgreSQL.Users
+	names := make([]string, 0, len(users))
+	for name := range users {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		user := users[name]
+		attrs := []string{"LOGIN"}
+		for _, opt := range user.Options {
+			switch opt {
+			case "login":
+			case "nologin":
+				attrs[0] = "NOLOGIN"
+			default:
+				attrs = append(attrs, strings.ToUpper(opt))
+			}
+		}
+		ident := `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+		literal := "'" + strings.ReplaceAll(name, "'", "''") + "'"
+		fmt.Fprintf(&sql, "DO $$BEGIN IF NOT EXISTS (SELECT FROM pg_roles WHERE rolname = %s) THEN CREATE ROLE %s; END IF; END$$;\n", literal, ident)
+		fmt.Fprintf(&sql, "ALTER ROLE %s WITH %s PASSWORD '%s';\n", ident, strings.Join(attrs, " "), strings.ReplaceAll(user.Password, "'", "''"))
+	}
+
+	psql := filepath.Join(cfg.Node.PostgreSQL.BinPath, "psql")
+	return []byte(fmt.Sprintf(`#!/bin/sh
+# Written by dbcp-agent: creates node.postgresql.users once Patroni has
+# initialized the cluster.
+set -e
+exec %s "$1" --no-psqlrc -v ON_ERROR_STOP=1 <<'DBCP_USERS_SQL'
+%sDBCP_USERS_SQL
+`, psql, sql.String()))
+}
+
+// patroniInitDB turns initdb entries into Patroni's form: a flag name, or
+// a name/value mapping.
+func patroniInitDB(cfg *config.AgentConfig) []any {
+	var initDB []any
+	for _, item := range cfg.Node.PostgreSQL.InitDB {
+		keys := make([]string, 0, len(item))
+		for k := range item {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if v := item[k]; v == "" {
+				initDB = append(initDB, k)
+			} else {
+				initDB = append(initDB, map[string]string{k: v})
+			}
+		}
+	}
+	return initDB
+}
+
+// patroniParameters returns the PostgreSQL settings for patroni.yml. The
+// socket directory defaults to tmp_path, and with a tuning profile the
+// computed settings apply, unless the parameters set them.
+func patroniParameters(cfg *config.AgentConfig) map[string]any {
+	params := map[string]any{"unix_socket_directories": cfg.Node.TmpPath}
+	tuned, err := tunedParameters(cfg)
+	if err != nil {
+		logger.Warn("Tuning skipped, PostgreSQL defaults apply: %v", err)
+	}
+	for name, value := range tuned {
+		params[name] = parameterValue(value)
+	}
+	for name, value := range cfg.Node.PostgreSQL.Parameters.Settings() {
+		params[name] = parameterValue(value)
+	}
+	return params
+}
+
+// parameterValue keeps plain numbers as numbers and everything else as a
+// string, so settings such as "on", "4GB" or "1 (node2,node3)" reach
+// Patroni as strings. Octal modes such as "0600" stay strings too: as the
+// number 600 PostgreSQL would reject or misread them.
+func parameterValue(value string) any {
+	if strings.ContainsAny(value, "xXeEnN_") || isOctal(value) {
+		return value
+	}
+	if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return n
+	}
+	if f, err := strconv.ParseFloat(value, 64); err == nil {
+		return f
+	}
+	return value
+}
+
+// isOctal reports whether value is written with a leading zero, the way
+// PostgreSQL spells file modes (unix_socket_permissions, log_file_mode).
+func isOctal(value string) bool {
+	digits := strings.TrimLeft(value, "+-")
+	return len(digits) > 1 && digits[0] == '0' && digits[1] >= '0' && digits[1] <= '9'
+}
+
 func StartPatroni2(cfg *config.AgentConfig) error {
 	configPath := cfg.Node.Patroni.ConfigPath
-	binary := "patroni"
+	binary := PatroniBinary(cfg)
 
 	logger.Info("Starting Patroni using config: %s", configPath)
 
 	cmd := exec.Command(binary, configPath)
 
-	// Pipe output
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	// Pipe output through the agent log
+	output := logger.NewComponentWriter("patroni", "")
+	cmd.Stdout = output
+	cmd.Stderr = output
 
 	// Optional: set env or working dir if needed
 	// cmd.Env = os.Environ()
 	// cmd.Dir = filepath.Dir(configPath)
 
-	if err := cmd.Start(); err != nil {
+	pid, err := executor.Start(cmd, "")
+	if err != nil {
 		return fmt.Errorf("failed to start Patroni: %w", err)
 	}
 
-	logger.Info("Patroni process started with PID: %d", cmd.Process.Pid)
+	logger.Info("Patroni process started with PID: %d", pid)
 	return nil
 }
 
 func StartPatroni(cfg *config.AgentConfig) error {
-	bin := "patroni"
 	user := cfg.Node.User
 	configPath := cfg.Node.Patroni.ConfigPath
 
@@ -193,41 +502,68 @@ func StartPatroni(cfg *config.AgentConfig) error {
 		return fmt.Errorf("patroni.config_path must be defined")
 	}
 
-	if _, err := os.Stat(configPath); err != nil {
+	if _, err := executor.Stat(configPath); err != nil {
 		return fmt.Errorf("patroni config not found at %s: %v", configPath, err)
 	}
 
-	logger.Info("Starting Patroni using user: %s", user)
-	cmd := exec.Command("sudo", "-u", user, bin, configPath)
+	if UseSystemd(cfg) {
+		if err := InstallUnit(cfg, PatroniUnitFor(cfg)); err != nil {
+			return err
+		}
+	} else {
+		logger.Info("Starting Patroni using user: %s", user)
+		cmd := PatroniCommand(cfg)
 
-	logFile := filepath.Join(cfg.Node.TmpPath, "patroni.log")
-	log, err := os.OpenFile(logFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
-	if err != nil {
-		return fmt.Errorf("failed to open patroni log file: %v", err)
-	}
-	cmd.Stdout = log
-	cmd.Stderr = log
+		logFile := filepath.Join(cfg.Node.TmpPath, "patroni.log")
+		pid, err := executor.Start(cmd, logFile)
+		if err != nil {
+			return fmt.Errorf("failed to start Patroni: %w", err)
+		}
 
-	if err := cmd.Start(); err != nil {
-		return fmt.Errorf("failed to start Patroni: %w", err)
+		logger.Info("Patroni started with PID %d", pid)
 	}
 
-	logger.Info("Patroni started with PID %d", cmd.Process.Pid)
+	SecurePGDataDir(cfg)
+
+	return nil
+}
+
+// PatroniCommand returns the command that runs Patroni as the node's OS user.
+func PatroniCommand(cfg *config.AgentConfig) *exec.Cmd {
+	return exec.Command("sudo", "-u", cfg.Node.User, PatroniBinary(cfg), cfg.Node.Patroni.ConfigPath)
+}
 
-	// Set PG data dir to 0700
+// SecurePGDataDir restricts the PostgreSQL data directory to its owner;
+// PostgreSQL refuses to start from a group- or world-readable one.
+func SecurePGDataDir(cfg *config.AgentConfig) {
 	dataDir := cfg.Node.PostgreSQL.DataDir
-	if err := os.Chmod(dataDir, 0700); err != nil {
+	if err := executor.Chmod(dataDir, 0700); err != nil {
 		logger.Warn("Failed to chmod PostgreSQL data dir (%s) to 0700: %v", dataDir, err)
 	} else {
 		logger.Info("PostgreSQL data directory permissions set to 0700")
 	}
+}
 
-	return nil
+// PatroniUnitFor describes the systemd unit running Patroni. It orders
+// itself after the local etcd member; SIGHUP makes Patroni reload its config.
+func PatroniUnitFor(cfg *config.AgentConfig) SystemdUnit {
+	return SystemdUnit{
+		Name:        PatroniUnit,
+		Description: "Patroni for cluster " + cfg.Cluster.Name + " (dbcp-agent)",
+		After:       []string{ETCDUnit},
+		Type:        "simple",
+		User:        cfg.Node.User,
+		ExecStart:   []string{PatroniBinary(cfg), cfg.Node.Patroni.ConfigPath},
+		ExecReload:  "/bin/kill -s HUP $MAINPID",
+		// Let PostgreSQL shut down on its own after Patroni exits
+		KillMode:  "process",
+		Overrides: cfg.Node.Systemd.PatroniOverrides,
+	}
 }
 
 func StartPatroniDaemon(cfg *config.AgentConfig) error {
 	configPath := cfg.Node.Patroni.ConfigPath
-	binary := "patroni"
+	binary := PatroniBinary(cfg)
 
 	logger.Info("Launching Patroni as daemon with config: %s", configPath)
 
@@ -236,22 +572,18 @@ func StartPatroniDaemon(cfg *config.AgentConfig) error {
 		Setsid: true,
 	}
 
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	output := logger.NewComponentWriter("patroni", "")
+	cmd.Stdout = output
+	cmd.Stderr = output
 
-	if err := cmd.Start(); err != nil {
+	pid, err := executor.Start(cmd, "")
+	if err != nil {
 		return fmt.Errorf("failed to start Patroni daemon: %w", err)
 	}
 
-	logger.Info("Patroni started with PID: %d", cmd.Process.Pid)
+	logger.Info("Patroni started with PID: %d", pid)
 
-	// Set PG data dir to 0700
-	dataDir := cfg.Node.PostgreSQL.DataDir
-	if err := os.Chmod(dataDir, 0700); err != nil {
-		logger.Warn("Failed to chmod PostgreSQL data dir (%s) to 0700: %v", dataDir, err)
-	} else {
-		logger.Info("PostgreSQL data directory permissions set to 0700")
-	}
+	SecurePGDataDir(cfg)
 
 	return nil
 }
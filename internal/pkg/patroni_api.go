@@ -0,0 +1,148 @@
+package pkg
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/virtlabs-io/dbcp-agent/internal/config"
+)
+
+// patroniAPITimeout covers restarts, which Patroni answers only once
+// PostgreSQL is back up.
+const patroniAPITimeout = 2 * time.Minute
+
+// PatchPatroniConfig merges patch into the cluster's dynamic configuration
+// (PATCH /config). Patroni applies it on every member and reloads or flags
+// PostgreSQL for restart as needed.
+func PatchPatroniConfig(cfg *config.AgentConfig, patch map[string]any) error {
+	body, err := json.Marshal(patch)
+	if err != nil {
+		return fmt.Errorf("failed to encode Patroni config patch: %w", err)
+	}
+	return patroniRequest(cfg, http.MethodPatch, "/config", body)
+}
+
+// ReloadPatroni makes Patroni re-read patroni.yml (POST /reload).
+func ReloadPatroni(cfg *config.AgentConfig) error {
+	return patroniRequest(cfg, http.MethodPost, "/reload", nil)
+}
+
+// RestartPostgres restarts PostgreSQL on this member through Patroni
+// (POST /restart), so the cluster knows about it.
+func RestartPostgres(cfg *config.AgentConfig) error {
+	return patroniRequest(cfg, http.MethodPost, "/restart", []byte(`{}`))
+}
+
+// DCSPatch builds a PATCH /config body from the changes that map to
+// Patroni dynamic settings. pg_hba is sent whole, as cfg renders it, since
+// generated rules change with pg_hba_auto.
+func DCSPatch(cfg *config.AgentConfig, changes []config.Change) map[string]any {
+	patch := map[string]any{}
+	for _, c := range changes {
+		if c.DCSKey == "" || c.Class == config.ChangeForbidden {
+			continue
+		}
+
+		// DCS keys are at most two levels deep above a setting's name, and
+		// extension settings keep their dot: postgresql.parameters.pg_stat_statements.track
+		parts := strings.SplitN(c.DCSKey, ".", 3)
+		node := patch
+		for _, part := range parts[:len(parts)-1] {
+			child, ok := node[part].(map[string]any)
+			if !ok {
+				child = map[string]any{}
+				node[part] = child
+			}
+			node = child
+		}
+		// A null value removes the setting from the DCS
+		value := c.New
+		if c.DCSKey == "postgresql.pg_hba" {
+			value = cfg.HBARules()
+		}
+		node[parts[len(parts)-1]] = value
+	}
+	return patch
+}
+
+func patroniRequest(cfg *config.AgentConfig, method, path string, body []byte) error {
+	baseURL, client, err := patroniAPIClient(cfg, patroniAPITimeout)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(method, baseURL+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	setPatroniAuth(req, cfg)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("patroni %s %s failed: %w", method, path, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("patroni %s %s returned %s: %s", method, path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// setPatroniAuth adds the REST API credentials, which Patroni requires
+// for the endpoints that change state when restapi.authentication is set.
+func setPatroniAuth(req *http.Request, cfg *config.AgentConfig) {
+	if api := cfg.Node.Patroni.RestAPI; api.Username != "" {
+		req.SetBasicAuth(api.Username, api.Password)
+	}
+}
+
+// patroniAPIClient returns the local REST API's base URL and a client for
+// it. With restapi TLS the API is reached over https, trusting ca_file (or
+// the system roots), and with the node's certificate when Patroni verifies
+// clients.
+func patroniAPIClient(cfg *config.AgentConfig, timeout time.Duration) (string, *http.Client, error) {
+	client := &http.Client{Timeout: timeout}
+	api := cfg.Node.Patroni.RestAPI
+	if !api.TLSEnabled() {
+		return fmt.Sprintf("http://127.0.0.1:%d", cfg.Node.Patroni.Port), client, nil
+	}
+
+	tlsConfig := &tls.Config{}
+	if api.CAFile != "" {
+		caPEM, err := os.ReadFile(api.CAFile)
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to read Patroni REST API CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return "", nil, fmt.Errorf("no certificates found in %s", api.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if verifiesClients(api) {
+		keyFile := api.KeyFile
+		if keyFile == "" {
+			keyFile = api.CertFile // Patroni accepts the key inside the certificate file
+		}
+		cert, err := tls.LoadX509KeyPair(api.CertFile, keyFile)
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to load Patroni REST API certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	client.Transport = &http.Transport{TLSClientConfig: tlsConfig}
+	return fmt.Sprintf("https://127.0.0.1:%d", cfg.Node.Patroni.Port), client, nil
+}
@@ -0,0 +1,78 @@
+package pkg
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/virtlabs-io/dbcp-agent/internal/config"
+)
+
+func TestDCSPatch(t *testing.T) {
+	cfg := &config.AgentConfig{}
+	cfg.Node.PostgreSQL.PGHBA = []config.HBARule{{Type: "local", Database: "all", User: "all", Method: "peer"}}
+	patch := DCSPatch(cfg, []config.Change{
+		{Path: "node.patroni.dcs.ttl", New: 20, DCSKey: "ttl"},
+		{Path: "node.postgresql.parameters.max_connections", New: 300, DCSKey: "postgresql.parameters.max_connections", Class: config.ChangePostgresRestart},
+		{Path: "node.postgresql.parameters.use_slots", New: false, DCSKey: "postgresql.use_slots"},
+		{Path: "node.postgresql.parameters.pg_stat_statements.track", New: "all", DCSKey: "postgresql.parameters.pg_stat_statements.track"},
+		{Path: "log_level", New: "debug"},
+		{Path: "node.postgresql.pg_hba_auto", New: false, DCSKey: "postgresql.pg_hba"},
+	})
+
+	want := map[string]any{
+		"ttl": 20,
+		"postgresql": map[string]any{
+			"use_slots":  false,
+			"parameters": map[string]any{"max_connections": 300, "pg_stat_statements.track": "all"},
+			"pg_hba":     []string{"local all all peer"},
+		},
+	}
+	if !reflect.DeepEqual(patch, want) {
+		t.Errorf("unexpected patch: %#v", patch)
+	}
+}
+
+func TestPatroniAPIRequests(t *testing.T) {
+	var calls []string
+	var body map[string]any
+	port := localServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := r.BasicAuth(); !ok || user != "patroni" || pass != "s3cret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		calls = append(calls, r.Method+" "+r.URL.Path)
+		if r.URL.Path == "/config" {
+			data, _ := io.ReadAll(r.Body)
+			json.Unmarshal(data, &body)
+		}
+		if r.URL.Path == "/restart" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("restart already in progress"))
+		}
+	})
+	cfg := &config.AgentConfig{Node: config.NodeConfig{Patroni: config.PatroniConfig{
+		Port:    port,
+		RestAPI: config.RestAPIConfig{Username: "patroni", Password: "s3cret"},
+	}}}
+
+	if err := PatchPatroniConfig(cfg, map[string]any{"ttl": 20}); err != nil {
+		t.Errorf("PATCH /config failed: %v", err)
+	}
+	if body["ttl"] != float64(20) {
+		t.Errorf("unexpected patch body: %v", body)
+	}
+	if err := ReloadPatroni(cfg); err != nil {
+		t.Errorf("POST /reload failed: %v", err)
+	}
+	if err := RestartPostgres(cfg); err == nil {
+		t.Error("expected a failed restart to be reported")
+	}
+
+	want := []string{"PATCH /config", "POST /reload", "POST /restart"}
+	if !reflect.DeepEqual(calls, want) {
+		t.Errorf("expected %v, got %v", want, calls)
+	}
+}
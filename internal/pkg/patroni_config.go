@@ -0,0 +1,250 @@
+package pkg
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/virtlabs-io/dbcp-agent/internal/config"
+	"gopkg.in/yaml.v3"
+)
+
+// PatroniFile mirrors the parts of Patroni's YAML configuration the agent
+// sets. Anything else goes through patroni.extra.
+type PatroniFile struct {
+	Scope      string             `yaml:"scope"`
+	Namespace  string             `yaml:"namespace,omitempty"`
+	Name       string             `yaml:"name"`
+	Log        PatroniLog         `yaml:"log"`
+	RestAPI    PatroniRestAPI     `yaml:"restapi"`
+	Etcd3      PatroniEtcd        `yaml:"etcd3"`
+	Bootstrap  PatroniBootstrap   `yaml:"bootstrap"`
+	PostgreSQL PatroniPostgreSQL  `yaml:"postgresql"`
+	Watchdog   *PatroniWatchdog   `yaml:"watchdog,omitempty"`
+	Ctl        *PatroniCtl        `yaml:"ctl,omitempty"`
+	Tags       config.PatroniTags `yaml:"tags"`
+}
+
+type PatroniLog struct {
+	Level string `yaml:"level"`
+}
+
+type PatroniRestAPI struct {
+	Listen         string `yaml:"listen"`
+	ConnectAddress string `yaml:"connect_address"`
+	CertFile       string `yaml:"certfile,omitempty"`
+	KeyFile        string `yaml:"keyfile,omitempty"`
+	CAFile         string `yaml:"cafile,omitempty"`
+	VerifyClient   string `yaml:"verify_client,omitempty"`
+}
+
+// PatroniEtcd is the etcd3 section. The TLS fields mirror the flags etcd
+// was started with, see etcdArgs.
+type PatroniEtcd struct {
+	Hosts    []string `yaml:"hosts"`
+	Protocol string   `yaml:"protocol,omitempty"`
+	CACert   string   `yaml:"cacert,omitempty"`
+	Cert     string   `yaml:"cert,omitempty"`
+	Key      string   `yaml:"key,omitempty"`
+}
+
+// PatroniCtl is what patronictl, and Patroni itself when calling other
+// members, use to reach a REST API served over TLS.
+type PatroniCtl struct {
+	CACert   string `yaml:"cacert,omitempty"`
+	CertFile string `yaml:"certfile,omitempty"`
+	KeyFile  string `yaml:"keyfile,omitempty"`
+}
+
+type PatroniBootstrap struct {
+	DCS           PatroniDCS `yaml:"dcs"`
+	InitDB        []any      `yaml:"initdb,omitempty"`
+	PostBootstrap string     `yaml:"post_bootstrap,omitempty"`
+}
+
+type PatroniDCS struct {
+	TTL                  int                  `yaml:"ttl"`
+	LoopWait             int                  `yaml:"loop_wait"`
+	RetryTimeout         int                  `yaml:"retry_timeout"`
+	MaximumLagOnFailover int                  `yaml:"maximum_lag_on_failover"`
+	PostgreSQL           PatroniDCSPostgreSQL `yaml:"postgresql"`
+}
+
+type PatroniDCSPostgreSQL struct {
+	UsePGRewind bool           `yaml:"use_pg_rewind"`
+	UseSlots    bool           `yaml:"use_slots"`
+	Parameters  map[string]any `yaml:"parameters"`
+	PGHBA       []string       `yaml:"pg_hba"`
+}
+
+type PatroniPostgreSQL struct {
+	Listen               string                   `yaml:"listen"`
+	ConnectAddress       string                   `yaml:"connect_address"`
+	DataDir              string                   `yaml:"data_dir"`
+	BinDir               string                   `yaml:"bin_dir"`
+	Parameters           map[string]any           `yaml:"parameters"`
+	PGHBA                []string                 `yaml:"pg_hba"`
+	Authentication       config.PatroniAuthConfig `yaml:"authentication"`
+	CreateReplicaMethods []string                 `yaml:"create_replica_methods,omitempty"`
+}
+
+type PatroniWatchdog struct {
+	Mode         string `yaml:"mode"`
+	Device       string `yaml:"device,omitempty"`
+	SafetyMargin int    `yaml:"safety_margin,omitempty"`
+}
+
+// BuildPatroniFile fills in PatroniFile from the agent config.
+func BuildPatroniFile(cfg *config.AgentConfig) *PatroniFile {
+	node := cfg.Node
+	p := node.Patroni
+	params := patroniParameters(cfg)
+	hba := cfg.HBARules()
+
+	file := &PatroniFile{
+		Scope:     cfg.Cluster.Name,
+		Namespace: p.Namespace,
+		Name:      node.Name,
+		Log:       PatroniLog{Level: patroniLogLevel(cfg.LogLevel)},
+		RestAPI:   patroniRestAPI(cfg),
+		Etcd3:     patroniEtcd3(cfg),
+		Ctl:       patroniCtl(cfg),
+		Bootstrap: PatroniBootstrap{
+			DCS: PatroniDCS{
+				TTL:                  p.DCS.TTL,
+				LoopWait:             p.DCS.LoopWait,
+				RetryTimeout:         p.DCS.RetryTimeout,
+				MaximumLagOnFailover: p.DCS.MaximumLagOnFailover,
+				PostgreSQL: PatroniDCSPostgreSQL{
+					UsePGRewind: node.PostgreSQL.Parameters.UsePGRewind,
+					UseSlots:    node.PostgreSQL.Parameters.UseSlots,
+					Parameters:  params,
+					PGHBA:       hba,
+				},
+			},
+			InitDB:        patroniInitDB(cfg),
+			PostBootstrap: patroniPostBootstrapPath(cfg),
+		},
+		PostgreSQL: PatroniPostgreSQL{
+			Listen:               fmt.Sprintf("%s:%d", node.Host, node.PostgreSQL.Parameters.Port),
+			ConnectAddress:       fmt.Sprintf("%s:%d", node.Host, node.PostgreSQL.Parameters.Port),
+			DataDir:              node.PostgreSQL.DataDir,
+			BinDir:               node.PostgreSQL.BinPath,
+			Parameters:           params,
+			PGHBA:                hba,
+			Authentication:       p.Authentication,
+			CreateReplicaMethods: p.CreateReplicaMethods,
+		},
+		Tags: p.Tags,
+	}
+
+	if p.Watchdog.Mode != "" {
+		file.Watchdog = &PatroniWatchdog{Mode: p.Watchdog.Mode, Device: p.Watchdog.Device, SafetyMargin: p.Watchdog.SafetyMargin}
+	}
+	return file
+}
+
+// patroniRestAPI builds the restapi section, with TLS when
+// patroni.restapi.cert_file is set.
+func patroniRestAPI(cfg *config.AgentConfig) PatroniRestAPI {
+	p := cfg.Node.Patroni
+	api := PatroniRestAPI{
+		Listen:         fmt.Sprintf("%s:%d", p.APIListen, p.Port),
+		ConnectAddress: fmt.Sprintf("%s:%d", cfg.Node.Host, p.Port),
+	}
+	if p.RestAPI.TLSEnabled() {
+		api.CertFile = p.RestAPI.CertFile
+		api.KeyFile = p.RestAPI.KeyFile
+		api.CAFile = p.RestAPI.CAFile
+		api.VerifyClient = p.RestAPI.VerifyClient
+	}
+	return api
+}
+
+// patroniEtcd3 builds the etcd3 section. When etcd runs with TLS, Patroni
+// connects over https and authenticates with the node's etcd certificate,
+// as etcd requires client certificates then.
+func patroniEtcd3(cfg *config.AgentConfig) PatroniEtcd {
+	etcd3 := PatroniEtcd{Hosts: patroniEtcdHosts(cfg)}
+	if etcd := cfg.Node.ETCD; etcd.TLSEnabled() {
+		etcd3.Protocol = "https"
+		etcd3.CACert = etcd.CAFile
+		etcd3.Cert = etcd.CertFile
+		etcd3.Key = etcd.KeyFile
+	}
+	return etcd3
+}
+
+// patroniCtl builds the ctl section for a REST API served over TLS: the CA
+// to trust and, when Patroni verifies clients, the certificate to present.
+func patroniCtl(cfg *config.AgentConfig) *PatroniCtl {
+	api := cfg.Node.Patroni.RestAPI
+	if !api.TLSEnabled() {
+		return nil
+	}
+	ctl := &PatroniCtl{CACert: api.CAFile}
+	if verifiesClients(api) {
+		ctl.CertFile = api.CertFile
+		ctl.KeyFile = api.KeyFile
+	}
+	if *ctl == (PatroniCtl{}) {
+		return nil
+	}
+	return ctl
+}
+
+// verifiesClients reports whether the REST API asks callers for a
+// certificate.
+func verifiesClients(api config.RestAPIConfig) bool {
+	return api.VerifyClient == "optional" || api.VerifyClient == "required"
+}
+
+// patroniLogLevel maps the agent's log level onto Python's level names.
+func patroniLogLevel(level string) string {
+	switch strings.ToLower(level) {
+	case "debug":
+		return "DEBUG"
+	case "warn", "warning":
+		return "WARNING"
+	case "error":
+		return "ERROR"
+	default:
+		return "INFO"
+	}
+}
+
+// marshalYAML encodes value with two-space indentation.
+func marshalYAML(value any) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(value); err != nil {
+		return nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// mergePatroniExtra deep-merges extra into a rendered patroni.yml: mappings
+// are merged key by key, anything else in extra replaces what was there.
+func mergePatroniExtra(data []byte, extra map[string]any) ([]byte, error) {
+	var doc, overlay yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("rendered Patroni config is not valid YAML: %w", err)
+	}
+	if len(doc.Content) == 0 {
+		return nil, fmt.Errorf("rendered Patroni config is empty")
+	}
+	if err := overlay.Encode(extra); err != nil {
+		return nil, fmt.Errorf("failed to encode patroni.extra: %w", err)
+	}
+	doc.Content[0] = config.MergeYAML(doc.Content[0], &overlay)
+
+	out, err := marshalYAML(&doc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode Patroni config: %w", err)
+	}
+	return out, nil
+}
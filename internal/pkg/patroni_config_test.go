@@ -0,0 +1,262 @@
+package pkg
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/virtlabs-io/dbcp-agent/internal/config"
+	"gopkg.in/yaml.v3"
+)
+
+func patroniTestConfig(t *testing.T) *config.AgentConfig {
+	t.Helper()
+	cfg := &config.AgentConfig{LogLevel: "debug"}
+	cfg.Cluster = config.ClusterConfig{
+		Name:  "pg-test",
+		Nodes: []config.ClusterNode{{Name: "node1", Host: "10.0.0.1"}, {Name: "node2", Host: "10.0.0.2"}},
+	}
+	cfg.Node.Name = "node1"
+	cfg.Node.Host = "10.0.0.1"
+	cfg.Node.TmpPath = "/tmp"
+	cfg.Node.ETCD.ClientPort = 2379
+	cfg.Node.PostgreSQL = config.PostgreSQLConfig{
+		DataDir: "/var/lib/pgsql/data",
+		BinPath: "/usr/pgsql-16/bin",
+		Users:   map[string]config.PostgresUser{"postgres": {Password: "p#1: x", Options: []string{"superuser"}}},
+		Parameters: config.PostgresSettings{
+			Port: 5432, UsePGRewind: true, WALLevel: "replica", HotStandby: "on",
+			MaxConnections: 200, Extra: map[string]string{"shared_buffers": "1GB"},
+		},
+		InitDB:    []map[string]string{{"encoding": "UTF8"}, {"data-checksums": ""}},
+		PGHBA:     []config.HBARule{{Type: "host", Database: "all", User: "all", Address: "10.0.0.0/24", Method: "scram-sha-256"}},
+		PGHBAAuto: true,
+	}
+	cfg.Node.Patroni = config.PatroniConfig{
+		Namespace:  "dbcp",
+		APIListen:  "0.0.0.0",
+		Port:       8008,
+		ConfigPath: filepath.Join(t.TempDir(), "patroni.yml"),
+		DCS:        config.DCSConfig{TTL: 30, LoopWait: 10, RetryTimeout: 10, MaximumLagOnFailover: 1048576},
+		Authentication: config.PatroniAuthConfig{
+			Superuser:   config.UserCredentials{Username: "postgres", Password: "p#1: x"},
+			Replication: config.UserCredentials{Username: "replicator", Password: "'quoted'"},
+		},
+		CreateReplicaMethods: []string{"basebackup"},
+		Tags:                 config.PatroniTags{NoSync: true},
+		Watchdog:             config.WatchdogConfig{Mode: "automatic", Device: "/dev/watchdog"},
+	}
+	return cfg
+}
+
+func generatedPatroniConfig(t *testing.T, cfg *config.AgentConfig) map[string]any {
+	t.Helper()
+	if err := GeneratePatroniConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(cfg.Node.Patroni.ConfigPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc := map[string]any{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		t.Fatalf("generated config is not valid YAML: %v", err)
+	}
+	return doc
+}
+
+func TestBuildPatroniFile(t *testing.T) {
+	file := BuildPatroniFile(patroniTestConfig(t))
+
+	if file.Scope != "pg-test" || file.Name != "node1" || file.Namespace != "dbcp" {
+		t.Errorf("unexpected identity: %s/%s/%s", file.Namespace, file.Scope, file.Name)
+	}
+	if file.Log.Level != "DEBUG" {
+		t.Errorf("log level = %q, want DEBUG", file.Log.Level)
+	}
+	if file.RestAPI.Listen != "0.0.0.0:8008" || file.RestAPI.ConnectAddress != "10.0.0.1:8008" {
+		t.Errorf("unexpected restapi: %+v", file.RestAPI)
+	}
+	if want := []string{"10.0.0.1:2379", "10.0.0.2:2379"}; !reflect.DeepEqual(file.Etcd3.Hosts, want) {
+		t.Errorf("etcd3 hosts = %v, want %v", file.Etcd3.Hosts, want)
+	}
+	if want := []any{map[string]string{"encoding": "UTF8"}, "data-checksums"}; !reflect.DeepEqual(file.Bootstrap.InitDB, want) {
+		t.Errorf("initdb = %v, want %v", file.Bootstrap.InitDB, want)
+	}
+	if got := file.Bootstrap.DCS.PostgreSQL.Parameters["max_connections"]; got != int64(200) {
+		t.Errorf("max_connections = %#v, want 200", got)
+	}
+	if got := file.PostgreSQL.Parameters["shared_buffers"]; got != "1GB" {
+		t.Errorf("shared_buffers = %#v, want 1GB", got)
+	}
+	if got := file.PostgreSQL.PGHBA; len(got) != 6 || got[len(got)-1] != "host all all 10.0.0.0/24 scram-sha-256" {
+		t.Errorf("unexpected pg_hba: %v", got)
+	}
+	if file.PostgreSQL.Listen != "10.0.0.1:5432" || file.PostgreSQL.DataDir != "/var/lib/pgsql/data" {
+		t.Errorf("unexpected postgresql section: %+v", file.PostgreSQL)
+	}
+	if file.PostgreSQL.Authentication.Replication.Password != "'quoted'" {
+		t.Errorf("unexpected replication password: %q", file.PostgreSQL.Authentication.Replication.Password)
+	}
+	if file.Watchdog == nil || file.Watchdog.Mode != "automatic" || file.Watchdog.Device != "/dev/watchdog" {
+		t.Errorf("unexpected watchdog: %+v", file.Watchdog)
+	}
+	if !file.Tags.NoSync {
+		t.Error("expected the nosync tag")
+	}
+
+	cfg := patroniTestConfig(t)
+	cfg.Node.Patroni.Watchdog = config.WatchdogConfig{}
+	if BuildPatroniFile(cfg).Watchdog != nil {
+		t.Error("expected no watchdog section without a mode")
+	}
+}
+
+func TestParameterValue(t *testing.T) {
+	cases := map[string]any{
+		"200":            int64(200),
+		"0":              int64(0),
+		"0.9":            0.9,
+		"4GB":            "4GB",
+		"on":             "on",
+		"0600":           "0600",
+		"0640":           "0640",
+		"1 (node2, n_3)": "1 (node2, n_3)",
+	}
+	for value, want := range cases {
+		if got := parameterValue(value); got != want {
+			t.Errorf("parameterValue(%q) = %#v, want %#v", value, got, want)
+		}
+	}
+
+	// Rendered, the mode stays quoted for PostgreSQL to read as octal
+	cfg := patroniTestConfig(t)
+	cfg.Node.PostgreSQL.Parameters.Extra["unix_socket_permissions"] = "0600"
+	doc := generatedPatroniConfig(t, cfg)
+	params := doc["postgresql"].(map[string]any)["parameters"].(map[string]any)
+	if got := params["unix_socket_permissions"]; got != "0600" {
+		t.Errorf("unix_socket_permissions = %#v, want \"0600\"", got)
+	}
+}
+
+func TestPatroniGeneratorsAgree(t *testing.T) {
+	cfg := patroniTestConfig(t)
+	cfg.Node.ETCD = config.EtcdConfig{ClientPort: 2379, CertFile: "/pki/node.crt", KeyFile: "/pki/node.key", CAFile: "/pki/ca.crt"}
+	cfg.Node.Patroni.RestAPI = config.RestAPIConfig{CertFile: "/pki/node.crt", KeyFile: "/pki/node.key", CAFile: "/pki/ca.crt", VerifyClient: "optional"}
+	fromTemplate := generatedPatroniConfig(t, cfg)
+
+	cfg.Node.Patroni.Generator = config.PatroniGeneratorStructured
+	fromStructs := generatedPatroniConfig(t, cfg)
+
+	if !reflect.DeepEqual(fromTemplate, fromStructs) {
+		a, _ := yaml.Marshal(fromTemplate)
+		b, _ := yaml.Marshal(fromStructs)
+		t.Errorf("template and structured output differ:\n--- template\n%s\n--- structured\n%s", a, b)
+	}
+}
+
+func TestPatroniTLSMatchesETCD(t *testing.T) {
+	for _, generator := range []string{config.PatroniGeneratorTemplate, config.PatroniGeneratorStructured} {
+		t.Run(generator, func(t *testing.T) {
+			cfg := patroniTestConfig(t)
+			cfg.Node.Patroni.Generator = generator
+			doc := generatedPatroniConfig(t, cfg)
+			if etcd3 := doc["etcd3"].(map[string]any); etcd3["protocol"] != nil || etcd3["cert"] != nil {
+				t.Errorf("expected plain etcd3 without TLS, got %v", etcd3)
+			}
+			if _, ok := doc["ctl"]; ok {
+				t.Error("expected no ctl section without REST API TLS")
+			}
+
+			cfg.Node.ETCD.CertFile = "/etc/dbcp/pki/node.crt"
+			cfg.Node.ETCD.KeyFile = "/etc/dbcp/pki/node.key"
+			cfg.Node.ETCD.CAFile = "/etc/dbcp/pki/ca.crt"
+			cfg.Node.Patroni.RestAPI = config.RestAPIConfig{
+				CertFile:     "/etc/dbcp/pki/node.crt",
+				KeyFile:      "/etc/dbcp/pki/node.key",
+				CAFile:       "/etc/dbcp/pki/ca.crt",
+				VerifyClient: "required",
+			}
+			doc = generatedPatroniConfig(t, cfg)
+
+			etcd3 := doc["etcd3"].(map[string]any)
+			want := map[string]any{"protocol": "https", "cacert": "/etc/dbcp/pki/ca.crt", "cert": "/etc/dbcp/pki/node.crt", "key": "/etc/dbcp/pki/node.key"}
+			for key, value := range want {
+				if etcd3[key] != value {
+					t.Errorf("etcd3.%s = %v, want %v", key, etcd3[key], value)
+				}
+			}
+			// etcd was started with the same files and https endpoints
+			args := strings.Join(etcdArgs(cfg), " ")
+			for _, flag := range []string{"--cert-file /etc/dbcp/pki/node.crt", "--trusted-ca-file /etc/dbcp/pki/ca.crt", "--client-cert-auth=true", "--listen-client-urls=https://"} {
+				if !strings.Contains(args, flag) {
+					t.Errorf("expected etcd to run with %s, got %s", flag, args)
+				}
+			}
+
+			restapi := doc["restapi"].(map[string]any)
+			if restapi["certfile"] != "/etc/dbcp/pki/node.crt" || restapi["cafile"] != "/etc/dbcp/pki/ca.crt" || restapi["verify_client"] != "required" {
+				t.Errorf("unexpected restapi: %v", restapi)
+			}
+			ctl, _ := doc["ctl"].(map[string]any)
+			if ctl["cacert"] != "/etc/dbcp/pki/ca.crt" || ctl["certfile"] != "/etc/dbcp/pki/node.crt" || ctl["keyfile"] != "/etc/dbcp/pki/node.key" {
+				t.Errorf("unexpected ctl: %v", doc["ctl"])
+			}
+		})
+	}
+}
+
+func TestPatroniExtraIsDeepMerged(t *testing.T) {
+	for _, generator := range []string{config.PatroniGeneratorTemplate, config.PatroniGeneratorStructured} {
+		t.Run(generator, func(t *testing.T) {
+			cfg := patroniTestConfig(t)
+			cfg.Node.Patroni.Generator = generator
+			cfg.Node.Patroni.Extra = map[string]any{
+				"postgresql": map[string]any{
+					"pgpass":     "/tmp/pgpass0",
+					"parameters": map[string]any{"jit": "off"},
+				},
+				"restapi": map[string]any{"connect_address": "node1.example.com:8008"},
+				"tags":    map[string]any{"failover_priority": 2},
+			}
+			doc := generatedPatroniConfig(t, cfg)
+
+			pg := doc["postgresql"].(map[string]any)
+			if pg["pgpass"] != "/tmp/pgpass0" {
+				t.Errorf("pgpass = %v", pg["pgpass"])
+			}
+			params := pg["parameters"].(map[string]any)
+			if params["jit"] != "off" || params["shared_buffers"] != "1GB" {
+				t.Errorf("parameters not merged: %v", params)
+			}
+			if pg["data_dir"] != "/var/lib/pgsql/data" {
+				t.Errorf("data_dir lost in the merge: %v", pg["data_dir"])
+			}
+			if got := doc["restapi"].(map[string]any)["connect_address"]; got != "node1.example.com:8008" {
+				t.Errorf("connect_address = %v", got)
+			}
+			tags := doc["tags"].(map[string]any)
+			if tags["failover_priority"] != 2 || tags["nosync"] != true {
+				t.Errorf("tags not merged: %v", tags)
+			}
+		})
+	}
+}
+
+func TestPatroniExtraKeepsTemplateLayout(t *testing.T) {
+	cfg := patroniTestConfig(t)
+	cfg.Node.Patroni.Extra = map[string]any{"postgresql": map[string]any{"pgpass": "/tmp/pgpass0"}}
+	if err := GeneratePatroniConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(cfg.Node.Patroni.ConfigPath)
+	text := string(data)
+	if !strings.HasPrefix(text, "scope:") {
+		t.Errorf("expected the template's key order to be kept, got:\n%s", text)
+	}
+	if !strings.Contains(text, "# Rewritten on every config reload") {
+		t.Error("expected the template's comments to be kept")
+	}
+}
@@ -2,12 +2,24 @@ package pkg
 
 import (
 	"os"
+	"os/user"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/virtlabs-io/dbcp-agent/internal/config"
+	"github.com/virtlabs-io/dbcp-agent/internal/system"
+	"gopkg.in/yaml.v3"
 )
 
 func TestGeneratePatroniConfig(t *testing.T) {
+	// The post_bootstrap script is handed to the node user, so it has to exist
+	current, err := user.Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+
 	cfg := &config.AgentConfig{
 		Cluster: config.ClusterConfig{
 			Name: "pg-test",
@@ -18,7 +30,7 @@ func TestGeneratePatroniConfig(t *testing.T) {
 		Node: config.NodeConfig{
 			Name:    "node1",
 			Host:    "127.0.0.1",
-			User:    "vagrant",
+			User:    current.Username,
 			TmpPath: "/tmp",
 			PostgreSQL: config.PostgreSQLConfig{
 				DataDir: "/tmp/pgdata",
@@ -37,16 +49,21 @@ func TestGeneratePatroniConfig(t *testing.T) {
 					HotStandby:              "on",
 					SynchronousCommit:       "remote_apply",
 					SynchronousStandbyNames: "1 (node2,node3)",
+					MaxConnections:          300,
+					Extra:                   map[string]string{"shared_buffers": "4GB", "random_page_cost": "1.1", "unix_socket_permissions": "0600"},
 				},
+				PGHBA: []config.HBARule{
+					{Type: "hostssl", Database: "all", User: "app", Address: "10.0.0.0/8", Method: "scram-sha-256", Options: map[string]string{"clientcert": "verify-full"}},
+				},
+				PGHBAAuto: true,
 			},
 			Patroni: config.PatroniConfig{
-				ConfigPath:   "/tmp/patroni.yml",
-				TemplatePath: "../../configs/patroni-template.yml",
-				APIListen:    "127.0.0.1",
-				Port:         8008,
+				ConfigPath: t.TempDir() + "/patroni.yml",
+				APIListen:  "127.0.0.1",
+				Port:       8008,
 				Authentication: config.PatroniAuthConfig{
 					Superuser: config.UserCredentials{
-						Username: "postgres", Password: "secret",
+						Username: "postgres", Password: `se: cr#et "x"`,
 					},
 					Replication: config.UserCredentials{
 						Username: "rep", Password: "rep-pass",
@@ -65,13 +82,252 @@ func TestGeneratePatroniConfig(t *testing.T) {
 		},
 	}
 
-	err := GeneratePatroniConfig(cfg)
+	err = GeneratePatroniConfig(cfg)
 	if err != nil {
 		t.Fatalf("Failed to generate Patroni config: %v", err)
 	}
 
 	// Verify config file was written
-	if _, err := os.Stat(cfg.Node.Patroni.ConfigPath); os.IsNotExist(err) {
-		t.Errorf("Expected Patroni config to exist at %s", cfg.Node.Patroni.ConfigPath)
+	data, err := os.ReadFile(cfg.Node.Patroni.ConfigPath)
+	if err != nil {
+		t.Fatalf("Expected Patroni config to exist at %s", cfg.Node.Patroni.ConfigPath)
+	}
+
+	var out struct {
+		Bootstrap struct {
+			DCS struct {
+				PostgreSQL struct {
+					Parameters map[string]any `yaml:"parameters"`
+					PGHBA      []string       `yaml:"pg_hba"`
+				} `yaml:"postgresql"`
+			} `yaml:"dcs"`
+			PostBootstrap string         `yaml:"post_bootstrap"`
+			Users         map[string]any `yaml:"users"`
+		} `yaml:"bootstrap"`
+		PostgreSQL struct {
+			Parameters     map[string]any `yaml:"parameters"`
+			PGHBA          []string       `yaml:"pg_hba"`
+			Authentication struct {
+				Superuser config.UserCredentials `yaml:"superuser"`
+			} `yaml:"authentication"`
+		} `yaml:"postgresql"`
+	}
+	if err := yaml.Unmarshal(data, &out); err != nil {
+		t.Fatalf("generated config is not valid YAML: %v", err)
+	}
+
+	if got := out.PostgreSQL.Authentication.Superuser.Password; got != `se: cr#et "x"` {
+		t.Errorf("superuser password not kept as a string: %q", got)
+	}
+
+	// Patroni 4 ignores bootstrap.users; the users come from post_bootstrap
+	script := filepath.Join(filepath.Dir(cfg.Node.Patroni.ConfigPath), "post_bootstrap.sh")
+	if out.Bootstrap.Users != nil || out.Bootstrap.PostBootstrap != script {
+		t.Errorf("expected post_bootstrap %s and no bootstrap.users, got %q and %v", script, out.Bootstrap.PostBootstrap, out.Bootstrap.Users)
+	}
+	if info, err := os.Stat(script); err != nil || info.Mode().Perm() != 0700 {
+		t.Errorf("expected a post_bootstrap script only its owner can read: %v", err)
+	}
+
+	want := map[string]any{
+		"max_connections":           300,
+		"shared_buffers":            "4GB",
+		"random_page_cost":          1.1,
+		"wal_level":                 "logical",
+		"hot_standby":               "on",
+		"synchronous_commit":        "remote_apply",
+		"synchronous_standby_names": "1 (node2,node3)",
+		"unix_socket_directories":   "/tmp",
+		"unix_socket_permissions":   "0600",
+	}
+	if got := out.Bootstrap.DCS.PostgreSQL.Parameters; !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected bootstrap parameters: %v", got)
+	}
+	if got := out.PostgreSQL.Parameters; !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected local parameters: %v", got)
+	}
+
+	// Generated rules come first; the duplicate localhost superuser rule is dropped
+	wantHBA := []string{
+		"host all postgres 127.0.0.1/32 scram-sha-256",
+		"host replication rep 127.0.0.1/32 scram-sha-256",
+		"hostssl all app 10.0.0.0/8 scram-sha-256 clientcert=verify-full",
+	}
+	if got := out.Bootstrap.DCS.PostgreSQL.PGHBA; !reflect.DeepEqual(got, wantHBA) {
+		t.Errorf("unexpected bootstrap pg_hba: %q", got)
+	}
+	if got := out.PostgreSQL.PGHBA; !reflect.DeepEqual(got, wantHBA) {
+		t.Errorf("unexpected local pg_hba: %q", got)
+	}
+}
+
+func TestPostBootstrapScript(t *testing.T) {
+	cfg := &config.AgentConfig{
+		Node: config.NodeConfig{
+			PostgreSQL: config.PostgreSQLConfig{
+				BinPath: "/usr/lib/postgresql/16/bin",
+				Users: map[string]config.PostgresUser{
+					"postgres": {Password: "it's", Options: []string{"superuser"}},
+					"app":      {Password: "app-pass", Options: []string{"login", "createdb"}},
+					"audit":    {Password: "x", Options: []string{"nologin"}},
+				},
+			},
+		},
+	}
+
+	script := string(postBootstrapScript(cfg))
+	for _, want := range []string{
+		`exec /usr/lib/postgresql/16/bin/psql "$1" --no-psqlrc -v ON_ERROR_STOP=1 <<'DBCP_USERS_SQL'`,
+		`IF NOT EXISTS (SELECT FROM pg_roles WHERE rolname = 'app') THEN CREATE ROLE "app"; END IF;`,
+		`ALTER ROLE "app" WITH LOGIN CREATEDB PASSWORD 'app-pass';`,
+		`ALTER ROLE "audit" WITH NOLOGIN PASSWORD 'x';`,
+		`ALTER ROLE "postgres" WITH LOGIN SUPERUSER PASSWORD 'it''s';`,
+	} {
+		if !strings.Contains(script, want) {
+			t.Errorf("expected the script to contain %s, got:\n%s", want, script)
+		}
+	}
+	if strings.Index(script, `"app"`) > strings.Index(script, `"postgres"`) {
+		t.Error("expected users in a stable, sorted order")
+	}
+}
+
+func TestInstallPatroniSources(t *testing.T) {
+	debian := &system.OSInfo{ID: "debian", Family: "debian", Arch: "amd64"}
+	rocky := &system.OSInfo{ID: "rocky", Family: "rhel", Arch: "amd64"}
+
+	tests := []struct {
+		name   string
+		source *config.RepoSource
+		osInfo *system.OSInfo
+		want   []string
+	}{
+		{
+			name:   "default pip into virtualenv",
+			osInfo: rocky,
+			want: []string{
+				"dnf install -y python3-virtualenv",
+				"python3 -m venv /opt/dbcp/patroni",
+				"/opt/dbcp/patroni/bin/python -m pip install patroni[etcd3,psycopg3]==4.0.4",
+			},
+		},
+		{
+			name:   "distro package",
+			source: &config.RepoSource{DebianPackage: "patroni"},
+			osInfo: debian,
+			want: []string{
+				"apt-get update",
+				"apt-get -y --allow-downgrades install patroni=4.0.4-*",
+			},
+		},
+		{
+			name:   "internal pip index",
+			source: &config.RepoSource{IndexURL: "https://pypi.example.com/simple", PipPackage: "patroni[etcd3]"},
+			osInfo: debian,
+			want: []string{
+				"apt-get install -y python3-venv",
+				"python3 -m venv /opt/dbcp/patroni",
+				"/opt/dbcp/patroni/bin/python -m pip install --index-url https://pypi.example.com/simple patroni[etcd3]==4.0.4",
+			},
+		},
+		{
+			name:   "internal rpm repository",
+			source: &config.RepoSource{RHEL: "https://repo.example.com/patroni/el9", RHELPackage: "patroni", SigningKey: "/etc/pki/patroni.asc"},
+			osInfo: rocky,
+			want:   []string{"dnf install -y patroni-4.0.4"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := NewRecorder()
+			defer SetExecutor(SetExecutor(rec))
+
+			cfg := &config.AgentConfig{Node: config.NodeConfig{Patroni: config.PatroniConfig{Version: "4.0.4"}}}
+			if tt.source != nil {
+				cfg.Repositories.Patroni = config.RepoEntry{
+					Default: "custom",
+					Sources: map[string]config.RepoSource{"custom": *tt.source},
+				}
+			}
+
+			if err := InstallPatroni(cfg, tt.osInfo); err != nil {
+				t.Fatalf("InstallPatroni failed: %v", err)
+			}
+			if got := rec.Commands(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("unexpected commands:\n got: %q\nwant: %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInstallPatroniInternalRepoFile(t *testing.T) {
+	rec := NewRecorder()
+	defer SetExecutor(SetExecutor(rec))
+
+	cfg := &config.AgentConfig{
+		Repositories: config.Repositories{
+			Patroni: config.RepoEntry{
+				Default: "custom",
+				Sources: map[string]config.RepoSource{"custom": {
+					RHEL:        "https://repo.example.com/patroni/el9",
+					RHELPackage: "patroni",
+					SigningKey:  "/etc/pki/patroni.asc",
+				}},
+			},
+		},
+	}
+
+	if err := InstallPatroni(cfg, &system.OSInfo{Family: "rhel"}); err != nil {
+		t.Fatalf("InstallPatroni failed: %v", err)
+	}
+
+	op := rec.Operations()[0]
+	if op.Kind != "write" || op.Target != "/etc/yum.repos.d/dbcp-patroni.repo" {
+		t.Fatalf("expected the .repo file to be written first, got %v", op)
+	}
+	for _, want := range []string{"baseurl=https://repo.example.com/patroni/el9", "gpgkey=file:///etc/pki/patroni.asc"} {
+		if !strings.Contains(string(op.Data), want) {
+			t.Errorf("expected %q in repo file:\n%s", want, op.Data)
+		}
+	}
+}
+
+func TestParsePatroniVersion(t *testing.T) {
+	for output, want := range map[string]string{
+		"patroni 4.0.4\n": "4.0.4",
+		"patroni 3.3.2":   "3.3.2",
+		"":                "",
+	} {
+		if got := parsePatroniVersion(output); got != want {
+			t.Errorf("parsePatroniVersion(%q) = %q, want %q", output, got, want)
+		}
+	}
+}
+
+func TestStartPatroniUsesVirtualenv(t *testing.T) {
+	rec := NewRecorder()
+	defer SetExecutor(SetExecutor(rec))
+
+	cfg := &config.AgentConfig{
+		Node: config.NodeConfig{
+			User:    "postgres",
+			TmpPath: "/dbcp/tmp",
+			Patroni: config.PatroniConfig{ConfigPath: "/etc/patroni/patroni.yml", VenvPath: "/srv/venv"},
+			Systemd: config.SystemdConfig{Mode: config.ServiceModeDirect},
+		},
+	}
+
+	if err := InstallPatroni(cfg, &system.OSInfo{Family: "debian"}); err != nil {
+		t.Fatalf("InstallPatroni failed: %v", err)
+	}
+	rec.WriteFile(cfg.Node.Patroni.ConfigPath, nil, 0644)
+	if err := StartPatroni(cfg); err != nil {
+		t.Fatalf("StartPatroni failed: %v", err)
+	}
+
+	cmds := rec.Commands()
+	if last := cmds[len(cmds)-1]; last != "sudo -u postgres /srv/venv/bin/patroni /etc/patroni/patroni.yml" {
+		t.Errorf("expected Patroni to start from the virtualenv, got %q", last)
 	}
 }
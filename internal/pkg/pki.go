@@ -0,0 +1,132 @@
+package pkg
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/virtlabs-io/dbcp-agent/internal/config"
+	"github.com/virtlabs-io/dbcp-agent/internal/logger"
+	"github.com/virtlabs-io/dbcp-agent/internal/pki"
+)
+
+// InitCA creates the cluster CA in pki.ca_dir. An existing CA is never
+// replaced, as every node certificate in the cluster was signed by it.
+func InitCA(cfg *config.AgentConfig) error {
+	certPath := filepath.Join(cfg.PKI.CADir, pki.CACertFile)
+	keyPath := filepath.Join(cfg.PKI.CADir, pki.CAKeyFile)
+	for _, path := range []string{certPath, keyPath} {
+		if _, err := executor.Stat(path); err == nil {
+			return fmt.Errorf("a CA already exists at %s", path)
+		}
+	}
+
+	ca, err := pki.NewCA(cfg.Cluster.Name+" CA", days(cfg.PKI.CAValidDays))
+	if err != nil {
+		return err
+	}
+	keyPEM, err := ca.KeyPEM()
+	if err != nil {
+		return err
+	}
+
+	// The CA stays with whoever runs the command, not the node's OS user
+	if err := executor.MkdirAll(cfg.PKI.CADir, 0700); err != nil {
+		return fmt.Errorf("failed to create directory %s: %w", cfg.PKI.CADir, err)
+	}
+	if err := writePKIFile(keyPath, keyPEM, 0600, ""); err != nil {
+		return err
+	}
+	if err := writePKIFile(certPath, ca.CertPEM(), 0644, ""); err != nil {
+		return err
+	}
+
+	logger.Info("Created CA %q in %s, valid until %s", ca.Cert.Subject.CommonName, cfg.PKI.CADir, ca.Cert.NotAfter.Format(time.DateOnly))
+	return nil
+}
+
+// IssueCertificate signs a certificate for node and writes it to dir with
+// its key and the CA certificate, owned by the node's OS user.
+func IssueCertificate(cfg *config.AgentConfig, node config.ClusterNode, dir string) error {
+	ca, err := loadCA(cfg)
+	if err != nil {
+		return err
+	}
+	certPEM, keyPEM, err := ca.Issue(node.Name, node.Host, days(cfg.PKI.ValidDays))
+	if err != nil {
+		return err
+	}
+
+	if err := MkdirAllAsUser(dir, cfg.Node.User, 0750); err != nil {
+		return err
+	}
+	files := []struct {
+		name string
+		data []byte
+		perm os.FileMode
+	}{
+		{pki.NodeKeyFile, keyPEM, 0600},
+		{pki.NodeCertFile, certPEM, 0644},
+		{pki.CACertFile, ca.CertPEM(), 0644},
+	}
+	for _, file := range files {
+		if err := writePKIFile(filepath.Join(dir, file.name), file.data, file.perm, cfg.Node.User); err != nil {
+			return err
+		}
+	}
+
+	logger.Info("Issued certificate for %s (%s) in %s", node.Name, node.Host, dir)
+	return nil
+}
+
+// ClusterNodeByName finds a node in cluster.nodes. The local node is always
+// found, even when cluster.nodes does not list it.
+func ClusterNodeByName(cfg *config.AgentConfig, name string) (config.ClusterNode, bool) {
+	for _, node := range cfg.Cluster.Nodes {
+		if node.Name == name {
+			return node, true
+		}
+	}
+	if name == cfg.Node.Name {
+		return config.ClusterNode{Name: cfg.Node.Name, Host: cfg.Node.Host}, true
+	}
+	return config.ClusterNode{}, false
+}
+
+func loadCA(cfg *config.AgentConfig) (*pki.CA, error) {
+	certPEM, err := os.ReadFile(filepath.Join(cfg.PKI.CADir, pki.CACertFile))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA certificate (run \"dbcp-agent pki init\" first): %w", err)
+	}
+	keyPEM, err := os.ReadFile(filepath.Join(cfg.PKI.CADir, pki.CAKeyFile))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA key: %w", err)
+	}
+	return pki.LoadCA(certPEM, keyPEM)
+}
+
+// writePKIFile writes through a temporary file so a service never reads a
+// half-written key, and fixes the mode in case the file already existed.
+func writePKIFile(path string, data []byte, perm os.FileMode, owner string) error {
+	tmp := path + ".tmp"
+	if err := executor.WriteFile(tmp, data, perm); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	if err := executor.Chmod(tmp, perm); err != nil {
+		return fmt.Errorf("failed to set mode on %s: %w", path, err)
+	}
+	if owner != "" {
+		if err := executor.Chown(tmp, owner, false); err != nil {
+			return fmt.Errorf("failed to set owner on %s: %w", path, err)
+		}
+	}
+	if err := executor.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to replace %s: %w", path, err)
+	}
+	return nil
+}
+
+func days(n int) time.Duration {
+	return time.Duration(n) * 24 * time.Hour
+}
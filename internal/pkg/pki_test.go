@@ -0,0 +1,121 @@
+package pkg
+
+import (
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/virtlabs-io/dbcp-agent/internal/config"
+	"github.com/virtlabs-io/dbcp-agent/internal/pki"
+)
+
+func pkiTestConfig(t *testing.T) *config.AgentConfig {
+	t.Helper()
+	current, err := user.Current()
+	if err != nil {
+		t.Skip("no current user")
+	}
+	dir := t.TempDir()
+	cfg := &config.AgentConfig{}
+	cfg.Cluster.Name = "pg-test"
+	cfg.Cluster.Nodes = []config.ClusterNode{{Name: "node1", Host: "10.0.0.1"}, {Name: "node2", Host: "10.0.0.2"}}
+	cfg.Node.Name = "node1"
+	cfg.Node.Host = "10.0.0.1"
+	cfg.Node.User = current.Username
+	cfg.PKI = config.PKIConfig{
+		Dir:         filepath.Join(dir, "pki"),
+		CADir:       filepath.Join(dir, "ca"),
+		ValidDays:   30,
+		CAValidDays: 365,
+	}
+	return cfg
+}
+
+func TestInitCAAndIssue(t *testing.T) {
+	cfg := pkiTestConfig(t)
+
+	if err := IssueCertificate(cfg, cfg.Cluster.Nodes[0], cfg.PKI.Dir); err == nil || !strings.Contains(err.Error(), "pki init") {
+		t.Errorf("expected issuing without a CA to point at pki init, got %v", err)
+	}
+
+	if err := InitCA(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := InitCA(cfg); err == nil {
+		t.Error("expected an existing CA not to be replaced")
+	}
+	if info, err := os.Stat(filepath.Join(cfg.PKI.CADir, pki.CAKeyFile)); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("CA key mode: %v %v", info, err)
+	}
+
+	if err := IssueCertificate(cfg, cfg.Cluster.Nodes[0], cfg.PKI.Dir); err != nil {
+		t.Fatal(err)
+	}
+	modes := map[string]os.FileMode{pki.NodeKeyFile: 0600, pki.NodeCertFile: 0644, pki.CACertFile: 0644}
+	for name, want := range modes {
+		info, err := os.Stat(filepath.Join(cfg.PKI.Dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != want {
+			t.Errorf("%s mode = %04o, want %04o", name, info.Mode().Perm(), want)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(cfg.PKI.Dir, pki.NodeKeyFile+".tmp")); !os.IsNotExist(err) {
+		t.Error("expected no temporary file to be left behind")
+	}
+
+	data, _ := os.ReadFile(filepath.Join(cfg.PKI.Dir, pki.NodeCertFile))
+	cert, err := pki.ParseCertificate(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.VerifyHostname("10.0.0.1") != nil || cert.VerifyHostname("node1") != nil {
+		t.Errorf("unexpected SANs: %v %v", cert.DNSNames, cert.IPAddresses)
+	}
+}
+
+func TestIssueCertificateDryRun(t *testing.T) {
+	cfg := pkiTestConfig(t)
+	if err := InitCA(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := NewRecorder()
+	defer SetExecutor(SetExecutor(rec))
+	if err := IssueCertificate(cfg, cfg.Cluster.Nodes[1], cfg.PKI.Dir); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(cfg.PKI.Dir); !os.IsNotExist(err) {
+		t.Error("dry run created the output directory")
+	}
+	var chowned, renamed int
+	for _, op := range rec.Operations() {
+		switch op.Kind {
+		case "chown":
+			chowned++
+		case "rename":
+			renamed++
+		}
+	}
+	if chowned != 4 || renamed != 3 {
+		t.Errorf("expected the directory and three files to be handed to the OS user, got:\n%v", rec.Operations())
+	}
+}
+
+func TestClusterNodeByName(t *testing.T) {
+	cfg := pkiTestConfig(t)
+	if node, ok := ClusterNodeByName(cfg, "node2"); !ok || node.Host != "10.0.0.2" {
+		t.Errorf("node2 = %+v, %v", node, ok)
+	}
+	cfg.Cluster.Nodes = nil
+	if node, ok := ClusterNodeByName(cfg, "node1"); !ok || node.Host != "10.0.0.1" {
+		t.Errorf("expected the local node to be found, got %+v, %v", node, ok)
+	}
+	if _, ok := ClusterNodeByName(cfg, "node3"); ok {
+		t.Error("expected an unknown node not to be found")
+	}
+}
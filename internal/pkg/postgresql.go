@@ -6,6 +6,7 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
 
 	"github.com/virtlabs-io/dbcp-agent/internal/config"
 	"github.com/virtlabs-io/dbcp-agent/internal/logger"
@@ -15,16 +16,34 @@ import (
 func InstallPostgreSQL(cfg *config.AgentConfig, osInfo *system.OSInfo) error {
 	logger.Info("Preparing to install PostgreSQL version %s...", cfg.Node.PostgreSQL.Version)
 
-	pgRepo := cfg.Repositories.PostgreSQL.Sources[cfg.Repositories.PostgreSQL.Default]
-	pgRepoURL := pgRepo[osInfo.Family]
+	if path, ok := cfg.Repositories.PostgreSQL.BundlePath(); ok {
+		dir, err := resolveBundle(cfg, osInfo, path)
+		if err != nil {
+			return err
+		}
+		if err := installPostgresBundle(cfg.Node.PostgreSQL.Version, osInfo, dir); err != nil {
+			return err
+		}
+		logger.Info("PostgreSQL %s installed from bundle %s.", cfg.Node.PostgreSQL.Version, path)
+		return nil
+	}
+
+	srcName := cfg.Repositories.PostgreSQL.Default
+	src := cfg.Repositories.PostgreSQL.Selected()
 
 	switch osInfo.ID {
 	case "debian", "ubuntu":
-		if err := installPostgresApt(cfg.Node.PostgreSQL.Version, pgRepoURL); err != nil {
+		if err := installPostgresApt(cfg.Node.PostgreSQL.Version, srcName, src); err != nil {
 			return err
 		}
 	case "rhel", "centos", "rocky", "almalinux", "oracle", "fedora":
-		if err := installPostgresRpm(cfg.Node.PostgreSQL.Version, osInfo.VersionID, pgRepoURL, cfg.Node.TmpPath); err != nil {
+		var err error
+		if src.IsMirror() {
+			err = installPostgresYumMirror(cfg.Node.PostgreSQL.Version, src)
+		} else {
+			err = installPostgresRpm(cfg.Node.PostgreSQL.Version, osInfo.VersionID, osInfo.RPMArch(), src.RHEL, cfg.Node.TmpPath)
+		}
+		if err != nil {
 			return err
 		}
 	default:
@@ -35,21 +54,74 @@ func InstallPostgreSQL(cfg *config.AgentConfig, osInfo *system.OSInfo) error {
 	return nil
 }
 
-func installPostgresApt(version, repoURL string) error {
+// pgdgSigningKey is used for PGDG-style sources that do not name their own key.
+const pgdgSigningKey = "https://www.postgresql.org/media/keys/ACCC4CF8.asc"
+
+func installPostgresApt(version, srcName string, src config.RepoSource) error {
+	signingKey := src.SigningKey
+	if signingKey == "" {
+		signingKey = pgdgSigningKey
+	}
+	keyPath := fmt.Sprintf("/usr/share/postgresql-common/pgdg/%s.asc", srcName)
+
+	suite := src.DebianSuite
+	if suite == "" {
+		suite = "$(lsb_release -cs)-pgdg"
+	}
+
 	cmds := []string{
 		"apt-get update",
 		"apt-get install -y curl ca-certificates gnupg lsb-release",
 		"mkdir -p /usr/share/postgresql-common/pgdg",
-		"curl -sSL https://www.postgresql.org/media/keys/ACCC4CF8.asc -o /usr/share/postgresql-common/pgdg/apt.postgresql.org.asc",
-		fmt.Sprintf(`sh -c 'echo "deb [signed-by=/usr/share/postgresql-common/pgdg/apt.postgresql.org.asc] %s $(lsb_release -cs)-pgdg main" > /etc/apt/sources.list.d/pgdg.list'`, repoURL),
+		fetchKeyCommand(signingKey, keyPath),
+		fmt.Sprintf(`sh -c 'echo "deb [signed-by=%s] %s %s main" > /etc/apt/sources.list.d/pgdg.list'`, keyPath, src.PackageRepoURL("debian"), suite),
 		"apt-get update",
 		fmt.Sprintf("apt-get install -y postgresql-%s", version),
-		"systemctl stop postgresql",
-		"systemctl disable postgresql",
-		"rm -Rf /etc/postgresql*",
-		"rm -Rf /var/lib/postgresql",
+	}
+	cmds = append(cmds, postgresAptCleanup...)
+
+	for _, cmd := range cmds {
+		logger.Debug("Executing: %s", cmd)
+		if err := runCommand(cmd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fetchKeyCommand installs a signing key from a URL or a local path.
+func fetchKeyCommand(key, dest string) string {
+	if strings.HasPrefix(key, "http://") || strings.HasPrefix(key, "https://") {
+		return fmt.Sprintf("curl -fsSL %s -o %s", key, dest)
+	}
+	return fmt.Sprintf("install -m 0644 %s %s", key, dest)
+}
+
+// postgresAptCleanup removes the cluster Debian creates on install; Patroni
+// owns initialization and startup.
+var postgresAptCleanup = []string{
+	"systemctl stop postgresql",
+	"systemctl disable postgresql",
+	"rm -Rf /etc/postgresql*",
+	"rm -Rf /var/lib/postgresql",
+}
+
+// installPostgresBundle installs the packages shipped in a bundle without
+// touching any network repository.
+func installPostgresBundle(version string, osInfo *system.OSInfo, bundleDir string) error {
+	pkgDir := filepath.Join(bundleDir, "postgresql")
+
+	var cmds []string
+	switch osInfo.Family {
+	case "debian":
+		cmds = append([]string{fmt.Sprintf("apt-get install -y --no-download %s/*.deb", pkgDir)}, postgresAptCleanup...)
+	case "rhel", "fedora":
+		cmds = []string{fmt.Sprintf("dnf install -y --disablerepo='*' %s/*.rpm", pkgDir)}
+	default:
+		return fmt.Errorf("unsupported OS family for bundle install: %s", osInfo.Family)
 	}
 
+	logger.Info("Installing PostgreSQL %s packages from %s", version, pkgDir)
 	for _, cmd := range cmds {
 		logger.Debug("Executing: %s", cmd)
 		if err := runCommand(cmd); err != nil {
@@ -59,9 +131,47 @@ func installPostgresApt(version, repoURL string) error {
 	return nil
 }
 
-func installPostgresRpm(version, osVersion, repoBaseURL, tmpPath string) error {
-	majorVersion := string(osVersion[0])
-	rpmURL := fmt.Sprintf("%s/reporpms/EL-%s-x86_64/pgdg-redhat-repo-latest.noarch.rpm", repoBaseURL, majorVersion)
+// installPostgresYumMirror points dnf at an internal mirror through a .repo
+// file instead of installing the PGDG repository RPM.
+func installPostgresYumMirror(version string, src config.RepoSource) error {
+	gpgKey := src.SigningKey
+	if !strings.Contains(gpgKey, "://") {
+		gpgKey = "file://" + gpgKey
+	}
+
+	repo := fmt.Sprintf(`[dbcp-postgresql%s]
+name=PostgreSQL %s (internal mirror)
+baseurl=%s
+enabled=1
+gpgcheck=1
+gpgkey=%s
+`, version, version, src.PackageRepoURL("rhel"), gpgKey)
+
+	repoFile := "/etc/yum.repos.d/dbcp-postgresql.repo"
+	if err := executor.WriteFile(repoFile, []byte(repo), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", repoFile, err)
+	}
+
+	cmds := []string{
+		"dnf -qy module disable postgresql",
+		fmt.Sprintf("dnf install -y postgresql%s-server postgresql%s", version, version),
+	}
+
+	for _, cmd := range cmds {
+		logger.Debug("Executing: %s", cmd)
+		if err := runCommand(cmd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func installPostgresRpm(version, osVersion, arch, repoBaseURL, tmpPath string) error {
+	majorVersion := strings.SplitN(osVersion, ".", 2)[0]
+	if majorVersion == "" {
+		return fmt.Errorf("unknown OS major version (VERSION_ID %q)", osVersion)
+	}
+	rpmURL := fmt.Sprintf("%s/reporpms/EL-%s-%s/pgdg-redhat-repo-latest.noarch.rpm", repoBaseURL, majorVersion, arch)
 	tmpFile := filepath.Join(tmpPath, "pgdg-redhat-repo-latest.noarch.rpm")
 
 	cmds := []string{
@@ -93,8 +203,7 @@ func StartPostgreSQLService(cfg *config.AgentConfig) error {
 
 	if _, err := exec.LookPath("systemctl"); err == nil {
 		logger.Info("Using systemctl to start PostgreSQL")
-		cmd := exec.Command("bash", "-c", "systemctl start postgresql")
-		output, err := cmd.CombinedOutput()
+		output, err := executor.Run("bash", "-c", "systemctl start postgresql")
 		if err != nil {
 			logger.Error("Failed to start PostgreSQL with systemctl: %v\nOutput: %s", err, string(output))
 			return err
@@ -108,25 +217,23 @@ func StartPostgreSQLService(cfg *config.AgentConfig) error {
 		return err
 	}
 
-	chownCmd := exec.Command("chown", "-R", fmt.Sprintf("%s:%s",
+	if output, err := executor.Run("chown", "-R", fmt.Sprintf("%s:%s",
 		cfg.Node.User,
 		cfg.Node.User),
-		cfg.Node.PostgreSQL.DataDir)
-	if output, err := chownCmd.CombinedOutput(); err != nil {
+		cfg.Node.PostgreSQL.DataDir); err != nil {
 		logger.Warn("Failed to chown data dir: %v\nOutput: %s", err, string(output))
 		return err
 	}
 
-	if _, err := os.Stat(filepath.Join(cfg.Node.PostgreSQL.DataDir, "PG_VERSION")); os.IsNotExist(err) {
+	if _, err := executor.Stat(filepath.Join(cfg.Node.PostgreSQL.DataDir, "PG_VERSION")); os.IsNotExist(err) {
 		logger.Warn("Initializing PostgreSQL data directory...")
-		cmd := exec.Command("su", "-",
+		output, err := executor.Run("su", "-",
 			cfg.Node.User,
 			"-c",
 			fmt.Sprintf("PATH=%s:$PATH %s/initdb -D %s",
 				cfg.Node.PostgreSQL.BinPath,
 				cfg.Node.PostgreSQL.BinPath,
 				cfg.Node.PostgreSQL.DataDir))
-		output, err := cmd.CombinedOutput()
 		if err != nil {
 			logger.Error("initdb failed: %v\nOutput: %s", err, string(output))
 			return err
@@ -135,14 +242,13 @@ func StartPostgreSQLService(cfg *config.AgentConfig) error {
 	}
 
 	logFile := filepath.Join(cfg.Node.PostgreSQL.DataDir, "postgres.log")
-	cmd := exec.Command("su", "-",
+	output, err := executor.Run("su", "-",
 		cfg.Node.User,
 		"-c",
 		fmt.Sprintf("PATH=%s:$PATH %s/pg_ctl -D %s -l %s start",
 			cfg.Node.PostgreSQL.BinPath,
 			cfg.Node.PostgreSQL.BinPath,
 			cfg.Node.PostgreSQL.DataDir, logFile))
-	output, err := cmd.CombinedOutput()
 	if err != nil {
 		logger.Error("pg_ctl failed: %v\nOutput: %s", err, string(output))
 		return err
@@ -159,8 +265,7 @@ func ensureUser(user string) error {
 	}
 
 	logger.Info("Creating '%s' user...", user)
-	addUser := exec.Command("useradd", "-m", user)
-	output, err := addUser.CombinedOutput()
+	output, err := executor.Run("useradd", "-m", user)
 	if err != nil {
 		logger.Error("Failed to create user '%s': %v\nOutput: %s", user, err, string(output))
 		return err
@@ -169,8 +274,7 @@ func ensureUser(user string) error {
 }
 
 func runCommand(command string) error {
-	cmd := exec.Command("bash", "-c", command)
-	output, err := cmd.CombinedOutput()
+	output, err := executor.Run("bash", "-c", command)
 	if err != nil {
 		logger.Error("Command failed: %s\nOutput: %s", command, string(output))
 		return err
@@ -188,10 +292,10 @@ func isPortInUse(port int) bool {
 }
 
 func StopPostgresProcess(cfg *config.AgentConfig) {
-	cmd := exec.Command(filepath.Join(cfg.Node.PostgreSQL.BinPath, "pg_ctl"),
+	_, err := executor.Run(filepath.Join(cfg.Node.PostgreSQL.BinPath, "pg_ctl"),
 		"-D", cfg.Node.PostgreSQL.DataDir,
 		"stop")
-	if err := cmd.Run(); err != nil {
+	if err != nil {
 		logger.Error("Failed to stop PostgreSQL gracefully: %v", err)
 	} else {
 		logger.Info("Stopped running PostgreSQL instance")
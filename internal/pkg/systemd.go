@@ -0,0 +1,215 @@
+package pkg
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/virtlabs-io/dbcp-agent/internal/config"
+	"github.com/virtlabs-io/dbcp-agent/internal/logger"
+)
+
+// Unit names are prefixed so they never collide with the units shipped by
+// distro etcd or Patroni packages.
+const (
+	ETCDUnit    = "dbcp-etcd.service"
+	PatroniUnit = "dbcp-patroni.service"
+)
+
+// SystemdUnit describes a service the agent runs under systemd.
+type SystemdUnit struct {
+	Name        string
+	Description string
+	After       []string
+	Type        string // simple or notify
+	User        string
+	ExecStart   []string
+	ExecReload  string
+	KillMode    string
+	// Overrides are written to a drop-in rather than the unit itself.
+	Overrides map[string]string
+}
+
+var unitTemplate = template.Must(template.New("unit").Funcs(template.FuncMap{
+	"execLine": systemdExecLine,
+}).Parse(`# Managed by dbcp-agent. Local changes belong in a drop-in.
+[Unit]
+Description={{ .Description }}
+Wants=network-online.target
+After=network-online.target{{ range .After }} {{ . }}{{ end }}
+
+[Service]
+Type={{ .Type }}
+User={{ .User }}
+ExecStart={{ execLine .ExecStart }}
+{{- if .ExecReload }}
+ExecReload={{ .ExecReload }}
+{{- end }}
+{{- if .KillMode }}
+KillMode={{ .KillMode }}
+{{- end }}
+Restart=on-failure
+RestartSec=5
+TimeoutStopSec=30
+LimitNOFILE=65536
+
+[Install]
+WantedBy=multi-user.target
+`))
+
+// UseSystemd reports whether etcd and Patroni should run as systemd units.
+func UseSystemd(cfg *config.AgentConfig) bool {
+	switch cfg.Node.Systemd.Mode {
+	case config.ServiceModeSystemd:
+		return true
+	case config.ServiceModeDirect:
+		return false
+	}
+	_, err := os.Stat("/run/systemd/system")
+	return err == nil
+}
+
+func systemdRoot(cfg *config.AgentConfig) string {
+	if cfg.Node.Systemd.Root == "" {
+		return "/"
+	}
+	return cfg.Node.Systemd.Root
+}
+
+// UnitPath returns where the unit file for name is written.
+func UnitPath(cfg *config.AgentConfig, name string) string {
+	return filepath.Join(systemdRoot(cfg), "etc", "systemd", "system", name)
+}
+
+// DropInPath returns where the agent's drop-in for unit name is written.
+func DropInPath(cfg *config.AgentConfig, name string) string {
+	return UnitPath(cfg, name) + ".d/50-dbcp.conf"
+}
+
+// RenderUnit returns the contents of the unit file and of its drop-in. The
+// drop-in is empty when the unit has no overrides.
+func RenderUnit(unit SystemdUnit) (string, string, error) {
+	var buf bytes.Buffer
+	if err := unitTemplate.Execute(&buf, unit); err != nil {
+		return "", "", fmt.Errorf("failed to render %s: %w", unit.Name, err)
+	}
+
+	if len(unit.Overrides) == 0 {
+		return buf.String(), "", nil
+	}
+
+	keys := make([]string, 0, len(unit.Overrides))
+	for k := range unit.Overrides {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var dropIn strings.Builder
+	dropIn.WriteString("# Managed by dbcp-agent from node.systemd overrides.\n[Service]\n")
+	for _, k := range keys {
+		fmt.Fprintf(&dropIn, "%s=%s\n", k, unit.Overrides[k])
+	}
+	return buf.String(), dropIn.String(), nil
+}
+
+// WriteUnit renders unit below the configured root. It reports whether the
+// unit or its drop-in differ from what was there before.
+func WriteUnit(cfg *config.AgentConfig, unit SystemdUnit) (bool, error) {
+	content, dropIn, err := RenderUnit(unit)
+	if err != nil {
+		return false, err
+	}
+
+	unitPath := UnitPath(cfg, unit.Name)
+	dropInPath := DropInPath(cfg, unit.Name)
+	changed := fileDiffers(unitPath, content) || fileDiffers(dropInPath, dropIn)
+
+	if err := executor.MkdirAll(filepath.Dir(unitPath), 0755); err != nil {
+		return false, fmt.Errorf("failed to create %s: %w", filepath.Dir(unitPath), err)
+	}
+	if err := executor.WriteFile(unitPath, []byte(content), 0644); err != nil {
+		return false, fmt.Errorf("failed to write %s: %w", unitPath, err)
+	}
+
+	if dropIn == "" {
+		if err := executor.Remove(dropInPath); err != nil {
+			return false, fmt.Errorf("failed to remove %s: %w", dropInPath, err)
+		}
+	} else {
+		if err := executor.MkdirAll(filepath.Dir(dropInPath), 0755); err != nil {
+			return false, fmt.Errorf("failed to create %s: %w", filepath.Dir(dropInPath), err)
+		}
+		if err := executor.WriteFile(dropInPath, []byte(dropIn), 0644); err != nil {
+			return false, fmt.Errorf("failed to write %s: %w", dropInPath, err)
+		}
+	}
+
+	logger.Info("Systemd unit written to %s", unitPath)
+	return changed, nil
+}
+
+// InstallUnit writes unit, enables it and makes sure it runs with the
+// current definition. With a custom root the unit is only enabled, which is
+// what image builds and tests want.
+func InstallUnit(cfg *config.AgentConfig, unit SystemdUnit) error {
+	changed, err := WriteUnit(cfg, unit)
+	if err != nil {
+		return err
+	}
+
+	if root := systemdRoot(cfg); root != "/" {
+		if output, err := executor.Run("systemctl", "--root", root, "enable", unit.Name); err != nil {
+			logger.Error("systemctl enable failed: %s", string(output))
+			return fmt.Errorf("failed to enable %s: %w", unit.Name, err)
+		}
+		logger.Info("Enabled %s below %s; not starting it", unit.Name, root)
+		return nil
+	}
+
+	action := "start"
+	if changed {
+		action = "restart"
+	}
+
+	for _, args := range [][]string{
+		{"daemon-reload"},
+		{"enable", unit.Name},
+		{action, unit.Name},
+	} {
+		if output, err := executor.Run("systemctl", args...); err != nil {
+			logger.Error("systemctl %s failed: %s", strings.Join(args, " "), string(output))
+			return fmt.Errorf("failed to %s %s: %w", args[0], unit.Name, err)
+		}
+	}
+
+	logger.Info("%s is enabled and running", unit.Name)
+	return nil
+}
+
+// fileDiffers reports whether path does not hold exactly content. A missing
+// file differs from anything but an empty string.
+func fileDiffers(path, content string) bool {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return content != ""
+	}
+	return string(data) != content
+}
+
+// systemdExecLine joins a command line for ExecStart, quoting arguments the
+// way systemd expects. "%" and "$" are doubled, so specifiers and
+// environment variables are not expanded in them.
+func systemdExecLine(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		if arg == "" || strings.ContainsAny(arg, " \t\"'\\") {
+			arg = `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(arg) + `"`
+		}
+		quoted[i] = strings.NewReplacer("%", "%%", "$", "$$").Replace(arg)
+	}
+	return strings.Join(quoted, " ")
+}
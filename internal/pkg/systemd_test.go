@@ -0,0 +1,143 @@
+package pkg
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/virtlabs-io/dbcp-agent/internal/config"
+)
+
+func systemdTestConfig(root string) *config.AgentConfig {
+	return &config.AgentConfig{
+		Cluster: config.ClusterConfig{
+			Name:  "pg-test",
+			Nodes: []config.ClusterNode{{Name: "node1", Host: "10.0.0.1"}},
+		},
+		Node: config.NodeConfig{
+			Name:    "node1",
+			Host:    "10.0.0.1",
+			User:    "postgres",
+			TmpPath: "/dbcp/tmp",
+			ETCD: config.EtcdConfig{
+				BinPath:    "/usr/local/bin",
+				DataDir:    "/dbcp/data/etcd",
+				PeerPort:   2380,
+				ClientPort: 2379,
+			},
+			Patroni: config.PatroniConfig{ConfigPath: "/etc/patroni/patroni.yml", VenvPath: "/opt/dbcp/patroni"},
+			Systemd: config.SystemdConfig{Mode: config.ServiceModeSystemd, Root: root},
+		},
+	}
+}
+
+func TestWriteUnitToRoot(t *testing.T) {
+	root := t.TempDir()
+	cfg := systemdTestConfig(root)
+	cfg.Node.Patroni.VenvPath = root + "/opt/dbcp/patroni"
+	os.MkdirAll(cfg.Node.Patroni.VenvPath+"/bin", 0755)
+	os.WriteFile(cfg.Node.Patroni.VenvPath+"/bin/patroni", nil, 0755)
+	cfg.Node.Systemd.PatroniOverrides = map[string]string{
+		"LimitNOFILE": "131072",
+		"Environment": "PATRONI_LOG_LEVEL=DEBUG",
+	}
+
+	changed, err := WriteUnit(cfg, ETCDUnitFor(cfg))
+	if err != nil {
+		t.Fatalf("WriteUnit failed: %v", err)
+	}
+	if !changed {
+		t.Error("expected a new unit to be reported as changed")
+	}
+
+	data, err := os.ReadFile(root + "/etc/systemd/system/dbcp-etcd.service")
+	if err != nil {
+		t.Fatalf("unit not written: %v", err)
+	}
+	for _, want := range []string{
+		"Type=notify",
+		"User=postgres",
+		"ExecStart=/usr/local/bin/etcd --name node1 --data-dir /dbcp/data/etcd",
+		"--initial-cluster node1=http://10.0.0.1:2380",
+		"Restart=on-failure",
+		"WantedBy=multi-user.target",
+	} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("expected %q in etcd unit:\n%s", want, data)
+		}
+	}
+	if _, err := os.Stat(DropInPath(cfg, ETCDUnit)); !os.IsNotExist(err) {
+		t.Errorf("expected no drop-in without overrides, got %v", err)
+	}
+
+	if changed, _ := WriteUnit(cfg, ETCDUnitFor(cfg)); changed {
+		t.Error("rewriting an identical unit should not be reported as changed")
+	}
+
+	if _, err := WriteUnit(cfg, PatroniUnitFor(cfg)); err != nil {
+		t.Fatalf("WriteUnit failed: %v", err)
+	}
+	dropIn, err := os.ReadFile(DropInPath(cfg, PatroniUnit))
+	if err != nil {
+		t.Fatalf("drop-in not written: %v", err)
+	}
+	if !strings.Contains(string(dropIn), "[Service]\nEnvironment=PATRONI_LOG_LEVEL=DEBUG\nLimitNOFILE=131072\n") {
+		t.Errorf("unexpected drop-in:\n%s", dropIn)
+	}
+	unit, _ := os.ReadFile(UnitPath(cfg, PatroniUnit))
+	for _, want := range []string{
+		"After=network-online.target dbcp-etcd.service",
+		"ExecStart=" + root + "/opt/dbcp/patroni/bin/patroni /etc/patroni/patroni.yml",
+		"ExecReload=/bin/kill -s HUP $MAINPID",
+		"KillMode=process",
+	} {
+		if !strings.Contains(string(unit), want) {
+			t.Errorf("expected %q in patroni unit:\n%s", want, unit)
+		}
+	}
+}
+
+func TestInstallUnitSequence(t *testing.T) {
+	rec := NewRecorder()
+	defer SetExecutor(SetExecutor(rec))
+
+	cfg := systemdTestConfig("/")
+	if err := StartETCD(cfg); err != nil {
+		t.Fatalf("StartETCD failed: %v", err)
+	}
+
+	want := []string{
+		"systemctl daemon-reload",
+		"systemctl enable dbcp-etcd.service",
+		"systemctl restart dbcp-etcd.service",
+	}
+	if got := rec.Commands(); !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected commands:\n got: %q\nwant: %q", got, want)
+	}
+}
+
+func TestInstallUnitCustomRootOnlyEnables(t *testing.T) {
+	rec := NewRecorder()
+	defer SetExecutor(SetExecutor(rec))
+
+	cfg := systemdTestConfig("/srv/image")
+	if err := InstallUnit(cfg, PatroniUnitFor(cfg)); err != nil {
+		t.Fatalf("InstallUnit failed: %v", err)
+	}
+
+	want := []string{"systemctl --root /srv/image enable dbcp-patroni.service"}
+	if got := rec.Commands(); !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected commands:\n got: %q\nwant: %q", got, want)
+	}
+	if op := rec.Operations()[1]; op.Target != "/srv/image/etc/systemd/system/dbcp-patroni.service" {
+		t.Errorf("expected the unit below the custom root, got %v", op)
+	}
+}
+
+func TestSystemdExecLine(t *testing.T) {
+	got := systemdExecLine([]string{"/bin/app", "--name", "two words", "100%", "pa$$word", "${HOME} dir"})
+	if want := `/bin/app --name "two words" 100%% pa$$$$word "$${HOME} dir"`; got != want {
+		t.Errorf("systemdExecLine = %s, want %s", got, want)
+	}
+}
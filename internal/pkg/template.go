@@ -0,0 +1,106 @@
+package pkg
+
+import (
+	_ "embed"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"gopkg.in/yaml.v3"
+)
+
+// defaultPatroniTemplate is used unless patroni.template_path names a file.
+//
+//go:embed templates/patroni.yml
+var defaultPatroniTemplate string
+
+// templateFuncs are available to the Patroni template, default or not.
+// Values from the config should go through quote or toYaml, so passwords
+// and names with YAML syntax in them (":", "#", quotes) stay plain strings.
+var templateFuncs = template.FuncMap{
+	"toYaml":  toYaml,
+	"quote":   quote,
+	"indent":  indent,
+	"nindent": func(spaces int, text string) string { return "\n" + indent(spaces, text) },
+	"default": defaultValue,
+}
+
+// toYaml encodes a value as a YAML document without the trailing newline;
+// combine it with indent to nest it.
+func toYaml(value any) (string, error) {
+	data, err := marshalYAML(value)
+	if err != nil {
+		return "", fmt.Errorf("toYaml: %w", err)
+	}
+	return strings.TrimSuffix(string(data), "\n"), nil
+}
+
+// quote renders a value as a double-quoted YAML string.
+func quote(value any) string {
+	if value == nil {
+		return `""`
+	}
+	return strconv.Quote(fmt.Sprint(value))
+}
+
+// indent prefixes every line of text with spaces.
+func indent(spaces int, text string) string {
+	pad := strings.Repeat(" ", spaces)
+	return pad + strings.ReplaceAll(text, "\n", "\n"+pad)
+}
+
+// defaultValue returns value, or fallback when value is empty: nil, a zero
+// number, false, or an empty string, slice or map. Used as
+// {{ .Value | default "x" }}.
+func defaultValue(fallback, value any) any {
+	if value == nil {
+		return fallback
+	}
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Slice, reflect.Map, reflect.Array, reflect.String:
+		if v.Len() == 0 {
+			return fallback
+		}
+	default:
+		if v.IsZero() {
+			return fallback
+		}
+	}
+	return value
+}
+
+// loadPatroniTemplate parses the template at path, or the embedded default
+// when path is empty.
+func loadPatroniTemplate(path string) (*template.Template, error) {
+	text, name := defaultPatroniTemplate, "patroni.yml"
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read template: %w", err)
+		}
+		text, name = string(data), path
+	}
+
+	tmpl, err := template.New(name).Funcs(templateFuncs).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse template: %w", err)
+	}
+	return tmpl, nil
+}
+
+// checkRenderedYAML makes sure a rendered config parses as a YAML mapping.
+// The error only carries the parser's position, as the text holds passwords.
+func checkRenderedYAML(data []byte) error {
+	var doc map[string]any
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("rendered Patroni config is not valid YAML: %w", err)
+	}
+	if len(doc) == 0 {
+		return fmt.Errorf("rendered Patroni config is empty")
+	}
+	return nil
+}
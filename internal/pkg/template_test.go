@@ -0,0 +1,77 @@
+package pkg
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"text/template"
+
+	"github.com/virtlabs-io/dbcp-agent/internal/config"
+)
+
+func TestTemplateFuncs(t *testing.T) {
+	text := `name: {{ quote .Name }}
+port: {{ .Port | default 5432 }}
+mode: {{ .Mode | default "replica" }}
+list:{{ toYaml .List | nindent 2 }}
+nested:
+{{ toYaml .Map | indent 2 }}
+`
+	tmpl, err := template.New("test").Funcs(templateFuncs).Parse(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	data := map[string]any{
+		"Name": `a: b # c`,
+		"Port": 0,
+		"Mode": "",
+		"List": []string{"x", "y: z"},
+		"Map":  map[string]any{"k": "on"},
+	}
+	if err := tmpl.Execute(&buf, data); err != nil {
+		t.Fatal(err)
+	}
+
+	want := `name: "a: b # c"
+port: 5432
+mode: replica
+list:
+  - x
+  - 'y: z'
+nested:
+  k: "on"
+`
+	if buf.String() != want {
+		t.Errorf("unexpected output:\n%s", buf.String())
+	}
+}
+
+func TestGeneratePatroniConfigTemplateOverride(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &config.AgentConfig{}
+	cfg.Cluster.Name = "pg-test"
+	cfg.Node.Patroni.ConfigPath = filepath.Join(dir, "patroni.yml")
+	cfg.Node.Patroni.TemplatePath = filepath.Join(dir, "custom.yml")
+
+	// A value written unquoted can break the document; nothing is written then
+	os.WriteFile(cfg.Node.Patroni.TemplatePath, []byte("scope: {{ .Cluster.Name }}: x\n"), 0644)
+	err := GeneratePatroniConfig(cfg)
+	if err == nil || !strings.Contains(err.Error(), "not valid YAML") {
+		t.Fatalf("expected invalid YAML to be rejected, got %v", err)
+	}
+	if _, err := os.Stat(cfg.Node.Patroni.ConfigPath); !os.IsNotExist(err) {
+		t.Error("expected no patroni.yml to be written")
+	}
+
+	os.WriteFile(cfg.Node.Patroni.TemplatePath, []byte("scope: {{ quote .Cluster.Name }}\n"), 0644)
+	if err := GeneratePatroniConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(cfg.Node.Patroni.ConfigPath); string(data) != "scope: \"pg-test\"\n" {
+		t.Errorf("expected the override template to be used, got %q", data)
+	}
+}
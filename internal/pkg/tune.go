@@ -0,0 +1,206 @@
+package pkg
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/virtlabs-io/dbcp-agent/internal/config"
+	"github.com/virtlabs-io/dbcp-agent/internal/system"
+)
+
+// detectHardware is swapped out by tests.
+var detectHardware = system.DetectHardware
+
+// defaultMaxConnections is PostgreSQL's own default, used to size work_mem
+// when the config leaves max_connections unset.
+const defaultMaxConnections = 100
+
+const (
+	kB = 1024
+	mB = 1024 * kB
+	gB = 1024 * mB
+)
+
+// Recommendation is one PostgreSQL setting computed from the hardware.
+type Recommendation struct {
+	Name   string
+	Value  string
+	Reason string
+	// Override is the value set in node.postgresql.parameters, which is
+	// used instead; empty when the computed value applies.
+	Override string
+}
+
+// Tune detects the node's hardware and computes settings for a workload
+// profile, noting where node.postgresql.parameters overrides them. A
+// configured storage type replaces the detected one.
+func Tune(cfg *config.AgentConfig, profile string) (*system.Hardware, []Recommendation, error) {
+	hw, err := detectHardware(cfg.Node.PostgreSQL.DataDir)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to detect hardware: %w", err)
+	}
+	if storage := cfg.Node.PostgreSQL.Tuning.Storage; storage != "" {
+		hw.Storage = storage
+	}
+
+	settings := cfg.Node.PostgreSQL.Parameters.Settings()
+	connections := defaultMaxConnections
+	if n, err := strconv.Atoi(settings["max_connections"]); err == nil && n > 0 {
+		connections = n
+	}
+
+	recs := Recommend(*hw, profile, connections)
+	for i := range recs {
+		if value, ok := settings[recs[i].Name]; ok {
+			recs[i].Override = value
+		}
+	}
+	return hw, recs, nil
+}
+
+// Recommend sizes memory, WAL, planner and parallelism settings for a
+// profile: oltp (many short transactions), olap (few large queries) or
+// mixed. Settings are left out where the hardware gives no reason to move
+// away from PostgreSQL's defaults.
+func Recommend(hw system.Hardware, profile string, connections int) []Recommendation {
+	var recs []Recommendation
+	add := func(name, value, reason string, args ...any) {
+		recs = append(recs, Recommendation{Name: name, Value: value, Reason: fmt.Sprintf(reason, args...)})
+	}
+	mem := hw.MemoryBytes
+	memText := formatMemory(mem)
+
+	// Memory
+	sharedBuffers := mem / 4
+	add("shared_buffers", formatMemory(sharedBuffers),
+		"25%% of %s memory; more mostly duplicates the OS page cache", memText)
+	add("effective_cache_size", formatMemory(mem*3/4),
+		"75%% of %s memory: shared_buffers plus what the OS is expected to cache", memText)
+
+	maintenance, share := mem/16, "1/16"
+	if profile == config.ProfileOLAP {
+		maintenance, share = mem/8, "1/8"
+	}
+	capped := ""
+	if maintenance > 2*gB {
+		maintenance, capped = 2*gB, ", capped at 2GB as larger values rarely speed up vacuum or index builds"
+	}
+	add("maintenance_work_mem", formatMemory(maintenance), "%s of memory for vacuum and index builds%s", share, capped)
+
+	// Parallelism, needed to size work_mem: every worker gets its own
+	perGather := 0
+	if hw.CPUs >= 4 {
+		perGather = hw.CPUs / 2
+		if profile != config.ProfileOLAP && perGather > 4 {
+			perGather = 4
+		}
+	}
+
+	workers := perGather
+	if workers < 1 {
+		workers = 1
+	}
+	workMem := (mem - sharedBuffers) / uint64(connections*3) / uint64(workers)
+	reason := fmt.Sprintf("memory left after shared_buffers, over %d connections running up to 3 sorts or hashes each", connections)
+	if workers > 1 {
+		reason += fmt.Sprintf(", split across %d parallel workers", workers)
+	}
+	if profile == config.ProfileOLAP {
+		workMem *= 2
+		reason += "; doubled as analytical queries are fewer and sort more data"
+	}
+	if workMem < 64*kB {
+		workMem = 64 * kB
+		reason += "; raised to the 64kB minimum"
+	}
+	add("work_mem", formatMemory(workMem), "%s", reason)
+
+	if sharedBuffers >= 512*mB {
+		add("wal_buffers", "16MB", "the usual maximum, reached once shared_buffers is 512MB or more")
+	}
+
+	// Checkpoints and WAL
+	switch profile {
+	case config.ProfileOLTP:
+		add("min_wal_size", "2GB", "oltp: keeps WAL segments recycled under a steady write load")
+		add("max_wal_size", "8GB", "oltp: spaces out checkpoints under frequent small writes")
+	case config.ProfileOLAP:
+		add("min_wal_size", "4GB", "olap: bulk loads write WAL in large bursts")
+		add("max_wal_size", "16GB", "olap: avoids checkpoints in the middle of bulk loads")
+	default:
+		add("min_wal_size", "1GB", "mixed: moderate write load")
+		add("max_wal_size", "4GB", "mixed: spaces out checkpoints without a long crash recovery")
+	}
+	add("checkpoint_completion_target", "0.9", "spreads checkpoint writes over most of the interval")
+
+	// Planner
+	if profile == config.ProfileOLAP {
+		add("default_statistics_target", "500", "olap: finer statistics for complex plans over large tables")
+	} else {
+		add("default_statistics_target", "100", "%s: the default keeps ANALYZE cheap", profileName(profile))
+	}
+	switch hw.Storage {
+	case system.StorageSSD:
+		add("random_page_cost", "1.1", "ssd storage: random reads cost about as much as sequential ones")
+		add("effective_io_concurrency", "200", "ssd storage handles many concurrent reads")
+	case system.StorageHDD:
+		add("random_page_cost", "4", "hdd storage: random reads need a seek")
+		add("effective_io_concurrency", "2", "hdd storage handles few concurrent reads")
+	}
+
+	// Parallel workers
+	if hw.CPUs >= 4 {
+		add("max_worker_processes", strconv.Itoa(hw.CPUs), "one background worker per CPU (%d)", hw.CPUs)
+		add("max_parallel_workers", strconv.Itoa(hw.CPUs), "parallel queries may use every CPU (%d)", hw.CPUs)
+		if profile == config.ProfileOLAP {
+			add("max_parallel_workers_per_gather", strconv.Itoa(perGather), "olap: half the CPUs for a single query")
+		} else {
+			add("max_parallel_workers_per_gather", strconv.Itoa(perGather), "%s: half the CPUs, at most 4, so concurrent queries are not starved", profileName(profile))
+		}
+		maintenanceWorkers := hw.CPUs / 2
+		if maintenanceWorkers > 4 {
+			maintenanceWorkers = 4
+		}
+		add("max_parallel_maintenance_workers", strconv.Itoa(maintenanceWorkers), "half the CPUs, at most 4, for index builds and vacuum")
+	}
+
+	return recs
+}
+
+func profileName(profile string) string {
+	if profile == "" {
+		return config.ProfileMixed
+	}
+	return profile
+}
+
+// tunedParameters returns the computed settings for patroni.yml, or nil
+// when tuning is off.
+func tunedParameters(cfg *config.AgentConfig) (map[string]string, error) {
+	profile := cfg.Node.PostgreSQL.Tuning.Profile
+	if profile == "" {
+		return nil, nil
+	}
+	_, recs, err := Tune(cfg, profile)
+	if err != nil {
+		return nil, err
+	}
+	params := map[string]string{}
+	for _, rec := range recs {
+		params[rec.Name] = rec.Value
+	}
+	return params, nil
+}
+
+// formatMemory renders bytes in the largest PostgreSQL unit that keeps the
+// value whole, rounded down to a megabyte above 1MB.
+func formatMemory(bytes uint64) string {
+	switch {
+	case bytes >= gB && bytes%gB == 0:
+		return fmt.Sprintf("%dGB", bytes/gB)
+	case bytes >= mB:
+		return fmt.Sprintf("%dMB", bytes/mB)
+	default:
+		return fmt.Sprintf("%dkB", bytes/kB)
+	}
+}
@@ -0,0 +1,161 @@
+package pkg
+
+import (
+	"testing"
+
+	"github.com/virtlabs-io/dbcp-agent/internal/config"
+	"github.com/virtlabs-io/dbcp-agent/internal/system"
+)
+
+func recommendations(recs []Recommendation) map[string]string {
+	values := map[string]string{}
+	for _, rec := range recs {
+		if rec.Reason == "" {
+			values[rec.Name+".reason"] = "missing"
+		}
+		values[rec.Name] = rec.Value
+	}
+	return values
+}
+
+func TestRecommend(t *testing.T) {
+	tests := []struct {
+		name        string
+		hw          system.Hardware
+		profile     string
+		connections int
+		want        map[string]string
+		absent      []string
+	}{
+		{
+			name:        "oltp on ssd",
+			hw:          system.Hardware{MemoryBytes: 16 * gB, CPUs: 16, Storage: system.StorageSSD},
+			profile:     config.ProfileOLTP,
+			connections: 200,
+			want: map[string]string{
+				"shared_buffers":                   "4GB",
+				"effective_cache_size":             "12GB",
+				"maintenance_work_mem":             "1GB",
+				"work_mem":                         "5MB", // 12GB / (200*3) / 4 workers
+				"wal_buffers":                      "16MB",
+				"max_wal_size":                     "8GB",
+				"random_page_cost":                 "1.1",
+				"effective_io_concurrency":         "200",
+				"max_worker_processes":             "16",
+				"max_parallel_workers_per_gather":  "4",
+				"max_parallel_maintenance_workers": "4",
+			},
+		},
+		{
+			name:        "olap on hdd",
+			hw:          system.Hardware{MemoryBytes: 64 * gB, CPUs: 16, Storage: system.StorageHDD},
+			profile:     config.ProfileOLAP,
+			connections: 50,
+			want: map[string]string{
+				"shared_buffers":                  "16GB",
+				"maintenance_work_mem":            "2GB", // 1/8 capped
+				"work_mem":                        "81MB",
+				"max_wal_size":                    "16GB",
+				"default_statistics_target":       "500",
+				"random_page_cost":                "4",
+				"max_parallel_workers_per_gather": "8",
+			},
+		},
+		{
+			name:        "small node, unknown storage",
+			hw:          system.Hardware{MemoryBytes: 512 * mB, CPUs: 2, Storage: system.StorageUnknown},
+			profile:     config.ProfileMixed,
+			connections: 1000,
+			want: map[string]string{
+				"shared_buffers": "128MB",
+				"work_mem":       "131kB", // 384MB / (1000*3)
+				"max_wal_size":   "4GB",
+			},
+			absent: []string{"wal_buffers", "random_page_cost", "max_worker_processes", "max_parallel_workers_per_gather"},
+		},
+		{
+			name:        "work_mem floor",
+			hw:          system.Hardware{MemoryBytes: 256 * mB, CPUs: 1},
+			profile:     config.ProfileOLTP,
+			connections: 5000,
+			want:        map[string]string{"work_mem": "64kB"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := recommendations(Recommend(tt.hw, tt.profile, tt.connections))
+			for name, want := range tt.want {
+				if got[name] != want {
+					t.Errorf("%s = %q, want %q", name, got[name], want)
+				}
+				if got[name+".reason"] != "" {
+					t.Errorf("%s has no reason", name)
+				}
+			}
+			for _, name := range tt.absent {
+				if value, ok := got[name]; ok {
+					t.Errorf("%s = %q, want it left at the default", name, value)
+				}
+			}
+		})
+	}
+}
+
+func TestTunedParametersYieldToConfig(t *testing.T) {
+	orig := detectHardware
+	defer func() { detectHardware = orig }()
+	detectHardware = func(string) (*system.Hardware, error) {
+		return &system.Hardware{MemoryBytes: 8 * gB, CPUs: 4, Storage: system.StorageHDD}, nil
+	}
+
+	cfg := &config.AgentConfig{}
+	cfg.Node.TmpPath = "/tmp"
+	cfg.Node.PostgreSQL.Parameters = config.PostgresSettings{
+		MaxConnections: 100,
+		Extra:          map[string]string{"work_mem": "64MB"},
+	}
+
+	params := patroniParameters(cfg)
+	if _, ok := params["shared_buffers"]; ok {
+		t.Fatal("tuning applied without a profile")
+	}
+
+	cfg.Node.PostgreSQL.Tuning = config.TuningConfig{Profile: config.ProfileOLTP, Storage: "ssd"}
+	params = patroniParameters(cfg)
+	for name, want := range map[string]any{
+		"shared_buffers":   "2GB",
+		"work_mem":         "64MB", // from the config, not computed
+		"random_page_cost": 1.1,    // configured storage replaces the detected one
+		"max_connections":  int64(100),
+	} {
+		if params[name] != want {
+			t.Errorf("%s = %#v, want %#v", name, params[name], want)
+		}
+	}
+
+	_, recs, err := Tune(cfg, config.ProfileOLTP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rec := range recs {
+		if rec.Name == "work_mem" && rec.Override != "64MB" {
+			t.Errorf("work_mem override = %q, want 64MB", rec.Override)
+		}
+	}
+}
+
+func TestFormatMemory(t *testing.T) {
+	for bytes, want := range map[uint64]string{
+		4 * gB:         "4GB",
+		4*gB + 512*mB:  "4608MB",
+		3*mB + 100*kB:  "3MB",
+		64 * kB:        "64kB",
+		1536 * kB * kB: "1536MB",
+		2*gB + 100*kB:  "2048MB",
+	} {
+		if got := formatMemory(bytes); got != want {
+			t.Errorf("formatMemory(%d) = %q, want %q", bytes, got, want)
+		}
+	}
+}
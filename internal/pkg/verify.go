@@ -0,0 +1,114 @@
+package pkg
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// httpClient also serves file:// URLs, so artifacts in a local bundle go
+// through the same download and verification code as remote ones.
+var httpClient = func() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.RegisterProtocol("file", http.NewFileTransport(http.Dir("/")))
+	return &http.Client{Transport: transport}
+}()
+
+// fetchURL downloads a small metadata file (checksums, signatures) into memory.
+func fetchURL(url string) ([]byte, error) {
+	resp, err := httpClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: unexpected status %s", url, resp.Status)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err == nil && len(data) == 0 {
+		err = fmt.Errorf("GET %s: empty response", url)
+	}
+	return data, err
+}
+
+// checksumFromSums looks up the digest for name in a SHA256SUMS listing.
+func checksumFromSums(sums []byte, name string) (string, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(sums))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		// "*" marks binary mode in sha256sum output
+		if strings.TrimPrefix(fields[1], "*") == name {
+			return strings.ToLower(fields[0]), nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", fmt.Errorf("no checksum listed for %s", name)
+}
+
+// verifySHA256File hashes the file at path and compares it to expected.
+func verifySHA256File(path, expected string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+
+	actual := hex.EncodeToString(h.Sum(nil))
+	if actual != strings.ToLower(expected) {
+		return fmt.Errorf("sha256 mismatch for %s: expected %s, got %s", path, expected, actual)
+	}
+	return nil
+}
+
+// verifySignature checks a detached GPG signature of data against keyring.
+func verifySignature(data, signature []byte, keyring string) error {
+	dataFile, err := writeTemp("dbcp-sums-*", data)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(dataFile)
+
+	sigFile, err := writeTemp("dbcp-sums-*.asc", signature)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(sigFile)
+
+	cmd := exec.Command("gpg", "--batch", "--no-default-keyring", "--keyring", keyring, "--verify", sigFile, dataFile)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("gpg verification failed: %v: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+func writeTemp(pattern string, data []byte) (string, error) {
+	f, err := os.CreateTemp("", pattern)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	if _, err := f.Write(data); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
@@ -0,0 +1,126 @@
+package pki
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestIssueVerifiesAgainstCA(t *testing.T) {
+	ca, err := NewCA("pg-test CA", 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM, keyPEM, err := ca.Issue("node1", "10.0.0.1", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keyPEM) == 0 {
+		t.Fatal("expected a key")
+	}
+	cert, err := ParseCertificate(certPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Cert)
+	for _, usage := range []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth} {
+		for _, name := range []string{"node1", "10.0.0.1", "localhost", "127.0.0.1", "::1"} {
+			opts := x509.VerifyOptions{Roots: roots, DNSName: name, KeyUsages: []x509.ExtKeyUsage{usage}}
+			if _, err := cert.Verify(opts); err != nil {
+				t.Errorf("verify %s for usage %v: %v", name, usage, err)
+			}
+		}
+	}
+	if err := cert.VerifyHostname("10.0.0.2"); err == nil {
+		t.Error("expected the certificate not to cover another node")
+	}
+	if cert.IsCA {
+		t.Error("node certificate must not be a CA")
+	}
+}
+
+func TestIssueIsCappedAtCAExpiry(t *testing.T) {
+	ca, _ := NewCA("short CA", time.Hour)
+	certPEM, _, err := ca.Issue("node1", "node1.example.com", 365*24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := ParseCertificate(certPEM)
+	if cert.NotAfter.After(ca.Cert.NotAfter) {
+		t.Errorf("certificate expires %s, after its CA (%s)", cert.NotAfter, ca.Cert.NotAfter)
+	}
+}
+
+func TestSignRequest(t *testing.T) {
+	ca, _ := NewCA("pg-test CA", 24*time.Hour)
+	keyPEM, csrPEM, err := NewRequest("node2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The names come from the caller, not from what the request asks for
+	certPEM, err := ca.Sign(csrPEM, "node2", "10.0.0.2", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tls.X509KeyPair(certPEM, keyPEM); err != nil {
+		t.Errorf("expected the certificate to match the requested key: %v", err)
+	}
+	cert, _ := ParseCertificate(certPEM)
+	if err := cert.VerifyHostname("10.0.0.2"); err != nil || cert.Subject.CommonName != "node2" {
+		t.Errorf("unexpected subject %s: %v", cert.Subject, err)
+	}
+
+	tampered := append([]byte{}, csrPEM...)
+	tampered[len(tampered)/2] ^= 1
+	if _, err := ca.Sign(tampered, "node2", "10.0.0.2", time.Hour); err == nil {
+		t.Error("expected a damaged request to be rejected")
+	}
+}
+
+func TestLoadCARoundTrip(t *testing.T) {
+	ca, _ := NewCA("pg-test CA", time.Hour)
+	keyPEM, err := ca.KeyPEM()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := LoadCA(ca.CertPEM(), keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !loaded.Cert.Equal(ca.Cert) {
+		t.Error("loaded a different certificate")
+	}
+
+	other, _ := NewCA("other CA", time.Hour)
+	otherKey, _ := other.KeyPEM()
+	if _, err := LoadCA(ca.CertPEM(), otherKey); err == nil {
+		t.Error("expected a mismatched key to be rejected")
+	}
+
+	leaf, leafKey, _ := ca.Issue("node1", "10.0.0.1", time.Hour)
+	if _, err := LoadCA(leaf, leafKey); err == nil {
+		t.Error("expected a node certificate to be rejected as a CA")
+	}
+}
+
+func TestSANs(t *testing.T) {
+	dns, ips := SANs("node1", "db1.example.com")
+	if want := []string{"node1", "db1.example.com", "localhost"}; !reflect.DeepEqual(dns, want) {
+		t.Errorf("DNS names = %v, want %v", dns, want)
+	}
+	if len(ips) != 2 || !ips[0].Equal(net.ParseIP("127.0.0.1")) || !ips[1].Equal(net.ParseIP("::1")) {
+		t.Errorf("unexpected IPs: %v", ips)
+	}
+
+	dns, ips = SANs("localhost", "127.0.0.1")
+	if len(dns) != 1 || len(ips) != 2 {
+		t.Errorf("expected duplicates to be dropped, got %v %v", dns, ips)
+	}
+}
@@ -0,0 +1,168 @@
+// Package secrets encrypts config values so they can be kept inline in node
+// YAML files. Values look like "enc:v1:<base64>", where the payload is an
+// AES-256-GCM nonce followed by the ciphertext, under a 32-byte key stored
+// base64-encoded in a local key file.
+package secrets
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Prefix marks an encrypted value.
+const Prefix = "enc:v1:"
+
+// DefaultKeyFile is used when neither DBCP_SECRETS_KEY_FILE nor
+// secrets.key_file name a key.
+const DefaultKeyFile = "/etc/dbcp/secrets.key"
+
+// KeyFileEnv overrides the key file configured in secrets.key_file.
+const KeyFileEnv = "DBCP_SECRETS_KEY_FILE"
+
+const keySize = 32
+
+var encryptedPattern = regexp.MustCompile(regexp.QuoteMeta(Prefix) + `[A-Za-z0-9+/=]+`)
+
+// KeyPath picks the key file: the environment first, then the configured
+// path, then DefaultKeyFile.
+func KeyPath(configured string) string {
+	if path := os.Getenv(KeyFileEnv); path != "" {
+		return path
+	}
+	if configured != "" {
+		return configured
+	}
+	return DefaultKeyFile
+}
+
+// IsEncrypted reports whether value is an encrypted value.
+func IsEncrypted(value string) bool {
+	return strings.HasPrefix(value, Prefix)
+}
+
+// GenerateKey returns a new random key.
+func GenerateKey() ([]byte, error) {
+	key := make([]byte, keySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("failed to generate key: %w", err)
+	}
+	return key, nil
+}
+
+// LoadKey reads a key file.
+func LoadKey(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key file: %w", err)
+	}
+
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) != keySize {
+		return nil, fmt.Errorf("%s is not a valid secrets key", path)
+	}
+	return key, nil
+}
+
+// WriteKey stores key at path, readable by its owner only.
+func WriteKey(path string, key []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create key directory: %w", err)
+	}
+
+	data := base64.StdEncoding.EncodeToString(key) + "\n"
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		return fmt.Errorf("failed to write key file: %w", err)
+	}
+	return nil
+}
+
+// Encrypt returns plaintext as an encrypted value.
+func Encrypt(key []byte, plaintext string) (string, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	sealed := gcm.Seal(nonce, nonce, []byte(plaintext), nil)
+	return Prefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt returns the plaintext of an encrypted value. Errors never include
+// the value itself.
+func Decrypt(key []byte, value string) (string, error) {
+	if !IsEncrypted(value) {
+		return "", fmt.Errorf("value is not encrypted (missing %q prefix)", Prefix)
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, Prefix))
+	if err != nil {
+		return "", fmt.Errorf("encrypted value is not valid base64")
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return "", fmt.Errorf("encrypted value is truncated")
+	}
+
+	nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt value: wrong key or corrupted data")
+	}
+	return string(plaintext), nil
+}
+
+// Reencrypt rewrites every encrypted value in a config file's text from
+// oldKey to newKey, leaving everything else (comments, layout) untouched.
+// It returns the new text and the number of values rewritten.
+func Reencrypt(text []byte, oldKey, newKey []byte) ([]byte, int, error) {
+	var firstErr error
+	count := 0
+
+	out := encryptedPattern.ReplaceAllFunc(text, func(match []byte) []byte {
+		if firstErr != nil {
+			return match
+		}
+		plaintext, err := Decrypt(oldKey, string(match))
+		if err == nil {
+			var value string
+			value, err = Encrypt(newKey, plaintext)
+			if err == nil {
+				count++
+				return []byte(value)
+			}
+		}
+		firstErr = err
+		return match
+	})
+	if firstErr != nil {
+		return nil, 0, firstErr
+	}
+	return out, count, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	if len(key) != keySize {
+		return nil, fmt.Errorf("secrets key must be %d bytes", keySize)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,90 @@
+package secrets
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEncryptDecryptRoundTrip(t *testing.T) {
+	key, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value, err := Encrypt(key, "s3cr3t: with yaml-ish chars #")
+	if err != nil {
+		t.Fatalf("Encrypt failed: %v", err)
+	}
+	if !IsEncrypted(value) || strings.Contains(value, "s3cr3t") {
+		t.Fatalf("unexpected encrypted value %q", value)
+	}
+
+	plaintext, err := Decrypt(key, value)
+	if err != nil {
+		t.Fatalf("Decrypt failed: %v", err)
+	}
+	if plaintext != "s3cr3t: with yaml-ish chars #" {
+		t.Errorf("round trip returned %q", plaintext)
+	}
+
+	other, _ := GenerateKey()
+	if _, err := Decrypt(other, value); err == nil {
+		t.Error("expected decryption with the wrong key to fail")
+	}
+}
+
+func TestKeyFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys", "secrets.key")
+	key, _ := GenerateKey()
+
+	if err := WriteKey(path, key); err != nil {
+		t.Fatalf("WriteKey failed: %v", err)
+	}
+	loaded, err := LoadKey(path)
+	if err != nil {
+		t.Fatalf("LoadKey failed: %v", err)
+	}
+	if string(loaded) != string(key) {
+		t.Error("loaded key differs from the written one")
+	}
+
+	t.Setenv(KeyFileEnv, "/from/env")
+	if got := KeyPath("/from/config"); got != "/from/env" {
+		t.Errorf("expected the environment to win, got %s", got)
+	}
+	t.Setenv(KeyFileEnv, "")
+	if got := KeyPath(""); got != DefaultKeyFile {
+		t.Errorf("expected the default key file, got %s", got)
+	}
+}
+
+func TestReencrypt(t *testing.T) {
+	oldKey, _ := GenerateKey()
+	newKey, _ := GenerateKey()
+	a, _ := Encrypt(oldKey, "alpha")
+	b, _ := Encrypt(oldKey, "beta")
+
+	text := "# passwords\nusers:\n  a:\n    password: " + a + "  # keep me\n  b:\n    password: \"" + b + "\"\n"
+	out, count, err := Reencrypt([]byte(text), oldKey, newKey)
+	if err != nil {
+		t.Fatalf("Reencrypt failed: %v", err)
+	}
+	if count != 2 {
+		t.Errorf("expected 2 values to be rotated, got %d", count)
+	}
+	if !strings.Contains(string(out), "# keep me") || !strings.HasPrefix(string(out), "# passwords\n") {
+		t.Errorf("comments were not preserved:\n%s", out)
+	}
+
+	values := encryptedPattern.FindAllString(string(out), -1)
+	for i, want := range []string{"alpha", "beta"} {
+		if got, err := Decrypt(newKey, values[i]); err != nil || got != want {
+			t.Errorf("value %d: got %q, %v", i, got, err)
+		}
+	}
+
+	if _, _, err := Reencrypt(out, oldKey, newKey); err == nil {
+		t.Error("expected values under another key to be rejected")
+	}
+}
@@ -0,0 +1,164 @@
+package system
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Storage types reported by DetectHardware
+const (
+	StorageSSD     = "ssd"
+	StorageHDD     = "hdd"
+	StorageUnknown = "unknown"
+)
+
+// Hardware holds the resources PostgreSQL settings are sized from
+type Hardware struct {
+	MemoryBytes uint64 // usable memory: the cgroup limit if lower than RAM
+	CPUs        int    // usable CPUs: the cgroup quota if lower than online CPUs
+	Storage     string // StorageSSD, StorageHDD or StorageUnknown
+	Device      string // block device holding the data directory, e.g. sda
+}
+
+// DetectHardware reads memory from /proc/meminfo, the CPU count, and
+// whether the disk holding dataDir is rotational. Container limits are
+// taken into account. dataDir need not exist yet; its nearest existing
+// parent is used.
+func DetectHardware(dataDir string) (*Hardware, error) {
+	mem, err := memTotal()
+	if err != nil {
+		return nil, err
+	}
+	if limit, ok := cgroupMemoryLimit(); ok && limit < mem {
+		mem = limit
+	}
+
+	cpus := runtime.NumCPU()
+	if quota, ok := cgroupCPUQuota(); ok && quota < cpus {
+		cpus = quota
+	}
+
+	hw := &Hardware{MemoryBytes: mem, CPUs: cpus, Storage: StorageUnknown}
+	if dataDir != "" {
+		hw.Device, hw.Storage = storageType(dataDir)
+	}
+	return hw, nil
+}
+
+func memTotal() (uint64, error) {
+	file, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "MemTotal:" {
+			kb, err := strconv.ParseUint(fields[1], 10, 64)
+			if err != nil {
+				return 0, fmt.Errorf("failed to parse MemTotal: %w", err)
+			}
+			return kb * 1024, nil
+		}
+	}
+	return 0, fmt.Errorf("MemTotal not found in /proc/meminfo")
+}
+
+// cgroupMemoryLimit returns the memory limit of the agent's cgroup (v2, then v1).
+func cgroupMemoryLimit() (uint64, bool) {
+	for _, path := range []string{
+		"/sys/fs/cgroup/memory.max",
+		"/sys/fs/cgroup/memory/memory.limit_in_bytes",
+	} {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		value := strings.TrimSpace(string(data))
+		if value == "max" {
+			return 0, false
+		}
+		limit, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return 0, false
+		}
+		// cgroup v1 reports "no limit" as a huge page-aligned number
+		return limit, limit < 1<<60
+	}
+	return 0, false
+}
+
+// cgroupCPUQuota returns the CPU quota of the agent's cgroup, rounded up
+// to whole CPUs (v2 cpu.max, then v1 cfs quota and period).
+func cgroupCPUQuota() (int, bool) {
+	var quota, period int64
+	if data, err := os.ReadFile("/sys/fs/cgroup/cpu.max"); err == nil {
+		fields := strings.Fields(string(data))
+		if len(fields) != 2 || fields[0] == "max" {
+			return 0, false
+		}
+		quota, _ = strconv.ParseInt(fields[0], 10, 64)
+		period, _ = strconv.ParseInt(fields[1], 10, 64)
+	} else {
+		q, err1 := os.ReadFile("/sys/fs/cgroup/cpu/cpu.cfs_quota_us")
+		p, err2 := os.ReadFile("/sys/fs/cgroup/cpu/cpu.cfs_period_us")
+		if err1 != nil || err2 != nil {
+			return 0, false
+		}
+		quota, _ = strconv.ParseInt(strings.TrimSpace(string(q)), 10, 64)
+		period, _ = strconv.ParseInt(strings.TrimSpace(string(p)), 10, 64)
+	}
+	if quota <= 0 || period <= 0 {
+		return 0, false
+	}
+	return int((quota + period - 1) / period), true
+}
+
+// storageType finds the block device holding path and reads its
+// rotational flag from sysfs. Partitions report through their disk.
+func storageType(path string) (string, string) {
+	for {
+		if _, err := os.Stat(path); err == nil {
+			break
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return "", StorageUnknown
+		}
+		path = parent
+	}
+
+	var st syscall.Stat_t
+	if err := syscall.Stat(path, &st); err != nil {
+		return "", StorageUnknown
+	}
+	dev := uint64(st.Dev)
+	major := (dev>>8)&0xfff | (dev>>32)&^uint64(0xfff)
+	minor := dev&0xff | (dev>>12)&^uint64(0xff)
+
+	sysPath, err := filepath.EvalSymlinks(fmt.Sprintf("/sys/dev/block/%d:%d", major, minor))
+	if err != nil {
+		return "", StorageUnknown
+	}
+	device := filepath.Base(sysPath)
+
+	for _, dir := range []string{sysPath, filepath.Dir(sysPath)} {
+		data, err := os.ReadFile(filepath.Join(dir, "queue", "rotational"))
+		if err != nil {
+			continue
+		}
+		if strings.TrimSpace(string(data)) == "0" {
+			return device, StorageSSD
+		}
+		return device, StorageHDD
+	}
+	return device, StorageUnknown
+}
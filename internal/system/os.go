@@ -3,7 +3,9 @@ package system
 import (
 	"bufio"
 	"os"
+	"runtime"
 	"strings"
+	"syscall"
 )
 
 // OSInfo holds basic operating system information
@@ -13,6 +15,7 @@ type OSInfo struct {
 	Name      string
 	Pretty    string
 	Family    string // e.g., debian, rhel
+	Arch      string // Go-style CPU architecture, e.g., amd64, arm64
 }
 
 // DetectOS reads /etc/os-release and returns basic OS info
@@ -23,12 +26,14 @@ func DetectOS() (*OSInfo, error) {
 	}
 	defer file.Close()
 
-	info := &OSInfo{}
+	info := &OSInfo{Arch: HostArch()}
 	scanner := bufio.NewScanner(file)
 	for scanner.Scan() {
 		line := scanner.Text()
 		if strings.HasPrefix(line, "ID=") {
 			info.ID = strings.Trim(strings.SplitN(line, "=", 2)[1], "\"")
+		} else if strings.HasPrefix(line, "VERSION_ID=") {
+			info.VersionID = strings.Trim(strings.SplitN(line, "=", 2)[1], "\"")
 		} else if strings.HasPrefix(line, "NAME=") {
 			info.Name = strings.Trim(strings.SplitN(line, "=", 2)[1], "\"")
 		} else if strings.HasPrefix(line, "PRETTY_NAME=") {
@@ -50,3 +55,66 @@ func DetectOS() (*OSInfo, error) {
 
 	return info, nil
 }
+
+// HostArch returns the machine's CPU architecture as the kernel reports it
+// (uname -m), which differs from GOARCH when the agent runs under emulation,
+// e.g. an amd64 build on arm64. GOARCH is only the fallback.
+func HostArch() string {
+	var uts syscall.Utsname
+	if err := syscall.Uname(&uts); err == nil {
+		if arch := NormalizeArch(utsString(uts.Machine[:])); arch != "" {
+			return arch
+		}
+	}
+	return NormalizeArch(runtime.GOARCH)
+}
+
+// utsString converts a NUL-terminated utsname field, whose element type
+// differs between architectures.
+func utsString[T int8 | uint8](field []T) string {
+	var b strings.Builder
+	for _, c := range field {
+		if c == 0 {
+			break
+		}
+		b.WriteByte(byte(c))
+	}
+	return b.String()
+}
+
+// NormalizeArch maps kernel, Debian and RPM architecture names onto the Go
+// names used throughout the agent. It returns "" for unsupported values.
+func NormalizeArch(arch string) string {
+	switch strings.ToLower(arch) {
+	case "amd64", "x86_64", "x86-64":
+		return "amd64"
+	case "arm64", "aarch64":
+		return "arm64"
+	case "ppc64le", "ppc64el":
+		return "ppc64le"
+	case "s390x":
+		return "s390x"
+	default:
+		return ""
+	}
+}
+
+// RPMArch returns the architecture name used by RPM-based distributions.
+func (o *OSInfo) RPMArch() string {
+	switch o.Arch {
+	case "amd64":
+		return "x86_64"
+	case "arm64":
+		return "aarch64"
+	default:
+		return o.Arch
+	}
+}
+
+// DebArch returns the architecture name used by Debian-based distributions.
+func (o *OSInfo) DebArch() string {
+	if o.Arch == "ppc64le" {
+		return "ppc64el"
+	}
+	return o.Arch
+}
@@ -1,10 +1,25 @@
 #!/bin/bash
 # scripts/generate-configs.sh
+#
+# Writes a per-node config overlay for every node of the cluster. Shared
+# settings live in configs/cluster.yaml; each overlay extends it and sets the
+# node's name and host.
+set -euo pipefail
 
 NODES=("node1" "node2" "node3")
-for NODE in "${NODES[@]}"; do
-  cp configs/agent-config-template.yaml configs/agent-config-${NODE}.yaml
-  sed -i "s/REPLACE_HOST/${NODE}/g" configs/agent-config-${NODE}.yaml
+HOSTS=("192.168.56.101" "192.168.56.102" "192.168.56.103")
+
+for i in "${!NODES[@]}"; do
+  OUT="configs/db-node-$((i + 1)).yaml"
+  cat > "${OUT}" <<YAML
+# Node $((i + 1)) of pg-cluster-01. Everything not set here comes from cluster.yaml;
+# mappings are merged key by key, lists and values here replace the shared ones.
+extends: cluster.yaml
+
+node:
+  name: "${NODES[$i]}"
+  host: "${HOSTS[$i]}"
+YAML
 done
 
 echo "Generated configs for: ${NODES[*]}"